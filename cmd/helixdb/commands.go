@@ -1 +1,334 @@
 package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/replication"
+	"github.com/developer51709/helixdb/internal/router"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func openEngine(cfg config.Config) (*storage.Engine, error) {
+	var sources []storage.RepairSource
+	if cfg.Backup.Directory != "" {
+		sources = append(sources, storage.BackupRepairSource(cfg.Backup.Directory))
+	}
+	return storage.NewEngineWithOptions(cfg.Storage.DataFile, cfg.Storage.WALDirectory, storage.Options{
+		WAL: storage.WALOptions{
+			SegmentSize:  int64(cfg.Storage.WALSegmentSizeMB) << 20,
+			ArchiveDir:   cfg.Storage.WALArchiveDirectory,
+			Sync:         storage.SyncMode(cfg.Storage.Durability),
+			MaxSyncDelay: time.Duration(cfg.Storage.DurabilityMaxDelayMs) * time.Millisecond,
+		},
+		VerifyChecksums:  cfg.Recovery.VerifyChecksums,
+		AutoRecover:      cfg.Recovery.AutoRecover,
+		RepairSources:    sources,
+		AutoCompact:      cfg.Storage.AutoCompact,
+		CompactThreshold: int64(cfg.Storage.CompactThresholdMB) << 20,
+	})
+}
+
+// runCompact compacts every collection with reclaimable space, regardless
+// of compactThresholdMB. The server must not be running on the same data.
+func runCompact(cfg config.Config) {
+	engine, err := openEngine(cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to initialize storage engine: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if status := engine.CompactionStatus(); status.Collection != "" {
+					fmt.Printf("Compacting %s (%d/%d collections, %.0f%%)\n",
+						status.Collection, status.CollectionsDone+1, status.CollectionsTotal, status.Progress*100)
+				}
+			}
+		}
+	}()
+	status, err := engine.Compact()
+	close(done)
+
+	if cerr := engine.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] Compaction failed: %v", err)
+	}
+	if status.CollectionsTotal == 0 {
+		fmt.Println("Nothing to compact")
+	}
+}
+
+// openFollower opens the data directory of a follower, first replacing it
+// with a snapshot of the leader if it is empty or the leader no longer has
+// the records needed to catch up.
+func openFollower(cfg config.Config) (*storage.Engine, error) {
+	if cfg.Replication.Leader == "" {
+		return nil, fmt.Errorf("replication.leader is required for a follower")
+	}
+	if _, err := os.Stat(cfg.Storage.DataFile); err == nil {
+		engine, err := openEngine(cfg)
+		if err != nil {
+			return nil, err
+		}
+		behind, err := replication.Behind(cfg, engine.LastLSN())
+		if err != nil || !behind {
+			if err != nil {
+				log.Printf("[WARN] Cannot reach leader %s: %v", cfg.Replication.Leader, err)
+			}
+			return engine, nil
+		}
+		log.Printf("[WARN] Leader %s no longer has the records after LSN %d", cfg.Replication.Leader, engine.LastLSN())
+		if err := engine.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("[INFO] Bootstrapping from a snapshot of %s", cfg.Replication.Leader)
+	report, err := replication.Bootstrap(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping from leader: %w", err)
+	}
+	log.Printf("[INFO] Bootstrapped at LSN %d", report.LSN)
+	if report.PreviousDir != "" {
+		log.Printf("[INFO] Previous data moved to %s", report.PreviousDir)
+	}
+	return openEngine(cfg)
+}
+
+// runBackup takes a snapshot backup into --to, or a new directory under
+// the backup directory. With --incremental it backs up the WAL records
+// logged since the newest backup in the backup directory (or --to)
+// instead, falling back to a snapshot when there is no base to build on.
+// The server must not be running on the same data; use POST /admin/backup
+// instead.
+func runBackup(cfg config.Config, args []string) {
+	var to string
+	var incremental bool
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--to="):
+			to = strings.TrimPrefix(arg, "--to=")
+		case arg == "--incremental":
+			incremental = true
+		}
+	}
+
+	engine, err := openEngine(cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to initialize storage engine: %v", err)
+	}
+	if incremental {
+		bcfg := cfg.Backup
+		bcfg.Mode = backup.ModeIncremental
+		if to != "" {
+			bcfg.Directory = to
+		}
+		var scheduler *backup.Scheduler
+		if scheduler, err = backup.New(engine, bcfg); err == nil {
+			var b *storage.BackupManifest
+			if b, err = scheduler.Run(); b == nil && err == nil {
+				fmt.Println("Nothing to back up")
+			}
+		}
+	} else {
+		if to == "" {
+			to = backup.NewDir(cfg.Backup.Directory)
+		}
+		_, err = engine.Backup(to)
+	}
+	if cerr := engine.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] Backup failed: %v", err)
+	}
+}
+
+// runRecover replaces the data directory with the backup in --from, a
+// backup or a backup directory. --until stops the replay at an LSN or an
+// RFC 3339 time.
+func runRecover(cfg config.Config, args []string) {
+	var from string
+	var opts backup.RestoreOptions
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--from="):
+			from = strings.TrimPrefix(arg, "--from=")
+		case strings.HasPrefix(arg, "--until="):
+			until := strings.TrimPrefix(arg, "--until=")
+			if lsn, err := strconv.ParseUint(until, 10, 64); err == nil {
+				opts.UntilLSN = lsn
+			} else if opts.UntilTime, err = time.Parse(time.RFC3339, until); err != nil {
+				log.Fatalf("[ERROR] --until must be an LSN or an RFC 3339 time: %q", until)
+			}
+		}
+	}
+	if from == "" {
+		log.Fatalf("[ERROR] recover needs --from=<backup or backup directory>")
+	}
+	opts.ArchiveDir = cfg.Storage.WALArchiveDirectory
+
+	report, err := backup.Restore(from, cfg.Storage.DataFile, cfg.Storage.WALDirectory, opts)
+	if errors.Is(err, storage.ErrDataDirLocked) {
+		log.Fatalf("[ERROR] %s is in use; stop the server before recovering", filepath.Dir(cfg.Storage.DataFile))
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] Recovery failed: %v", err)
+	}
+	fmt.Printf("Restored %s to LSN %d (%d records replayed)\n", strings.Join(report.Backups, " + "), report.LSN, report.Replayed)
+	if report.PreviousDir != "" {
+		fmt.Printf("Previous data moved to %s\n", report.PreviousDir)
+	}
+	if report.PreviousArchiveDir != "" {
+		fmt.Printf("Previous WAL archive moved to %s\n", report.PreviousArchiveDir)
+	}
+}
+
+// runVerify checks the data directory of a stopped server and exits with
+// status 1 if any problem is left. --repair fixes what automatic recovery
+// can, --json prints the report as JSON instead of a summary, and
+// --report=path also saves it to a file.
+func runVerify(cfg config.Config, args []string) {
+	var repair, asJSON bool
+	var reportPath string
+	for _, arg := range args {
+		switch {
+		case arg == "--repair":
+			repair = true
+		case arg == "--json":
+			asJSON = true
+		case strings.HasPrefix(arg, "--report="):
+			reportPath = strings.TrimPrefix(arg, "--report=")
+		}
+	}
+
+	opts := storage.Options{WAL: storage.WALOptions{ArchiveDir: cfg.Storage.WALArchiveDirectory}}
+	verify := storage.Verify
+	if repair {
+		verify = storage.Repair
+	}
+	report, err := verify(cfg.Storage.DataFile, cfg.Storage.WALDirectory, opts)
+	if err != nil {
+		log.Fatalf("[ERROR] Verification failed: %v", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("[ERROR] Encoding report: %v", err)
+	}
+	if reportPath != "" {
+		if err := os.WriteFile(reportPath, append(data, '\n'), 0644); err != nil {
+			log.Fatalf("[ERROR] Writing report: %v", err)
+		}
+	}
+	if asJSON {
+		fmt.Println(string(data))
+	} else {
+		printVerifyReport(report)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
+
+func printVerifyReport(report *storage.VerifyReport) {
+	fmt.Printf("Data file %s (%s, checkpoint LSN %d)\n", report.DataFile, report.Format, report.CheckpointLSN)
+	for _, c := range report.Collections {
+		fmt.Printf("  %s: %d documents, %d indexes\n", c.Name, c.Documents, c.Indexes)
+	}
+	fmt.Printf("WAL: %d segments, %d records", report.WAL.Segments, report.WAL.Records)
+	if report.WAL.Records > 0 {
+		fmt.Printf(" (LSN %d-%d)", report.WAL.FirstLSN, report.WAL.LastLSN)
+	}
+	if report.WAL.ArchivedSegments > 0 {
+		fmt.Printf(", %d archived segments", report.WAL.ArchivedSegments)
+	}
+	fmt.Println()
+
+	if r := report.Repair; r != nil {
+		repaired := 0
+		for _, doc := range r.Corrupt {
+			if doc.RepairedFrom != "" {
+				repaired++
+			}
+		}
+		fmt.Printf("Repair: %d problems found, %d of %d corrupt documents restored", r.Found, repaired, len(r.Corrupt))
+		if r.TornTail != nil {
+			fmt.Printf(", torn WAL tail of %d bytes removed", r.TornTail.Bytes)
+		}
+		fmt.Println()
+		if r.QuarantineDir != "" {
+			fmt.Printf("Corrupt documents were copied to %s\n", r.QuarantineDir)
+		}
+	}
+
+	if report.OK() {
+		fmt.Println("No problems found")
+		return
+	}
+	fmt.Printf("%d problems:\n", len(report.Problems))
+	for _, p := range report.Problems {
+		where := p.Collection
+		if p.ID != "" {
+			where += "/" + p.ID
+		}
+		if where != "" {
+			where += ": "
+		}
+		fmt.Printf("  [%s] %s%s", p.Check, where, p.Message)
+		if p.File != "" {
+			fmt.Printf(" (%s, offset %d)", p.File, p.Offset)
+		}
+		fmt.Println()
+	}
+}
+
+// runRouter serves the document API over the shards in the router config,
+// holding no data itself.
+func runRouter(cfg config.Config) {
+	rt, err := router.New(cfg)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to initialize router: %v", err)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-quit
+		log.Println("[INFO] Shutting down HelixDB router...")
+		rt.Stop()
+		os.Exit(0)
+	}()
+
+	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
+	status := rt.Status()
+	log.Printf("[INFO] HelixDB router starting on %s", addr)
+	for _, sh := range status.Shards {
+		log.Printf("[INFO] Shard %s at %s", sh.ID, sh.Address)
+	}
+	rt.Start()
+	if err := http.ListenAndServe(addr, rt.Handler(cfg.Security)); err != nil {
+		log.Fatalf("[ERROR] Router failed: %v", err)
+	}
+}
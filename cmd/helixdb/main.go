@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/clientsync"
+	"github.com/developer51709/helixdb/internal/cluster"
 	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/replication"
 	"github.com/developer51709/helixdb/internal/server"
 	"github.com/developer51709/helixdb/internal/storage"
 )
@@ -19,7 +25,7 @@ func main() {
 	args := os.Args[1:]
 	for i, arg := range args {
 		switch arg {
-		case "serve", "backup", "recover":
+		case "serve", "backup", "recover", "compact", "verify", "router":
 			command = arg
 		case "--config", "-c":
 			if i+1 < len(args) {
@@ -36,20 +42,79 @@ func main() {
 	switch command {
 	case "serve":
 		runServe(cfg)
+	case "compact":
+		runCompact(cfg)
+	case "backup":
+		runBackup(cfg, args)
+	case "recover":
+		runRecover(cfg, args)
+	case "verify":
+		runVerify(cfg, args)
+	case "router":
+		runRouter(cfg)
 	default:
 		fmt.Printf("Unknown command: %s\n", command)
-		fmt.Println("Usage: helixdb [serve|backup|recover] [--config path]")
+		fmt.Println("Usage: helixdb [serve|backup|recover|compact|verify|router] [--config path]")
 		os.Exit(1)
 	}
 }
 
 func runServe(cfg config.Config) {
-	engine, err := storage.NewEngine(cfg.Storage.DataFile, cfg.Storage.WALDirectory)
+	var engine *storage.Engine
+	var err error
+	switch cfg.Replication.Role {
+	case "", replication.RoleLeader:
+		engine, err = openEngine(cfg)
+	case replication.RoleFollower:
+		engine, err = openFollower(cfg)
+	default:
+		log.Fatalf("[ERROR] Unknown replication role %q", cfg.Replication.Role)
+	}
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to initialize storage engine: %v", err)
 	}
 
-	srv := server.New(engine, cfg)
+	var follower *replication.Follower
+	if cfg.Replication.Role == replication.RoleFollower {
+		// Indexes come from the leader.
+		cfg.Storage.Indexes = nil
+		follower = replication.NewFollower(engine, cfg)
+	}
+	var node *cluster.Node
+	if cfg.Cluster.Enabled {
+		if follower != nil {
+			log.Fatalf("[ERROR] A cluster node cannot also be a read replica")
+		}
+		node, err = cluster.NewNode(engine, cfg)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to initialize cluster node: %v", err)
+		}
+		// Writes need a leader, so indexes are created once one is elected.
+		go createClusterIndexes(engine, cfg)
+		cfg.Storage.Indexes = nil
+	}
+	for collection, indexes := range cfg.Storage.Indexes {
+		for _, ic := range indexes {
+			status, err := engine.CreateIndex(collection, ic.Definition())
+			if errors.Is(err, storage.ErrIndexExists) {
+				continue
+			}
+			if err != nil {
+				log.Fatalf("[ERROR] Failed to create index on %s: %v", collection, err)
+			}
+			log.Printf("[INFO] Created %s index %s on %s (%s)", status.Type, status.Name, collection, status.State)
+		}
+	}
+
+	backups, err := backup.New(engine, cfg.Backup)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid backup configuration: %v", err)
+	}
+	sync, err := clientsync.New(engine, cfg.Sync)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid sync configuration: %v", err)
+	}
+	srv := server.New(engine, backups, follower, node, sync, cfg)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -67,3 +132,28 @@ func runServe(cfg config.Config) {
 		log.Fatalf("[ERROR] Server failed: %v", err)
 	}
 }
+
+// createClusterIndexes creates the configured indexes through the cluster,
+// retrying while there is no leader. On the other nodes the attempts stop
+// once the index has been replicated to them.
+func createClusterIndexes(engine *storage.Engine, cfg config.Config) {
+	for collection, indexes := range cfg.Storage.Indexes {
+		for _, ic := range indexes {
+			for {
+				status, err := engine.CreateIndex(collection, ic.Definition())
+				if errors.Is(err, cluster.ErrNotLeader) || errors.Is(err, cluster.ErrLeadershipLost) {
+					time.Sleep(time.Second)
+					continue
+				}
+				switch {
+				case errors.Is(err, storage.ErrIndexExists), errors.Is(err, cluster.ErrStopped), errors.Is(err, storage.ErrEngineClosed):
+				case err != nil:
+					log.Printf("[ERROR] Failed to create index on %s: %v", collection, err)
+				default:
+					log.Printf("[INFO] Created %s index %s on %s (%s)", status.Type, status.Name, collection, status.State)
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// List returns the complete backups in dir, oldest first. Directories
+// without a readable manifest, such as interrupted backups, are skipped.
+func List(dir string) ([]*storage.BackupManifest, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []*storage.BackupManifest
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasSuffix(entry.Name(), ".partial") {
+			continue
+		}
+		b, err := storage.LoadBackupManifest(filepath.Join(dir, entry.Name()))
+		if errors.Is(err, storage.ErrBackupInvalid) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].CreatedAt.Equal(backups[j].CreatedAt) {
+			return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+		}
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, nil
+}
+
+// Chain returns the snapshot named base followed by its incremental
+// backups in LSN order, stopping at the first one that does not continue
+// from the previous.
+func Chain(backups []*storage.BackupManifest, base string) ([]*storage.BackupManifest, error) {
+	var chain []*storage.BackupManifest
+	for _, b := range backups {
+		if b.ID == base && b.Type == storage.BackupSnapshot {
+			chain = append(chain, b)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%w: no snapshot named %s", storage.ErrBackupInvalid, base)
+	}
+	var incrementals []*storage.BackupManifest
+	for _, b := range backups {
+		if b.Type == storage.BackupIncremental && b.Base == base {
+			incrementals = append(incrementals, b)
+		}
+	}
+	sort.Slice(incrementals, func(i, j int) bool { return incrementals[i].FromLSN < incrementals[j].FromLSN })
+	for _, b := range incrementals {
+		if b.FromLSN == chain[len(chain)-1].LSN {
+			chain = append(chain, b)
+		}
+	}
+	return chain, nil
+}
+
+// latestChain returns the chain of the newest snapshot, or nil.
+func latestChain(backups []*storage.BackupManifest) []*storage.BackupManifest {
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].Type == storage.BackupSnapshot {
+			chain, _ := Chain(backups, backups[i].ID)
+			return chain
+		}
+	}
+	return nil
+}
+
+// expired returns the IDs of the backups the retention policy drops. The
+// newest snapshot is always kept, along with the newest snapshot of each
+// of the keepDaily most recent days and keepWeekly most recent ISO weeks
+// that have one. An incremental backup goes with its snapshot. With both
+// limits at zero nothing expires.
+func expired(backups []*storage.BackupManifest, keepDaily, keepWeekly int) []string {
+	if keepDaily <= 0 && keepWeekly <= 0 {
+		return nil
+	}
+	var snapshots []*storage.BackupManifest
+	for _, b := range backups {
+		if b.Type == storage.BackupSnapshot {
+			snapshots = append(snapshots, b)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt) })
+
+	keep := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for i, b := range snapshots {
+		t := b.CreatedAt.UTC()
+		day := t.Format(time.DateOnly)
+		year, week := t.ISOWeek()
+		weekKey := fmt.Sprintf("%d-%02d", year, week)
+		if i == 0 {
+			keep[b.ID] = true
+		}
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep[b.ID] = true
+		}
+		if !weeks[weekKey] && len(weeks) < keepWeekly {
+			weeks[weekKey] = true
+			keep[b.ID] = true
+		}
+	}
+
+	var ids []string
+	for _, b := range backups {
+		switch {
+		case b.Type == storage.BackupSnapshot && !keep[b.ID]:
+			ids = append(ids, b.ID)
+		case b.Type == storage.BackupIncremental && !keep[b.Base]:
+			ids = append(ids, b.ID)
+		}
+	}
+	return ids
+}
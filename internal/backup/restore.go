@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+var ErrRestoreTarget = errors.New("restore target not reachable")
+
+// RestoreOptions bounds a point-in-time recovery. Zero values restore
+// everything the backups hold.
+type RestoreOptions struct {
+	UntilLSN  uint64
+	UntilTime time.Time
+	// ArchiveDir holds WAL segments archived by the server. Its records
+	// are applied after those of the backups.
+	ArchiveDir string
+}
+
+type RestoreReport struct {
+	Snapshot string `json:"snapshot"`
+	// Backups lists the snapshot and incremental backups applied.
+	Backups []string `json:"backups"`
+	// LSN is the last record restored, and Replayed how many records were
+	// applied on top of the snapshot's checkpoint.
+	LSN      uint64 `json:"lsn"`
+	Replayed int    `json:"replayed"`
+	// PreviousDir holds the data the restore replaced, and
+	// PreviousArchiveDir the WAL archive if it went past the restored LSN.
+	PreviousDir        string `json:"previousDir,omitempty"`
+	PreviousArchiveDir string `json:"previousArchiveDir,omitempty"`
+}
+
+// Restore replaces the database at dataFile and walDir with the one in a
+// backup. from is a snapshot, which is restored with its incremental
+// backups, an incremental backup, restored up to and including itself, or
+// a backup directory, from which the newest snapshot old enough for the
+// target is picked. Records are then replayed up to opts.UntilLSN or
+// opts.UntilTime.
+//
+// Every backup is checked against its manifest and the result is opened
+// and checkpointed in a staging directory before the live files are
+// touched. The replaced files are moved to a sibling directory of the data
+// directory rather than deleted. So is the WAL archive, if it holds records
+// past the restored LSN: the server will log new records under those LSNs.
+// The archived records up to the restored LSN are copied back. Restore
+// fails with
+// storage.ErrDataDirLocked if an engine has the data directory open.
+func Restore(from, dataFile, walDir string, opts RestoreOptions) (*RestoreReport, error) {
+	lock, err := storage.LockDataDir(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	root, chain, err := restoreChain(from, opts)
+	if err != nil {
+		return nil, err
+	}
+	report := &RestoreReport{Snapshot: chain[0].ID}
+	snapshotDir := filepath.Join(root, chain[0].ID)
+
+	var entries []storage.WALEntry
+	for _, b := range chain {
+		dir := filepath.Join(root, b.ID)
+		if _, err := storage.ReadBackup(dir); err != nil {
+			return nil, err
+		}
+		records, err := storage.ReadWALDir(filepath.Join(dir, "wal"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading %s: %w", dir, err)
+		}
+		entries = append(entries, records...)
+		report.Backups = append(report.Backups, b.ID)
+	}
+	var archived []storage.WALEntry
+	if opts.ArchiveDir != "" {
+		archived, err = storage.ReadWALDir(opts.ArchiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading WAL archive: %w", err)
+		}
+		entries = append(entries, archived...)
+	}
+	replay, err := restoreRecords(entries, chain[0].CheckpointLSN, opts)
+	if err != nil {
+		return nil, err
+	}
+	report.Replayed = len(replay)
+	report.LSN = chain[0].CheckpointLSN
+	if n := len(replay); n > 0 {
+		report.LSN = replay[n-1].LSN
+	}
+
+	dataDir := filepath.Dir(dataFile)
+	staging := dataDir + ".restore"
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	if err := stage(snapshotDir, chain[0], staging, filepath.Base(dataFile), replay); err != nil {
+		return nil, fmt.Errorf("staging restore: %w", err)
+	}
+
+	previous := asideName(dataDir)
+	moves := [][2]string{
+		{dataFile, filepath.Base(dataFile)},
+		{filepath.Join(dataDir, "segments"), "segments"},
+		{walDir, "wal"},
+	}
+	for _, m := range moves {
+		if _, err := os.Stat(m[0]); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(previous, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(m[0], filepath.Join(previous, m[1])); err != nil {
+			return nil, fmt.Errorf("moving aside %s: %w", m[0], err)
+		}
+		report.PreviousDir = previous
+	}
+	for _, m := range moves {
+		if err := os.Rename(filepath.Join(staging, m[1]), m[0]); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("installing %s: %w", m[0], err)
+		}
+	}
+	if n := len(archived); n > 0 && archived[n-1].LSN > report.LSN {
+		if report.PreviousArchiveDir, err = replaceArchive(opts.ArchiveDir, archived, report.LSN); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// asideName returns a free name next to dir for moving it out of the way.
+func asideName(dir string) string {
+	name := fmt.Sprintf("%s.pre-restore-%s", dir, storage.NewBackupID(time.Now()))
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.pre-restore-%s-%d", dir, storage.NewBackupID(time.Now()), i)
+	}
+}
+
+// replaceArchive moves the WAL archive at dir aside and starts a new one
+// with the archived records up to lsn, and returns where the old one went.
+func replaceArchive(dir string, archived []storage.WALEntry, lsn uint64) (string, error) {
+	previous := asideName(dir)
+	if err := os.Rename(dir, previous); err != nil {
+		return "", fmt.Errorf("moving aside WAL archive: %w", err)
+	}
+	var kept []storage.WALEntry
+	for _, entry := range archived {
+		if entry.LSN <= lsn {
+			kept = append(kept, entry)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if err := storage.WriteWALSegment(dir, kept); err != nil {
+		return "", fmt.Errorf("writing WAL archive: %w", err)
+	}
+	return previous, nil
+}
+
+// restoreChain resolves from to the directory holding the backups and
+// the backups to apply, snapshot first.
+func restoreChain(from string, opts RestoreOptions) (string, []*storage.BackupManifest, error) {
+	if _, err := os.Stat(filepath.Join(from, storage.BackupManifestFile)); os.IsNotExist(err) {
+		backups, err := List(from)
+		if err != nil {
+			return "", nil, err
+		}
+		for i := len(backups) - 1; i >= 0; i-- {
+			s := backups[i]
+			if s.Type != storage.BackupSnapshot ||
+				(opts.UntilLSN != 0 && s.CheckpointLSN > opts.UntilLSN) ||
+				(!opts.UntilTime.IsZero() && s.CreatedAt.After(opts.UntilTime)) {
+				continue
+			}
+			chain, err := Chain(backups, s.ID)
+			return from, chain, err
+		}
+		return "", nil, fmt.Errorf("%w: no snapshot in %s old enough", ErrRestoreTarget, from)
+	}
+
+	b, err := storage.LoadBackupManifest(from)
+	if err != nil {
+		return "", nil, err
+	}
+	root := filepath.Dir(from)
+	backups, err := List(root)
+	if err != nil {
+		return "", nil, err
+	}
+	base := b.ID
+	if b.Type == storage.BackupIncremental {
+		base = b.Base
+	}
+	chain, err := Chain(backups, base)
+	if err != nil {
+		return "", nil, err
+	}
+	if opts.UntilLSN != 0 && chain[0].CheckpointLSN > opts.UntilLSN {
+		return "", nil, fmt.Errorf("%w: snapshot %s is at LSN %d, past %d", ErrRestoreTarget, chain[0].ID, chain[0].CheckpointLSN, opts.UntilLSN)
+	}
+	if !opts.UntilTime.IsZero() && chain[0].CreatedAt.After(opts.UntilTime) {
+		return "", nil, fmt.Errorf("%w: snapshot %s was taken after %s", ErrRestoreTarget, chain[0].ID, opts.UntilTime.Format(time.RFC3339))
+	}
+	if b.Type == storage.BackupIncremental {
+		for i, c := range chain {
+			if c.ID == b.ID {
+				return root, chain[:i+1], nil
+			}
+		}
+		return "", nil, fmt.Errorf("%w: %s does not continue from snapshot %s", storage.ErrBackupInvalid, b.ID, base)
+	}
+	return root, chain, nil
+}
+
+// restoreRecords returns the records after checkpoint up to the target,
+// which must form an unbroken sequence.
+func restoreRecords(entries []storage.WALEntry, checkpoint uint64, opts RestoreOptions) ([]storage.WALEntry, error) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].LSN < entries[j].LSN })
+	var replay []storage.WALEntry
+	next := checkpoint + 1
+	for _, entry := range entries {
+		if entry.LSN < next {
+			continue
+		}
+		if opts.UntilLSN != 0 && entry.LSN > opts.UntilLSN {
+			break
+		}
+		if !opts.UntilTime.IsZero() && entry.Timestamp.After(opts.UntilTime) {
+			break
+		}
+		if entry.LSN != next {
+			return nil, fmt.Errorf("%w: records %d to %d are in no backup", ErrRestoreTarget, next, entry.LSN-1)
+		}
+		replay = append(replay, entry)
+		next++
+	}
+	if opts.UntilLSN != 0 && next <= opts.UntilLSN {
+		return nil, fmt.Errorf("%w: the backups end at LSN %d", ErrRestoreTarget, next-1)
+	}
+	return replay, nil
+}
+
+// stage builds the restored database in dir and checks that it opens.
+func stage(snapshotDir string, snapshot *storage.BackupManifest, dir, dataFileName string, replay []storage.WALEntry) error {
+	for _, file := range snapshot.Files {
+		if strings.HasPrefix(file.Path, "wal/") {
+			continue
+		}
+		name := filepath.FromSlash(file.Path)
+		if file.Path == snapshot.DataFile {
+			name = dataFileName
+		}
+		if err := copyFile(filepath.Join(snapshotDir, filepath.FromSlash(file.Path)), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	if err := storage.WriteWALSegment(filepath.Join(dir, "wal"), replay); err != nil {
+		return err
+	}
+
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, dataFileName), filepath.Join(dir, "wal"), storage.Options{VerifyChecksums: true})
+	if err != nil {
+		return err
+	}
+	return engine.Close()
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,276 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+const (
+	// ModeIncremental takes a base snapshot every SnapshotIntervalHours
+	// and, in between, backs up the WAL records logged since the previous
+	// backup.
+	ModeIncremental = "incremental"
+	// ModeSnapshot takes a full snapshot on every run.
+	ModeSnapshot = "snapshot"
+
+	// walHold names the engine's WAL hold for records not yet backed up.
+	walHold = "backup"
+)
+
+var ErrInvalidMode = errors.New("unknown backup mode")
+
+// Status reports the scheduler's configuration, the outcome of its last
+// runs and the backups on disk.
+type Status struct {
+	Enabled     bool       `json:"enabled"`
+	Mode        string     `json:"mode"`
+	Directory   string     `json:"directory"`
+	Running     bool       `json:"running"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	NextRun     *time.Time `json:"nextRun,omitempty"`
+	Backups     []Info     `json:"backups"`
+	TotalSize   int64      `json:"totalSize"`
+}
+
+type Info struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Base      string    `json:"base,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	FromLSN   uint64    `json:"fromLSN,omitempty"`
+	LSN       uint64    `json:"lsn"`
+	Size      int64     `json:"size"`
+}
+
+// Scheduler takes the backups configured in config.BackupConfig, every
+// IntervalMinutes while enabled and on demand, and applies the retention
+// policy after each scheduled run.
+type Scheduler struct {
+	engine *storage.Engine
+	cfg    config.BackupConfig
+
+	// runMu serializes backups.
+	runMu  sync.Mutex
+	mu     sync.Mutex
+	status Status
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func New(engine *storage.Engine, cfg config.BackupConfig) (*Scheduler, error) {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeIncremental
+	case ModeIncremental, ModeSnapshot:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMode, cfg.Mode)
+	}
+	if cfg.IntervalMinutes <= 0 {
+		cfg.IntervalMinutes = 30
+	}
+	if cfg.SnapshotIntervalHours <= 0 {
+		cfg.SnapshotIntervalHours = 24
+	}
+	return &Scheduler{
+		engine: engine,
+		cfg:    cfg,
+		status: Status{Enabled: cfg.Enabled, Mode: cfg.Mode, Directory: cfg.Directory},
+	}, nil
+}
+
+// Start begins taking scheduled backups if they are enabled. The first
+// one is due an interval after the newest backup on disk.
+func (s *Scheduler) Start() error {
+	if !s.cfg.Enabled {
+		return nil
+	}
+	backups, err := List(s.cfg.Directory)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(s.cfg.IntervalMinutes) * time.Minute
+	delay := time.Duration(0)
+	if n := len(backups); n > 0 {
+		delay = max(0, time.Until(backups[n-1].CreatedAt.Add(interval)))
+	}
+	if chain := latestChain(backups); chain != nil && s.cfg.Mode == ModeIncremental {
+		s.engine.HoldWAL(walHold, chain[len(chain)-1].LSN)
+	}
+
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.loop(delay, interval)
+	return nil
+}
+
+// Stop waits for a running backup and stops the schedule.
+func (s *Scheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *Scheduler) loop(delay, interval time.Duration) {
+	defer close(s.done)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		next := time.Now().Add(delay).UTC()
+		s.mu.Lock()
+		s.status.NextRun = &next
+		s.mu.Unlock()
+
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+			if _, err := s.Run(); err != nil {
+				log.Printf("[ERROR] Scheduled backup failed: %v", err)
+			}
+			delay = interval
+			timer.Reset(delay)
+		}
+	}
+}
+
+// Run takes one scheduled backup. In incremental mode that is an
+// incremental backup on top of the newest snapshot, unless the snapshot
+// is older than SnapshotIntervalHours or the WAL no longer holds the
+// records it needs, in which case a new snapshot is taken. It returns nil
+// if nothing was written since the previous backup.
+func (s *Scheduler) Run() (*storage.BackupManifest, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.setRunning()
+	b, err := s.run()
+	s.finish(err)
+	return b, err
+}
+
+func (s *Scheduler) run() (*storage.BackupManifest, error) {
+	backups, err := List(s.cfg.Directory)
+	if err != nil {
+		return nil, err
+	}
+	snapshotInterval := time.Duration(s.cfg.SnapshotIntervalHours) * time.Hour
+	if chain := latestChain(backups); s.cfg.Mode == ModeIncremental && chain != nil && time.Since(chain[0].CreatedAt) < snapshotInterval {
+		last := chain[len(chain)-1]
+		if s.engine.LastLSN() == last.LSN {
+			return nil, nil
+		}
+		b, err := s.engine.BackupIncremental(s.newDir(), chain[0].ID, last.LSN)
+		if !errors.Is(err, storage.ErrWALGap) {
+			return s.taken(b, err)
+		}
+		log.Printf("[WARN] %v; taking a new snapshot", err)
+	}
+	return s.taken(s.engine.Backup(s.newDir()))
+}
+
+// Snapshot takes a snapshot now, outside the schedule.
+func (s *Scheduler) Snapshot() (*storage.BackupManifest, error) {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.setRunning()
+	b, err := s.taken(s.engine.Backup(s.newDir()))
+	s.finish(err)
+	return b, err
+}
+
+// taken moves the WAL hold past a new backup and applies the retention
+// policy.
+func (s *Scheduler) taken(b *storage.BackupManifest, err error) (*storage.BackupManifest, error) {
+	if err != nil || !s.cfg.Enabled {
+		return b, err
+	}
+	if s.cfg.Mode == ModeIncremental {
+		s.engine.HoldWAL(walHold, b.LSN)
+	}
+	return b, s.prune()
+}
+
+func (s *Scheduler) prune() error {
+	backups, err := List(s.cfg.Directory)
+	if err != nil {
+		return err
+	}
+	for _, id := range expired(backups, s.cfg.KeepDaily, s.cfg.KeepWeekly) {
+		if err := os.RemoveAll(filepath.Join(s.cfg.Directory, id)); err != nil {
+			return fmt.Errorf("removing expired backup %s: %w", id, err)
+		}
+		log.Printf("[INFO] Removed expired backup %s", id)
+	}
+	return nil
+}
+
+func (s *Scheduler) newDir() string {
+	return NewDir(s.cfg.Directory)
+}
+
+// NewDir returns where in directory to write a backup taken now. The ID has
+// a suffix if another backup was taken in the same second.
+func NewDir(directory string) string {
+	id := storage.NewBackupID(time.Now())
+	dir := filepath.Join(directory, id)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return dir
+		}
+		dir = filepath.Join(directory, fmt.Sprintf("%s-%d", id, i))
+	}
+}
+
+func (s *Scheduler) setRunning() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = true
+}
+
+func (s *Scheduler) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	s.status.Running = false
+	if err != nil {
+		s.status.LastFailure, s.status.LastError = &now, err.Error()
+	} else {
+		s.status.LastSuccess = &now
+	}
+}
+
+// Status returns the scheduler state and lists the backups on disk.
+func (s *Scheduler) Status() (Status, error) {
+	backups, err := List(s.cfg.Directory)
+	if err != nil {
+		return Status{}, err
+	}
+	s.mu.Lock()
+	status := s.status
+	s.mu.Unlock()
+	status.Backups = make([]Info, 0, len(backups))
+	for _, b := range backups {
+		status.Backups = append(status.Backups, Info{
+			ID:        b.ID,
+			Type:      b.Type,
+			Base:      b.Base,
+			CreatedAt: b.CreatedAt,
+			FromLSN:   b.FromLSN,
+			LSN:       b.LSN,
+			Size:      b.Size,
+		})
+		status.TotalSize += b.Size
+	}
+	return status, nil
+}
@@ -0,0 +1,306 @@
+package clientsync
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// Mutation operations.
+const (
+	OpPut    = "put"
+	OpDelete = "delete"
+)
+
+// Result statuses.
+const (
+	// StatusApplied means the mutation was written without a conflict, or
+	// had already been written by an earlier push.
+	StatusApplied = "applied"
+	// StatusResolved means the mutation conflicted and was written anyway,
+	// as it was or merged with the server's document.
+	StatusResolved = "resolved"
+	// StatusRejected means the mutation conflicted and the server's
+	// document was kept.
+	StatusRejected = "rejected"
+	// StatusFailed means the mutation could not be written, for instance
+	// because it broke a unique index.
+	StatusFailed = "failed"
+)
+
+// Conflict resolutions.
+const (
+	ResolutionClientWins = "client-wins"
+	ResolutionServerWins = "server-wins"
+	ResolutionMerged     = "merged"
+	ResolutionRejected   = "rejected"
+)
+
+// pushAttempts is how many times a mutation is resolved again when the
+// document changes between reading and writing it.
+const pushAttempts = 3
+
+// Mutation is a write a client made to its copy. BaseVersion is the
+// version of the document it changed, zero if it created it, and Base its
+// data, which the merge strategy needs to tell which fields changed. HLC is
+// the client's timestamp for the write; pushing the same mutation again is
+// harmless.
+type Mutation struct {
+	Collection  string                 `json:"collection"`
+	ID          string                 `json:"id"`
+	Op          string                 `json:"op"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+	Base        map[string]interface{} `json:"base,omitempty"`
+	BaseVersion uint64                 `json:"baseVersion"`
+	HLC         string                 `json:"hlc"`
+}
+
+type Conflict struct {
+	Strategy      string `json:"strategy"`
+	Resolution    string `json:"resolution"`
+	Reason        string `json:"reason"`
+	BaseVersion   uint64 `json:"baseVersion"`
+	ServerVersion uint64 `json:"serverVersion"`
+	// Fields are the fields both sides changed, when a merge failed.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// Result is the outcome of one mutation. Document is the server's document
+// afterwards, nil if it does not exist.
+type Result struct {
+	Collection string            `json:"collection"`
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Document   *storage.Document `json:"document,omitempty"`
+	Conflict   *Conflict         `json:"conflict,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type PushResponse struct {
+	Results   []Result `json:"results"`
+	Conflicts int      `json:"conflicts"`
+	HLC       string   `json:"hlc"`
+}
+
+// Push applies mutations in order, each on its own. The whole push fails
+// without writing anything if a mutation is malformed or stamped too far
+// ahead of the server's clock.
+func (s *Service) Push(mutations []Mutation) (*PushResponse, error) {
+	stamps := make([]storage.HLC, len(mutations))
+	limit := s.engine.Now().Wall + int64(s.cfg.MaxClockDriftMs)
+	for i, m := range mutations {
+		hlc, err := checkMutation(m)
+		if err != nil {
+			return nil, fmt.Errorf("mutation %d: %w", i, err)
+		}
+		if hlc.Wall > limit {
+			return nil, fmt.Errorf("%w: mutation %d is stamped %s", ErrClockDrift, i, m.HLC)
+		}
+		stamps[i] = hlc
+	}
+
+	resp := &PushResponse{Results: make([]Result, 0, len(mutations))}
+	for i, m := range mutations {
+		s.engine.Observe(stamps[i])
+		result := s.apply(m, stamps[i])
+		if result.Conflict != nil {
+			resp.Conflicts++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	resp.HLC = s.engine.Now().String()
+	return resp, nil
+}
+
+func checkMutation(m Mutation) (storage.HLC, error) {
+	if m.Collection == "" || m.ID == "" {
+		return storage.HLC{}, fmt.Errorf("%w: collection and id are required", ErrInvalidMutation)
+	}
+	switch m.Op {
+	case OpPut:
+		if m.Data == nil {
+			return storage.HLC{}, fmt.Errorf("%w: put needs data", ErrInvalidMutation)
+		}
+	case OpDelete:
+	default:
+		return storage.HLC{}, fmt.Errorf("%w: unknown op %q", ErrInvalidMutation, m.Op)
+	}
+	hlc, err := storage.ParseHLC(m.HLC)
+	if err != nil {
+		return storage.HLC{}, fmt.Errorf("%w: %v", ErrInvalidMutation, err)
+	}
+	if hlc.IsZero() {
+		return storage.HLC{}, fmt.Errorf("%w: hlc is required", ErrInvalidMutation)
+	}
+	return hlc, nil
+}
+
+func (s *Service) apply(m Mutation, hlc storage.HLC) Result {
+	var err error
+	for attempt := 0; attempt < pushAttempts; attempt++ {
+		current, _ := s.engine.GetDocument(m.Collection, m.ID)
+		var result Result
+		result, err = s.resolve(m, hlc, current)
+		if errors.Is(err, storage.ErrPreconditionFailed) || errors.Is(err, storage.ErrDocumentNotFound) {
+			// The document changed under us; look at it again.
+			continue
+		}
+		if err != nil {
+			break
+		}
+		return result
+	}
+	return Result{Collection: m.Collection, ID: m.ID, Status: StatusFailed, Error: err.Error()}
+}
+
+// resolve applies m to current, the server's document, and returns what
+// happened. It fails with ErrPreconditionFailed if the document changed
+// meanwhile.
+func (s *Service) resolve(m Mutation, hlc storage.HLC, current *storage.Document) (Result, error) {
+	result := Result{Collection: m.Collection, ID: m.ID, Document: current}
+	switch {
+	case current != nil && current.HLC == hlc.String():
+		// Already written by an earlier push.
+		result.Status = StatusApplied
+		return result, nil
+	case current == nil && m.Op == OpDelete:
+		result.Status = StatusApplied
+		return result, nil
+	case version(current) == m.BaseVersion:
+		doc, err := s.write(m, m.Data, hlc, current)
+		result.Status, result.Document = StatusApplied, doc
+		return result, err
+	}
+
+	strategy := s.Strategy(m.Collection)
+	conflict := &Conflict{Strategy: strategy, BaseVersion: m.BaseVersion, ServerVersion: version(current)}
+	result.Status, result.Conflict = StatusRejected, conflict
+	switch {
+	case current == nil && strategy == StrategyLWW:
+		if deleted, ok := s.engine.DeletedAt(m.Collection, m.ID); ok && hlc.Compare(deleted) <= 0 {
+			conflict.Resolution, conflict.Reason = ResolutionServerWins, "the server's delete is later"
+			break
+		}
+		doc, err := s.write(m, m.Data, hlc, nil)
+		if err != nil {
+			return result, err
+		}
+		conflict.Resolution, conflict.Reason = ResolutionClientWins, "the client's write is later"
+		result.Status, result.Document = StatusResolved, doc
+	case current == nil:
+		conflict.Resolution, conflict.Reason = ResolutionRejected, "the document was deleted on the server"
+	case strategy == StrategyLWW:
+		if hlc.Compare(storage.DocumentHLC(current)) <= 0 {
+			conflict.Resolution, conflict.Reason = ResolutionServerWins, "the server's write is later"
+			break
+		}
+		doc, err := s.write(m, m.Data, hlc, current)
+		if err != nil {
+			return result, err
+		}
+		conflict.Resolution, conflict.Reason = ResolutionClientWins, "the client's write is later"
+		result.Status, result.Document = StatusResolved, doc
+	case strategy == StrategyMerge:
+		if m.Op == OpDelete {
+			conflict.Resolution, conflict.Reason = ResolutionRejected, "a delete cannot be merged"
+			break
+		}
+		if m.Base == nil && m.BaseVersion > 0 {
+			conflict.Resolution, conflict.Reason = ResolutionRejected, "merging needs the base data"
+			break
+		}
+		merged, fields := merge(m.Base, m.Data, current.Data)
+		if len(fields) > 0 {
+			conflict.Resolution, conflict.Reason, conflict.Fields = ResolutionRejected, "both sides changed the same fields", fields
+			break
+		}
+		conflict.Resolution, conflict.Reason = ResolutionMerged, "the changes touch different fields"
+		result.Status = StatusResolved
+		if reflect.DeepEqual(merged, current.Data) {
+			break
+		}
+		// The merged document is a new write, stamped by the server.
+		doc, err := s.write(m, merged, storage.HLC{}, current)
+		if err != nil {
+			return result, err
+		}
+		result.Document = doc
+	default:
+		conflict.Resolution, conflict.Reason = ResolutionRejected, "the document changed on the server"
+	}
+	return result, nil
+}
+
+// write applies m with data, provided the document is still current.
+func (s *Service) write(m Mutation, data map[string]interface{}, hlc storage.HLC, current *storage.Document) (*storage.Document, error) {
+	cond := storage.Precondition{IfNoneMatchAny: true}
+	if current != nil {
+		cond = storage.Precondition{IfMatch: []uint64{current.Version}}
+	}
+	if m.Op == OpDelete {
+		return nil, s.engine.DeleteDocumentAt(m.Collection, m.ID, hlc, cond)
+	}
+	doc, _, err := s.engine.PutDocumentAt(m.Collection, m.ID, data, hlc, cond)
+	return doc, err
+}
+
+// merge applies the client's changes from base to ours onto theirs, the
+// server's data. It returns the fields both changed, differently, in which
+// case there is no merge.
+func merge(base, ours, theirs map[string]interface{}) (map[string]interface{}, []string) {
+	var fields []string
+	mine, others := changedFields(base, ours), changedFields(base, theirs)
+	for field := range mine {
+		if _, changed := others[field]; !changed {
+			continue
+		}
+		v, inOurs := ours[field]
+		w, inTheirs := theirs[field]
+		if inOurs != inTheirs || !reflect.DeepEqual(v, w) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > 0 {
+		sort.Strings(fields)
+		return nil, fields
+	}
+
+	merged := make(map[string]interface{}, len(theirs))
+	for k, v := range theirs {
+		merged[k] = v
+	}
+	for field := range mine {
+		if v, ok := ours[field]; ok {
+			merged[field] = v
+		} else {
+			delete(merged, field)
+		}
+	}
+	return merged, nil
+}
+
+// changedFields returns the top-level fields that differ between a and b.
+func changedFields(a, b map[string]interface{}) map[string]struct{} {
+	changed := make(map[string]struct{})
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !reflect.DeepEqual(v, w) {
+			changed[k] = struct{}{}
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			changed[k] = struct{}{}
+		}
+	}
+	return changed
+}
+
+func version(doc *storage.Document) uint64 {
+	if doc == nil {
+		return 0
+	}
+	return doc.Version
+}
@@ -0,0 +1,156 @@
+package clientsync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+const (
+	// PullPath returns the changes since ?since=, or a snapshot of the
+	// documents when there is no checkpoint to resume from.
+	PullPath = "/sync/pull"
+	// PushPath applies a batch of client mutations.
+	PushPath = "/sync/push"
+)
+
+// Conflict strategies.
+const (
+	// StrategyLWW keeps whichever write has the later hybrid logical clock
+	// timestamp.
+	StrategyLWW = "lww"
+	// StrategyReject keeps the server's document.
+	StrategyReject = "reject"
+	// StrategyMerge combines the two writes if they changed different
+	// top-level fields.
+	StrategyMerge = "merge"
+)
+
+var (
+	ErrInvalidStrategy = errors.New("unknown conflict strategy")
+	ErrInvalidMutation = errors.New("invalid mutation")
+	ErrClockDrift      = errors.New("client clock too far ahead")
+)
+
+// Service syncs app-embedded copies of the database with the engine. A
+// client pulls the changes since its checkpoint and pushes the mutations
+// it made offline, each with the version it was based on; a mutation
+// based on an older version than the server's is a conflict, resolved by
+// the collection's strategy.
+type Service struct {
+	engine *storage.Engine
+	cfg    config.SyncConfig
+}
+
+func New(engine *storage.Engine, cfg config.SyncConfig) (*Service, error) {
+	if cfg.Strategy == "" {
+		cfg.Strategy = StrategyReject
+	}
+	if err := checkStrategy(cfg.Strategy); err != nil {
+		return nil, err
+	}
+	for collection, strategy := range cfg.Collections {
+		if err := checkStrategy(strategy); err != nil {
+			return nil, fmt.Errorf("%w (collection %s)", err, collection)
+		}
+	}
+	if cfg.MaxClockDriftMs <= 0 {
+		cfg.MaxClockDriftMs = 60000
+	}
+	if cfg.PullLimit <= 0 {
+		cfg.PullLimit = 1000
+	}
+	return &Service{engine: engine, cfg: cfg}, nil
+}
+
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case StrategyLWW, StrategyReject, StrategyMerge:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidStrategy, strategy)
+}
+
+// Strategy returns the conflict strategy of collection.
+func (s *Service) Strategy(collection string) string {
+	if strategy, ok := s.cfg.Collections[collection]; ok {
+		return strategy
+	}
+	return s.cfg.Strategy
+}
+
+type PullRequest struct {
+	// Since is the checkpoint of the last pull; nil asks for a snapshot.
+	Since *uint64
+	// Collections limits the pull; empty means all.
+	Collections []string
+	Limit       int
+}
+
+// PullResponse carries either a snapshot of the documents (Reset) or the
+// changes since the client's checkpoint. The client pulls again from
+// Checkpoint, right away if More is set.
+type PullResponse struct {
+	Checkpoint uint64                         `json:"checkpoint"`
+	Reset      bool                           `json:"reset"`
+	More       bool                           `json:"more"`
+	Documents  map[string][]*storage.Document `json:"documents,omitempty"`
+	Changes    []storage.Change               `json:"changes"`
+	// HLC is the server's clock, for the client to move its own past.
+	HLC string `json:"hlc"`
+}
+
+// Pull returns what the client needs to catch up. If its checkpoint can
+// no longer be resumed from, because the WAL records after it have been
+// removed or the server was restored to an earlier point, the client gets
+// a snapshot instead and must replace its copy.
+func (s *Service) Pull(req PullRequest) (*PullResponse, error) {
+	limit := s.cfg.PullLimit
+	if req.Limit > 0 && req.Limit < limit {
+		limit = req.Limit
+	}
+	if req.Since != nil {
+		changes, checkpoint, more, err := s.engine.ReadChanges(*req.Since, req.Collections, limit)
+		if err == nil {
+			if changes == nil {
+				changes = []storage.Change{}
+			}
+			return &PullResponse{Checkpoint: checkpoint, More: more, Changes: changes, HLC: s.engine.Now().String()}, nil
+		}
+		if !errors.Is(err, storage.ErrChangesUnavailable) {
+			return nil, err
+		}
+	}
+	return s.snapshot(req.Collections)
+}
+
+// snapshot returns every document. Its checkpoint is taken first, so that
+// writes made while it is read are pulled again as changes, and the WAL is
+// synced last, so that none of the writes it holds can be lost in a crash.
+func (s *Service) snapshot(collections []string) (*PullResponse, error) {
+	resp := &PullResponse{
+		Checkpoint: s.engine.LastLSN(),
+		Reset:      true,
+		Documents:  make(map[string][]*storage.Document),
+		Changes:    []storage.Change{},
+	}
+	if len(collections) == 0 {
+		collections = s.engine.ListCollections()
+		sort.Strings(collections)
+	}
+	for _, collection := range collections {
+		result, err := s.engine.Query(collection, storage.QueryOptions{Sort: []storage.SortField{{Field: "id"}}})
+		if err != nil {
+			return nil, err
+		}
+		resp.Documents[collection] = result.Documents
+	}
+	if err := s.engine.SyncWAL(); err != nil {
+		return nil, err
+	}
+	resp.HLC = s.engine.Now().String()
+	return resp, nil
+}
@@ -0,0 +1,420 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// Entry kinds.
+const (
+	EntryRecord = "record"
+	EntryConfig = "config"
+	EntryNoop   = "noop"
+	// EntrySnapshot only starts a compacted log.
+	EntrySnapshot = "snapshot"
+)
+
+// Entry is one entry of the Raft log: a WAL record to apply, the new
+// member list of a configuration change, or the no-op a leader appends
+// when elected.
+//
+// A compacted log starts with a snapshot entry standing for every entry
+// up to its index, which the engine holds: LSN is the last record among
+// them, and Members the configuration set by the entry at ConfigIndex.
+type Entry struct {
+	Index       uint64            `json:"index"`
+	Term        uint64            `json:"term"`
+	Kind        string            `json:"kind"`
+	Record      *storage.WALEntry `json:"record,omitempty"`
+	Members     []Member          `json:"members,omitempty"`
+	LSN         uint64            `json:"lsn,omitempty"`
+	ConfigIndex uint64            `json:"configIndex,omitempty"`
+}
+
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// entryMeta is what the log keeps in memory about an entry; the entry
+// itself is read back from the file when needed.
+type entryMeta struct {
+	term   uint64
+	offset int64
+	// lsn is the LSN of the entry's record, or 0.
+	lsn    uint64
+	config bool
+}
+
+// raftLog is a node's persistent Raft state: its term and vote in
+// state.json, and its entries in log, one JSON line each. It is not safe
+// for concurrent use.
+type raftLog struct {
+	dir  string
+	file *os.File
+	size int64
+	// snap is the snapshot entry the log starts with, if compacted, and
+	// metas describe the entries after it.
+	snap  Entry
+	metas []entryMeta
+
+	term     uint64
+	votedFor string
+}
+
+type logState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor,omitempty"`
+}
+
+// openLog loads the log in dir, cutting off an entry torn by a crash at
+// its end.
+func openLog(dir string) (*raftLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating Raft directory: %w", err)
+	}
+	l := &raftLog{dir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	switch {
+	case err == nil:
+		var state logState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("reading Raft state: %w", err)
+		}
+		l.term, l.votedFor = state.Term, state.VotedFor
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "log")
+	l.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(l.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("[WARN] Truncating torn Raft log entry at offset %d of %s", l.size, path)
+				if err := l.file.Truncate(l.size); err != nil {
+					l.file.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		var entry Entry
+		err = json.Unmarshal(line, &entry)
+		if err == nil && l.size == 0 && entry.Kind == EntrySnapshot {
+			l.snap = entry
+			l.size += int64(len(line))
+			continue
+		}
+		if err != nil || entry.Index != l.lastIndex()+1 {
+			l.file.Close()
+			return nil, fmt.Errorf("damaged Raft log entry at offset %d of %s", l.size, path)
+		}
+		l.metas = append(l.metas, metaOf(entry, l.size))
+		l.size += int64(len(line))
+	}
+	return l, nil
+}
+
+func metaOf(entry Entry, offset int64) entryMeta {
+	meta := entryMeta{term: entry.Term, offset: offset, config: entry.Kind == EntryConfig}
+	if entry.Record != nil {
+		meta.lsn = entry.Record.LSN
+	}
+	return meta
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snap.Index + uint64(len(l.metas))
+}
+
+// meta returns the entry at index, which must be after the snapshot.
+func (l *raftLog) meta(index uint64) entryMeta {
+	return l.metas[index-l.snap.Index-1]
+}
+
+// termAt returns the term of the entry at index, or 0 if there is none.
+// The snapshot's index has the snapshot's term.
+func (l *raftLog) termAt(index uint64) uint64 {
+	switch {
+	case index == l.snap.Index:
+		return l.snap.Term
+	case index < l.snap.Index || index > l.lastIndex():
+		return 0
+	}
+	return l.meta(index).term
+}
+
+func (l *raftLog) entry(index uint64) (Entry, error) {
+	entries, err := l.slice(index, index)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entries[0], nil
+}
+
+// slice returns the entries from index from to index to, inclusive. The
+// entries up to the snapshot are gone.
+func (l *raftLog) slice(from, to uint64) ([]Entry, error) {
+	if from <= l.snap.Index || from > to || to > l.lastIndex() {
+		return nil, nil
+	}
+	start, end := l.meta(from).offset, l.size
+	if to < l.lastIndex() {
+		end = l.meta(to + 1).offset
+	}
+	data := make([]byte, end-start)
+	if _, err := l.file.ReadAt(data, start); err != nil {
+		return nil, fmt.Errorf("reading Raft log: %w", err)
+	}
+	entries := make([]Entry, 0, to-from+1)
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("reading Raft log: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// append writes entries, which must follow the last one, and syncs them.
+func (l *raftLog) append(entries ...Entry) error {
+	var buf bytes.Buffer
+	metas := make([]entryMeta, 0, len(entries))
+	for i, entry := range entries {
+		if entry.Index != l.lastIndex()+uint64(i)+1 {
+			return fmt.Errorf("appending Raft entry %d after %d", entry.Index, l.lastIndex()+uint64(i))
+		}
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		metas = append(metas, metaOf(entry, l.size+int64(buf.Len())))
+		buf.Write(payload)
+		buf.WriteByte('\n')
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("writing Raft log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("syncing Raft log: %w", err)
+	}
+	l.size += int64(buf.Len())
+	l.metas = append(l.metas, metas...)
+	return nil
+}
+
+// truncate removes the entries from index on, which must be after the
+// snapshot.
+func (l *raftLog) truncate(index uint64) error {
+	if index <= l.snap.Index {
+		return fmt.Errorf("truncating Raft log at %d, within its snapshot (%d)", index, l.snap.Index)
+	}
+	if index > l.lastIndex() {
+		return nil
+	}
+	size := l.meta(index).offset
+	if err := l.file.Truncate(size); err != nil {
+		return fmt.Errorf("truncating Raft log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("syncing Raft log: %w", err)
+	}
+	l.size = size
+	l.metas = l.metas[:index-l.snap.Index-1]
+	return nil
+}
+
+// lastLSN returns the LSN of the last record in the log, or 0.
+func (l *raftLog) lastLSN() uint64 {
+	return l.lsnAt(l.lastIndex())
+}
+
+// lsnAt returns the LSN of the last record up to index, or 0.
+func (l *raftLog) lsnAt(index uint64) uint64 {
+	for ; index > l.snap.Index; index-- {
+		if lsn := l.meta(index).lsn; lsn != 0 {
+			return lsn
+		}
+	}
+	return l.snap.LSN
+}
+
+// indexOfLSN returns the index of the record with the given LSN, or of the
+// snapshot if that is its last record.
+func (l *raftLog) indexOfLSN(lsn uint64) (uint64, bool) {
+	for index := l.lastIndex(); index > l.snap.Index; index-- {
+		if m := l.meta(index); m.lsn != 0 && m.lsn <= lsn {
+			return index, m.lsn == lsn
+		}
+	}
+	return l.snap.Index, l.snap.LSN == lsn
+}
+
+// config returns the members named by the last configuration entry and
+// its index, which is 0 if the log has none.
+func (l *raftLog) config() ([]Member, uint64, error) {
+	return l.configAt(l.lastIndex())
+}
+
+// configAt returns the configuration in force at index.
+func (l *raftLog) configAt(index uint64) ([]Member, uint64, error) {
+	for ; index > l.snap.Index; index-- {
+		if l.meta(index).config {
+			entry, err := l.entry(index)
+			return entry.Members, entry.Index, err
+		}
+	}
+	return l.snap.Members, l.snap.ConfigIndex, nil
+}
+
+// snapshotAt returns the snapshot entry standing for the entries up to
+// index.
+func (l *raftLog) snapshotAt(index uint64) (Entry, error) {
+	members, configIndex, err := l.configAt(index)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{
+		Index:       index,
+		Term:        l.termAt(index),
+		Kind:        EntrySnapshot,
+		LSN:         l.lsnAt(index),
+		Members:     members,
+		ConfigIndex: configIndex,
+	}, nil
+}
+
+// compact drops the entries up to index, which the engine must hold.
+func (l *raftLog) compact(index uint64) error {
+	snap, err := l.snapshotAt(index)
+	if err != nil {
+		return err
+	}
+	return l.install(snap)
+}
+
+// install makes snap the start of the log. The entries after it are kept
+// if the log has snap's last entry, and dropped otherwise. The log is
+// rewritten to a temporary file that then replaces it, so a crash leaves
+// either the old log or the new one.
+func (l *raftLog) install(snap Entry) error {
+	header, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	header = append(header, '\n')
+	var keep []entryMeta
+	var tail int64
+	if snap.Index < l.lastIndex() && l.termAt(snap.Index) == snap.Term {
+		keep, tail = l.metas[snap.Index-l.snap.Index:], l.meta(snap.Index+1).offset
+	}
+
+	path := filepath.Join(l.dir, "log")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(header)
+	if err == nil && keep != nil {
+		_, err = io.Copy(f, io.NewSectionReader(l.file, tail, l.size-tail))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(l.dir)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("compacting Raft log: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	size, shift := int64(len(header)), int64(len(header))-tail
+	if keep != nil {
+		size += l.size - tail
+	}
+	metas := make([]entryMeta, len(keep))
+	for i, m := range keep {
+		m.offset += shift
+		metas[i] = m
+	}
+	l.file, l.size, l.snap, l.metas = file, size, snap, metas
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// setState durably records the current term and vote.
+func (l *raftLog) setState(term uint64, votedFor string) error {
+	data, err := json.Marshal(logState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, "state.json.tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(l.dir, "state.json")); err != nil {
+		return err
+	}
+	l.term, l.votedFor = term, votedFor
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,865 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// Roles.
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotEntries   = 10000
+	// maxAppendEntries is how many entries go in one AppendEntries call.
+	maxAppendEntries = 256
+)
+
+var (
+	ErrNotLeader = errors.New("not the cluster leader")
+	// ErrLeadershipLost means the node stopped being leader before a write
+	// was committed. The write may still be committed by the next leader.
+	ErrLeadershipLost   = errors.New("leadership lost before the write was committed")
+	ErrStopped          = errors.New("cluster node stopped")
+	ErrMembershipChange = errors.New("another membership change is in progress")
+)
+
+// Node is a member of a Raft cluster. Writes to its engine are proposed
+// through the Raft log and every node applies them once committed; on a
+// node that is not the leader they fail with ErrNotLeader.
+type Node struct {
+	id      string
+	address string
+	engine  *storage.Engine
+	log     *raftLog
+	client  *http.Client
+	token   string
+
+	electionTimeout time.Duration
+	heartbeat       time.Duration
+	snapshotEntries uint64
+
+	// applyMu is held while applying entries or installing a snapshot.
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	cond    *sync.Cond
+	role    string
+	// leader is the last leader heard from in the current term.
+	leader      Member
+	lastContact time.Time
+	deadline    time.Time
+	// round identifies the election in progress, if any.
+	round uint64
+	// members is the latest configuration in the log, or the initial one
+	// while the log has none.
+	members     []Member
+	configIndex uint64
+	bootstrap   []Member
+	commitIndex uint64
+	lastApplied uint64
+	// readyIndex is the no-op a leader appends when elected; it accepts
+	// writes once that has been applied, as its state is then current.
+	readyIndex uint64
+	leaderFrom time.Time
+	peers      map[string]*peer
+	pending    map[uint64]*proposal
+	applyErr   error
+	stopped    bool
+
+	applyCh chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// peer is another member, as tracked by the leader replicating to it.
+type peer struct {
+	member     Member
+	nextIndex  uint64
+	matchIndex uint64
+	lastAck    time.Time
+	// snapshotAfter holds off sending another snapshot after one failed.
+	snapshotAfter time.Time
+	trigger       chan struct{}
+	stop          chan struct{}
+}
+
+type proposal struct {
+	done chan error
+}
+
+// NewNode opens the Raft log next to the engine's data file and routes the
+// engine's writes through it. Call Start to join the cluster.
+func NewNode(engine *storage.Engine, cfg config.Config) (*Node, error) {
+	ccfg := cfg.Cluster
+	if ccfg.NodeID == "" || ccfg.Address == "" {
+		return nil, errors.New("cluster.nodeId and cluster.address are required")
+	}
+	l, err := openLog(filepath.Join(filepath.Dir(cfg.Storage.DataFile), "raft"))
+	if err != nil {
+		return nil, err
+	}
+	// Every record in the engine must have come through the log, or the
+	// nodes' LSNs would not line up.
+	switch lsn := engine.LastLSN(); {
+	case l.lastIndex() == 0 && lsn > 0:
+		l.close()
+		return nil, fmt.Errorf("the data directory holds records up to LSN %d but there is no Raft log; a new cluster node must start with no data", lsn)
+	case lsn < l.snap.LSN:
+		l.close()
+		return nil, fmt.Errorf("the data directory ends at LSN %d, before the Raft log's snapshot (%d)", lsn, l.snap.LSN)
+	}
+	n := &Node{
+		id:              ccfg.NodeID,
+		address:         ccfg.Address,
+		engine:          engine,
+		log:             l,
+		client:          &http.Client{},
+		token:           cfg.Security.Token,
+		electionTimeout: time.Duration(ccfg.ElectionTimeoutMs) * time.Millisecond,
+		heartbeat:       time.Duration(ccfg.HeartbeatIntervalMs) * time.Millisecond,
+		snapshotEntries: DefaultSnapshotEntries,
+		role:            RoleFollower,
+		commitIndex:     l.snap.Index,
+		lastApplied:     l.snap.Index,
+		pending:         make(map[uint64]*proposal),
+		applyCh:         make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = DefaultElectionTimeout
+	}
+	if n.heartbeat <= 0 {
+		n.heartbeat = DefaultHeartbeatInterval
+	}
+	if ccfg.SnapshotEntries > 0 {
+		n.snapshotEntries = uint64(ccfg.SnapshotEntries)
+	}
+	for _, m := range ccfg.Members {
+		n.bootstrap = append(n.bootstrap, Member{ID: m.ID, Address: m.Address})
+	}
+	n.cond = sync.NewCond(&n.mu)
+	if err := n.loadConfigLocked(); err != nil {
+		l.close()
+		return nil, err
+	}
+	engine.SetProposer(n.propose)
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Start begins taking part in elections and applying committed entries.
+func (n *Node) Start() {
+	n.mu.Lock()
+	n.resetDeadlineLocked()
+	n.mu.Unlock()
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+}
+
+// Stop leaves the cluster until the node is started again. Writes waiting
+// to be committed fail with ErrStopped.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	n.stopPeersLocked()
+	close(n.stop)
+	n.cond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+
+	n.mu.Lock()
+	n.failPendingLocked(ErrStopped)
+	n.mu.Unlock()
+	if err := n.log.close(); err != nil {
+		log.Printf("[ERROR] Closing Raft log: %v", err)
+	}
+}
+
+// run drives elections and heartbeats.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == RoleLeader && !n.hasQuorumLocked():
+			log.Printf("[WARN] Lost contact with a majority of the cluster; stepping down")
+			n.stepDownLocked(n.log.term)
+		case n.role == RoleLeader:
+			n.prunePeersLocked()
+			n.triggerPeersLocked()
+		case time.Now().After(n.deadline):
+			n.campaignLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) resetDeadlineLocked() {
+	n.deadline = time.Now().Add(n.electionTimeout + rand.N(n.electionTimeout))
+	n.round++
+}
+
+// hasQuorumLocked reports whether a leader has heard from a majority
+// within the election timeout.
+func (n *Node) hasQuorumLocked() bool {
+	if time.Since(n.leaderFrom) < n.electionTimeout {
+		return true
+	}
+	acks := 0
+	for _, m := range n.members {
+		if p := n.peers[m.ID]; m.ID == n.id || p != nil && time.Since(p.lastAck) < n.electionTimeout {
+			acks++
+		}
+	}
+	return acks > len(n.members)/2
+}
+
+func (n *Node) isMemberLocked(id string) bool {
+	return slices.ContainsFunc(n.members, func(m Member) bool { return m.ID == id })
+}
+
+// campaignLocked starts an election for the next term, once a pre-vote
+// shows that a majority would take part in it. A node that cannot win, such
+// as one cut off from the others, thus leaves the term unchanged instead of
+// forcing the leader to step down when it comes back.
+func (n *Node) campaignLocked() {
+	if !n.isMemberLocked(n.id) {
+		n.resetDeadlineLocked()
+		return
+	}
+	n.requestVotesLocked(true)
+}
+
+func (n *Node) requestVotesLocked(preVote bool) {
+	n.resetDeadlineLocked()
+	round, term := n.round, n.log.term+1
+	if !preVote {
+		if err := n.log.setState(term, n.id); err != nil {
+			log.Printf("[ERROR] Saving Raft state: %v", err)
+			return
+		}
+		n.role, n.leader = RoleCandidate, Member{}
+		log.Printf("[INFO] Starting election for term %d", term)
+	}
+	won := func() {
+		if preVote {
+			n.requestVotesLocked(false)
+		} else {
+			n.becomeLeaderLocked()
+		}
+	}
+
+	req := VoteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.termAt(n.log.lastIndex()),
+		PreVote:      preVote,
+	}
+	votes, needed := 1, len(n.members)/2+1
+	if votes >= needed {
+		won()
+		return
+	}
+	for _, m := range n.members {
+		if m.ID == n.id {
+			continue
+		}
+		go func(m Member) {
+			var resp VoteResponse
+			err := n.call(m, VotePath, req, &resp)
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			switch {
+			case err != nil || n.stopped:
+				return
+			case resp.Term > n.log.term:
+				n.stepDownLocked(resp.Term)
+				return
+			}
+			// The round changes whenever the election timer is reset, as
+			// when a leader is heard from or another round starts.
+			if n.round != round || n.role == RoleLeader || !resp.VoteGranted {
+				return
+			}
+			if votes++; votes == needed {
+				won()
+			}
+		}(m)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	n.role, n.leader = RoleLeader, Member{ID: n.id, Address: n.address}
+	n.leaderFrom = time.Now()
+	entry := Entry{Index: n.log.lastIndex() + 1, Term: n.log.term, Kind: EntryNoop}
+	if err := n.log.append(entry); err != nil {
+		log.Printf("[ERROR] Appending to Raft log: %v", err)
+		n.stepDownLocked(n.log.term)
+		return
+	}
+	n.readyIndex = entry.Index
+	n.peers = make(map[string]*peer)
+	n.syncPeersLocked()
+	log.Printf("[INFO] Elected cluster leader for term %d", n.log.term)
+	n.advanceCommitLocked()
+}
+
+// stepDownLocked makes the node a follower, moving to term if it is newer.
+func (n *Node) stepDownLocked(term uint64) {
+	if term > n.log.term {
+		if err := n.log.setState(term, ""); err != nil {
+			log.Printf("[ERROR] Saving Raft state: %v", err)
+		}
+		n.leader = Member{}
+	}
+	if n.role == RoleLeader {
+		n.stopPeersLocked()
+		n.failPendingLocked(ErrLeadershipLost)
+		n.leader = Member{}
+	}
+	n.role = RoleFollower
+	n.resetDeadlineLocked()
+	n.cond.Broadcast()
+}
+
+// syncPeersLocked starts replicating to new members. Removed members are
+// dropped by prunePeersLocked.
+func (n *Node) syncPeersLocked() {
+	for _, m := range n.members {
+		if m.ID == n.id || n.peers[m.ID] != nil {
+			continue
+		}
+		p := &peer{
+			member:    m,
+			nextIndex: n.log.lastIndex() + 1,
+			lastAck:   time.Now(),
+			trigger:   make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+		}
+		n.peers[m.ID] = p
+		n.wg.Add(1)
+		go n.replicate(p)
+		p.trigger <- struct{}{}
+	}
+}
+
+// prunePeersLocked stops replicating to removed members once they have the
+// configuration that removes them, so that they stop campaigning, or once
+// it is committed and they have stopped answering.
+func (n *Node) prunePeersLocked() {
+	for id, p := range n.peers {
+		if n.isMemberLocked(id) {
+			continue
+		}
+		if p.matchIndex >= n.configIndex || n.configIndex <= n.commitIndex && time.Since(p.lastAck) > n.electionTimeout {
+			close(p.stop)
+			delete(n.peers, id)
+		}
+	}
+}
+
+func (n *Node) stopPeersLocked() {
+	for id, p := range n.peers {
+		close(p.stop)
+		delete(n.peers, id)
+	}
+}
+
+func (n *Node) triggerPeersLocked() {
+	for _, p := range n.peers {
+		select {
+		case p.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// replicate sends p the entries it is missing, and heartbeats.
+func (n *Node) replicate(p *peer) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-p.stop:
+			return
+		case <-p.trigger:
+		}
+		for n.sendAppend(p) {
+		}
+	}
+}
+
+// sendAppend sends one AppendEntries call and reports whether p has more
+// entries to catch up on.
+func (n *Node) sendAppend(p *peer) bool {
+	n.mu.Lock()
+	if n.role != RoleLeader || n.peers[p.member.ID] != p {
+		n.mu.Unlock()
+		return false
+	}
+	if p.nextIndex <= n.log.snap.Index {
+		n.mu.Unlock()
+		return n.sendSnapshot(p)
+	}
+	prev := p.nextIndex - 1
+	req := AppendRequest{
+		Term:          n.log.term,
+		LeaderID:      n.id,
+		LeaderAddress: n.address,
+		PrevLogIndex:  prev,
+		PrevLogTerm:   n.log.termAt(prev),
+		LeaderCommit:  n.commitIndex,
+	}
+	entries, err := n.log.slice(p.nextIndex, min(n.log.lastIndex(), prev+maxAppendEntries))
+	n.mu.Unlock()
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return false
+	}
+	req.Entries = entries
+
+	var resp AppendResponse
+	if err := n.call(p.member, AppendPath, req, &resp); err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case resp.Term > n.log.term:
+		n.stepDownLocked(resp.Term)
+		return false
+	case n.role != RoleLeader || n.log.term != req.Term || n.peers[p.member.ID] != p:
+		return false
+	}
+	p.lastAck = time.Now()
+	if !resp.Success {
+		// Back up to the end of the follower's log, or to before the
+		// entries that conflict with ours.
+		p.nextIndex = max(1, min(p.nextIndex-1, resp.LastIndex+1))
+		return true
+	}
+	if match := prev + uint64(len(entries)); match > p.matchIndex {
+		p.matchIndex = match
+		n.advanceCommitLocked()
+	}
+	p.nextIndex = p.matchIndex + 1
+	return p.nextIndex <= n.log.lastIndex()
+}
+
+// advanceCommitLocked commits the entries of the current term stored on a
+// majority, and with them every entry before.
+func (n *Node) advanceCommitLocked() {
+	for index := n.log.lastIndex(); index > n.commitIndex && n.log.termAt(index) == n.log.term; index-- {
+		count := 0
+		for _, m := range n.members {
+			if p := n.peers[m.ID]; m.ID == n.id || p != nil && p.matchIndex >= index {
+				count++
+			}
+		}
+		if count > len(n.members)/2 {
+			n.commitIndex = index
+			n.notifyApplyLocked()
+			n.triggerPeersLocked()
+			return
+		}
+	}
+}
+
+func (n *Node) notifyApplyLocked() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// loadConfigLocked sets members from the log, or to the initial members if
+// the log has no configuration entry.
+func (n *Node) loadConfigLocked() error {
+	members, index, err := n.log.config()
+	if err != nil {
+		return err
+	}
+	if index == 0 {
+		members = n.bootstrap
+	}
+	n.members, n.configIndex = members, index
+	return nil
+}
+
+// HandleVote answers a candidate's RequestVote call.
+func (n *Node) HandleVote(req VoteRequest) VoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// While a leader is in contact, candidates are ignored so that a node
+	// cut off from it, or removed from the cluster, cannot disrupt it.
+	if n.stopped || n.role == RoleLeader || n.leader.ID != "" && time.Since(n.lastContact) < n.electionTimeout {
+		return VoteResponse{Term: n.log.term}
+	}
+	if req.Term < n.log.term {
+		return VoteResponse{Term: n.log.term}
+	}
+	last := n.log.lastIndex()
+	upToDate := req.LastLogTerm > n.log.termAt(last) || req.LastLogTerm == n.log.termAt(last) && req.LastLogIndex >= last
+	if req.PreVote {
+		// A pre-vote changes nothing; it only tells whether a vote would
+		// be granted in req.Term.
+		return VoteResponse{Term: n.log.term, VoteGranted: req.Term > n.log.term && upToDate}
+	}
+	if req.Term > n.log.term {
+		n.stepDownLocked(req.Term)
+	}
+	if !upToDate || n.log.votedFor != "" && n.log.votedFor != req.CandidateID {
+		return VoteResponse{Term: n.log.term}
+	}
+	if err := n.log.setState(req.Term, req.CandidateID); err != nil {
+		log.Printf("[ERROR] Saving Raft state: %v", err)
+		return VoteResponse{Term: n.log.term}
+	}
+	n.resetDeadlineLocked()
+	return VoteResponse{Term: n.log.term, VoteGranted: true}
+}
+
+// HandleAppend answers the leader's AppendEntries call.
+func (n *Node) HandleAppend(req AppendRequest) AppendResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.followLocked(req.Term, Member{ID: req.LeaderID, Address: req.LeaderAddress}) {
+		return AppendResponse{Term: n.log.term, LastIndex: n.log.lastIndex()}
+	}
+
+	resp := AppendResponse{Term: n.log.term}
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if snap := n.log.snap; prevIndex < snap.Index {
+		// The entries up to the snapshot are committed, so the leader's
+		// are the same.
+		for len(entries) > 0 && entries[0].Index <= snap.Index {
+			entries = entries[1:]
+		}
+		prevIndex, prevTerm = snap.Index, snap.Term
+	}
+	if prevIndex > n.log.lastIndex() {
+		resp.LastIndex = n.log.lastIndex()
+		return resp
+	}
+	if term := n.log.termAt(prevIndex); term != prevTerm {
+		// Skip back over the whole conflicting term at once.
+		index := prevIndex
+		for index > n.log.snap.Index+1 && n.log.termAt(index-1) == term {
+			index--
+		}
+		resp.LastIndex = index - 1
+		return resp
+	}
+
+	for len(entries) > 0 && entries[0].Index <= n.log.lastIndex() {
+		if n.log.termAt(entries[0].Index) != entries[0].Term {
+			if err := n.log.truncate(entries[0].Index); err != nil {
+				log.Printf("[ERROR] %v", err)
+				resp.LastIndex = n.log.lastIndex()
+				return resp
+			}
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) > 0 {
+		if err := n.log.append(entries...); err != nil {
+			log.Printf("[ERROR] %v", err)
+			resp.LastIndex = n.log.lastIndex()
+			return resp
+		}
+	}
+	if err := n.loadConfigLocked(); err != nil {
+		log.Printf("[ERROR] Reading cluster configuration: %v", err)
+	}
+	if last := req.PrevLogIndex + uint64(len(req.Entries)); req.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, last)
+		n.notifyApplyLocked()
+	}
+	resp.Success, resp.LastIndex = true, n.log.lastIndex()
+	return resp
+}
+
+// followLocked takes a call from leader in term, and reports whether that
+// is the current term.
+func (n *Node) followLocked(term uint64, leader Member) bool {
+	if n.stopped || term < n.log.term {
+		return false
+	}
+	if term > n.log.term || n.role != RoleFollower {
+		n.stepDownLocked(term)
+	}
+	if n.leader.ID != leader.ID {
+		log.Printf("[INFO] Following cluster leader %s for term %d", leader.ID, term)
+	}
+	n.leader = leader
+	n.lastContact = time.Now()
+	n.resetDeadlineLocked()
+	return true
+}
+
+// propose is the engine's Proposer: it appends the record to the log and
+// waits for it to be committed and logged by the engine.
+func (n *Node) propose(record storage.WALEntry) (uint64, error) {
+	n.mu.Lock()
+	if err := n.waitReadyLocked(); err != nil {
+		n.mu.Unlock()
+		return 0, err
+	}
+	record.LSN = n.log.lastLSN()
+	if record.LSN == 0 {
+		record.LSN = n.engine.LastLSN()
+	}
+	record.LSN++
+	p, err := n.appendLocked(Entry{Kind: EntryRecord, Record: &record})
+	n.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return record.LSN, <-p.done
+}
+
+// waitReadyLocked waits until the node is a leader able to take writes.
+func (n *Node) waitReadyLocked() error {
+	for {
+		switch {
+		case n.stopped:
+			return ErrStopped
+		case n.role != RoleLeader:
+			if n.leader.ID == "" {
+				return fmt.Errorf("%w: no leader elected", ErrNotLeader)
+			}
+			return fmt.Errorf("%w: the leader is %s at %s", ErrNotLeader, n.leader.ID, n.leader.Address)
+		case n.lastApplied >= n.readyIndex:
+			return nil
+		}
+		n.cond.Wait()
+	}
+}
+
+// appendLocked appends entry to a leader's log in its term, and returns the
+// proposal that is completed when it is applied.
+func (n *Node) appendLocked(entry Entry) (*proposal, error) {
+	entry.Index, entry.Term = n.log.lastIndex()+1, n.log.term
+	if err := n.log.append(entry); err != nil {
+		return nil, err
+	}
+	p := &proposal{done: make(chan error, 1)}
+	n.pending[entry.Index] = p
+	if entry.Kind == EntryConfig {
+		n.members, n.configIndex = entry.Members, entry.Index
+		n.syncPeersLocked()
+	}
+	n.advanceCommitLocked()
+	n.triggerPeersLocked()
+	return p, nil
+}
+
+func (n *Node) failPendingLocked(err error) {
+	for index, p := range n.pending {
+		p.done <- err
+		delete(n.pending, index)
+	}
+}
+
+// applyLoop applies committed entries to the engine in order.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+		for n.applyNext() {
+		}
+		n.compactLog()
+	}
+}
+
+// applyNext applies the next committed entry, and reports whether it did.
+func (n *Node) applyNext() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.stopped || n.applyErr != nil || n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	index := n.lastApplied + 1
+	entry, err := n.log.entry(index)
+	p := n.pending[index]
+	delete(n.pending, index)
+	n.mu.Unlock()
+
+	if err == nil && entry.Kind == EntryRecord {
+		switch record := *entry.Record; {
+		case p != nil:
+			// The writer that proposed it applies it once it is logged.
+			err = n.engine.LogCommitted(record)
+		case record.LSN <= n.engine.LastLSN():
+			// Applied before a restart.
+		default:
+			err = n.engine.ApplyReplicated(record)
+		}
+	}
+	if p != nil {
+		p.done <- err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.applyErr = fmt.Errorf("applying Raft entry %d: %w", index, err)
+		log.Printf("[ERROR] %v; this node stops applying writes", n.applyErr)
+		return false
+	}
+	n.lastApplied = index
+	n.cond.Broadcast()
+	if entry.Kind == EntryConfig && n.role == RoleLeader && !n.isMemberLocked(n.id) {
+		log.Printf("[INFO] Removed from the cluster; stepping down")
+		n.stepDownLocked(n.log.term)
+	}
+	return true
+}
+
+// AddMember adds a node to the cluster, or changes its address. The node
+// must start with an empty data directory and no members of its own; it
+// receives a snapshot of the leader's data if the leader's log has been
+// compacted, and the log after it.
+func (n *Node) AddMember(m Member) error {
+	if m.ID == "" || m.Address == "" {
+		return errors.New("member id and address are required")
+	}
+	return n.changeMembers(func(members []Member) []Member {
+		members = slices.DeleteFunc(members, func(old Member) bool { return old.ID == m.ID })
+		return append(members, m)
+	})
+}
+
+// RemoveMember removes a node from the cluster. A removed node should be
+// shut down.
+func (n *Node) RemoveMember(id string) error {
+	return n.changeMembers(func(members []Member) []Member {
+		return slices.DeleteFunc(members, func(m Member) bool { return m.ID == id })
+	})
+}
+
+// changeMembers commits a configuration entry with the members returned by
+// change. Changes go one at a time, each waiting for the previous one to
+// be committed.
+func (n *Node) changeMembers(change func([]Member) []Member) error {
+	n.mu.Lock()
+	if err := n.waitReadyLocked(); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrMembershipChange
+	}
+	members := change(slices.Clone(n.members))
+	if len(members) == 0 {
+		n.mu.Unlock()
+		return errors.New("a cluster needs at least one member")
+	}
+	p, err := n.appendLocked(Entry{Kind: EntryConfig, Members: members})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return <-p.done
+}
+
+// IsLeader reports whether the node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == RoleLeader
+}
+
+// Leader returns the current leader, if one is known.
+func (n *Node) Leader() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader, n.leader.ID != ""
+}
+
+type Status struct {
+	ID        string   `json:"id"`
+	Role      string   `json:"role"`
+	Term      uint64   `json:"term"`
+	Leader    string   `json:"leader,omitempty"`
+	Members   []Member `json:"members"`
+	LastIndex uint64   `json:"lastIndex"`
+	// SnapshotIndex is the last entry dropped by compacting the log.
+	SnapshotIndex uint64       `json:"snapshotIndex,omitempty"`
+	CommitIndex   uint64       `json:"commitIndex"`
+	AppliedIndex  uint64       `json:"appliedIndex"`
+	Peers         []PeerStatus `json:"peers,omitempty"`
+	Error         string       `json:"error,omitempty"`
+}
+
+// PeerStatus is how far a leader has replicated its log to a member.
+type PeerStatus struct {
+	ID         string    `json:"id"`
+	MatchIndex uint64    `json:"matchIndex"`
+	LastAck    time.Time `json:"lastAck"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	status := Status{
+		ID:            n.id,
+		Role:          n.role,
+		Term:          n.log.term,
+		Leader:        n.leader.ID,
+		Members:       n.members,
+		LastIndex:     n.log.lastIndex(),
+		SnapshotIndex: n.log.snap.Index,
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+	}
+	for _, m := range n.members {
+		if p := n.peers[m.ID]; p != nil {
+			status.Peers = append(status.Peers, PeerStatus{ID: m.ID, MatchIndex: p.matchIndex, LastAck: p.lastAck.UTC()})
+		}
+	}
+	if n.applyErr != nil {
+		status.Error = n.applyErr.Error()
+	}
+	return status
+}
@@ -0,0 +1,103 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Nodes call each other over their HTTP APIs.
+const (
+	StatusPath  = "/cluster"
+	MembersPath = "/cluster/members"
+	VotePath    = "/cluster/vote"
+	AppendPath  = "/cluster/append"
+	// SnapshotPath takes a SnapshotRequest as a JSON line followed by a
+	// snapshot backup, as written by replication.WriteSnapshot.
+	SnapshotPath = "/cluster/snapshot"
+)
+
+// VoteRequest asks for a vote in Term, or with PreVote only asks whether
+// the vote would be granted.
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+	PreVote      bool   `json:"preVote,omitempty"`
+}
+
+type VoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type AppendRequest struct {
+	Term          uint64  `json:"term"`
+	LeaderID      string  `json:"leaderId"`
+	LeaderAddress string  `json:"leaderAddress"`
+	PrevLogIndex  uint64  `json:"prevLogIndex"`
+	PrevLogTerm   uint64  `json:"prevLogTerm"`
+	Entries       []Entry `json:"entries,omitempty"`
+	LeaderCommit  uint64  `json:"leaderCommit"`
+}
+
+// AppendResponse reports, with LastIndex, where the follower's log ends,
+// or on a mismatch the last entry before the conflicting term.
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"lastIndex"`
+}
+
+// SnapshotRequest replaces a follower's state with the leader's when the
+// entries it is missing have been compacted away. Snapshot is the entry
+// the follower's log starts with afterwards.
+type SnapshotRequest struct {
+	Term          uint64 `json:"term"`
+	LeaderID      string `json:"leaderId"`
+	LeaderAddress string `json:"leaderAddress"`
+	Snapshot      Entry  `json:"snapshot"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// call posts req to path on member m and decodes the answer into resp. It
+// gives up after an election timeout.
+func (n *Node) call(m Member, path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+	return n.post(ctx, m, path, bytes.NewReader(body), resp)
+}
+
+// post sends body to path on member m and decodes the answer into resp.
+func (n *Node) post(ctx context.Context, m Member, path string, body io.Reader, resp interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(m.Address, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if n.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	httpResp, err := n.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", m.ID, httpResp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
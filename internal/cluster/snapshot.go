@@ -0,0 +1,223 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/replication"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// compactLog drops the applied entries from the front of the log once
+// there are snapshotEntries of them. A leader keeps those that members in
+// contact still need, rather than sending them a snapshot.
+func (n *Node) compactLog() {
+	n.mu.Lock()
+	index := n.lastApplied
+	if n.role == RoleLeader {
+		for _, p := range n.peers {
+			if time.Since(p.lastAck) < n.electionTimeout {
+				index = min(index, p.matchIndex)
+			}
+		}
+	}
+	if index < n.log.snap.Index+n.snapshotEntries {
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	// The engine must hold the entries for good before the log drops them.
+	if err := n.engine.SyncWAL(); err != nil {
+		log.Printf("[ERROR] Compacting Raft log: %v", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped || index <= n.log.snap.Index {
+		return
+	}
+	if err := n.log.compact(index); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
+
+// sendSnapshot sends p a backup of the engine in place of the entries it
+// is missing that have been compacted away, and reports whether p has more
+// entries to catch up on.
+func (n *Node) sendSnapshot(p *peer) bool {
+	if time.Now().Before(p.snapshotAfter) {
+		return false
+	}
+	err := n.trySendSnapshot(p)
+	if err != nil {
+		log.Printf("[WARN] Sending a snapshot to %s: %v", p.member.ID, err)
+		p.snapshotAfter = time.Now().Add(n.electionTimeout)
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == RoleLeader && p.nextIndex <= n.log.lastIndex()
+}
+
+func (n *Node) trySendSnapshot(p *peer) error {
+	root, err := os.MkdirTemp(n.log.dir, "send-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, storage.NewBackupID(time.Now()))
+	b, err := n.engine.Backup(dir)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if n.role != RoleLeader || n.peers[p.member.ID] != p {
+		n.mu.Unlock()
+		return nil
+	}
+	index, ok := n.log.indexOfLSN(b.LSN)
+	snap, err := n.log.snapshotAt(index)
+	req := SnapshotRequest{Term: n.log.term, LeaderID: n.id, LeaderAddress: n.address, Snapshot: snap}
+	n.mu.Unlock()
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		// The log was compacted past the backup meanwhile.
+		return fmt.Errorf("the log holds no entry for LSN %d", b.LSN)
+	}
+
+	header, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := replication.WriteSnapshot(pw, dir, b)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+	// A transfer takes as long as it takes, unless the node stops
+	// replicating to p.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.stop:
+		case <-p.stop:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	body := io.MultiReader(bytes.NewReader(append(header, '\n')), pr)
+	var resp SnapshotResponse
+	if err := n.post(ctx, p.member, SnapshotPath, body, &resp); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case resp.Term > n.log.term:
+		n.stepDownLocked(resp.Term)
+		return nil
+	case n.role != RoleLeader || n.log.term != req.Term || n.peers[p.member.ID] != p:
+		return nil
+	}
+	log.Printf("[INFO] Sent %s a snapshot up to entry %d", p.member.ID, snap.Index)
+	p.lastAck = time.Now()
+	if snap.Index > p.matchIndex {
+		p.matchIndex = snap.Index
+		n.advanceCommitLocked()
+	}
+	p.nextIndex = p.matchIndex + 1
+	return nil
+}
+
+// HandleSnapshot answers the leader's InstallSnapshot call, replacing the
+// engine's state with the snapshot in body unless the node has already
+// applied the entries it stands for.
+func (n *Node) HandleSnapshot(body io.Reader) (SnapshotResponse, error) {
+	r := bufio.NewReader(body)
+	line, err := r.ReadBytes('\n')
+	var req SnapshotRequest
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	if err != nil {
+		return SnapshotResponse{}, fmt.Errorf("reading snapshot request: %w", err)
+	}
+	snap := req.Snapshot
+	n.mu.Lock()
+	current := n.followLocked(req.Term, Member{ID: req.LeaderID, Address: req.LeaderAddress})
+	resp := SnapshotResponse{Term: n.log.term}
+	n.mu.Unlock()
+	if !current || snap.Kind != EntrySnapshot {
+		return resp, nil
+	}
+
+	root, err := os.MkdirTemp(n.log.dir, "install-")
+	if err != nil {
+		return resp, err
+	}
+	defer os.RemoveAll(root)
+	dir, err := replication.ReadSnapshot(r, filepath.Join(root, "snapshot"))
+	if err != nil {
+		return resp, err
+	}
+	dataFile, walDir := filepath.Join(root, "data", "helix.db"), filepath.Join(root, "data", "wal")
+	if _, err := backup.Restore(dir, dataFile, walDir, backup.RestoreOptions{}); err != nil {
+		return resp, err
+	}
+	src, err := storage.NewEngine(dataFile, walDir)
+	if err != nil {
+		return resp, err
+	}
+	defer src.Close()
+	if lsn := src.LastLSN(); lsn != snap.LSN {
+		return resp, fmt.Errorf("the snapshot ends at LSN %d, not %d", lsn, snap.LSN)
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	applied := n.lastApplied >= snap.Index
+	n.mu.Unlock()
+	if applied {
+		return resp, nil
+	}
+	if err := n.engine.InstallSnapshot(src); err != nil {
+		return resp, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return resp, ErrStopped
+	}
+	if err := n.log.install(snap); err != nil {
+		return resp, err
+	}
+	log.Printf("[INFO] Installed a snapshot up to entry %d from %s", snap.Index, req.LeaderID)
+	n.commitIndex = max(n.commitIndex, snap.Index)
+	n.lastApplied, n.applyErr = snap.Index, nil
+	if err := n.loadConfigLocked(); err != nil {
+		log.Printf("[ERROR] Reading cluster configuration: %v", err)
+	}
+	n.lastContact = time.Now()
+	n.resetDeadlineLocked()
+	n.cond.Broadcast()
+	n.notifyApplyLocked()
+	return resp, nil
+}
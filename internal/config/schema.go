@@ -1,12 +1,18 @@
 package config
 
+import "github.com/developer51709/helixdb/internal/indexing"
+
 type Config struct {
-        Server   ServerConfig   `json:"server"`
-        Storage  StorageConfig  `json:"storage"`
-        Backup   BackupConfig   `json:"backup"`
-        Recovery RecoveryConfig `json:"recovery"`
-        Logging  LoggingConfig  `json:"logging"`
-        Security SecurityConfig `json:"security"`
+        Server      ServerConfig      `json:"server"`
+        Storage     StorageConfig     `json:"storage"`
+        Backup      BackupConfig      `json:"backup"`
+        Recovery    RecoveryConfig    `json:"recovery"`
+        Replication ReplicationConfig `json:"replication"`
+        Cluster     ClusterConfig     `json:"cluster"`
+        Router      RouterConfig      `json:"router"`
+        Sync        SyncConfig        `json:"sync"`
+        Logging     LoggingConfig     `json:"logging"`
+        Security    SecurityConfig    `json:"security"`
 }
 
 type ServerConfig struct {
@@ -15,17 +21,50 @@ type ServerConfig struct {
 }
 
 type StorageConfig struct {
-        DataFile           string `json:"dataFile"`
-        WALDirectory       string `json:"walDirectory"`
-        AutoCompact        bool   `json:"autoCompact"`
-        CompactThresholdMB int    `json:"compactThresholdMB"`
+        DataFile             string                   `json:"dataFile"`
+        WALDirectory         string                   `json:"walDirectory"`
+        WALSegmentSizeMB     int                      `json:"walSegmentSizeMB"`
+        WALArchiveDirectory  string                   `json:"walArchiveDirectory"`
+        Durability           string                   `json:"durability"`
+        DurabilityMaxDelayMs int                      `json:"durabilityMaxDelayMs"`
+        AutoCompact          bool                     `json:"autoCompact"`
+        CompactThresholdMB   int                      `json:"compactThresholdMB"`
+        Indexes              map[string][]IndexConfig `json:"indexes"`
+}
+
+type IndexConfig struct {
+        Name   string   `json:"name"`
+        Field  string   `json:"field"`
+        Fields []string `json:"fields"`
+        Type   string   `json:"type"`
+        Unique bool     `json:"unique"`
+        Sparse bool     `json:"sparse"`
+}
+
+// Definition returns the index definition, accepting either a single field
+// or a list of fields.
+func (ic IndexConfig) Definition() indexing.Definition {
+        fields := ic.Fields
+        if len(fields) == 0 && ic.Field != "" {
+                fields = []string{ic.Field}
+        }
+        return indexing.Definition{
+                Name:   ic.Name,
+                Fields: fields,
+                Type:   ic.Type,
+                Unique: ic.Unique,
+                Sparse: ic.Sparse,
+        }
 }
 
 type BackupConfig struct {
-        Enabled         bool   `json:"enabled"`
-        Mode            string `json:"mode"`
-        Directory       string `json:"directory"`
-        IntervalMinutes int    `json:"intervalMinutes"`
+        Enabled               bool   `json:"enabled"`
+        Mode                  string `json:"mode"`
+        Directory             string `json:"directory"`
+        IntervalMinutes       int    `json:"intervalMinutes"`
+        SnapshotIntervalHours int    `json:"snapshotIntervalHours"`
+        KeepDaily             int    `json:"keepDaily"`
+        KeepWeekly            int    `json:"keepWeekly"`
 }
 
 type RecoveryConfig struct {
@@ -33,6 +72,72 @@ type RecoveryConfig struct {
         VerifyChecksums bool `json:"verifyChecksums"`
 }
 
+// ReplicationConfig makes the server a read-only follower of Leader when
+// Role is "follower". Any other server can act as a leader.
+type ReplicationConfig struct {
+        Role   string `json:"role"`
+        Leader string `json:"leader"`
+        // Name identifies the follower to the leader; empty means the host
+        // name and port.
+        Name string `json:"name"`
+        // Token authenticates with the leader; empty means security.token.
+        Token string `json:"token"`
+}
+
+// ClusterConfig makes the server a node of a Raft cluster when Enabled.
+type ClusterConfig struct {
+        Enabled bool   `json:"enabled"`
+        NodeID  string `json:"nodeId"`
+        // Address is the URL the other nodes reach this one's API at.
+        Address string `json:"address"`
+        // Members lists the nodes of a new cluster, this one included. A node
+        // joining an existing cluster starts with none and is added through
+        // the membership API.
+        Members             []ClusterMember `json:"members"`
+        ElectionTimeoutMs   int             `json:"electionTimeoutMs"`
+        HeartbeatIntervalMs int             `json:"heartbeatIntervalMs"`
+        // SnapshotEntries is how many applied entries the Raft log keeps
+        // before dropping them, the engine then holding their effect.
+        SnapshotEntries int `json:"snapshotEntries"`
+}
+
+type ClusterMember struct {
+        ID      string `json:"id"`
+        Address string `json:"address"`
+}
+
+// RouterConfig configures `helixdb router`, which spreads documents over
+// Shards by a consistent hash of their collection and ID.
+type RouterConfig struct {
+        Shards []RouterShard `json:"shards"`
+        // VirtualNodes is how many points each shard gets on the hash ring.
+        VirtualNodes int `json:"virtualNodes"`
+        // StateFile keeps the shards added at runtime and any rebalance in
+        // progress. Once it exists it takes precedence over Shards.
+        StateFile string `json:"stateFile"`
+        // Token authenticates with the shards; empty means security.token.
+        Token string `json:"token"`
+}
+
+type RouterShard struct {
+        ID      string `json:"id"`
+        Address string `json:"address"`
+}
+
+// SyncConfig configures how client sync resolves conflicting writes.
+type SyncConfig struct {
+        // Strategy is the conflict strategy of collections not listed in
+        // Collections: "lww" (last writer wins by hybrid logical clock),
+        // "reject" or "merge" (of disjoint fields).
+        Strategy    string            `json:"strategy"`
+        Collections map[string]string `json:"collections"`
+        // MaxClockDriftMs is how far ahead of the server's clock a client
+        // timestamp may be.
+        MaxClockDriftMs int `json:"maxClockDriftMs"`
+        // PullLimit caps the changes returned by one pull.
+        PullLimit int `json:"pullLimit"`
+}
+
 type LoggingConfig struct {
         Level string `json:"level"`
         File  string `json:"file"`
@@ -50,21 +155,41 @@ func DefaultConfig() Config {
                         Host: "0.0.0.0",
                 },
                 Storage: StorageConfig{
-                        DataFile:           "./data/helix.db",
-                        WALDirectory:       "./data/wal",
-                        AutoCompact:        true,
-                        CompactThresholdMB: 128,
+                        DataFile:             "./data/helix.db",
+                        WALDirectory:         "./data/wal",
+                        WALSegmentSizeMB:     64,
+                        Durability:           "always",
+                        DurabilityMaxDelayMs: 5,
+                        AutoCompact:          true,
+                        CompactThresholdMB:   128,
                 },
                 Backup: BackupConfig{
-                        Enabled:         false,
-                        Mode:            "incremental",
-                        Directory:       "./backups",
-                        IntervalMinutes: 30,
+                        Enabled:               false,
+                        Mode:                  "incremental",
+                        Directory:             "./backups",
+                        IntervalMinutes:       30,
+                        SnapshotIntervalHours: 24,
+                        KeepDaily:             7,
+                        KeepWeekly:            4,
                 },
                 Recovery: RecoveryConfig{
                         AutoRecover:     true,
                         VerifyChecksums: true,
                 },
+                Cluster: ClusterConfig{
+                        ElectionTimeoutMs:   1000,
+                        HeartbeatIntervalMs: 100,
+                        SnapshotEntries:     10000,
+                },
+                Router: RouterConfig{
+                        VirtualNodes: 128,
+                        StateFile:    "./data/router.json",
+                },
+                Sync: SyncConfig{
+                        Strategy:        "reject",
+                        MaxClockDriftMs: 60000,
+                        PullLimit:       1000,
+                },
                 Logging: LoggingConfig{
                         Level: "info",
                         File:  "",
@@ -0,0 +1,379 @@
+package indexing
+
+import "sort"
+
+// btreeDegree is the minimum number of children of a non-root interior
+// node. Nodes hold between degree-1 and 2*degree-1 items.
+const btreeDegree = 32
+
+const (
+	maxItems = 2*btreeDegree - 1
+	minItems = btreeDegree - 1
+)
+
+// BTree is an in-memory B-tree mapping keys, ordered by Compare, to sorted
+// posting lists of document IDs.
+type BTree struct {
+	root   *btreeNode
+	length int
+}
+
+type btreeItem struct {
+	key interface{}
+	ids []string
+}
+
+type btreeNode struct {
+	items    []*btreeItem
+	children []*btreeNode
+}
+
+func NewBTree() *BTree {
+	return &BTree{}
+}
+
+// Len returns the number of distinct keys in the tree.
+func (t *BTree) Len() int {
+	return t.length
+}
+
+// Get returns the posting list for key. The slice must not be modified.
+func (t *BTree) Get(key interface{}) []string {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].ids
+		}
+		if len(n.children) == 0 {
+			return nil
+		}
+		n = n.children[i]
+	}
+	return nil
+}
+
+// Insert adds id to key's posting list and reports whether it was absent.
+func (t *BTree) Insert(key interface{}, id string) bool {
+	if t.root == nil {
+		t.root = &btreeNode{}
+	}
+	if len(t.root.items) >= maxItems {
+		item, second := t.root.split(maxItems / 2)
+		first := t.root
+		t.root = &btreeNode{
+			items:    []*btreeItem{item},
+			children: []*btreeNode{first, second},
+		}
+	}
+
+	item, created := t.root.insert(key)
+	if created {
+		t.length++
+	}
+
+	i := sort.SearchStrings(item.ids, id)
+	if i < len(item.ids) && item.ids[i] == id {
+		return false
+	}
+	item.ids = append(item.ids, "")
+	copy(item.ids[i+1:], item.ids[i:])
+	item.ids[i] = id
+	return true
+}
+
+// Delete removes id from key's posting list, dropping the key once its
+// posting list is empty. It reports whether id was present.
+func (t *BTree) Delete(key interface{}, id string) bool {
+	n := t.root
+	var item *btreeItem
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			item = n.items[i]
+			break
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	if item == nil {
+		return false
+	}
+
+	i := sort.SearchStrings(item.ids, id)
+	if i >= len(item.ids) || item.ids[i] != id {
+		return false
+	}
+	item.ids = append(item.ids[:i], item.ids[i+1:]...)
+
+	if len(item.ids) == 0 {
+		t.root.remove(key, removeItem)
+		if len(t.root.items) == 0 && len(t.root.children) > 0 {
+			t.root = t.root.children[0]
+		}
+		t.length--
+	}
+	return true
+}
+
+// Ascend calls fn for each key in [lo, hi] in ascending order until fn
+// returns false. A nil bound is unbounded.
+func (t *BTree) Ascend(lo, hi *Bound, fn func(key interface{}, ids []string) bool) {
+	if t.root != nil {
+		t.root.ascend(lo, hi, fn)
+	}
+}
+
+// Descend is Ascend in descending key order. Each posting list is still
+// passed in ascending ID order.
+func (t *BTree) Descend(lo, hi *Bound, fn func(key interface{}, ids []string) bool) {
+	if t.root != nil {
+		t.root.descend(lo, hi, fn)
+	}
+}
+
+// find returns the index of key in n.items, or the index of the child that
+// would contain it.
+func (n *btreeNode) find(key interface{}) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return Compare(key, n.items[i].key) < 0
+	})
+	if i > 0 && Compare(n.items[i-1].key, key) == 0 {
+		return i - 1, true
+	}
+	return i, false
+}
+
+// split moves the items after i (and their children) into a new node and
+// returns the item at i, which the caller promotes into the parent.
+func (n *btreeNode) split(i int) (*btreeItem, *btreeNode) {
+	item := n.items[i]
+	next := &btreeNode{}
+	next.items = append(next.items, n.items[i+1:]...)
+	n.items = truncateItems(n.items, i)
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		n.children = truncateChildren(n.children, i+1)
+	}
+	return item, next
+}
+
+func (n *btreeNode) maybeSplitChild(i int) bool {
+	if len(n.children[i].items) < maxItems {
+		return false
+	}
+	item, second := n.children[i].split(maxItems / 2)
+	n.items = insertItem(n.items, i, item)
+	n.children = insertChild(n.children, i+1, second)
+	return true
+}
+
+func (n *btreeNode) insert(key interface{}) (*btreeItem, bool) {
+	i, found := n.find(key)
+	if found {
+		return n.items[i], false
+	}
+	if len(n.children) == 0 {
+		item := &btreeItem{key: key}
+		n.items = insertItem(n.items, i, item)
+		return item, true
+	}
+	if n.maybeSplitChild(i) {
+		switch c := Compare(key, n.items[i].key); {
+		case c == 0:
+			return n.items[i], false
+		case c > 0:
+			i++
+		}
+	}
+	return n.children[i].insert(key)
+}
+
+type removeKind int
+
+const (
+	removeItem removeKind = iota
+	removeMax
+)
+
+// remove deletes key (or the maximum item) from the subtree rooted at n,
+// making sure every node it descends into can afford to lose an item.
+func (n *btreeNode) remove(key interface{}, kind removeKind) *btreeItem {
+	var i int
+	var found bool
+	switch kind {
+	case removeMax:
+		if len(n.children) == 0 {
+			item := n.items[len(n.items)-1]
+			n.items = truncateItems(n.items, len(n.items)-1)
+			return item
+		}
+		i = len(n.items)
+	case removeItem:
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if !found {
+				return nil
+			}
+			item := n.items[i]
+			n.items = removeItemAt(n.items, i)
+			return item
+		}
+	}
+
+	if len(n.children[i].items) <= minItems {
+		return n.growChildAndRemove(i, key, kind)
+	}
+	child := n.children[i]
+	if found {
+		// Replace the item with its predecessor from the left subtree.
+		out := n.items[i]
+		n.items[i] = child.remove(nil, removeMax)
+		return out
+	}
+	return child.remove(key, kind)
+}
+
+// growChildAndRemove gives child i an extra item, by borrowing from a
+// sibling or merging with one, and then retries the removal.
+func (n *btreeNode) growChildAndRemove(i int, key interface{}, kind removeKind) *btreeItem {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > minItems:
+		child, left := n.children[i], n.children[i-1]
+		stolen := left.items[len(left.items)-1]
+		left.items = truncateItems(left.items, len(left.items)-1)
+		child.items = insertItem(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		if len(left.children) > 0 {
+			moved := left.children[len(left.children)-1]
+			left.children = truncateChildren(left.children, len(left.children)-1)
+			child.children = insertChild(child.children, 0, moved)
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > minItems:
+		child, right := n.children[i], n.children[i+1]
+		stolen := right.items[0]
+		right.items = removeItemAt(right.items, 0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(right.children) > 0 {
+			moved := right.children[0]
+			right.children = removeChildAt(right.children, 0)
+			child.children = append(child.children, moved)
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.children[i]
+		merged := n.items[i]
+		right := n.children[i+1]
+		n.items = removeItemAt(n.items, i)
+		n.children = removeChildAt(n.children, i+1)
+		child.items = append(child.items, merged)
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+	}
+	return n.remove(key, kind)
+}
+
+func (n *btreeNode) ascend(lo, hi *Bound, fn func(interface{}, []string) bool) bool {
+	start := 0
+	if lo != nil {
+		start = sort.Search(len(n.items), func(i int) bool {
+			return Compare(n.items[i].key, lo.Value) >= 0
+		})
+	}
+	for i := start; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(lo, hi, fn) {
+			return false
+		}
+		item := n.items[i]
+		if lo != nil && !lo.Inclusive && Compare(item.key, lo.Value) == 0 {
+			continue
+		}
+		if hi != nil {
+			if c := Compare(item.key, hi.Value); c > 0 || (c == 0 && !hi.Inclusive) {
+				return false
+			}
+		}
+		if !fn(item.key, item.ids) {
+			return false
+		}
+	}
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(lo, hi, fn)
+	}
+	return true
+}
+
+func (n *btreeNode) descend(lo, hi *Bound, fn func(interface{}, []string) bool) bool {
+	end := len(n.items)
+	if hi != nil {
+		end = sort.Search(len(n.items), func(i int) bool {
+			return Compare(n.items[i].key, hi.Value) > 0
+		})
+	}
+	if len(n.children) > 0 && !n.children[end].descend(lo, hi, fn) {
+		return false
+	}
+	for i := end - 1; i >= 0; i-- {
+		item := n.items[i]
+		skip := hi != nil && !hi.Inclusive && Compare(item.key, hi.Value) == 0
+		if !skip {
+			if lo != nil {
+				if c := Compare(item.key, lo.Value); c < 0 || (c == 0 && !lo.Inclusive) {
+					return false
+				}
+			}
+			if !fn(item.key, item.ids) {
+				return false
+			}
+		}
+		if len(n.children) > 0 && !n.children[i].descend(lo, hi, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func insertItem(items []*btreeItem, i int, item *btreeItem) []*btreeItem {
+	items = append(items, nil)
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+func removeItemAt(items []*btreeItem, i int) []*btreeItem {
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = nil
+	return items[:len(items)-1]
+}
+
+func truncateItems(items []*btreeItem, n int) []*btreeItem {
+	for i := n; i < len(items); i++ {
+		items[i] = nil
+	}
+	return items[:n]
+}
+
+func insertChild(children []*btreeNode, i int, child *btreeNode) []*btreeNode {
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = child
+	return children
+}
+
+func removeChildAt(children []*btreeNode, i int) []*btreeNode {
+	copy(children[i:], children[i+1:])
+	children[len(children)-1] = nil
+	return children[:len(children)-1]
+}
+
+func truncateChildren(children []*btreeNode, n int) []*btreeNode {
+	for i := n; i < len(children); i++ {
+		children[i] = nil
+	}
+	return children[:n]
+}
@@ -0,0 +1,431 @@
+package indexing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	TypeHash  = "hash"
+	TypeBTree = "btree"
+)
+
+var ErrInvalidDefinition = errors.New("invalid index definition")
+
+// Definition describes a secondary index. Fields are dot-notation paths
+// into the document data; an index over several fields is keyed by the
+// tuple of their values. Unique indexes reject two documents sharing a key,
+// and sparse indexes skip documents that have none of the fields.
+type Definition struct {
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"`
+	Type   string   `json:"type"`
+	Unique bool     `json:"unique,omitempty"`
+	Sparse bool     `json:"sparse,omitempty"`
+}
+
+// Normalize validates d and fills in the default type and name.
+func (d *Definition) Normalize() error {
+	if len(d.Fields) == 0 {
+		return fmt.Errorf("%w: at least one field is required", ErrInvalidDefinition)
+	}
+	seen := make(map[string]bool, len(d.Fields))
+	for _, f := range d.Fields {
+		if f == "" || strings.HasPrefix(f, "$") || strings.HasPrefix(f, ".") || strings.HasSuffix(f, ".") || strings.Contains(f, "..") {
+			return fmt.Errorf("%w: bad field %q", ErrInvalidDefinition, f)
+		}
+		if seen[f] {
+			return fmt.Errorf("%w: field %q listed twice", ErrInvalidDefinition, f)
+		}
+		seen[f] = true
+	}
+	switch d.Type {
+	case "":
+		d.Type = TypeBTree
+	case TypeHash, TypeBTree:
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidDefinition, d.Type)
+	}
+	if d.Name == "" {
+		d.Name = strings.Join(d.Fields, "_") + "_" + d.Type
+	}
+	return nil
+}
+
+// Compound reports whether the index is keyed by a tuple of fields.
+func (d Definition) Compound() bool {
+	return len(d.Fields) > 1
+}
+
+// Index maps field values to the IDs of the documents holding them. A
+// document contributes one key per value its field resolves to, so array
+// fields produce several keys ("multikey" indexes). Indexes are not safe for
+// concurrent use; callers guard them with the owning collection's lock.
+type Index interface {
+	Definition() Definition
+	Insert(id string, keys []interface{})
+	Remove(id string, keys []interface{})
+	Lookup(key interface{}) []string
+	Count(key interface{}) int
+	// Entries returns the number of distinct documents indexed.
+	Entries() int
+	// Multikey reports whether any document ever contributed more than one
+	// key, in which case index order cannot stand in for sort order.
+	Multikey() bool
+}
+
+// OrderedIndex is an Index that can also walk its keys in order.
+type OrderedIndex interface {
+	Index
+	Range(lo, hi *Bound, descending bool, fn func(key interface{}, ids []string) bool)
+}
+
+// Bound is one end of a key range.
+type Bound struct {
+	Value     interface{}
+	Inclusive bool
+}
+
+func New(def Definition) (Index, error) {
+	if err := def.Normalize(); err != nil {
+		return nil, err
+	}
+	if def.Type == TypeHash {
+		return newHashIndex(def), nil
+	}
+	return newBTreeIndex(def), nil
+}
+
+type hashIndex struct {
+	def      Definition
+	postings map[string]map[string]struct{}
+	docs     map[string]int
+	multikey bool
+}
+
+func newHashIndex(def Definition) *hashIndex {
+	return &hashIndex{
+		def:      def,
+		postings: make(map[string]map[string]struct{}),
+		docs:     make(map[string]int),
+	}
+}
+
+func (h *hashIndex) Definition() Definition { return h.def }
+func (h *hashIndex) Entries() int           { return len(h.docs) }
+func (h *hashIndex) Multikey() bool         { return h.multikey }
+
+func (h *hashIndex) Insert(id string, keys []interface{}) {
+	if len(keys) > 1 {
+		h.multikey = true
+	}
+	for _, key := range keys {
+		hk := HashKey(key)
+		ids, ok := h.postings[hk]
+		if !ok {
+			ids = make(map[string]struct{})
+			h.postings[hk] = ids
+		}
+		if _, dup := ids[id]; !dup {
+			ids[id] = struct{}{}
+			h.docs[id]++
+		}
+	}
+}
+
+func (h *hashIndex) Remove(id string, keys []interface{}) {
+	for _, key := range keys {
+		hk := HashKey(key)
+		ids, ok := h.postings[hk]
+		if !ok {
+			continue
+		}
+		if _, present := ids[id]; !present {
+			continue
+		}
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(h.postings, hk)
+		}
+		if h.docs[id]--; h.docs[id] <= 0 {
+			delete(h.docs, id)
+		}
+	}
+}
+
+func (h *hashIndex) Lookup(key interface{}) []string {
+	ids := h.postings[HashKey(key)]
+	out := make([]string, 0, len(ids))
+	for id := range ids {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (h *hashIndex) Count(key interface{}) int {
+	return len(h.postings[HashKey(key)])
+}
+
+type btreeIndex struct {
+	def      Definition
+	tree     *BTree
+	docs     map[string]int
+	multikey bool
+}
+
+func newBTreeIndex(def Definition) *btreeIndex {
+	return &btreeIndex{def: def, tree: NewBTree(), docs: make(map[string]int)}
+}
+
+func (b *btreeIndex) Definition() Definition { return b.def }
+func (b *btreeIndex) Entries() int           { return len(b.docs) }
+func (b *btreeIndex) Multikey() bool         { return b.multikey }
+
+func (b *btreeIndex) Insert(id string, keys []interface{}) {
+	if len(keys) > 1 {
+		b.multikey = true
+	}
+	for _, key := range keys {
+		if b.tree.Insert(key, id) {
+			b.docs[id]++
+		}
+	}
+}
+
+func (b *btreeIndex) Remove(id string, keys []interface{}) {
+	for _, key := range keys {
+		if b.tree.Delete(key, id) {
+			if b.docs[id]--; b.docs[id] <= 0 {
+				delete(b.docs, id)
+			}
+		}
+	}
+}
+
+func (b *btreeIndex) Lookup(key interface{}) []string {
+	ids := b.tree.Get(key)
+	out := make([]string, len(ids))
+	copy(out, ids)
+	return out
+}
+
+func (b *btreeIndex) Count(key interface{}) int {
+	return len(b.tree.Get(key))
+}
+
+func (b *btreeIndex) Range(lo, hi *Bound, descending bool, fn func(key interface{}, ids []string) bool) {
+	if descending {
+		b.tree.Descend(lo, hi, fn)
+		return
+	}
+	b.tree.Ascend(lo, hi, fn)
+}
+
+// HashKey returns a string that is equal for two values exactly when
+// Compare considers them equal.
+func HashKey(v interface{}) string {
+	data, err := json.Marshal(normalize(v))
+	if err != nil {
+		return fmt.Sprintf("%T:%v", v, v)
+	}
+	return string(data)
+}
+
+func normalize(v interface{}) interface{} {
+	if n, ok := Number(v); ok {
+		return n
+	}
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[k] = normalize(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = normalize(child)
+		}
+		return out
+	}
+	return v
+}
+
+// Number converts any Go numeric type, or a json.Number, to float64.
+func Number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// TypeRank orders JSON types the way MongoDB does when values of different
+// types are compared: null < numbers < strings < objects < arrays < booleans.
+func TypeRank(v interface{}) int {
+	if v == nil {
+		return 0
+	}
+	if b, ok := v.(typeBound); ok {
+		return b.rank
+	}
+	if _, ok := Number(v); ok {
+		return 1
+	}
+	switch v.(type) {
+	case string:
+		return 2
+	case map[string]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bool:
+		return 5
+	}
+	return 6
+}
+
+// typeBound sorts before (or after) every value of one type rank. It lets
+// range scans stay inside a single type, e.g. {"$gt": 5} stops at strings.
+type typeBound struct {
+	rank int
+	high bool
+}
+
+// MinKey and MaxKey sort before and after every other value.
+var (
+	MinKey interface{} = typeBound{rank: -1}
+	MaxKey interface{} = typeBound{rank: 100, high: true}
+)
+
+// TypeFloor and TypeCeiling return keys that sort immediately before and
+// after all values with the same type as v.
+func TypeFloor(v interface{}) interface{}   { return typeBound{rank: TypeRank(v)} }
+func TypeCeiling(v interface{}) interface{} { return typeBound{rank: TypeRank(v), high: true} }
+
+// Compare is a total order over JSON values. Values of different types are
+// ordered by TypeRank.
+func Compare(a, b interface{}) int {
+	ra, rb := TypeRank(a), TypeRank(b)
+	if ra != rb {
+		return compareInts(ra, rb)
+	}
+
+	ba, aIsBound := a.(typeBound)
+	bb, bIsBound := b.(typeBound)
+	if aIsBound || bIsBound {
+		switch {
+		case aIsBound && bIsBound:
+			return compareBools(ba.high, bb.high)
+		case aIsBound:
+			if ba.high {
+				return 1
+			}
+			return -1
+		default:
+			if bb.high {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch ra {
+	case 1:
+		x, _ := Number(a)
+		y, _ := Number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case 2:
+		return strings.Compare(a.(string), b.(string))
+	case 3:
+		ma, mb := a.(map[string]interface{}), b.(map[string]interface{})
+		ka, kb := sortedKeys(ma), sortedKeys(mb)
+		for i := 0; i < len(ka) && i < len(kb); i++ {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := Compare(ma[ka[i]], mb[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(ka), len(kb))
+	case 4:
+		la, lb := a.([]interface{}), b.([]interface{})
+		for i := 0; i < len(la) && i < len(lb); i++ {
+			if c := Compare(la[i], lb[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(la), len(lb))
+	case 5:
+		return compareBools(a.(bool), b.(bool))
+	case 6:
+		return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,320 @@
+package indexing
+
+import "sort"
+
+const (
+	PlanCollectionScan = "COLLSCAN"
+	PlanIndexEquality  = "IXEQ"
+	PlanIndexRange     = "IXRANGE"
+	PlanIndexOrder     = "IXORDER"
+)
+
+// Predicate is the index-usable part of a filter clause on one field:
+// either a set of equality values ($eq / $in) or a range. The full filter is
+// always re-checked against candidate documents, so a predicate only needs
+// to select a superset of the matches.
+type Predicate struct {
+	Field string
+	Eq    []interface{}
+	Lower *Bound
+	Upper *Bound
+}
+
+func (p Predicate) isRange() bool {
+	return p.Eq == nil && (p.Lower != nil || p.Upper != nil)
+}
+
+func (p Predicate) hasNullEq() bool {
+	for _, v := range p.Eq {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Order is the requested sort on a single data field.
+type Order struct {
+	Field      string
+	Descending bool
+}
+
+// KeyRange is a contiguous run of index keys.
+type KeyRange struct {
+	Lower *Bound
+	Upper *Bound
+}
+
+// Plan is the access path chosen for a query.
+type Plan struct {
+	Kind       string
+	Index      Index
+	Predicates []Predicate
+	// Keys are looked up exactly for equality plans; Ranges are walked in
+	// order for range and ordered plans.
+	Keys   []interface{}
+	Ranges []KeyRange
+	// Estimate is the expected number of documents the plan examines.
+	Estimate int
+	// Ordered is set when candidates come out in the requested sort order,
+	// letting the caller skip sorting and stop early.
+	Ordered    bool
+	Descending bool
+}
+
+// maxEqualityKeys caps the cartesian product of $in lists an equality plan
+// on a compound index will look up.
+const maxEqualityKeys = 1024
+
+// Choose picks the cheapest plan for preds among indexes, given the total
+// number of documents. order may be nil when the query has no sort on a data
+// field; limited reports whether the caller only needs a prefix of the
+// results, which makes a full ordered index walk worthwhile.
+func Choose(indexes []Index, preds []Predicate, order *Order, limited bool, total int) Plan {
+	byField := make(map[string]Predicate, len(preds))
+	for _, p := range preds {
+		if _, dup := byField[p.Field]; !dup {
+			byField[p.Field] = p
+		}
+	}
+
+	best := Plan{Kind: PlanCollectionScan, Estimate: total}
+	for _, idx := range indexes {
+		for _, candidate := range candidatePlans(idx, byField, order, total) {
+			if better(candidate, best) {
+				best = candidate
+			}
+		}
+	}
+
+	if best.Kind == PlanCollectionScan && order != nil && limited {
+		for _, idx := range indexes {
+			def := idx.Definition()
+			if _, ok := idx.(OrderedIndex); !ok || def.Compound() || idx.Multikey() || def.Fields[0] != order.Field {
+				continue
+			}
+			// Every document must be in the index for an ordered walk to
+			// see all of them.
+			if idx.Entries() != total {
+				continue
+			}
+			return Plan{
+				Kind:       PlanIndexOrder,
+				Index:      idx,
+				Ranges:     []KeyRange{{}},
+				Estimate:   total,
+				Ordered:    true,
+				Descending: order.Descending,
+			}
+		}
+	}
+	return best
+}
+
+func candidatePlans(idx Index, byField map[string]Predicate, order *Order, total int) []Plan {
+	def := idx.Definition()
+	var plans []Plan
+
+	if keys, used, ok := equalityKeys(def, byField); ok {
+		estimate := 0
+		for _, k := range keys {
+			estimate += idx.Count(k)
+		}
+		plans = append(plans, Plan{Kind: PlanIndexEquality, Index: idx, Predicates: used, Keys: keys, Estimate: estimate})
+	}
+
+	lead, ok := byField[def.Fields[0]]
+	if _, ordered := idx.(OrderedIndex); !ok || !ordered {
+		return plans
+	}
+	if def.Sparse && lead.hasNullEq() {
+		return plans
+	}
+
+	switch {
+	case !def.Compound() && lead.isRange():
+		lo, hi := typeBounds(lead.Lower, lead.Upper)
+		plan := Plan{
+			Kind:       PlanIndexRange,
+			Index:      idx,
+			Predicates: []Predicate{lead},
+			Ranges:     []KeyRange{{Lower: lo, Upper: hi}},
+			Estimate:   rangeEstimate(lead, total),
+		}
+		if order != nil && order.Field == lead.Field && !idx.Multikey() {
+			plan.Ordered = true
+			plan.Descending = order.Descending
+		}
+		plans = append(plans, plan)
+	case def.Compound() && lead.Eq != nil:
+		// Walk the run of tuples sharing each leading value.
+		var ranges []KeyRange
+		for _, v := range sortedValues(lead.Eq) {
+			ranges = append(ranges, KeyRange{
+				Lower: &Bound{Value: []interface{}{v}, Inclusive: true},
+				Upper: &Bound{Value: []interface{}{v, MaxKey}, Inclusive: true},
+			})
+		}
+		plans = append(plans, Plan{
+			Kind:       PlanIndexRange,
+			Index:      idx,
+			Predicates: []Predicate{lead},
+			Ranges:     ranges,
+			Estimate:   min(total, len(lead.Eq)*total/10),
+		})
+	case def.Compound() && lead.isRange():
+		lo, hi := typeBounds(lead.Lower, lead.Upper)
+		lower := &Bound{Value: []interface{}{lo.Value}, Inclusive: true}
+		if lead.Lower != nil && !lead.Lower.Inclusive {
+			lower = &Bound{Value: []interface{}{lo.Value, MaxKey}}
+		}
+		upper := &Bound{Value: []interface{}{hi.Value, MaxKey}, Inclusive: true}
+		if lead.Upper != nil && !lead.Upper.Inclusive {
+			upper = &Bound{Value: []interface{}{hi.Value}}
+		}
+		plans = append(plans, Plan{
+			Kind:       PlanIndexRange,
+			Index:      idx,
+			Predicates: []Predicate{lead},
+			Ranges:     []KeyRange{{Lower: lower, Upper: upper}},
+			Estimate:   rangeEstimate(lead, total),
+		})
+	}
+	return plans
+}
+
+// equalityKeys returns the exact keys to look up when every indexed field
+// has an equality predicate. For compound indexes the keys are the
+// cartesian product of the per-field values.
+func equalityKeys(def Definition, byField map[string]Predicate) ([]interface{}, []Predicate, bool) {
+	used := make([]Predicate, 0, len(def.Fields))
+	for _, f := range def.Fields {
+		p, ok := byField[f]
+		if !ok || p.Eq == nil || (def.Sparse && p.hasNullEq()) {
+			return nil, nil, false
+		}
+		used = append(used, p)
+	}
+
+	if !def.Compound() {
+		return sortedValues(used[0].Eq), used, true
+	}
+
+	tuples := [][]interface{}{{}}
+	for _, p := range used {
+		if len(tuples)*len(p.Eq) > maxEqualityKeys {
+			return nil, nil, false
+		}
+		next := make([][]interface{}, 0, len(tuples)*len(p.Eq))
+		for _, t := range tuples {
+			for _, v := range p.Eq {
+				tuple := append(append([]interface{}(nil), t...), v)
+				next = append(next, tuple)
+			}
+		}
+		tuples = next
+	}
+	keys := make([]interface{}, len(tuples))
+	for i, t := range tuples {
+		keys[i] = t
+	}
+	return sortedValues(keys), used, true
+}
+
+func sortedValues(values []interface{}) []interface{} {
+	out := append([]interface{}(nil), values...)
+	sort.Slice(out, func(i, j int) bool { return Compare(out[i], out[j]) < 0 })
+	return out
+}
+
+func better(a, b Plan) bool {
+	if a.Estimate != b.Estimate {
+		return a.Estimate < b.Estimate
+	}
+	return rank(a) < rank(b)
+}
+
+// rank breaks estimate ties: exact lookups beat walks, and indexes covering
+// more fields beat narrower ones.
+func rank(p Plan) int {
+	r := 0
+	switch p.Kind {
+	case PlanIndexEquality:
+		r = 0
+	case PlanIndexRange:
+		r = 100
+	case PlanIndexOrder:
+		r = 200
+	default:
+		return 300
+	}
+	return r - len(p.Predicates)
+}
+
+// rangeEstimate guesses the selectivity of a range the way many planners do
+// without histograms: a third of the collection per bound.
+func rangeEstimate(pred Predicate, total int) int {
+	if pred.Lower != nil && pred.Upper != nil {
+		return total / 9
+	}
+	return total / 3
+}
+
+// Scan calls fn with the ID of every candidate document until fn returns
+// false. Candidates may repeat for multikey indexes; Scan filters those
+// duplicates out. It must not be called for a collection scan.
+func (p Plan) Scan(fn func(id string) bool) {
+	seen := make(map[string]struct{})
+	emit := func(_ interface{}, ids []string) bool {
+		for _, id := range ids {
+			if _, dup := seen[id]; dup {
+				continue
+			}
+			seen[id] = struct{}{}
+			if !fn(id) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if p.Kind == PlanIndexEquality {
+		for _, k := range p.Keys {
+			if !emit(k, p.Index.Lookup(k)) {
+				return
+			}
+		}
+		return
+	}
+
+	ordered := p.Index.(OrderedIndex)
+	stopped := false
+	for i := range p.Ranges {
+		r := p.Ranges[i]
+		if p.Descending {
+			r = p.Ranges[len(p.Ranges)-1-i]
+		}
+		ordered.Range(r.Lower, r.Upper, p.Descending, func(key interface{}, ids []string) bool {
+			if !emit(key, ids) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// typeBounds closes an open-ended range at the edge of its value's type,
+// since range operators never match values of another type.
+func typeBounds(lo, hi *Bound) (*Bound, *Bound) {
+	if lo == nil {
+		lo = &Bound{Value: TypeFloor(hi.Value), Inclusive: true}
+	}
+	if hi == nil {
+		hi = &Bound{Value: TypeCeiling(lo.Value), Inclusive: true}
+	}
+	return lo, hi
+}
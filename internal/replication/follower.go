@@ -0,0 +1,278 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+
+	// streamTimeout is how long a follower waits for a message before it
+	// reconnects.
+	streamTimeout = 3 * HeartbeatInterval
+	maxRetryDelay = 10 * time.Second
+)
+
+var ErrBehindLeader = errors.New("leader no longer has the records this follower needs")
+
+// Status reports how far a follower is behind its leader. LagSeconds is
+// the time since it was last caught up.
+type Status struct {
+	Leader      string     `json:"leader"`
+	Connected   bool       `json:"connected"`
+	AppliedLSN  uint64     `json:"appliedLSN"`
+	LeaderLSN   uint64     `json:"leaderLSN"`
+	LagRecords  uint64     `json:"lagRecords"`
+	LagSeconds  float64    `json:"lagSeconds"`
+	LastContact *time.Time `json:"lastContact,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// Follower tails the leader's WAL into a read-only engine.
+type Follower struct {
+	engine *storage.Engine
+	cfg    config.ReplicationConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	status   Status
+	caughtUp time.Time
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewFollower makes engine read-only and prepares to replicate into it.
+func NewFollower(engine *storage.Engine, cfg config.Config) *Follower {
+	rcfg := leaderConfig(cfg)
+	if rcfg.Name == "" {
+		host, _ := os.Hostname()
+		rcfg.Name = fmt.Sprintf("%s:%d", host, cfg.Server.Port)
+	}
+	engine.SetReadOnly(true)
+	return &Follower{
+		engine:   engine,
+		cfg:      rcfg,
+		client:   &http.Client{},
+		status:   Status{Leader: rcfg.Leader},
+		caughtUp: time.Now(),
+	}
+}
+
+// Start begins replicating, reconnecting after every failure until Stop.
+func (f *Follower) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel, f.done = cancel, make(chan struct{})
+	go f.loop(ctx)
+}
+
+func (f *Follower) Stop() {
+	if f.cancel == nil {
+		return
+	}
+	f.cancel()
+	<-f.done
+	f.cancel = nil
+}
+
+func (f *Follower) loop(ctx context.Context) {
+	defer close(f.done)
+	delay := time.Second
+	for {
+		connected, err := f.tail(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		f.mu.Lock()
+		f.status.Connected, f.status.LastError = false, err.Error()
+		f.mu.Unlock()
+		if errors.Is(err, ErrBehindLeader) {
+			log.Printf("[ERROR] %v; restart the server to bootstrap from a new snapshot", err)
+		} else {
+			log.Printf("[WARN] Replication from %s interrupted: %v", f.cfg.Leader, err)
+		}
+
+		if connected {
+			delay = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// tail streams records from the leader into the engine until the stream
+// breaks, and reports whether it got connected.
+func (f *Follower) tail(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := f.get(ctx, WALPath, url.Values{
+		"since":    {strconv.FormatUint(f.engine.LastLSN(), 10)},
+		"follower": {f.cfg.Name},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	f.status.Connected, f.status.LastError = true, ""
+	f.mu.Unlock()
+	log.Printf("[INFO] Replicating from %s after LSN %d", f.cfg.Leader, f.engine.LastLSN())
+
+	watchdog := time.AfterFunc(streamTimeout, cancel)
+	defer watchdog.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		watchdog.Reset(streamTimeout)
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			return true, fmt.Errorf("decoding replication stream: %w", err)
+		}
+		if msg.Record != nil {
+			if err := f.engine.ApplyReplicated(*msg.Record); err != nil {
+				return true, fmt.Errorf("applying LSN %d: %w", msg.Record.LSN, err)
+			}
+		}
+		f.update(msg)
+	}
+	switch {
+	case ctx.Err() != nil:
+		return true, errors.New("leader stopped responding")
+	case scanner.Err() != nil:
+		return true, scanner.Err()
+	}
+	return true, errors.New("leader closed the stream")
+}
+
+func (f *Follower) update(msg Message) {
+	now := time.Now().UTC()
+	applied := f.engine.LastLSN()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status.LastContact = &now
+	f.status.AppliedLSN = applied
+	f.status.LeaderLSN = max(msg.LeaderLSN, applied)
+	if applied >= f.status.LeaderLSN {
+		f.caughtUp = now
+	}
+}
+
+// Status reports the replication state.
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := f.status
+	status.AppliedLSN = f.engine.LastLSN()
+	if status.LeaderLSN > status.AppliedLSN {
+		status.LagRecords = status.LeaderLSN - status.AppliedLSN
+	}
+	if status.LagRecords > 0 || !status.Connected {
+		status.LagSeconds = time.Since(f.caughtUp).Seconds()
+	}
+	return status
+}
+
+func (f *Follower) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	return get(ctx, f.client, f.cfg, path, query)
+}
+
+func get(ctx context.Context, client *http.Client, cfg config.ReplicationConfig, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimSuffix(cfg.Leader, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	return client.Do(req)
+}
+
+func checkResponse(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusGone:
+		return fmt.Errorf("%w: %s", ErrBehindLeader, decodeError(resp.Body))
+	default:
+		return fmt.Errorf("leader answered %s: %s", resp.Status, decodeError(resp.Body))
+	}
+}
+
+// Behind reports whether the leader has already removed records after
+// lsn, in which case the follower has to bootstrap again.
+func Behind(cfg config.Config, lsn uint64) (bool, error) {
+	resp, err := get(context.Background(), http.DefaultClient, leaderConfig(cfg), WALPath, url.Values{
+		"since": {strconv.FormatUint(lsn, 10)},
+		"probe": {"1"},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp)
+	if errors.Is(err, ErrBehindLeader) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Bootstrap replaces the local data directory with a snapshot of the
+// leader. The engine must not be open.
+func Bootstrap(cfg config.Config) (*backup.RestoreReport, error) {
+	resp, err := get(context.Background(), http.DefaultClient, leaderConfig(cfg), SnapshotPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	root := filepath.Dir(cfg.Storage.DataFile) + ".bootstrap"
+	if err := os.RemoveAll(root); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+	dir, err := ReadSnapshot(resp.Body, root)
+	if err != nil {
+		return nil, err
+	}
+	return backup.Restore(dir, cfg.Storage.DataFile, cfg.Storage.WALDirectory, backup.RestoreOptions{})
+}
+
+func leaderConfig(cfg config.Config) config.ReplicationConfig {
+	rcfg := cfg.Replication
+	if rcfg.Token == "" {
+		rcfg.Token = cfg.Security.Token
+	}
+	return rcfg
+}
@@ -0,0 +1,123 @@
+package replication
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+const (
+	// WALPath streams WAL records after ?since= as newline-delimited
+	// Messages.
+	WALPath = "/replication/wal"
+	// SnapshotPath returns a new snapshot backup as a tar archive.
+	SnapshotPath = "/replication/snapshot"
+
+	// HeartbeatInterval is how often an idle WAL stream sends a Message
+	// without a record.
+	HeartbeatInterval = 5 * time.Second
+)
+
+// Message is one line of the WAL stream: a record, or a heartbeat when
+// Record is nil. LeaderLSN is the leader's last LSN when it was sent.
+type Message struct {
+	Record    *storage.WALEntry `json:"record,omitempty"`
+	LeaderLSN uint64            `json:"leaderLSN"`
+	Time      time.Time         `json:"time"`
+}
+
+// WriteSnapshot writes the backup in dir as a tar archive of a directory
+// named after its ID, manifest first.
+func WriteSnapshot(w io.Writer, dir string, b *storage.BackupManifest) error {
+	tw := tar.NewWriter(w)
+	names := []string{storage.BackupManifestFile}
+	for _, f := range b.Files {
+		names = append(names, f.Path)
+	}
+	for _, name := range names {
+		if err := addFile(tw, filepath.Join(dir, filepath.FromSlash(name)), path.Join(b.ID, name)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addFile(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ReadSnapshot extracts a snapshot written by WriteSnapshot into root,
+// checks it against its manifest and returns its directory.
+func ReadSnapshot(r io.Reader, root string) (string, error) {
+	tr := tar.NewReader(r)
+	var dir string
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading snapshot: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg || !filepath.IsLocal(h.Name) {
+			return "", fmt.Errorf("%w: unexpected entry %q", storage.ErrBackupInvalid, h.Name)
+		}
+		if dir == "" {
+			dir = filepath.Join(root, filepath.Dir(filepath.FromSlash(h.Name)))
+		}
+		dst := filepath.Join(root, filepath.FromSlash(h.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading snapshot: %w", err)
+		}
+	}
+	if dir == "" {
+		return "", fmt.Errorf("%w: empty snapshot", storage.ErrBackupInvalid)
+	}
+	if _, err := storage.ReadBackup(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func decodeError(r io.Reader) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(r, 4096))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		return body.Error
+	}
+	return string(data)
+}
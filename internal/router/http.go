@@ -0,0 +1,606 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+const (
+	StatusPath = "/router"
+	ShardsPath = "/router/shards"
+)
+
+// Handler returns the router's API: the document API of a single server,
+// spread over the shards, plus its own status and shard endpoints.
+func (rt *Router) Handler(security config.SecurityConfig) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rt.handleRoot)
+	mux.HandleFunc("/health", rt.handleHealth)
+	mux.HandleFunc("/collections", rt.handleListCollections)
+	mux.HandleFunc("/collections/", rt.handleCollections)
+	mux.HandleFunc("/transactions", rt.handleTransactions)
+	mux.HandleFunc(StatusPath, rt.handleStatus)
+	mux.HandleFunc(ShardsPath, rt.handleShards)
+
+	var handler http.Handler = mux
+	if security.RequireAuth && security.Token != "" {
+		handler = authMiddleware(handler, security.Token)
+	}
+	return loggingMiddleware(handler)
+}
+
+func (rt *Router) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not available through the router"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":    "HelixDB",
+		"version": "0.1.0",
+		"status":  "running",
+		"role":    "router",
+	})
+}
+
+func (rt *Router) handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := rt.Status()
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	shards := make([]map[string]interface{}, len(status.Shards))
+	healthy := true
+	scatter(status.Shards, func(i int, sh Shard) error {
+		shards[i] = map[string]interface{}{"id": sh.ID, "address": sh.Address, "status": "healthy"}
+		if err := rt.callJSON(ctx, sh, http.MethodGet, "/health", nil, nil); err != nil {
+			shards[i]["status"] = "unreachable"
+			shards[i]["error"] = err.Error()
+		}
+		return nil
+	})
+	for _, sh := range shards {
+		if sh["status"] != "healthy" {
+			healthy = false
+		}
+	}
+
+	health := map[string]interface{}{
+		"status": "healthy",
+		"role":   "router",
+		"shards": shards,
+	}
+	if !healthy {
+		health["status"] = "degraded"
+	}
+	if status.Rebalance != nil {
+		health["rebalance"] = status.Rebalance
+	}
+	writeJSON(w, http.StatusOK, health)
+}
+
+func (rt *Router) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, rt.Status())
+}
+
+// handleShards adds a shard with POST {"id", "address"}. The answer comes
+// as soon as the rebalance has started; GET /router follows its progress.
+func (rt *Router) handleShards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var sh Shard
+	if err := json.NewDecoder(r.Body).Decode(&sh); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	err := rt.AddShard(r.Context(), sh)
+	switch {
+	case errors.Is(err, ErrInvalidShard):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrShardExists), errors.Is(err, ErrRebalancing):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusAccepted, rt.Status())
+	}
+}
+
+func (rt *Router) handleListCollections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	shards := rt.Status().Shards
+	lists := make([][]string, len(shards))
+	err := scatter(shards, func(i int, sh Shard) error {
+		var list struct {
+			Collections []string `json:"collections"`
+		}
+		err := rt.callJSON(r.Context(), sh, http.MethodGet, "/collections", nil, &list)
+		lists[i] = list.Collections
+		return err
+	})
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	collections := []string{}
+	for _, list := range lists {
+		for _, name := range list {
+			if !seen[name] {
+				seen[name] = true
+				collections = append(collections, name)
+			}
+		}
+	}
+	sort.Strings(collections)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"collections": collections,
+	})
+}
+
+func (rt *Router) handleCollections(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/collections/")
+	parts := strings.Split(path, "/")
+
+	if len(parts) == 0 || parts[0] == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "collection name required"})
+		return
+	}
+
+	collection := parts[0]
+	switch {
+	case len(parts) >= 2 && parts[1] == "query":
+		rt.handleQuery(w, r, collection, len(parts) == 3 && parts[2] == "explain")
+	case len(parts) == 2 && parts[1] == "aggregate":
+		rt.handleAggregate(w, r, collection)
+	case len(parts) == 2 && parts[1] == "changes":
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "change streams are not available through the router; subscribe to each shard"})
+	case len(parts) >= 2 && parts[1] == "indexes":
+		rt.handleIndexes(w, r)
+	case len(parts) == 2 && parts[1] != "":
+		rt.forwardDocument(w, r, collection, parts[1])
+	case r.Method == http.MethodPost:
+		rt.handleCreateDocument(w, r, collection)
+	case r.Method == http.MethodGet:
+		opts, err := server.ListOptionsFromQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		rt.query(w, r, collection, opts)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// forwardDocument proxies a request for one document to the shard that
+// holds it.
+func (rt *Router) forwardDocument(w http.ResponseWriter, r *http.Request, collection, id string) {
+	proxy, release, err := rt.place(r.Context(), collection, id)
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+	defer release()
+	proxy.ServeHTTP(w, r)
+}
+
+// handleCreateDocument picks the ID of a new document itself when the
+// client leaves it out, since the ID decides the shard.
+func (rt *Router) handleCreateDocument(w http.ResponseWriter, r *http.Request, collection string) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	var id string
+	if raw, ok := body["id"]; ok {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id must be a string"})
+			return
+		}
+	}
+	if id == "" {
+		id = fmt.Sprintf("%d", time.Now().UnixNano())
+		body["id"], _ = json.Marshal(id)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	rt.forwardDocument(w, r, collection, id)
+}
+
+// handleQuery serves /collections/:name/query and, with explainOnly set,
+// /collections/:name/query/explain.
+func (rt *Router) handleQuery(w http.ResponseWriter, r *http.Request, collection string, explainOnly bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Filter     map[string]interface{} `json:"filter"`
+		Sort       []storage.SortField    `json:"sort"`
+		Projection map[string]interface{} `json:"projection"`
+		Skip       int                    `json:"skip"`
+		Limit      int                    `json:"limit"`
+		Cursor     string                 `json:"cursor"`
+		Explain    bool                   `json:"explain"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	opts := storage.QueryOptions{
+		Filter:     body.Filter,
+		Sort:       body.Sort,
+		Projection: body.Projection,
+		Skip:       body.Skip,
+		Limit:      body.Limit,
+		Cursor:     body.Cursor,
+		Explain:    body.Explain,
+	}
+
+	if explainOnly {
+		shards := rt.Status().Shards
+		explains := make(map[string]*storage.QueryExplain, len(shards))
+		answers := make([]*storage.QueryExplain, len(shards))
+		err := scatter(shards, func(i int, sh Shard) error {
+			var answer struct {
+				Explain *storage.QueryExplain `json:"explain"`
+			}
+			err := rt.callJSON(r.Context(), sh, http.MethodPost, collectionPath(collection)+"/query/explain", body, &answer)
+			answers[i] = answer.Explain
+			return err
+		})
+		if err != nil {
+			writeShardError(w, err)
+			return
+		}
+		for i, sh := range shards {
+			explains[sh.ID] = answers[i]
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"collection": collection,
+			"explain":    explains,
+		})
+		return
+	}
+	rt.query(w, r, collection, opts)
+}
+
+// query scatters a query to every shard and merges what they return. The
+// explain of a merged result has one entry per shard.
+func (rt *Router) query(w http.ResponseWriter, r *http.Request, collection string, opts storage.QueryOptions) {
+	docs, explains, err := rt.gather(r.Context(), collection, opts)
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+	result, err := storage.MergeQuery(docs, opts)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"collection": collection,
+		"count":      len(result.Documents),
+		"documents":  result.Documents,
+	}
+	if result.NextCursor != "" {
+		resp["nextCursor"] = result.NextCursor
+	}
+	if opts.Explain {
+		resp["explain"] = explains
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// gather runs the shard side of a query on every shard: the filter, sort
+// and cursor, and enough of a limit to cover the page. A document caught
+// on two shards by a rebalance is taken from the one that owns it now.
+func (rt *Router) gather(ctx context.Context, collection string, opts storage.QueryOptions) ([]*storage.Document, map[string]*storage.QueryExplain, error) {
+	rt.mu.RLock()
+	ring, rebalancing := rt.ring, rt.prev != nil
+	rt.mu.RUnlock()
+	shards := ring.Shards()
+
+	req := map[string]interface{}{
+		"filter":  opts.Filter,
+		"sort":    opts.Sort,
+		"cursor":  opts.Cursor,
+		"explain": opts.Explain,
+	}
+	if opts.Limit > 0 {
+		req["limit"] = opts.Skip + opts.Limit + 1
+	}
+	results := make([][]*storage.Document, len(shards))
+	explains := make(map[string]*storage.QueryExplain, len(shards))
+	answers := make([]*storage.QueryExplain, len(shards))
+	err := scatter(shards, func(i int, sh Shard) error {
+		var answer struct {
+			Documents []*storage.Document   `json:"documents"`
+			Explain   *storage.QueryExplain `json:"explain"`
+		}
+		err := rt.callJSON(ctx, sh, http.MethodPost, collectionPath(collection)+"/query", req, &answer)
+		results[i], answers[i] = answer.Documents, answer.Explain
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var docs []*storage.Document
+	seen := make(map[string]int)
+	for i, sh := range shards {
+		explains[sh.ID] = answers[i]
+		for _, doc := range results[i] {
+			if !rebalancing {
+				docs = append(docs, doc)
+				continue
+			}
+			if at, dup := seen[doc.ID]; dup {
+				if ring.Owner(collection, doc.ID).ID == sh.ID {
+					docs[at] = doc
+				}
+				continue
+			}
+			seen[doc.ID] = len(docs)
+			docs = append(docs, doc)
+		}
+	}
+	return docs, explains, nil
+}
+
+// handleAggregate gathers the documents matching a leading $match from
+// every shard and runs the pipeline over them.
+func (rt *Router) handleAggregate(w http.ResponseWriter, r *http.Request, collection string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Pipeline []storage.Stage `json:"pipeline"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if _, err := storage.AggregateDocuments(nil, body.Pipeline); err != nil {
+		writeQueryError(w, err)
+		return
+	}
+
+	var filter map[string]interface{}
+	if len(body.Pipeline) > 0 && len(body.Pipeline[0]) == 1 {
+		filter, _ = body.Pipeline[0]["$match"].(map[string]interface{})
+	}
+	docs, _, err := rt.gather(r.Context(), collection, storage.QueryOptions{Filter: filter})
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+	results, err := storage.AggregateDocuments(docs, body.Pipeline)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"collection": collection,
+		"count":      len(results),
+		"results":    results,
+	})
+}
+
+// handleIndexes reads index status from the first shard and creates or
+// drops indexes on every shard.
+func (rt *Router) handleIndexes(w http.ResponseWriter, r *http.Request) {
+	shards := rt.Status().Shards
+	if r.Method == http.MethodGet {
+		rt.mu.RLock()
+		proxy := rt.proxies[shards[0].ID]
+		rt.mu.RUnlock()
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reading body: " + err.Error()})
+		return
+	}
+	if r.Method == http.MethodDelete {
+		body = nil
+	}
+	statuses := make([]int, len(shards))
+	answers := make([][]byte, len(shards))
+	err = scatter(shards, func(i int, sh Shard) error {
+		var err error
+		statuses[i], answers[i], err = rt.call(r.Context(), sh, r.Method, r.URL.Path, body, nil)
+		return err
+	})
+	if err != nil {
+		writeShardError(w, err)
+		return
+	}
+	// The first failure is the answer; otherwise the first shard's.
+	pick := 0
+	for i, status := range statuses {
+		if status >= 300 {
+			pick = i
+			break
+		}
+	}
+	writeRaw(w, statuses[pick], answers[pick])
+}
+
+// handleTransactions forwards a transaction to the shard all of its
+// documents live on. Transactions across shards are refused.
+func (rt *Router) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "reading body: " + err.Error()})
+		return
+	}
+	var body struct {
+		Operations []struct {
+			Collection string `json:"collection"`
+			ID         string `json:"id"`
+		} `json:"operations"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if len(body.Operations) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "operations are required"})
+		return
+	}
+
+	stripes := make(map[uint64]bool)
+	for i, op := range body.Operations {
+		if op.Collection == "" || op.ID == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": fmt.Sprintf("operation %d: collection and id are required", i), "operation": i})
+			return
+		}
+		stripes[stripe(op.Collection, op.ID)] = true
+	}
+
+	// The documents' locks are taken in index order so that transactions
+	// cannot deadlock, and for writing, since documents a rebalance is
+	// moving are moved first.
+	order := make([]uint64, 0, len(stripes))
+	for i := range stripes {
+		order = append(order, i)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i] < order[j] })
+	for _, i := range order {
+		rt.locks[i].Lock()
+		defer rt.locks[i].Unlock()
+	}
+
+	rt.mu.RLock()
+	ring, prev := rt.ring, rt.prev
+	rt.mu.RUnlock()
+	var target Shard
+	for i, op := range body.Operations {
+		sh := ring.Owner(op.Collection, op.ID)
+		if i > 0 && sh.ID != target.ID {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": fmt.Sprintf("operation %d: the transaction spans shards %s and %s", i, target.ID, sh.ID), "operation": i})
+			return
+		}
+		target = sh
+	}
+	if prev != nil {
+		for _, op := range body.Operations {
+			from := prev.Owner(op.Collection, op.ID)
+			if from.ID == target.ID {
+				continue
+			}
+			if _, err := rt.moveDocument(r.Context(), from, target, op.Collection, op.ID); err != nil {
+				writeShardError(w, err)
+				return
+			}
+		}
+	}
+
+	rt.mu.RLock()
+	proxy := rt.proxies[target.ID]
+	rt.mu.RUnlock()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	proxy.ServeHTTP(w, r)
+}
+
+func writeShardError(w http.ResponseWriter, err error) {
+	var se *shardError
+	if errors.As(err, &se) {
+		writeRaw(w, se.status, se.body)
+		return
+	}
+	writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrInvalidFilter) || errors.Is(err, storage.ErrInvalidQuery) || errors.Is(err, storage.ErrInvalidPipeline) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		log.Printf("[%s] %s %s (%s)", r.Method, r.URL.Path, r.RemoteAddr, time.Since(start))
+	})
+}
+
+func authMiddleware(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authorization required"})
+			return
+		}
+		if auth != "Bearer "+token {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
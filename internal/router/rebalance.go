@@ -0,0 +1,367 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// Rebalance states.
+const (
+	RebalanceRunning   = "running"
+	RebalanceCompleted = "completed"
+)
+
+const (
+	// rebalanceBatch is how many documents a rebalance reads from a shard
+	// at a time.
+	rebalanceBatch = 500
+	// rebalanceRetry is how long a rebalance waits after an error before
+	// going over the shards again.
+	rebalanceRetry = 5 * time.Second
+)
+
+var errStopped = errors.New("router stopped")
+
+type RebalanceStatus struct {
+	Shard      string     `json:"shard"`
+	State      string     `json:"state"`
+	Moved      int        `json:"moved"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Error is the last error, which the rebalance retries after.
+	Error string `json:"error,omitempty"`
+}
+
+// routerState is what the state file holds. Previous is set while a
+// rebalance is moving documents off the shards it lists.
+type routerState struct {
+	Shards   []Shard `json:"shards"`
+	Previous []Shard `json:"previous,omitempty"`
+}
+
+// AddShard adds sh to the ring and starts moving the documents it now owns
+// onto it. Requests are served throughout; only one shard can be added at
+// a time.
+func (rt *Router) AddShard(ctx context.Context, sh Shard) error {
+	rt.addMu.Lock()
+	defer rt.addMu.Unlock()
+
+	rt.mu.RLock()
+	shards, rebalancing := rt.ring.Shards(), rt.prev != nil
+	rt.mu.RUnlock()
+	if rebalancing {
+		return ErrRebalancing
+	}
+	for _, existing := range shards {
+		if existing.ID == sh.ID {
+			return fmt.Errorf("%w: %s", ErrShardExists, sh.ID)
+		}
+	}
+	proxy, err := rt.newProxy(sh)
+	if err != nil {
+		return err
+	}
+	if err := rt.callJSON(ctx, sh, http.MethodGet, "/health", nil, nil); err != nil {
+		return err
+	}
+	if err := rt.copyIndexes(ctx, shards, sh); err != nil {
+		return err
+	}
+
+	rt.mu.Lock()
+	next := NewRing(append(shards, sh), rt.vnodes)
+	if err := rt.saveState(routerState{Shards: next.shards, Previous: shards}); err != nil {
+		rt.mu.Unlock()
+		return err
+	}
+	rt.prev, rt.ring = rt.ring, next
+	rt.proxies[sh.ID] = proxy
+	rt.mu.Unlock()
+
+	// A request placed by the old ring could still write a document the
+	// rebalance has gone past.
+	rt.drain()
+	log.Printf("[INFO] Added shard %s at %s; rebalancing", sh.ID, sh.Address)
+	rt.startRebalance(sh)
+	return nil
+}
+
+// copyIndexes creates on the new shard every index the others have, so
+// that it has them before it takes any documents.
+func (rt *Router) copyIndexes(ctx context.Context, shards []Shard, to Shard) error {
+	for _, from := range shards {
+		var list struct {
+			Collections []string `json:"collections"`
+		}
+		if err := rt.callJSON(ctx, from, http.MethodGet, "/collections", nil, &list); err != nil {
+			return err
+		}
+		for _, collection := range list.Collections {
+			var indexes struct {
+				Indexes []storage.IndexStatus `json:"indexes"`
+			}
+			if err := rt.callJSON(ctx, from, http.MethodGet, collectionPath(collection)+"/indexes", nil, &indexes); err != nil {
+				return err
+			}
+			for _, index := range indexes.Indexes {
+				body, err := json.Marshal(index.Definition)
+				if err != nil {
+					return err
+				}
+				status, data, err := rt.call(ctx, to, http.MethodPost, collectionPath(collection)+"/indexes", body, nil)
+				if err != nil {
+					return err
+				}
+				if status != http.StatusCreated && status != http.StatusAccepted && status != http.StatusConflict {
+					return &shardError{shard: to.ID, status: status, body: data}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// startRebalance starts moving documents onto added.
+func (rt *Router) startRebalance(added Shard) {
+	rt.statusMu.Lock()
+	rt.rebalance = &RebalanceStatus{Shard: added.ID, State: RebalanceRunning, StartedAt: time.Now().UTC()}
+	rt.statusMu.Unlock()
+	rt.wg.Add(1)
+	go rt.runRebalance()
+}
+
+func (rt *Router) runRebalance() {
+	defer rt.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rt.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := rt.rebalancePass(ctx)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errStopped) || ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] Rebalance failed, retrying in %s: %v", rebalanceRetry, err)
+		rt.updateRebalance(func(s *RebalanceStatus) { s.Error = err.Error() })
+		select {
+		case <-rt.stop:
+			return
+		case <-time.After(rebalanceRetry):
+		}
+	}
+
+	rt.mu.Lock()
+	if err := rt.saveState(routerState{Shards: rt.ring.shards}); err != nil {
+		// The next start goes over the shards again, finding nothing to move.
+		log.Printf("[ERROR] Failed to record the end of the rebalance: %v", err)
+	}
+	rt.prev = nil
+	rt.mu.Unlock()
+
+	now := time.Now().UTC()
+	rt.updateRebalance(func(s *RebalanceStatus) {
+		s.State, s.FinishedAt, s.Error = RebalanceCompleted, &now, ""
+	})
+	status := rt.Status()
+	log.Printf("[INFO] Rebalance onto shard %s completed; moved %d documents", status.Rebalance.Shard, status.Rebalance.Moved)
+}
+
+// rebalancePass goes over every document on the shards of the previous
+// ring, in ID order, and moves those the new ring places elsewhere.
+func (rt *Router) rebalancePass(ctx context.Context) error {
+	rt.mu.RLock()
+	ring, prev := rt.ring, rt.prev
+	rt.mu.RUnlock()
+
+	for _, from := range prev.Shards() {
+		var list struct {
+			Collections []string `json:"collections"`
+		}
+		if err := rt.callJSON(ctx, from, http.MethodGet, "/collections", nil, &list); err != nil {
+			return err
+		}
+		for _, collection := range list.Collections {
+			cursor := ""
+			for {
+				select {
+				case <-rt.stop:
+					return errStopped
+				default:
+				}
+				var page struct {
+					Documents  []*storage.Document `json:"documents"`
+					NextCursor string              `json:"nextCursor"`
+				}
+				query := map[string]interface{}{
+					"sort":       []storage.SortField{{Field: "id"}},
+					"limit":      rebalanceBatch,
+					"cursor":     cursor,
+					"projection": map[string]interface{}{"id": 1},
+				}
+				if err := rt.callJSON(ctx, from, http.MethodPost, collectionPath(collection)+"/query", query, &page); err != nil {
+					return err
+				}
+				for _, doc := range page.Documents {
+					to := ring.Owner(collection, doc.ID)
+					if to.ID == from.ID {
+						continue
+					}
+					if err := rt.move(ctx, from, to, collection, doc.ID); err != nil {
+						return err
+					}
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+		}
+	}
+	return nil
+}
+
+// move moves one document for the background rebalance, under the same
+// lock a client request for it would take.
+func (rt *Router) move(ctx context.Context, from, to Shard, collection, id string) error {
+	mu := &rt.locks[stripe(collection, id)]
+	mu.Lock()
+	defer mu.Unlock()
+	moved, err := rt.moveDocument(ctx, from, to, collection, id)
+	if err != nil {
+		return err
+	}
+	if moved {
+		rt.updateRebalance(func(s *RebalanceStatus) { s.Moved++ })
+	}
+	return nil
+}
+
+// moveDocument copies a document from one shard to another, as it is, and
+// then deletes it from the first. A copy already on the target was written
+// there after the document started moving and wins. The caller must hold
+// the document's lock.
+func (rt *Router) moveDocument(ctx context.Context, from, to Shard, collection, id string) (bool, error) {
+	path := documentPath(collection, id)
+	status, data, err := rt.call(ctx, from, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	if status != http.StatusOK {
+		return false, &shardError{shard: from.ID, status: status, body: data}
+	}
+	var doc storage.Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return false, fmt.Errorf("shard %s: decoding %s: %w", from.ID, path, err)
+	}
+	if doc.Data == nil {
+		doc.Data = map[string]interface{}{}
+	}
+
+	// The copy keeps the document's version, timestamps and HLC, so that
+	// clients' preconditions and sync checkpoints still hold after the
+	// move.
+	body, err := json.Marshal(map[string]interface{}{"collection": collection, "document": doc})
+	if err != nil {
+		return false, err
+	}
+	status, data, err = rt.call(ctx, to, http.MethodPost, server.ImportPath, body, nil)
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusCreated && status != http.StatusPreconditionFailed {
+		return false, &shardError{shard: to.ID, status: status, body: data}
+	}
+
+	etag := `"` + strconv.FormatUint(doc.Version, 10) + `"`
+	status, data, err = rt.call(ctx, from, http.MethodDelete, path, nil, http.Header{"If-Match": {etag}})
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK && status != http.StatusNotFound {
+		return false, &shardError{shard: from.ID, status: status, body: data}
+	}
+	return true, nil
+}
+
+func (rt *Router) updateRebalance(fn func(*RebalanceStatus)) {
+	rt.statusMu.Lock()
+	defer rt.statusMu.Unlock()
+	if rt.rebalance != nil {
+		fn(rt.rebalance)
+	}
+}
+
+func (rt *Router) loadState() (*routerState, error) {
+	if rt.statePath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(rt.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading router state: %w", err)
+	}
+	var state routerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading router state: %w", err)
+	}
+	return &state, nil
+}
+
+// saveState atomically replaces the state file.
+func (rt *Router) saveState(state routerState) error {
+	if rt.statePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(rt.statePath), 0755); err != nil {
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	tmp := rt.statePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	if err := os.Rename(tmp, rt.statePath); err != nil {
+		return fmt.Errorf("writing router state: %w", err)
+	}
+	return nil
+}
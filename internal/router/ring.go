@@ -0,0 +1,63 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points a shard gets on the ring when the
+// configuration does not say.
+const DefaultVirtualNodes = 128
+
+type Shard struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// Ring is a consistent-hash ring. Each shard owns the arcs of the hash
+// space that end at one of its virtual nodes, so adding a shard moves only
+// the keys on the arcs it takes over.
+type Ring struct {
+	shards []Shard
+	points []point
+}
+
+func NewRing(shards []Shard, vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{shards: shards, points: make([]point, 0, len(shards)*vnodes)}
+	for i, sh := range shards {
+		for v := 0; v < vnodes; v++ {
+			r.points = append(r.points, point{hash: hashKey(sh.ID + "#" + strconv.Itoa(v)), shard: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Owner returns the shard that holds the document id of collection.
+func (r *Ring) Owner(collection, id string) Shard {
+	h := hashKey(collection + "/" + id)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i].shard]
+}
+
+func (r *Ring) Shards() []Shard {
+	return append([]Shard(nil), r.shards...)
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
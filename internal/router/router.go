@@ -0,0 +1,318 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/config"
+)
+
+var (
+	ErrNoShards     = errors.New("the router needs at least one shard")
+	ErrInvalidShard = errors.New("invalid shard")
+	ErrShardExists  = errors.New("shard already exists")
+	ErrRebalancing  = errors.New("a rebalance is already in progress")
+)
+
+// lockStripes is how many locks documents are spread over. Requests for a
+// document hold its lock for reading, and moving it takes it for writing.
+const lockStripes = 256
+
+// shardTimeout bounds every request the router makes of a shard on its own
+// behalf, as opposed to the client requests it proxies.
+const shardTimeout = 30 * time.Second
+
+// Router spreads documents over shards by a consistent hash of their
+// collection and ID. While a shard is being added, prev is the ring from
+// before and documents whose owner differs between the two are moved, in
+// the background and whenever a request touches one of them.
+type Router struct {
+	vnodes    int
+	token     string
+	statePath string
+	client    *http.Client
+
+	mu      sync.RWMutex
+	ring    *Ring
+	prev    *Ring
+	proxies map[string]*httputil.ReverseProxy
+
+	statusMu  sync.Mutex
+	rebalance *RebalanceStatus
+
+	// addMu serialises AddShard.
+	addMu sync.Mutex
+	locks [lockStripes]sync.RWMutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Status describes the ring and the last rebalance.
+type Status struct {
+	Shards       []Shard          `json:"shards"`
+	VirtualNodes int              `json:"virtualNodes"`
+	Rebalancing  bool             `json:"rebalancing"`
+	Rebalance    *RebalanceStatus `json:"rebalance,omitempty"`
+}
+
+func New(cfg config.Config) (*Router, error) {
+	rt := &Router{
+		vnodes:    cfg.Router.VirtualNodes,
+		token:     cfg.Router.Token,
+		statePath: cfg.Router.StateFile,
+		client:    &http.Client{Timeout: shardTimeout},
+		proxies:   make(map[string]*httputil.ReverseProxy),
+		stop:      make(chan struct{}),
+	}
+	if rt.token == "" {
+		rt.token = cfg.Security.Token
+	}
+
+	var shards []Shard
+	for _, sh := range cfg.Router.Shards {
+		shards = append(shards, Shard{ID: sh.ID, Address: sh.Address})
+	}
+	state, err := rt.loadState()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		shards = state.Shards
+	}
+	if len(shards) == 0 {
+		return nil, ErrNoShards
+	}
+	for _, sh := range shards {
+		if _, exists := rt.proxies[sh.ID]; exists {
+			return nil, fmt.Errorf("%w: %s", ErrShardExists, sh.ID)
+		}
+		proxy, err := rt.newProxy(sh)
+		if err != nil {
+			return nil, err
+		}
+		rt.proxies[sh.ID] = proxy
+	}
+	rt.ring = NewRing(shards, rt.vnodes)
+	if state != nil && len(state.Previous) > 0 {
+		rt.prev = NewRing(state.Previous, rt.vnodes)
+	}
+	return rt, nil
+}
+
+// Start resumes a rebalance that was cut short by a restart.
+func (rt *Router) Start() {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if rt.prev != nil {
+		added := rt.ring.shards[len(rt.ring.shards)-1]
+		log.Printf("[INFO] Resuming the rebalance onto shard %s", added.ID)
+		rt.startRebalance(added)
+	}
+}
+
+func (rt *Router) Stop() {
+	close(rt.stop)
+	rt.wg.Wait()
+}
+
+func (rt *Router) Status() Status {
+	rt.mu.RLock()
+	status := Status{Shards: rt.ring.Shards(), VirtualNodes: rt.vnodes, Rebalancing: rt.prev != nil}
+	rt.mu.RUnlock()
+	if status.VirtualNodes <= 0 {
+		status.VirtualNodes = DefaultVirtualNodes
+	}
+	rt.statusMu.Lock()
+	if rt.rebalance != nil {
+		rb := *rt.rebalance
+		status.Rebalance = &rb
+	}
+	rt.statusMu.Unlock()
+	return status
+}
+
+// newProxy sets up the reverse proxy that client requests for documents on
+// sh go through.
+func (rt *Router) newProxy(sh Shard) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(sh.Address)
+	if sh.ID == "" || err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("%w: %q needs an id and an http(s) address", ErrInvalidShard, sh.ID)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	direct := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		direct(r)
+		r.Header.Del("Authorization")
+		if rt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+rt.token)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("shard %s: %v", sh.ID, err)})
+	}
+	return proxy, nil
+}
+
+// place returns the proxy for the shard a request for a document goes to,
+// holding the document's lock until release is called. If a rebalance is
+// moving the document, it is moved first, so that the move cannot overtake
+// the request. mu is only held to read the ring, never across a request to
+// a shard.
+func (rt *Router) place(ctx context.Context, collection, id string) (*httputil.ReverseProxy, func(), error) {
+	mu := &rt.locks[stripe(collection, id)]
+	mu.RLock()
+	from, to, proxy := rt.owners(collection, id)
+	if from.ID == to.ID {
+		return proxy, mu.RUnlock, nil
+	}
+	mu.RUnlock()
+
+	// The ring may have moved on while the lock was let go.
+	mu.Lock()
+	from, to, proxy = rt.owners(collection, id)
+	if from.ID != to.ID {
+		if _, err := rt.moveDocument(ctx, from, to, collection, id); err != nil {
+			mu.Unlock()
+			return nil, nil, err
+		}
+	}
+	return proxy, mu.Unlock, nil
+}
+
+// owners returns the shard that holds a document by the previous ring and
+// the one that owns it by the current ring, the same shard unless a
+// rebalance is moving it, and the proxy for the latter.
+func (rt *Router) owners(collection, id string) (Shard, Shard, *httputil.ReverseProxy) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	to := rt.ring.Owner(collection, id)
+	from := to
+	if rt.prev != nil {
+		from = rt.prev.Owner(collection, id)
+	}
+	return from, to, rt.proxies[to.ID]
+}
+
+// drain waits for every request placed by a ring that has since been
+// replaced, which holds its document's lock until it is done.
+func (rt *Router) drain() {
+	for i := range rt.locks {
+		rt.locks[i].Lock()
+		rt.locks[i].Unlock()
+	}
+}
+
+// stripe returns the index of the lock that guards moving a document.
+func stripe(collection, id string) uint64 {
+	return hashKey(collection+"/"+id) % lockStripes
+}
+
+// shardError is an answer from a shard that was not a success. The router
+// passes it on to the client as it is.
+type shardError struct {
+	shard  string
+	status int
+	body   []byte
+}
+
+func (e *shardError) Error() string {
+	return fmt.Sprintf("shard %s answered %d: %s", e.shard, e.status, bytes.TrimSpace(e.body))
+}
+
+// call makes a request of sh on the router's behalf and returns the status
+// and body of the answer.
+func (rt *Router) call(ctx context.Context, sh Shard, method, path string, body []byte, header http.Header) (int, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(sh.Address, "/")+path, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if rt.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rt.token)
+	}
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("shard %s: %w", sh.ID, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("shard %s: %w", sh.ID, err)
+	}
+	return resp.StatusCode, data, nil
+}
+
+// callJSON is call for a request that must succeed with 200 OK, decoding
+// the answer into out.
+func (rt *Router) callJSON(ctx context.Context, sh Shard, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	status, data, err := rt.call(ctx, sh, method, path, body, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return &shardError{shard: sh.ID, status: status, body: data}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("shard %s: decoding answer: %w", sh.ID, err)
+	}
+	return nil
+}
+
+// scatter runs fn for every shard at once and returns the first error.
+func scatter(shards []Shard, fn func(i int, sh Shard) error) error {
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, sh := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, sh)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func collectionPath(collection string) string {
+	return "/collections/" + url.PathEscape(collection)
+}
+
+func documentPath(collection, id string) string {
+	return collectionPath(collection) + "/" + url.PathEscape(id)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// handleAdmin serves the maintenance endpoints under /admin/.
+func (s *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/admin/") {
+	case "compact":
+		s.handleCompact(w, r)
+	case "backup":
+		s.handleBackup(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleCompact reports compaction progress on GET and starts a compaction
+// on POST.
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.engine.CompactionStatus())
+	case http.MethodPost:
+		status, err := s.engine.StartCompaction()
+		switch {
+		case errors.Is(err, storage.ErrCompactionRunning):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case errors.Is(err, storage.ErrEngineClosed):
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusAccepted, status)
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleBackup lists the backups and the scheduler state on GET, and takes
+// a snapshot into the backup directory on POST. Writes carry on while it
+// runs.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status, err := s.backups.Status()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case http.MethodPost:
+		manifest, err := s.backups.Snapshot()
+		switch {
+		case errors.Is(err, storage.ErrBackupExists):
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		case errors.Is(err, storage.ErrEngineClosed):
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusCreated, manifest)
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
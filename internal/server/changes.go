@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// changesKeepAlive is how often an idle stream sends a keep-alive.
+const changesKeepAlive = 15 * time.Second
+
+// handleChanges serves /collections/:name/changes as Server-Sent Events,
+// or as a WebSocket when the request asks for an upgrade. ?filter= takes
+// a query filter as JSON, and ?since= (or an SSE Last-Event-ID) the LSN to
+// resume after, or an event ID to resume inside a transaction.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request, collection string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	opts := storage.ChangeOptions{Collection: collection}
+	if raw := r.URL.Query().Get("filter"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &opts.Filter); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "filter must be a JSON object"})
+			return
+		}
+	}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = r.Header.Get("Last-Event-ID")
+	}
+	if since != "" {
+		lsn, within, err := parseEventID(since)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an LSN or an event ID"})
+			return
+		}
+		opts.Since, opts.Within = lsn, within
+	}
+
+	stream, err := s.engine.Changes(opts)
+	switch {
+	case errors.Is(err, storage.ErrInvalidFilter):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrChangesUnavailable):
+		writeJSON(w, http.StatusGone, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrEngineClosed):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	if isWebSocketUpgrade(r) {
+		s.streamWebSocket(w, r, stream)
+	} else {
+		s.streamEvents(w, r, stream)
+	}
+}
+
+// eventID identifies a change as <lsn>.<index>, since the writes of a
+// transaction share one LSN.
+func eventID(c storage.Change) string {
+	return fmt.Sprintf("%d.%d", c.LSN, c.Index)
+}
+
+// parseEventID reads an LSN, or an event ID as the LSN of its record and
+// the number of the record's writes it covers.
+func parseEventID(id string) (uint64, int, error) {
+	lsnPart, indexPart, found := strings.Cut(id, ".")
+	lsn, err := strconv.ParseUint(lsnPart, 10, 64)
+	if err != nil || !found {
+		return lsn, 0, err
+	}
+	index, err := strconv.Atoi(indexPart)
+	if err != nil || index < 0 {
+		return 0, 0, fmt.Errorf("invalid event ID %q", id)
+	}
+	return lsn, index + 1, nil
+}
+
+// streamEvents writes each change as an event with its event ID, so that
+// EventSource clients resume where they left off when they reconnect.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, stream *storage.ChangeStream) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), changesKeepAlive)
+		change, err := stream.Next(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "id: %s\ndata: %s\n\n", eventID(change), data)
+		case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case r.Context().Err() != nil:
+			return
+		default:
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamWebSocket sends each change as a JSON text message. A stream that
+// ends sends {"error": ...} before closing.
+func (s *Server) streamWebSocket(w http.ResponseWriter, r *http.Request, stream *storage.ChangeStream) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-conn.Done()
+		cancel()
+	}()
+
+	code, reason := wsCloseNormal, ""
+	for {
+		change, err := stream.Next(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			code, reason = wsCloseError, err.Error()
+			if errors.Is(err, storage.ErrEngineClosed) {
+				code = wsCloseGoingAway
+			}
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			conn.WriteText(data)
+			break
+		}
+		data, _ := json.Marshal(change)
+		if err := conn.WriteText(data); err != nil {
+			break
+		}
+	}
+
+	conn.Close(code, reason)
+	select {
+	case <-conn.Done():
+	case <-time.After(5 * time.Second):
+	}
+	conn.conn.Close()
+}
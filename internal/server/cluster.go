@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/cluster"
+)
+
+// forwardedHeader marks a write forwarded to the leader, which must not be
+// forwarded again.
+const forwardedHeader = "X-Helix-Forwarded-By"
+
+func (s *Server) handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "clustering is not enabled"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cluster.Status())
+}
+
+// handleClusterMembers adds a member with POST {"id", "address"} or
+// removes one with DELETE /cluster/members/:id.
+func (s *Server) handleClusterMembers(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "clustering is not enabled"})
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, cluster.MembersPath), "/")
+	var err error
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		var m cluster.Member
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+			return
+		}
+		if m.ID == "" || m.Address == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id and address are required"})
+			return
+		}
+		err = s.cluster.AddMember(m)
+	case r.Method == http.MethodDelete && id != "":
+		err = s.cluster.RemoveMember(id)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	switch {
+	case errors.Is(err, cluster.ErrMembershipChange):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, cluster.ErrNotLeader), errors.Is(err, cluster.ErrLeadershipLost), errors.Is(err, cluster.ErrStopped):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, s.cluster.Status())
+	}
+}
+
+func (s *Server) handleClusterVote(w http.ResponseWriter, r *http.Request) {
+	var req cluster.VoteRequest
+	if !s.decodeClusterRPC(w, r, &req) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cluster.HandleVote(req))
+}
+
+func (s *Server) handleClusterAppend(w http.ResponseWriter, r *http.Request) {
+	var req cluster.AppendRequest
+	if !s.decodeClusterRPC(w, r, &req) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cluster.HandleAppend(req))
+}
+
+// handleClusterSnapshot streams the leader's snapshot into the node; the
+// body is not JSON alone, so it is read by the node itself.
+func (s *Server) handleClusterSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case s.cluster == nil:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "clustering is not enabled"})
+		return
+	case r.Method != http.MethodPost:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	resp, err := s.cluster.HandleSnapshot(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) decodeClusterRPC(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	switch {
+	case s.cluster == nil:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "clustering is not enabled"})
+	case r.Method != http.MethodPost:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	case json.NewDecoder(r.Body).Decode(req) != nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+	default:
+		return true
+	}
+	return false
+}
+
+// forwardMiddleware sends writes that reach a node other than the leader
+// on to the leader. Reads are served by every node from its own state.
+func (s *Server) forwardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions ||
+			isReadRequest(r.URL.Path) || r.URL.Path == cluster.VotePath || r.URL.Path == cluster.AppendPath || r.URL.Path == cluster.SnapshotPath ||
+			s.cluster.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		leader, ok := s.cluster.Leader()
+		if !ok || r.Header.Get(forwardedHeader) != "" {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no cluster leader elected"})
+			return
+		}
+		target, err := url.Parse(leader.Address)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "invalid leader address: " + leader.Address})
+			return
+		}
+		r.Header.Set(forwardedHeader, s.cluster.ID())
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func setETag(w http.ResponseWriter, doc *storage.Document) {
+	w.Header().Set("ETag", formatETag(doc.Version))
+}
+
+// preconditionFromRequest translates If-Match and If-None-Match into a
+// storage.Precondition. ETags that are not document versions can never
+// match, but still make the header count as present.
+func preconditionFromRequest(r *http.Request) storage.Precondition {
+	var cond storage.Precondition
+	if values := r.Header.Values("If-Match"); len(values) > 0 {
+		cond.IfMatch, cond.IfMatchAny = parseETags(values)
+	}
+	if values := r.Header.Values("If-None-Match"); len(values) > 0 {
+		cond.IfNoneMatch, cond.IfNoneMatchAny = parseETags(values)
+	}
+	return cond
+}
+
+func parseETags(values []string) ([]uint64, bool) {
+	versions := []uint64{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" {
+				return nil, true
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+			tag = strings.Trim(tag, `"`)
+			if v, err := strconv.ParseUint(tag, 10, 64); err == nil {
+				versions = append(versions, v)
+			}
+		}
+	}
+	return versions, false
+}
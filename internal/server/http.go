@@ -5,21 +5,37 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/clientsync"
+	"github.com/developer51709/helixdb/internal/cluster"
 	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/replication"
 	"github.com/developer51709/helixdb/internal/storage"
 )
 
 type Server struct {
-	engine *storage.Engine
-	config config.Config
-	mux    *http.ServeMux
+	engine  *storage.Engine
+	backups *backup.Scheduler
+	// follower is set when the server is a read-only replica.
+	follower *replication.Follower
+	// cluster is set when the server is a node of a Raft cluster.
+	cluster *cluster.Node
+	// sync serves offline clients; nil disables it.
+	sync     *clientsync.Service
+	replicas replicaSet
+	config   config.Config
+	mux      *http.ServeMux
 }
 
-func New(engine *storage.Engine, cfg config.Config) *Server {
+func New(engine *storage.Engine, backups *backup.Scheduler, follower *replication.Follower, node *cluster.Node, sync *clientsync.Service, cfg config.Config) *Server {
 	s := &Server{
-		engine: engine,
-		config: cfg,
-		mux:    http.NewServeMux(),
+		engine:   engine,
+		backups:  backups,
+		follower: follower,
+		cluster:  node,
+		sync:     sync,
+		config:   cfg,
+		mux:      http.NewServeMux(),
 	}
 	s.registerRoutes()
 	return s
@@ -28,15 +44,39 @@ func New(engine *storage.Engine, cfg config.Config) *Server {
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
 
-	handler := s.withMiddleware(s.mux)
+	handler := s.Handler()
 
 	log.Printf("[INFO] HelixDB server starting on %s", addr)
 	log.Printf("[INFO] Data file: %s", s.config.Storage.DataFile)
 	log.Printf("[INFO] WAL directory: %s", s.config.Storage.WALDirectory)
 
+	if err := s.backups.Start(); err != nil {
+		return fmt.Errorf("starting backups: %w", err)
+	}
+	if s.follower != nil {
+		log.Printf("[INFO] Following %s (read-only)", s.config.Replication.Leader)
+		s.follower.Start()
+	}
+	if s.cluster != nil {
+		log.Printf("[INFO] Cluster node %s at %s", s.cluster.ID(), s.config.Cluster.Address)
+		s.cluster.Start()
+	}
+
 	return http.ListenAndServe(addr, handler)
 }
 
+// Handler returns the server's routes wrapped in its middleware.
+func (s *Server) Handler() http.Handler {
+	return s.withMiddleware(s.mux)
+}
+
 func (s *Server) Shutdown() error {
+	if s.follower != nil {
+		s.follower.Stop()
+	}
+	if s.cluster != nil {
+		s.cluster.Stop()
+	}
+	s.backups.Stop()
 	return s.engine.Close()
 }
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// handleIndexes serves /collections/:name/indexes and
+// /collections/:name/indexes/:index.
+func (s *Server) handleIndexes(w http.ResponseWriter, r *http.Request, collection string, rest []string) {
+	if len(rest) == 0 || rest[0] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"collection": collection,
+				"indexes":    s.engine.ListIndexes(collection),
+			})
+		case http.MethodPost:
+			s.handleCreateIndex(w, r, collection)
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+		return
+	}
+	if len(rest) > 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := rest[0]
+	switch r.Method {
+	case http.MethodGet:
+		for _, status := range s.engine.ListIndexes(collection) {
+			if status.Name == name {
+				writeJSON(w, http.StatusOK, status)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "index not found"})
+	case http.MethodDelete:
+		err := s.engine.DropIndex(collection, name)
+		switch {
+		case errors.Is(err, storage.ErrIndexNotFound):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "index not found"})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"status": "dropped"})
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (s *Server) handleCreateIndex(w http.ResponseWriter, r *http.Request, collection string) {
+	var body struct {
+		Name   string   `json:"name"`
+		Field  string   `json:"field"`
+		Fields []string `json:"fields"`
+		Type   string   `json:"type"`
+		Unique bool     `json:"unique"`
+		Sparse bool     `json:"sparse"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if len(body.Fields) == 0 && body.Field != "" {
+		body.Fields = []string{body.Field}
+	}
+
+	status, err := s.engine.CreateIndex(collection, indexing.Definition{
+		Name:   body.Name,
+		Fields: body.Fields,
+		Type:   body.Type,
+		Unique: body.Unique,
+		Sparse: body.Sparse,
+	})
+	switch {
+	case errors.Is(err, indexing.ErrInvalidDefinition):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrIndexExists):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	code := http.StatusCreated
+	switch status.State {
+	case storage.IndexBuilding:
+		code = http.StatusAccepted
+	case storage.IndexFailed:
+		code = http.StatusConflict
+	}
+	writeJSON(w, code, status)
+}
@@ -9,6 +9,15 @@ import (
 func (s *Server) withMiddleware(next http.Handler) http.Handler {
 	handler := next
 
+	if s.follower != nil {
+		handler = s.readOnlyMiddleware(handler)
+	}
+	if s.cluster != nil {
+		handler = s.forwardMiddleware(handler)
+	}
+
+	handler = s.failedMiddleware(handler)
+
 	if s.config.Security.RequireAuth && s.config.Security.Token != "" {
 		handler = s.authMiddleware(handler)
 	}
@@ -19,6 +28,18 @@ func (s *Server) withMiddleware(next http.Handler) http.Handler {
 	return handler
 }
 
+// failedMiddleware answers every request but /health with 503 once the
+// engine has failed: what it holds in memory may not be on disk.
+func (s *Server) failedMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.engine.Err(); err != nil && r.URL.Path != "/health" {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -30,8 +51,9 @@ func loggingMiddleware(next http.Handler) http.Handler {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
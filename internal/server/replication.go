@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/replication"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// replica is a follower connected to this server's WAL stream.
+type replica struct {
+	Name        string    `json:"name"`
+	Address     string    `json:"address"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	SentLSN     uint64    `json:"sentLSN"`
+	LagRecords  uint64    `json:"lagRecords"`
+}
+
+type replicaSet struct {
+	mu       sync.Mutex
+	replicas map[*replica]struct{}
+}
+
+func (rs *replicaSet) add(r *replica) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.replicas == nil {
+		rs.replicas = make(map[*replica]struct{})
+	}
+	rs.replicas[r] = struct{}{}
+}
+
+func (rs *replicaSet) remove(r *replica) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.replicas, r)
+}
+
+func (rs *replicaSet) sent(r *replica, lsn uint64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	r.SentLSN = lsn
+}
+
+// list returns the connected replicas, with their lag behind lastLSN.
+func (rs *replicaSet) list(lastLSN uint64) []replica {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := make([]replica, 0, len(rs.replicas))
+	for r := range rs.replicas {
+		c := *r
+		if lastLSN > c.SentLSN {
+			c.LagRecords = lastLSN - c.SentLSN
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// handleReplicationWAL streams the WAL records after ?since= to a
+// follower, one JSON Message per line, with a heartbeat when idle. The
+// records the follower still needs are held in the WAL while it is
+// connected. With ?probe= set it only checks that the records are still
+// available.
+func (s *Server) handleReplicationWAL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an LSN"})
+		return
+	}
+	stream, err := s.engine.StreamWAL(since)
+	switch {
+	case errors.Is(err, storage.ErrChangesUnavailable):
+		writeJSON(w, http.StatusGone, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrEngineClosed):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer stream.Close()
+	if r.URL.Query().Get("probe") != "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+
+	name := r.URL.Query().Get("follower")
+	if name == "" {
+		name = r.RemoteAddr
+	}
+	hold := "replica:" + name + "@" + r.RemoteAddr
+	s.engine.HoldWAL(hold, since)
+	defer s.engine.ReleaseWAL(hold)
+	rep := &replica{Name: name, Address: r.RemoteAddr, ConnectedAt: time.Now().UTC(), SentLSN: since}
+	s.replicas.add(rep)
+	defer s.replicas.remove(rep)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), replication.HeartbeatInterval)
+		entry, err := stream.Next(ctx)
+		cancel()
+		msg := replication.Message{Time: time.Now().UTC()}
+		switch {
+		case err == nil:
+			msg.Record = &entry
+		case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+		default:
+			// The follower reconnects and resumes from what it applied.
+			return
+		}
+		msg.LeaderLSN = s.engine.LastLSN()
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+		flusher.Flush()
+		if msg.Record != nil {
+			s.replicas.sent(rep, entry.LSN)
+			s.engine.HoldWAL(hold, entry.LSN)
+		}
+	}
+}
+
+// handleReplicationSnapshot sends a new snapshot backup as a tar archive
+// for a follower to bootstrap from.
+func (s *Server) handleReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	tmp, err := os.MkdirTemp("", "helixdb-snapshot-")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, storage.NewBackupID(time.Now()))
+	b, err := s.engine.Backup(dir)
+	if errors.Is(err, storage.ErrEngineClosed) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := replication.WriteSnapshot(w, dir, b); err != nil {
+		log.Printf("[ERROR] Sending snapshot to %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// readOnlyMiddleware rejects writes on a follower, letting reads that use
+// POST through.
+func (s *Server) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || isReadRequest(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeJSON(w, http.StatusForbidden, map[string]string{
+			"error":  storage.ErrReadOnly.Error(),
+			"leader": s.config.Replication.Leader,
+		})
+	})
+}
+
+func isReadRequest(path string) bool {
+	if strings.HasPrefix(path, "/admin/") {
+		return true
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/collections/"), "/")
+	if !strings.HasPrefix(path, "/collections/") || len(parts) < 2 {
+		return false
+	}
+	switch parts[1] {
+	case "query":
+		return true
+	case "aggregate":
+		return len(parts) == 2
+	}
+	return false
+}
@@ -1,20 +1,47 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/developer51709/helixdb/internal/clientsync"
+	"github.com/developer51709/helixdb/internal/cluster"
+	"github.com/developer51709/helixdb/internal/replication"
 	"github.com/developer51709/helixdb/internal/storage"
 )
 
+// ImportPath creates a document as it is given, keeping its version,
+// timestamps and HLC. The router moves documents between shards through
+// it.
+const ImportPath = "/internal/import"
+
 func (s *Server) registerRoutes() {
 	s.mux.HandleFunc("/", s.handleRoot)
 	s.mux.HandleFunc("/health", s.handleHealth)
 	s.mux.HandleFunc("/collections", s.handleListCollections)
 	s.mux.HandleFunc("/collections/", s.handleCollections)
+	s.mux.HandleFunc("/transactions", s.handleTransactions)
+	s.mux.HandleFunc(ImportPath, s.handleImportDocument)
+	s.mux.HandleFunc("/admin/", s.handleAdmin)
+	s.mux.HandleFunc(replication.WALPath, s.handleReplicationWAL)
+	s.mux.HandleFunc(replication.SnapshotPath, s.handleReplicationSnapshot)
+	s.mux.HandleFunc(cluster.StatusPath, s.handleClusterStatus)
+	s.mux.HandleFunc(cluster.MembersPath, s.handleClusterMembers)
+	s.mux.HandleFunc(cluster.MembersPath+"/", s.handleClusterMembers)
+	s.mux.HandleFunc(cluster.VotePath, s.handleClusterVote)
+	s.mux.HandleFunc(cluster.AppendPath, s.handleClusterAppend)
+	s.mux.HandleFunc(cluster.SnapshotPath, s.handleClusterSnapshot)
+	s.mux.HandleFunc(clientsync.PullPath, s.handleSyncPull)
+	s.mux.HandleFunc(clientsync.PushPath, s.handleSyncPush)
 }
 
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -31,9 +58,28 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	health := map[string]interface{}{
 		"status": "healthy",
-	})
+		"lsn":    s.engine.LastLSN(),
+	}
+	switch {
+	case s.cluster != nil:
+		status := s.cluster.Status()
+		health["role"] = status.Role
+		health["cluster"] = status
+	case s.follower != nil:
+		health["role"] = replication.RoleFollower
+		health["replication"] = s.follower.Status()
+	default:
+		health["role"] = replication.RoleLeader
+		health["replicas"] = s.replicas.list(s.engine.LastLSN())
+	}
+	if err := s.engine.Err(); err != nil {
+		health["status"], health["error"] = "failed", err.Error()
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+	writeJSON(w, http.StatusOK, health)
 }
 
 func (s *Server) handleListCollections(w http.ResponseWriter, r *http.Request) {
@@ -59,7 +105,22 @@ func (s *Server) handleCollections(w http.ResponseWriter, r *http.Request) {
 	collectionName := parts[0]
 
 	if len(parts) >= 2 && parts[1] == "query" {
-		s.handleQuery(w, r, collectionName)
+		s.handleQuery(w, r, collectionName, len(parts) == 3 && parts[2] == "explain")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "aggregate" {
+		s.handleAggregate(w, r, collectionName)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "changes" {
+		s.handleChanges(w, r, collectionName)
+		return
+	}
+
+	if len(parts) >= 2 && parts[1] == "indexes" {
+		s.handleIndexes(w, r, collectionName, parts[2:])
 		return
 	}
 
@@ -68,6 +129,10 @@ func (s *Server) handleCollections(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			s.handleGetDocument(w, r, collectionName, docID)
+		case http.MethodPut:
+			s.handleReplaceDocument(w, r, collectionName, docID)
+		case http.MethodPatch:
+			s.handlePatchDocument(w, r, collectionName, docID)
 		case http.MethodDelete:
 			s.handleDeleteDocument(w, r, collectionName, docID)
 		default:
@@ -107,12 +172,57 @@ func (s *Server) handleCreateDocument(w http.ResponseWriter, r *http.Request, co
 		id = generateID()
 	}
 
-	doc, err := s.engine.InsertDocument(collection, id, body.Data)
+	doc, err := s.engine.InsertDocumentIf(collection, id, body.Data, preconditionFromRequest(r))
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": err.Error()})
+		return
+	}
+	if writeUniqueViolation(w, err) {
+		return
+	}
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
 
+	setETag(w, doc)
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+// handleImportDocument creates the document in a POST {"collection",
+// "document"} body unless one with its ID exists, which answers 412.
+func (s *Server) handleImportDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var body struct {
+		Collection string            `json:"collection"`
+		Document   *storage.Document `json:"document"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if body.Collection == "" || body.Document == nil || body.Document.ID == "" || body.Document.Data == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "collection and a document with an id and data are required"})
+		return
+	}
+
+	doc, err := s.engine.ImportDocument(body.Collection, body.Document)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": err.Error()})
+		return
+	}
+	if writeUniqueViolation(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	setETag(w, doc)
 	writeJSON(w, http.StatusCreated, doc)
 }
 
@@ -122,35 +232,157 @@ func (s *Server) handleGetDocument(w http.ResponseWriter, r *http.Request, colle
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "document not found"})
 		return
 	}
+
+	setETag(w, doc)
+	if cond := preconditionFromRequest(r); cond.IfNoneMatchAny || cond.IfNoneMatch != nil {
+		cond.IfMatch, cond.IfMatchAny = nil, false
+		if errors.Is(cond.Check(doc), storage.ErrPreconditionFailed) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 	writeJSON(w, http.StatusOK, doc)
 }
 
+func (s *Server) handleReplaceDocument(w http.ResponseWriter, r *http.Request, collection, id string) {
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+
+	if body.Data == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "data field is required"})
+		return
+	}
+
+	doc, created, err := s.engine.UpsertDocumentIf(collection, id, body.Data, preconditionFromRequest(r))
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": err.Error()})
+		return
+	}
+	if writeUniqueViolation(w, err) {
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	setETag(w, doc)
+	writeJSON(w, status, doc)
+}
+
+func (s *Server) handlePatchDocument(w http.ResponseWriter, r *http.Request, collection, id string) {
+	patch, err := decodePatch(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	doc, err := s.engine.PatchDocumentIf(collection, id, patch, preconditionFromRequest(r))
+	if writeUniqueViolation(w, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, storage.ErrDocumentNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "document not found"})
+		return
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrPatchTestFailed):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, storage.ErrInvalidPatch):
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	setETag(w, doc)
+	writeJSON(w, http.StatusOK, doc)
+}
+
+// decodePatch picks the patch format from the request's Content-Type. Plain
+// application/json bodies are treated as a JSON Patch when they are an array
+// and as a merge patch otherwise.
+func decodePatch(r *http.Request) (storage.Patch, error) {
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json-patch+json":
+		return storage.ParseJSONPatch(raw)
+	case "application/merge-patch+json":
+		return storage.ParseMergePatch(raw)
+	}
+
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		return storage.ParseJSONPatch(raw)
+	}
+	return storage.ParseMergePatch(raw)
+}
+
 func (s *Server) handleDeleteDocument(w http.ResponseWriter, r *http.Request, collection, id string) {
-	if deleted := s.engine.DeleteDocument(collection, id); !deleted {
+	err := s.engine.DeleteDocumentIf(collection, id, preconditionFromRequest(r))
+	switch {
+	case errors.Is(err, storage.ErrDocumentNotFound):
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "document not found"})
 		return
+	case errors.Is(err, storage.ErrPreconditionFailed):
+		writeJSON(w, http.StatusPreconditionFailed, map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
 func (s *Server) handleListDocuments(w http.ResponseWriter, r *http.Request, collection string) {
-	docs := s.engine.QueryDocuments(collection, nil, 0)
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"collection": collection,
-		"count":      len(docs),
-		"documents":  docs,
-	})
+	opts, err := ListOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	result, err := s.engine.Query(collection, opts)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	writeQueryResult(w, collection, result)
 }
 
-func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request, collection string) {
+// handleQuery serves /collections/:name/query and, with explainOnly set,
+// /collections/:name/query/explain.
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request, collection string, explainOnly bool) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 		return
 	}
 
 	var body struct {
-		Filter map[string]interface{} `json:"filter"`
-		Limit  int                    `json:"limit"`
+		Filter     map[string]interface{} `json:"filter"`
+		Sort       []storage.SortField    `json:"sort"`
+		Projection map[string]interface{} `json:"projection"`
+		Skip       int                    `json:"skip"`
+		Limit      int                    `json:"limit"`
+		Cursor     string                 `json:"cursor"`
+		Explain    bool                   `json:"explain"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -158,20 +390,161 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request, collection
 		return
 	}
 
-	docs := s.engine.QueryDocuments(collection, body.Filter, body.Limit)
+	opts := storage.QueryOptions{
+		Filter:     body.Filter,
+		Sort:       body.Sort,
+		Projection: body.Projection,
+		Skip:       body.Skip,
+		Limit:      body.Limit,
+		Cursor:     body.Cursor,
+		Explain:    body.Explain,
+	}
+	if explainOnly {
+		explain, err := s.engine.ExplainQuery(collection, opts)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"collection": collection,
+			"explain":    explain,
+		})
+		return
+	}
+
+	result, err := s.engine.Query(collection, opts)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	writeQueryResult(w, collection, result)
+}
+
+// writeUniqueViolation answers 409 Conflict for a unique index violation,
+// naming the field and the document already holding the value. It reports
+// whether err was one.
+func writeUniqueViolation(w http.ResponseWriter, err error) bool {
+	var uv *storage.UniqueViolationError
+	if !errors.As(err, &uv) {
+		return false
+	}
+	writeJSON(w, http.StatusConflict, map[string]interface{}{
+		"error":      err.Error(),
+		"index":      uv.Index,
+		"field":      strings.Join(uv.Fields, ","),
+		"value":      uv.Key,
+		"existingId": uv.ExistingID,
+	})
+	return true
+}
+
+func (s *Server) handleAggregate(w http.ResponseWriter, r *http.Request, collection string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
 
-	result := make([]storage.Document, 0, len(docs))
-	for _, d := range docs {
-		result = append(result, *d)
+	var body struct {
+		Pipeline []storage.Stage `json:"pipeline"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
 	}
 
+	results, err := s.engine.Aggregate(collection, body.Pipeline)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"collection": collection,
-		"count":      len(result),
-		"documents":  result,
+		"count":      len(results),
+		"results":    results,
 	})
 }
 
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrInvalidFilter) || errors.Is(err, storage.ErrInvalidQuery) || errors.Is(err, storage.ErrInvalidPipeline) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+}
+
+func writeQueryResult(w http.ResponseWriter, collection string, result *storage.QueryResult) {
+	resp := map[string]interface{}{
+		"collection": collection,
+		"count":      len(result.Documents),
+		"documents":  result.Documents,
+	}
+	if result.NextCursor != "" {
+		resp["nextCursor"] = result.NextCursor
+	}
+	if result.Explain != nil {
+		resp["explain"] = result.Explain
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ListOptionsFromQuery reads query options from a URL query string:
+//
+//	?sort=-createdAt,name&projection=name,email&skip=10&limit=20&cursor=...
+//
+// A leading '-' on a sort field sorts descending; on a field name it
+// excludes that field from the projection.
+func ListOptionsFromQuery(q url.Values) (storage.QueryOptions, error) {
+	var opts storage.QueryOptions
+
+	if raw := q.Get("filter"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &opts.Filter); err != nil {
+			return opts, fmt.Errorf("filter must be a JSON object")
+		}
+	}
+
+	for _, field := range splitList(q.Get("sort")) {
+		sf := storage.SortField{Field: field, Direction: "asc"}
+		if strings.HasPrefix(field, "-") {
+			sf = storage.SortField{Field: field[1:], Direction: "desc"}
+		}
+		opts.Sort = append(opts.Sort, sf)
+	}
+
+	if fields := splitList(q.Get("projection")); len(fields) > 0 {
+		opts.Projection = make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			if strings.HasPrefix(field, "-") {
+				opts.Projection[field[1:]] = 0
+			} else {
+				opts.Projection[field] = 1
+			}
+		}
+	}
+
+	for name, dst := range map[string]*int{"skip": &opts.Skip, "limit": &opts.Limit} {
+		if raw := q.Get(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*dst = n
+		}
+	}
+
+	opts.Cursor = q.Get("cursor")
+	return opts, nil
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/clientsync"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func (s *Server) handleSyncPull(w http.ResponseWriter, r *http.Request) {
+	if s.sync == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sync is not enabled"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var req clientsync.PullRequest
+	query := r.URL.Query()
+	if since := query.Get("since"); since != "" {
+		lsn, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be a checkpoint"})
+			return
+		}
+		req.Since = &lsn
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "limit must be a non-negative integer"})
+			return
+		}
+		req.Limit = n
+	}
+	for _, c := range strings.Split(query.Get("collections"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			req.Collections = append(req.Collections, c)
+		}
+	}
+
+	resp, err := s.sync.Pull(req)
+	switch {
+	case errors.Is(err, storage.ErrEngineClosed):
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) handleSyncPush(w http.ResponseWriter, r *http.Request) {
+	if s.sync == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sync is not enabled"})
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	var body struct {
+		Mutations []clientsync.Mutation `json:"mutations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+
+	resp, err := s.sync.Push(body.Mutations)
+	switch {
+	case errors.Is(err, clientsync.ErrInvalidMutation), errors.Is(err, clientsync.ErrClockDrift):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
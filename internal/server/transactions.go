@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// maxTxnAttempts bounds how often a batch is retried after losing a race
+// with another writer. Preconditions are re-evaluated on every attempt.
+const maxTxnAttempts = 3
+
+type txnOperation struct {
+	Op          string                 `json:"op"`
+	Collection  string                 `json:"collection"`
+	ID          string                 `json:"id"`
+	Data        map[string]interface{} `json:"data"`
+	Patch       json.RawMessage        `json:"patch"`
+	IfMatch     string                 `json:"ifMatch"`
+	IfNoneMatch string                 `json:"ifNoneMatch"`
+}
+
+// txnError records which operation of a batch failed.
+type txnError struct {
+	index int
+	err   error
+}
+
+func (e *txnError) Error() string { return fmt.Sprintf("operation %d: %v", e.index, e.err) }
+func (e *txnError) Unwrap() error { return e.err }
+
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body struct {
+		Operations []txnOperation `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	if len(body.Operations) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "operations are required"})
+		return
+	}
+
+	var docs []*storage.Document
+	var err error
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		docs, err = s.runTransaction(body.Operations)
+		if !errors.Is(err, storage.ErrTxnConflict) {
+			break
+		}
+	}
+
+	var opErr *txnError
+	if errors.As(err, &opErr) {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errInvalidOperation), errors.Is(err, storage.ErrInvalidPatch):
+			status = http.StatusBadRequest
+		case errors.Is(err, storage.ErrDocumentNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, storage.ErrPreconditionFailed):
+			status = http.StatusPreconditionFailed
+		case errors.Is(err, storage.ErrPatchTestFailed):
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, map[string]interface{}{"error": err.Error(), "operation": opErr.index})
+		return
+	}
+	if writeUniqueViolation(w, err) {
+		return
+	}
+	if errors.Is(err, storage.ErrTxnConflict) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	results := make([]interface{}, 0, len(body.Operations))
+	i := 0
+	for _, op := range body.Operations {
+		switch op.Op {
+		case "check":
+			results = append(results, map[string]string{"status": "ok"})
+			continue
+		case "delete":
+			results = append(results, map[string]string{"status": "deleted"})
+		default:
+			results = append(results, docs[i])
+		}
+		i++
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "committed",
+		"results": results,
+	})
+}
+
+var errInvalidOperation = errors.New("invalid operation")
+
+func (s *Server) runTransaction(ops []txnOperation) ([]*storage.Document, error) {
+	tx := s.engine.Begin()
+	for i, op := range ops {
+		if err := applyTxnOperation(tx, op); err != nil {
+			tx.Rollback()
+			return nil, &txnError{index: i, err: err}
+		}
+	}
+	return tx.Commit()
+}
+
+func applyTxnOperation(tx *storage.Txn, op txnOperation) error {
+	if op.Collection == "" || op.ID == "" {
+		return fmt.Errorf("%w: collection and id are required", errInvalidOperation)
+	}
+
+	var cond storage.Precondition
+	if op.IfMatch != "" {
+		cond.IfMatch, cond.IfMatchAny = parseETags([]string{op.IfMatch})
+	}
+	if op.IfNoneMatch != "" {
+		cond.IfNoneMatch, cond.IfNoneMatchAny = parseETags([]string{op.IfNoneMatch})
+	}
+	if err := tx.Check(op.Collection, op.ID, cond); err != nil {
+		return err
+	}
+
+	switch op.Op {
+	case "check":
+		return nil
+	case "insert", "update", "upsert":
+		if op.Data == nil {
+			return fmt.Errorf("%w: %s requires data", errInvalidOperation, op.Op)
+		}
+		switch op.Op {
+		case "insert":
+			return tx.Insert(op.Collection, op.ID, op.Data)
+		case "update":
+			return tx.Update(op.Collection, op.ID, op.Data)
+		}
+		return tx.Upsert(op.Collection, op.ID, op.Data)
+	case "patch":
+		if len(op.Patch) == 0 {
+			return fmt.Errorf("%w: patch requires a patch document", errInvalidOperation)
+		}
+		var patch storage.Patch
+		var err error
+		if trimmed := bytes.TrimSpace(op.Patch); trimmed[0] == '[' {
+			patch, err = storage.ParseJSONPatch(op.Patch)
+		} else {
+			patch, err = storage.ParseMergePatch(op.Patch)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Patch(op.Collection, op.ID, patch)
+	case "delete":
+		return tx.Delete(op.Collection, op.ID)
+	}
+	return fmt.Errorf("%w: unknown op %q", errInvalidOperation, op.Op)
+}
@@ -0,0 +1,531 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+var ErrInvalidPipeline = errors.New("invalid pipeline")
+
+// Stage is one step of an aggregation pipeline, an object with a single
+// operator key such as {"$match": {...}}.
+type Stage map[string]interface{}
+
+// stageFunc transforms the rows flowing through a pipeline. Rows are the
+// document data plus an "_id" field; stages must not modify the maps they
+// receive, since the first stage's input is shared with stored documents.
+type stageFunc func(rows []map[string]interface{}) []map[string]interface{}
+
+// Aggregate runs a pipeline over a collection. A leading $match is handed to
+// the query planner, so it can use indexes; every later stage runs in memory
+// on the rows the previous stage produced.
+func (e *Engine) Aggregate(collection string, pipeline []Stage) ([]map[string]interface{}, error) {
+	filter, stages, err := compilePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	result, err := e.Query(collection, QueryOptions{Filter: filter})
+	if err != nil {
+		return nil, err
+	}
+	return runPipeline(result.Documents, stages), nil
+}
+
+// AggregateDocuments runs a pipeline over documents gathered from
+// elsewhere, such as the shards behind a router.
+func AggregateDocuments(docs []*Document, pipeline []Stage) ([]map[string]interface{}, error) {
+	filter, stages, err := compilePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	match, err := CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]*Document, 0, len(docs))
+	for _, doc := range docs {
+		if match.Match(doc.Data) {
+			matched = append(matched, doc)
+		}
+	}
+	return runPipeline(matched, stages), nil
+}
+
+// compilePipeline splits off a leading $match as a query filter and
+// compiles the remaining stages.
+func compilePipeline(pipeline []Stage) (map[string]interface{}, []stageFunc, error) {
+	var filter map[string]interface{}
+	if len(pipeline) > 0 {
+		if spec, ok := pipeline[0]["$match"]; ok && len(pipeline[0]) == 1 {
+			m, ok := spec.(map[string]interface{})
+			if !ok {
+				return nil, nil, fmt.Errorf("%w: stage 0: $match expects an object", ErrInvalidPipeline)
+			}
+			filter = m
+			pipeline = pipeline[1:]
+		}
+	}
+
+	stages := make([]stageFunc, 0, len(pipeline))
+	for i, stage := range pipeline {
+		fn, err := compileStage(stage)
+		if err != nil {
+			return nil, nil, fmt.Errorf("stage %d: %w", i, err)
+		}
+		stages = append(stages, fn)
+	}
+	return filter, stages, nil
+}
+
+func runPipeline(docs []*Document, stages []stageFunc) []map[string]interface{} {
+	rows := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		row := make(map[string]interface{}, len(doc.Data)+1)
+		for k, v := range doc.Data {
+			row[k] = v
+		}
+		if _, exists := row["_id"]; !exists {
+			row["_id"] = doc.ID
+		}
+		rows[i] = row
+	}
+
+	for _, stage := range stages {
+		rows = stage(rows)
+	}
+	return rows
+}
+
+func compileStage(stage Stage) (stageFunc, error) {
+	if len(stage) != 1 {
+		return nil, fmt.Errorf("%w: a stage must have exactly one operator", ErrInvalidPipeline)
+	}
+	for op, spec := range stage {
+		switch op {
+		case "$match":
+			return compileMatchStage(spec)
+		case "$group":
+			return compileGroupStage(spec)
+		case "$sort":
+			return compileSortStage(spec)
+		case "$limit":
+			return compileLimitStage(spec)
+		case "$project":
+			return compileProjectStage(spec)
+		case "$unwind":
+			return compileUnwindStage(spec)
+		case "$count":
+			return compileCountStage(spec)
+		default:
+			return nil, fmt.Errorf("%w: unknown stage %s", ErrInvalidPipeline, op)
+		}
+	}
+	return nil, nil
+}
+
+func compileMatchStage(spec interface{}) (stageFunc, error) {
+	m, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: $match expects an object", ErrInvalidPipeline)
+	}
+	filter, err := CompileFilter(m)
+	if err != nil {
+		return nil, err
+	}
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		out := rows[:0:0]
+		for _, row := range rows {
+			if filter.Match(row) {
+				out = append(out, row)
+			}
+		}
+		return out
+	}, nil
+}
+
+type accumulator struct {
+	field string
+	op    string
+	expr  interface{}
+}
+
+type groupState struct {
+	key    interface{}
+	sums   []float64
+	counts []int
+	values []interface{}
+	lists  [][]interface{}
+}
+
+func compileGroupStage(spec interface{}) (stageFunc, error) {
+	m, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: $group expects an object", ErrInvalidPipeline)
+	}
+	keyExpr, ok := m["_id"]
+	if !ok {
+		return nil, fmt.Errorf("%w: $group requires an _id expression", ErrInvalidPipeline)
+	}
+
+	var accs []accumulator
+	for _, field := range sortedKeys(m) {
+		if field == "_id" {
+			continue
+		}
+		if strings.Contains(field, ".") || strings.HasPrefix(field, "$") {
+			return nil, fmt.Errorf("%w: bad $group field %q", ErrInvalidPipeline, field)
+		}
+		obj, ok := m[field].(map[string]interface{})
+		if !ok || len(obj) != 1 {
+			return nil, fmt.Errorf("%w: $group field %q must be a single accumulator", ErrInvalidPipeline, field)
+		}
+		for op, expr := range obj {
+			switch op {
+			case "$sum", "$avg", "$min", "$max", "$push":
+			case "$count":
+				if c, ok := expr.(map[string]interface{}); !ok || len(c) != 0 {
+					return nil, fmt.Errorf("%w: $count accumulator takes {}", ErrInvalidPipeline)
+				}
+			default:
+				return nil, fmt.Errorf("%w: unknown accumulator %s", ErrInvalidPipeline, op)
+			}
+			accs = append(accs, accumulator{field: field, op: op, expr: expr})
+		}
+	}
+
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		groups := make(map[string]*groupState)
+		var order []*groupState
+		for _, row := range rows {
+			key, _ := evalExpr(row, keyExpr)
+			hk := indexing.HashKey(key)
+			g, ok := groups[hk]
+			if !ok {
+				g = &groupState{
+					key:    key,
+					sums:   make([]float64, len(accs)),
+					counts: make([]int, len(accs)),
+					values: make([]interface{}, len(accs)),
+					lists:  make([][]interface{}, len(accs)),
+				}
+				groups[hk] = g
+				order = append(order, g)
+			}
+			for i, acc := range accs {
+				accumulate(g, i, acc, row)
+			}
+		}
+
+		out := make([]map[string]interface{}, 0, len(order))
+		for _, g := range order {
+			res := map[string]interface{}{"_id": g.key}
+			for i, acc := range accs {
+				switch acc.op {
+				case "$sum":
+					res[acc.field] = g.sums[i]
+				case "$count":
+					res[acc.field] = float64(g.counts[i])
+				case "$avg":
+					if g.counts[i] == 0 {
+						res[acc.field] = nil
+					} else {
+						res[acc.field] = g.sums[i] / float64(g.counts[i])
+					}
+				case "$min", "$max":
+					res[acc.field] = g.values[i]
+				case "$push":
+					if g.lists[i] == nil {
+						g.lists[i] = []interface{}{}
+					}
+					res[acc.field] = g.lists[i]
+				}
+			}
+			out = append(out, res)
+		}
+		return out
+	}, nil
+}
+
+func accumulate(g *groupState, i int, acc accumulator, row map[string]interface{}) {
+	if acc.op == "$count" {
+		g.counts[i]++
+		return
+	}
+	v, present := evalExpr(row, acc.expr)
+	switch acc.op {
+	case "$sum", "$avg":
+		// Non-numeric values are ignored, as in MongoDB.
+		if n, ok := indexing.Number(v); ok {
+			g.sums[i] += n
+			g.counts[i]++
+		}
+	case "$min", "$max":
+		if !present || v == nil {
+			return
+		}
+		c := 0
+		if g.counts[i] > 0 {
+			c = indexing.Compare(v, g.values[i])
+		}
+		if g.counts[i] == 0 || (acc.op == "$min" && c < 0) || (acc.op == "$max" && c > 0) {
+			g.values[i] = v
+		}
+		g.counts[i]++
+	case "$push":
+		if present {
+			g.lists[i] = append(g.lists[i], v)
+		}
+	}
+}
+
+func compileSortStage(spec interface{}) (stageFunc, error) {
+	var fields []SortField
+	switch s := spec.(type) {
+	case map[string]interface{}:
+		// JSON objects are unordered, so a multi-key sort needs the array
+		// form to say which key comes first.
+		if len(s) != 1 {
+			return nil, fmt.Errorf("%w: $sort object must have one field; use an array of {field, direction} to sort by several", ErrInvalidPipeline)
+		}
+		for field, dir := range s {
+			n, ok := indexing.Number(dir)
+			if !ok || (n != 1 && n != -1) {
+				return nil, fmt.Errorf("%w: $sort direction for %q must be 1 or -1", ErrInvalidPipeline, field)
+			}
+			f := SortField{Field: field, Direction: "asc"}
+			if n == -1 {
+				f.Direction = "desc"
+			}
+			fields = append(fields, f)
+		}
+	case []interface{}:
+		for _, item := range s {
+			obj, ok := item.(map[string]interface{})
+			field, _ := obj["field"].(string)
+			dir, _ := obj["direction"].(string)
+			if !ok || field == "" {
+				return nil, fmt.Errorf("%w: $sort array entries must be {field, direction}", ErrInvalidPipeline)
+			}
+			fields = append(fields, SortField{Field: field, Direction: dir})
+		}
+	default:
+		return nil, fmt.Errorf("%w: $sort expects an object or an array", ErrInvalidPipeline)
+	}
+	for _, f := range fields {
+		switch strings.ToLower(f.Direction) {
+		case "", "asc", "ascending", "desc", "descending":
+		default:
+			return nil, fmt.Errorf("%w: sort direction for %q must be asc or desc", ErrInvalidPipeline, f.Field)
+		}
+	}
+
+	paths := make([][]string, len(fields))
+	for i, f := range fields {
+		paths[i] = strings.Split(f.Field, ".")
+	}
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		out := append([]map[string]interface{}(nil), rows...)
+		sort.SliceStable(out, func(a, b int) bool {
+			for i, f := range fields {
+				c := indexing.Compare(firstValue(out[a], paths[i]), firstValue(out[b], paths[i]))
+				if f.descending() {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return false
+		})
+		return out
+	}, nil
+}
+
+func compileLimitStage(spec interface{}) (stageFunc, error) {
+	n, ok := indexing.Number(spec)
+	if !ok || n <= 0 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("%w: $limit expects a positive integer", ErrInvalidPipeline)
+	}
+	limit := int(n)
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		if len(rows) > limit {
+			return rows[:limit]
+		}
+		return rows
+	}, nil
+}
+
+// compileProjectStage supports the same inclusion and exclusion forms as
+// query projections, plus computed fields given as expressions. _id is kept
+// unless explicitly excluded.
+func compileProjectStage(spec interface{}) (stageFunc, error) {
+	m, ok := spec.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, fmt.Errorf("%w: $project expects a non-empty object", ErrInvalidPipeline)
+	}
+
+	include, exclude := newProjectionNode(), newProjectionNode()
+	computed := make(map[string]interface{})
+	keepID := true
+	includes, excludes := 0, 0
+	for field, v := range m {
+		if field == "" || strings.HasPrefix(field, "$") {
+			return nil, fmt.Errorf("%w: bad $project field %q", ErrInvalidPipeline, field)
+		}
+		on, isFlag := projectionFlag(v)
+		switch {
+		case !isFlag:
+			computed[field] = v
+		case field == "_id":
+			keepID = on
+		case on:
+			include.add(field)
+			includes++
+		default:
+			exclude.add(field)
+			excludes++
+		}
+	}
+	if excludes > 0 && (includes > 0 || len(computed) > 0) {
+		return nil, fmt.Errorf("%w: $project cannot mix inclusion and exclusion", ErrInvalidPipeline)
+	}
+	if !keepID {
+		exclude.add("_id")
+	}
+	inclusive := includes > 0 || len(computed) > 0
+	if inclusive && keepID {
+		include.add("_id")
+	}
+	computedFields := make([]string, 0, len(computed))
+	for field := range computed {
+		computedFields = append(computedFields, field)
+	}
+	sort.Strings(computedFields)
+
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		out := make([]map[string]interface{}, len(rows))
+		for i, row := range rows {
+			if !inclusive {
+				out[i] = excludePaths(row, exclude)
+				continue
+			}
+			res := includePaths(row, include)
+			for _, field := range computedFields {
+				if v, present := evalExpr(row, computed[field]); present {
+					res = setField(res, strings.Split(field, "."), v)
+				}
+			}
+			out[i] = res
+		}
+		return out
+	}, nil
+}
+
+func compileUnwindStage(spec interface{}) (stageFunc, error) {
+	var ref string
+	preserve := false
+	switch s := spec.(type) {
+	case string:
+		ref = s
+	case map[string]interface{}:
+		ref, _ = s["path"].(string)
+		if p, ok := s["preserveNullAndEmptyArrays"]; ok {
+			if preserve, ok = p.(bool); !ok {
+				return nil, fmt.Errorf("%w: preserveNullAndEmptyArrays expects a boolean", ErrInvalidPipeline)
+			}
+		}
+	}
+	if !strings.HasPrefix(ref, "$") || len(ref) < 2 {
+		return nil, fmt.Errorf("%w: $unwind expects a field path such as \"$tags\"", ErrInvalidPipeline)
+	}
+	path := strings.Split(ref[1:], ".")
+
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, row := range rows {
+			v, present := evalExpr(row, ref)
+			arr, isArray := v.([]interface{})
+			switch {
+			case isArray && len(arr) > 0:
+				for _, el := range arr {
+					out = append(out, setField(row, path, el))
+				}
+			case isArray || !present || v == nil:
+				if preserve {
+					out = append(out, row)
+				}
+			default:
+				// A non-array value unwinds to itself.
+				out = append(out, row)
+			}
+		}
+		return out
+	}, nil
+}
+
+func compileCountStage(spec interface{}) (stageFunc, error) {
+	field, ok := spec.(string)
+	if !ok || field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+		return nil, fmt.Errorf("%w: $count expects a field name", ErrInvalidPipeline)
+	}
+	return func(rows []map[string]interface{}) []map[string]interface{} {
+		return []map[string]interface{}{{field: float64(len(rows))}}
+	}, nil
+}
+
+// evalExpr evaluates an aggregation expression against a row: "$path"
+// strings are field references, objects are evaluated field by field, and
+// anything else is a literal. It reports whether a referenced field exists.
+func evalExpr(row map[string]interface{}, expr interface{}) (interface{}, bool) {
+	switch e := expr.(type) {
+	case string:
+		if !strings.HasPrefix(e, "$") {
+			return e, true
+		}
+		values := lookupPath(row, strings.Split(e[1:], "."))
+		switch len(values) {
+		case 0:
+			return nil, false
+		case 1:
+			return values[0], true
+		}
+		return values, true
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(e))
+		for k, sub := range e {
+			if v, present := evalExpr(row, sub); present {
+				out[k] = v
+			}
+		}
+		return out, true
+	}
+	return expr, true
+}
+
+func firstValue(row map[string]interface{}, path []string) interface{} {
+	if values := lookupPath(row, path); len(values) > 0 {
+		return values[0]
+	}
+	return nil
+}
+
+// setField returns a copy of m with the value at path replaced, copying
+// only the maps along the path.
+func setField(m map[string]interface{}, path []string, v interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m)+1)
+	for k, val := range m {
+		out[k] = val
+	}
+	if len(path) == 1 {
+		out[path[0]] = v
+		return out
+	}
+	child, _ := m[path[0]].(map[string]interface{})
+	out[path[0]] = setField(child, path[1:], v)
+	return out
+}
@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+// A snapshot backup is a directory laid out like a data directory: the
+// manifest under the data file's name, the segments it refers to, and a
+// wal directory holding the records logged after the checkpoint, up to
+// the backup's LSN. An incremental backup only has the wal directory, with
+// the records logged after the previous backup of the same base snapshot.
+// BackupManifestFile, written last, lists every file with its checksum; a
+// directory without it is incomplete.
+
+const (
+	BackupManifestFile = "backup.json"
+	BackupSnapshot     = "snapshot"
+	BackupIncremental  = "incremental"
+
+	backupFormat = 1
+	backupWALDir = "wal"
+)
+
+var (
+	ErrBackupExists  = errors.New("backup already exists")
+	ErrBackupInvalid = errors.New("backup invalid")
+	ErrWALGap        = errors.New("WAL records missing")
+)
+
+type BackupManifest struct {
+	Format    int       `json:"format"`
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	// DataFile is the name of the data file within the backup.
+	DataFile string `json:"dataFile"`
+	// Base is the snapshot an incremental backup applies to, and FromLSN
+	// the last record of the backup before it.
+	Base    string `json:"base,omitempty"`
+	FromLSN uint64 `json:"fromLSN,omitempty"`
+	// CheckpointLSN is the LSN the copied segments reflect, and LSN the
+	// last record of the copied WAL tail.
+	CheckpointLSN uint64                           `json:"checkpointLSN"`
+	LSN           uint64                           `json:"lsn"`
+	Indexes       map[string][]indexing.Definition `json:"indexes,omitempty"`
+	Files         []BackupFile                     `json:"files"`
+	Size          int64                            `json:"size"`
+}
+
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewBackupID returns the default name of a backup taken at t.
+func NewBackupID(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Backup writes a snapshot of the database to dir, which must not exist.
+// It checkpoints, then copies the segments while holding off further
+// checkpoints and compactions; writers are not blocked. Records they log
+// in the meantime up to the moment the copy ends are included as the WAL
+// tail.
+func (e *Engine) Backup(dir string) (*BackupManifest, error) {
+	return e.writeBackup(dir, BackupSnapshot, e.snapshotTo)
+}
+
+// BackupIncremental writes the records logged after since to dir, as an
+// incremental backup on top of the snapshot named base. If the log no
+// longer holds all of them it fails with ErrWALGap; HoldWAL prevents
+// that.
+func (e *Engine) BackupIncremental(dir, base string, since uint64) (*BackupManifest, error) {
+	return e.writeBackup(dir, BackupIncremental, func(w *backupWriter) error {
+		b := w.manifest
+		b.Base, b.FromLSN = base, since
+		b.LSN = e.wal.LastLSN()
+		entries, err := e.wal.History()
+		if err != nil {
+			return err
+		}
+		next := since + 1
+		var tail []WALEntry
+		for _, entry := range entries {
+			if entry.LSN <= since || entry.LSN > b.LSN {
+				continue
+			}
+			if entry.LSN != next {
+				break
+			}
+			tail = append(tail, entry)
+			next++
+		}
+		if next != b.LSN+1 {
+			return fmt.Errorf("%w: records %d to %d are no longer in the log", ErrWALGap, next, b.LSN)
+		}
+		return w.writeWAL(tail)
+	})
+}
+
+// writeBackup creates dir through a temporary directory, with fill
+// copying the files.
+func (e *Engine) writeBackup(dir, kind string, fill func(*backupWriter) error) (*BackupManifest, error) {
+	if e.closing.Load() {
+		return nil, ErrEngineClosed
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackupExists, dir)
+	}
+	tmp := dir + ".partial"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+
+	w := &backupWriter{dir: tmp, manifest: &BackupManifest{
+		Format:    backupFormat,
+		ID:        filepath.Base(dir),
+		Type:      kind,
+		CreatedAt: time.Now().UTC(),
+		DataFile:  filepath.Base(e.dataFile),
+	}}
+	err := fill(w)
+	if err == nil {
+		err = w.finish()
+	}
+	if err == nil {
+		err = os.Rename(tmp, dir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	b := w.manifest
+	fmt.Printf("[INFO] Backed up to %s at LSN %d (%s, %d files, %d bytes)\n", dir, b.LSN, kind, len(b.Files), b.Size)
+	return b, nil
+}
+
+func (e *Engine) snapshotTo(w *backupWriter) error {
+	b := w.manifest
+	b.Indexes = make(map[string][]indexing.Definition)
+
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+	if err := e.checkpointLocked(); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(e.dataFile)
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	b.CheckpointLSN = m.LastLSN
+	if err := w.write(b.DataFile, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	for name, mc := range m.Collections {
+		if len(mc.Indexes) > 0 {
+			b.Indexes[name] = mc.Indexes
+		}
+		if mc.IndexSize == 0 {
+			continue
+		}
+		src := filepath.Join(e.segmentDir, mc.Dir)
+		dst := filepath.Join(segmentsDirName, mc.Dir)
+		s := &segmentStore{dir: src}
+		segments, err := s.segmentNumbers()
+		if err != nil {
+			return err
+		}
+		for _, n := range segments {
+			if err := w.copy(filepath.Join(dst, segmentFileName(n)), filepath.Join(src, segmentFileName(n)), -1); err != nil {
+				return err
+			}
+		}
+		// Only the committed part of the index log is copied.
+		index := mc.Index
+		if index == "" {
+			index = segmentIndexFile
+		}
+		if err := w.copy(filepath.Join(dst, index), filepath.Join(src, index), mc.IndexSize); err != nil {
+			return err
+		}
+	}
+
+	// The checkpoint also holds off WAL truncation, so every record after
+	// it is still in the log.
+	b.LSN = e.wal.LastLSN()
+	entries, err := e.wal.ReadAll()
+	if err != nil {
+		return err
+	}
+	var tail []WALEntry
+	for _, entry := range entries {
+		if entry.LSN > b.CheckpointLSN && entry.LSN <= b.LSN {
+			tail = append(tail, entry)
+		}
+	}
+	if len(tail) == 0 {
+		b.LSN = b.CheckpointLSN
+	}
+	return w.writeWAL(tail)
+}
+
+// backupWriter copies files into a backup, recording their checksums.
+type backupWriter struct {
+	dir      string
+	manifest *BackupManifest
+}
+
+// writeWAL saves entries as a WAL segment in the backup's wal directory.
+func (w *backupWriter) writeWAL(entries []WALEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	data, err := encodeSegment(entries)
+	if err != nil {
+		return err
+	}
+	return w.write(filepath.Join(backupWALDir, segmentName(entries[0].LSN)), bytes.NewReader(data))
+}
+
+// finish writes the manifest, which does not list itself.
+func (w *backupWriter) finish() error {
+	sort.Slice(w.manifest.Files, func(i, j int) bool { return w.manifest.Files[i].Path < w.manifest.Files[j].Path })
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(w.dir, BackupManifestFile))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return syncAndClose(f)
+}
+
+// copy copies the first limit bytes of src, or all of it if limit is
+// negative.
+func (w *backupWriter) copy(name, src string, limit int64) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+	return w.write(name, r)
+}
+
+func (w *backupWriter) write(name string, r io.Reader) error {
+	path := filepath.Join(w.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+	w.manifest.Files = append(w.manifest.Files, BackupFile{Path: filepath.ToSlash(name), Size: n, SHA256: fmt.Sprintf("%x", h.Sum(nil))})
+	w.manifest.Size += n
+	return nil
+}
+
+// ReadBackup loads the manifest of the backup in dir and checks the size
+// and checksum of every file it lists.
+func ReadBackup(dir string) (*BackupManifest, error) {
+	b, err := LoadBackupManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range b.Files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBackupInvalid, err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n != file.Size || fmt.Sprintf("%x", h.Sum(nil)) != file.SHA256 {
+			return nil, fmt.Errorf("%w: %s does not match its checksum", ErrBackupInvalid, file.Path)
+		}
+	}
+	return b, nil
+}
+
+// LoadBackupManifest loads the manifest of the backup in dir without
+// checking its files.
+func LoadBackupManifest(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BackupManifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s has no %s", ErrBackupInvalid, dir, BackupManifestFile)
+		}
+		return nil, err
+	}
+	var b BackupManifest
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrBackupInvalid, BackupManifestFile, err)
+	}
+	if b.Format != backupFormat {
+		return nil, fmt.Errorf("%w: unknown format %d", ErrBackupInvalid, b.Format)
+	}
+	return &b, nil
+}
+
+// BackupRepairSource returns a RepairSource that looks documents up in the
+// newest valid snapshot under root. Only the segments of the backup are
+// searched, not its WAL tail. The backup is found and checked on the first
+// lookup.
+func BackupRepairSource(root string) RepairSource {
+	var (
+		loaded bool
+		dir    string
+		m      manifest
+		stores = make(map[string]*segmentStore)
+	)
+	load := func() error {
+		loaded = true
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		// Backup IDs sort by time.
+		for i := len(entries) - 1; i >= 0 && dir == ""; i-- {
+			candidate := filepath.Join(root, entries[i].Name())
+			b, err := ReadBackup(candidate)
+			if err != nil || b.Type != BackupSnapshot {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(candidate, b.DataFile))
+			if err == nil && json.Unmarshal(data, &m) == nil {
+				dir = candidate
+			}
+		}
+		if dir == "" {
+			return fmt.Errorf("no valid snapshot in %s", root)
+		}
+		return nil
+	}
+
+	return RepairSource{
+		Name: "backup",
+		Lookup: func(collection, id string) (*Document, error) {
+			if !loaded {
+				if err := load(); err != nil {
+					return nil, err
+				}
+			}
+			mc, exists := m.Collections[collection]
+			if dir == "" || !exists || mc.IndexSize == 0 {
+				return nil, nil
+			}
+			s := stores[collection]
+			if s == nil {
+				s = &segmentStore{
+					dir:       filepath.Join(dir, segmentsDirName, mc.Dir),
+					locations: make(map[string]segmentLocation),
+					index:     mc.Index,
+					indexSize: mc.IndexSize,
+				}
+				if s.index == "" {
+					s.index = segmentIndexFile
+				}
+				if err := s.loadIndex(); err != nil {
+					return nil, err
+				}
+				stores[collection] = s
+			}
+			loc, exists := s.locations[id]
+			if !exists {
+				return nil, nil
+			}
+			f, err := os.Open(filepath.Join(s.dir, segmentFileName(loc.Segment)))
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			doc, _, reason, err := readSegmentRecord(f, loc)
+			if err != nil || reason != "" {
+				return nil, err
+			}
+			return doc, nil
+		},
+	}
+}
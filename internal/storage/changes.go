@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// changeBufferSize is how many recent WAL records the engine keeps in
+	// memory, at least, for resuming streams; older ones are read back
+	// from the WAL.
+	changeBufferSize = 4096
+	// changeStreamBuffer is how many records a stream can fall behind
+	// before it is closed with ErrStreamLagged.
+	changeStreamBuffer = 1024
+	// changeReadBatch is how many records a subscription reads back from
+	// the WAL at a time.
+	changeReadBatch = 1024
+)
+
+var (
+	ErrChangesUnavailable = errors.New("changes no longer available")
+	ErrStreamLagged       = errors.New("change stream fell behind")
+)
+
+// Change is a document write as recorded in the WAL. Writes in one
+// transaction share the LSN of its record; Index is the position of the
+// write within it.
+type Change struct {
+	LSN        uint64                 `json:"lsn"`
+	Index      int                    `json:"index,omitempty"`
+	Operation  string                 `json:"operation"`
+	Collection string                 `json:"collection"`
+	DocumentID string                 `json:"documentId"`
+	Version    uint64                 `json:"version"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	HLC        string                 `json:"hlc,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+type ChangeOptions struct {
+	// Collection limits the stream to one collection; empty means all.
+	Collection string
+	// Filter is matched against the data of inserted and updated
+	// documents. Deletes carry no data and always pass.
+	Filter map[string]interface{}
+	// Since resumes the stream after the record with this LSN. Zero
+	// streams only changes made from now on.
+	Since uint64
+	// Within, if positive, resumes inside the record Since instead, after
+	// its first Within writes.
+	Within int
+}
+
+// changeFeed publishes the records appended to the WAL to the open
+// streams, in LSN order.
+type changeFeed struct {
+	mu sync.Mutex
+	// recent holds the latest records, oldest first, from recentFrom up
+	// to last.
+	recent     []WALEntry
+	recentFrom uint64
+	last       uint64
+	subs       map[*subscription]struct{}
+	closed     bool
+}
+
+func newChangeFeed(last uint64) *changeFeed {
+	return &changeFeed{recentFrom: last + 1, last: last, subs: make(map[*subscription]struct{})}
+}
+
+// publish is called by the WAL, under its lock, for every record appended.
+func (f *changeFeed) publish(entry WALEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = entry.LSN
+	f.recent = append(f.recent, entry)
+	if over := len(f.recent) - changeBufferSize; over >= changeBufferSize {
+		f.recentFrom = f.recent[over].LSN
+		f.recent = append([]WALEntry(nil), f.recent[over:]...)
+	}
+
+	for s := range f.subs {
+		if s.want != nil && !s.want(entry) {
+			continue
+		}
+		select {
+		case s.ch <- entry:
+		default:
+			f.drop(s, ErrStreamLagged)
+		}
+	}
+}
+
+// drop closes s with err. The caller holds f.mu.
+func (f *changeFeed) drop(s *subscription, err error) {
+	if _, ok := f.subs[s]; !ok {
+		return
+	}
+	delete(f.subs, s)
+	s.err = err
+	close(s.ch)
+}
+
+// reset restarts the feed after last, when the engine's state has been
+// replaced. Open streams cannot follow and are dropped.
+func (f *changeFeed) reset(last uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recent, f.recentFrom, f.last = nil, last+1, last
+	for s := range f.subs {
+		f.drop(s, ErrChangesUnavailable)
+	}
+}
+
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for s := range f.subs {
+		f.drop(s, ErrEngineClosed)
+	}
+}
+
+// subscription receives the records after since, first those already
+// logged and then new ones as they are appended.
+type subscription struct {
+	feed    *changeFeed
+	want    func(WALEntry) bool
+	backlog []WALEntry
+	// wal, if set, still holds records from to to that come before the
+	// live ones; they are read into the backlog a batch at a time and held
+	// back from truncation until then.
+	wal      *WAL
+	from, to uint64
+	// ch receives live records; err is set before it is closed.
+	ch  chan WALEntry
+	err error
+}
+
+// subscribe opens a subscription. Without replay it starts at the next
+// record. Otherwise the records after since come first, from memory or
+// from the WAL (including archived segments) as the subscriber gets to
+// them; if some of them have been removed it fails with
+// ErrChangesUnavailable.
+func (e *Engine) subscribe(since uint64, replay bool, want func(WALEntry) bool) (*subscription, error) {
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	s := &subscription{feed: e.changes, want: want, ch: make(chan WALEntry, changeStreamBuffer)}
+
+	f := e.changes
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil, ErrEngineClosed
+	}
+	last, fromMemory := f.last, since+1 >= f.recentFrom
+	if since > last {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("%w: LSN %d is ahead of the log (%d)", ErrChangesUnavailable, since, last)
+	}
+	if replay && fromMemory {
+		for _, entry := range f.recent {
+			if entry.LSN > since && (want == nil || want(entry)) {
+				s.backlog = append(s.backlog, entry)
+			}
+		}
+	}
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+
+	if replay && !fromMemory {
+		s.wal, s.from, s.to = e.wal, since+1, last
+		s.wal.Hold(s.holdName(), since)
+		// Reading the first batch tells whether the records are still there.
+		if err := s.fill(); err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *subscription) holdName() string {
+	return fmt.Sprintf("subscription %p", s)
+}
+
+// fill reads the next batch of records to come from the WAL into the
+// backlog.
+func (s *subscription) fill() error {
+	entries, err := s.wal.Read(s.from-1, changeReadBatch)
+	if err != nil {
+		return err
+	}
+	read := false
+	for _, entry := range entries {
+		if entry.LSN != s.from || entry.LSN > s.to {
+			break
+		}
+		if s.want == nil || s.want(entry) {
+			s.backlog = append(s.backlog, entry)
+		}
+		s.from, read = s.from+1, true
+	}
+	switch {
+	case s.from > s.to:
+		s.wal.Release(s.holdName())
+	case !read:
+		return fmt.Errorf("%w: the WAL no longer holds LSN %d", ErrChangesUnavailable, s.from)
+	default:
+		s.wal.Hold(s.holdName(), s.from-1)
+	}
+	return nil
+}
+
+// logged returns the next record logged before the subscription opened, if
+// any are left.
+func (s *subscription) logged() (WALEntry, bool, error) {
+	for len(s.backlog) == 0 && s.wal != nil && s.from <= s.to {
+		if err := s.fill(); err != nil {
+			return WALEntry{}, false, err
+		}
+	}
+	if len(s.backlog) == 0 {
+		return WALEntry{}, false, nil
+	}
+	entry := s.backlog[0]
+	s.backlog = s.backlog[1:]
+	return entry, true, nil
+}
+
+func (s *subscription) next(ctx context.Context) (WALEntry, error) {
+	if entry, ok, err := s.logged(); err != nil || ok {
+		return entry, err
+	}
+	select {
+	case <-ctx.Done():
+		return WALEntry{}, ctx.Err()
+	case entry, ok := <-s.ch:
+		if !ok {
+			return WALEntry{}, s.err
+		}
+		return entry, nil
+	}
+}
+
+func (s *subscription) close() {
+	if s.wal != nil {
+		s.wal.Release(s.holdName())
+	}
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	s.feed.drop(s, ErrEngineClosed)
+}
+
+// entryChanges returns the document writes in a WAL record.
+func entryChanges(entry WALEntry) []Change {
+	switch entry.Operation {
+	case "INSERT", "UPDATE", "DELETE":
+		return []Change{{
+			LSN:        entry.LSN,
+			Operation:  entry.Operation,
+			Collection: entry.Collection,
+			DocumentID: entry.DocumentID,
+			Version:    entry.Version,
+			Data:       entry.Data,
+			HLC:        entry.HLC,
+			Timestamp:  entry.Timestamp,
+		}}
+	case "TXN":
+		var changes []Change
+		for i, op := range entry.Ops {
+			op.LSN = entry.LSN
+			for _, c := range entryChanges(op) {
+				c.Index = i
+				changes = append(changes, c)
+			}
+		}
+		return changes
+	}
+	return nil
+}
+
+// touches reports whether entry writes to collection.
+func touches(entry WALEntry, collection string) bool {
+	if entry.Operation == "TXN" {
+		for _, op := range entry.Ops {
+			if op.Collection == collection {
+				return true
+			}
+		}
+		return false
+	}
+	return entry.Collection == collection
+}
+
+// ChangeStream delivers the changes selected by its ChangeOptions.
+type ChangeStream struct {
+	sub        *subscription
+	wal        *WAL
+	collection string
+	filter     *Filter
+	pending    []Change
+	// resume is the record the stream resumes inside of, and within how
+	// many of its writes to skip.
+	resume uint64
+	within int
+}
+
+// Changes opens a stream of document writes. With opts.Since set it first
+// replays every change after that LSN, or after the first opts.Within
+// writes of its record, and fails with ErrChangesUnavailable if some of
+// those records have already been removed from the WAL.
+func (e *Engine) Changes(opts ChangeOptions) (*ChangeStream, error) {
+	filter, err := CompileFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	var want func(WALEntry) bool
+	if opts.Collection != "" {
+		want = func(entry WALEntry) bool { return touches(entry, opts.Collection) }
+	}
+	stream := &ChangeStream{wal: e.wal, collection: opts.Collection, filter: filter}
+	since := opts.Since
+	if since > 0 && opts.Within > 0 {
+		since--
+		stream.resume, stream.within = opts.Since, opts.Within
+	}
+	stream.sub, err = e.subscribe(since, opts.Since != 0, want)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Next returns the next change, waiting for one if needed. It fails with
+// ErrStreamLagged if the reader fell too far behind, in which case it can
+// resume from the LSN of the last change it got, and with ErrEngineClosed
+// once the engine is closed. As with WALStream.Next, a change is only
+// returned once its record is on stable storage, so that an LSN a client
+// resumes from is never given to another record after a crash.
+func (s *ChangeStream) Next(ctx context.Context) (Change, error) {
+	for {
+		for len(s.pending) > 0 {
+			c := s.pending[0]
+			s.pending = s.pending[1:]
+			if s.collection != "" && c.Collection != s.collection {
+				continue
+			}
+			if c.Operation == "DELETE" || s.filter.Match(c.Data) {
+				return c, nil
+			}
+		}
+		entry, err := s.sub.next(ctx)
+		if err != nil {
+			return Change{}, err
+		}
+		if err := s.wal.flush(entry.LSN); err != nil {
+			return Change{}, err
+		}
+		s.pending = entryChanges(entry)
+		if entry.LSN == s.resume {
+			for len(s.pending) > 0 && s.pending[0].Index < s.within {
+				s.pending = s.pending[1:]
+			}
+		}
+	}
+}
+
+// Close stops the stream.
+func (s *ChangeStream) Close() {
+	s.sub.close()
+}
+
+// ReadChanges returns, without waiting, the changes to the given
+// collections (all if none are given) recorded after since, up to about
+// limit of them; the writes of a transaction are never split. It also
+// returns the LSN to read on from, which is past every record read even if
+// none of them matched, and whether more records follow it. Like
+// ChangeStream.Next it waits for the records read to reach stable storage.
+func (e *Engine) ReadChanges(since uint64, collections []string, limit int) ([]Change, uint64, bool, error) {
+	wanted := make(map[string]bool, len(collections))
+	for _, c := range collections {
+		wanted[c] = true
+	}
+	sub, err := e.subscribe(since, true, nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	defer sub.close()
+
+	var changes []Change
+	checkpoint := since
+	done := func(more bool) ([]Change, uint64, bool, error) {
+		if err := e.wal.flush(checkpoint); err != nil {
+			return nil, 0, false, err
+		}
+		return changes, checkpoint, more, nil
+	}
+	for {
+		entry, ok, err := sub.logged()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if !ok {
+			return done(false)
+		}
+		if limit > 0 && len(changes) >= limit {
+			return done(true)
+		}
+		checkpoint = entry.LSN
+		for _, c := range entryChanges(entry) {
+			if len(wanted) == 0 || wanted[c.Collection] {
+				changes = append(changes, c)
+			}
+		}
+	}
+}
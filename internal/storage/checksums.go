@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var ErrCorruptData = errors.New("corrupt documents found")
+
+// quarantineDirName is the directory, next to the data file, that receives
+// a copy of every document failing verification.
+const quarantineDirName = "_corrupt"
+
+func computeChecksum(doc *Document) string {
+	data, _ := json.Marshal(doc.Data)
+	h := sha256.Sum256(data)
+	return fmt.Sprintf("%x", h[:8])
+}
+
+// CorruptDocument is a stored document that failed verification: its
+// record could not be read, or its data no longer matches its checksum.
+type CorruptDocument struct {
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+	// Version is the version the damaged copy claims, when it could be
+	// decoded.
+	Version uint64 `json:"version,omitempty"`
+	Segment string `json:"segment,omitempty"`
+	Offset  int64  `json:"offset,omitempty"`
+	Reason  string `json:"reason"`
+	// RepairedFrom names where an intact copy was found: "wal" or a
+	// RepairSource. Empty means the document was not repaired.
+	RepairedFrom string `json:"repairedFrom,omitempty"`
+	raw          []byte
+}
+
+// QuarantineReport is saved as report.json in each quarantine directory.
+type QuarantineReport struct {
+	CreatedAt time.Time         `json:"createdAt"`
+	Documents []CorruptDocument `json:"documents"`
+}
+
+// verifyChecksums removes the documents whose data does not match their
+// stored checksum from docs and returns them. Documents saved without a
+// checksum are trusted.
+func verifyChecksums(collection string, docs map[string]*Document) []CorruptDocument {
+	var corrupt []CorruptDocument
+	for id, doc := range docs {
+		if doc.Checksum == "" {
+			continue
+		}
+		if sum := computeChecksum(doc); sum != doc.Checksum {
+			raw, _ := json.Marshal(doc)
+			corrupt = append(corrupt, CorruptDocument{
+				Collection: collection,
+				ID:         id,
+				Version:    doc.Version,
+				Reason:     fmt.Sprintf("checksum mismatch: stored %s, computed %s", doc.Checksum, sum),
+				raw:        raw,
+			})
+			delete(docs, id)
+		}
+	}
+	return corrupt
+}
+
+// quarantine copies the raw bytes of every corrupt document into a new
+// directory under _corrupt, along with a report, and returns its path.
+func quarantine(root string, docs []CorruptDocument) (string, error) {
+	dir := filepath.Join(root, quarantineDirName, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	for _, doc := range docs {
+		if doc.raw == nil {
+			continue
+		}
+		colDir := filepath.Join(dir, collectionDirName(doc.Collection))
+		if err := os.MkdirAll(colDir, 0755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(colDir, collectionDirName(doc.ID)), doc.raw, 0644); err != nil {
+			return "", err
+		}
+	}
+	return dir, writeQuarantineReport(dir, docs)
+}
+
+func writeQuarantineReport(dir string, docs []CorruptDocument) error {
+	sorted := append([]CorruptDocument(nil), docs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Collection != sorted[j].Collection {
+			return sorted[i].Collection < sorted[j].Collection
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	data, err := json.MarshalIndent(QuarantineReport{CreatedAt: time.Now().UTC(), Documents: sorted}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "report.json"), data, 0644)
+}
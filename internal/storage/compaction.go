@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	CompactionIdle    = "idle"
+	CompactionRunning = "running"
+	CompactionDone    = "done"
+	CompactionFailed  = "failed"
+
+	DefaultCompactThreshold = 128 << 20
+)
+
+var (
+	ErrCompactionRunning = errors.New("compaction already running")
+	ErrEngineClosed      = errors.New("engine closed")
+	ErrEngineFailed      = errors.New("engine failed")
+)
+
+// CompactionStatus reports the progress of the current or most recent
+// compaction.
+type CompactionStatus struct {
+	State string `json:"state"`
+	// Trigger is "auto" when the garbage threshold started the run and
+	// "manual" otherwise.
+	Trigger          string     `json:"trigger,omitempty"`
+	Collection       string     `json:"collection,omitempty"`
+	CollectionsDone  int        `json:"collectionsDone"`
+	CollectionsTotal int        `json:"collectionsTotal"`
+	BytesCopied      int64      `json:"bytesCopied"`
+	BytesTotal       int64      `json:"bytesTotal"`
+	Progress         float64    `json:"progress"`
+	ReclaimedBytes   int64      `json:"reclaimedBytes"`
+	StartedAt        *time.Time `json:"startedAt,omitempty"`
+	FinishedAt       *time.Time `json:"finishedAt,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+type compactionState struct {
+	mu     sync.Mutex
+	status CompactionStatus
+}
+
+func (e *Engine) CompactionStatus() CompactionStatus {
+	e.compaction.mu.Lock()
+	defer e.compaction.mu.Unlock()
+	status := e.compaction.status
+	if status.State == "" {
+		status.State = CompactionIdle
+	}
+	return status
+}
+
+// StartCompaction compacts every collection with reclaimable space in the
+// background. Writers are not blocked; checkpoints wait until it finishes.
+func (e *Engine) StartCompaction() (CompactionStatus, error) {
+	if err := e.beginCompaction("manual"); err != nil {
+		return e.CompactionStatus(), err
+	}
+	e.saves.Add(1)
+	go func() {
+		defer e.saves.Done()
+		e.compact(0)
+	}()
+	return e.CompactionStatus(), nil
+}
+
+// Compact is StartCompaction, waiting for the result.
+func (e *Engine) Compact() (CompactionStatus, error) {
+	if err := e.beginCompaction("manual"); err != nil {
+		return e.CompactionStatus(), err
+	}
+	err := e.compact(0)
+	return e.CompactionStatus(), err
+}
+
+// maybeCompact starts an automatic compaction of the collections whose
+// reclaimable space exceeds the threshold. It runs on the checkpoint loop.
+func (e *Engine) maybeCompact() {
+	if !e.autoCompact {
+		return
+	}
+	e.saveMu.Lock()
+	due := len(e.compactionCandidates(e.compactThreshold)) > 0
+	e.saveMu.Unlock()
+	if !due || e.beginCompaction("auto") != nil {
+		return
+	}
+	if err := e.compact(e.compactThreshold); err != nil {
+		fmt.Printf("[WARN] Compaction failed: %v\n", err)
+	}
+}
+
+func (e *Engine) beginCompaction(trigger string) error {
+	if e.closing.Load() {
+		return ErrEngineClosed
+	}
+	e.compaction.mu.Lock()
+	defer e.compaction.mu.Unlock()
+	if e.compaction.status.State == CompactionRunning {
+		return ErrCompactionRunning
+	}
+	now := time.Now().UTC()
+	e.compaction.status = CompactionStatus{State: CompactionRunning, Trigger: trigger, StartedAt: &now}
+	return nil
+}
+
+func (e *Engine) updateCompaction(fn func(*CompactionStatus)) {
+	e.compaction.mu.Lock()
+	defer e.compaction.mu.Unlock()
+	fn(&e.compaction.status)
+	if s := &e.compaction.status; s.BytesTotal > 0 {
+		s.Progress = float64(s.BytesCopied) / float64(s.BytesTotal)
+	}
+}
+
+// compact rewrites the live records of every collection with more than
+// threshold bytes of garbage into fresh segments, then commits them with a
+// checkpoint and deletes the old files. It holds saveMu throughout.
+func (e *Engine) compact(threshold int64) (err error) {
+	defer func() {
+		now := time.Now().UTC()
+		e.updateCompaction(func(s *CompactionStatus) {
+			s.State, s.Collection, s.FinishedAt = CompactionDone, "", &now
+			if err != nil {
+				s.State, s.Error = CompactionFailed, err.Error()
+			} else {
+				s.Progress = 1
+			}
+		})
+	}()
+
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+
+	// Checkpoint first so that the WAL is trimmed and every change is in
+	// the segments being rewritten.
+	if err := e.checkpointLocked(); err != nil {
+		return err
+	}
+
+	names := e.compactionCandidates(threshold)
+	var total int64
+	for _, name := range names {
+		total += e.stores[name].liveBytes
+	}
+	e.updateCompaction(func(s *CompactionStatus) {
+		s.CollectionsTotal, s.BytesTotal = len(names), total
+	})
+
+	var reclaimed int64
+	for _, name := range names {
+		if e.closing.Load() {
+			return ErrEngineClosed
+		}
+		store := e.stores[name]
+		e.updateCompaction(func(s *CompactionStatus) { s.Collection = name })
+		before, buried := store.diskBytes, store.copyTombstones()
+		err := store.compact(e.segmentSize, func(n int64) {
+			e.updateCompaction(func(s *CompactionStatus) { s.BytesCopied += n })
+		}, e.closing.Load)
+		if err != nil {
+			return fmt.Errorf("compacting %s: %w", name, err)
+		}
+		e.GetCollection(name).foldTombstones(buried, store.floor)
+		reclaimed += before - store.diskBytes
+		e.updateCompaction(func(s *CompactionStatus) { s.CollectionsDone++ })
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	if err := e.checkpointLocked(); err != nil {
+		return err
+	}
+	e.updateCompaction(func(s *CompactionStatus) { s.ReclaimedBytes = reclaimed })
+	fmt.Printf("[INFO] Compacted %d collections, reclaimed %d bytes\n", len(names), reclaimed)
+	return nil
+}
+
+// foldTombstones raises the floor to floor and drops the tombstones
+// compaction folded into it, unless they changed meanwhile.
+func (c *Collection) foldTombstones(folded map[string]tombstone, floor tombstone) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.floor = c.floor.cover(floor)
+	for id, t := range folded {
+		if c.tombstones[id] == t {
+			delete(c.tombstones, id)
+		}
+	}
+}
+
+// compactionCandidates returns the collections with more than threshold
+// bytes of garbage. The caller must hold saveMu.
+func (e *Engine) compactionCandidates(threshold int64) []string {
+	var names []string
+	for name, store := range e.stores {
+		if g := store.garbage(); g > 0 && g >= threshold {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compact copies the live records into new segments numbered after the
+// existing ones and writes a new index log for them. The old files are only
+// queued in obsolete: they stay valid until a manifest naming the new
+// index log is written. progress is called with the bytes copied; stop
+// aborts the copy, leaving the store unchanged.
+func (s *segmentStore) compact(segmentSize int64, progress func(int64), stop func() bool) error {
+	ids := make([]string, 0, len(s.locations))
+	for id := range s.locations {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.locations[ids[i]], s.locations[ids[j]]
+		if a.Segment != b.Segment {
+			return a.Segment < b.Segment
+		}
+		return a.Offset < b.Offset
+	})
+
+	next := &segmentStore{
+		dir:       s.dir,
+		name:      s.name,
+		locations: make(map[string]segmentLocation, len(s.locations)),
+		active:    s.active + 1,
+		index:     fmt.Sprintf("%s-%06d", segmentIndexFile, s.active+1),
+	}
+	var created []string
+	fail := func(err error) error {
+		for _, path := range created {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	var (
+		out      *os.File
+		size     int64
+		in       *os.File
+		inSeg    uint32
+		records  []indexRecord
+		inflight int64
+	)
+	closeIn := func() {
+		if in != nil {
+			in.Close()
+			in = nil
+		}
+	}
+	for i, id := range ids {
+		if i%1024 == 0 && stop() {
+			closeIn()
+			if out != nil {
+				out.Close()
+			}
+			return fail(ErrEngineClosed)
+		}
+		loc := s.locations[id]
+		if in == nil || inSeg != loc.Segment {
+			closeIn()
+			f, err := os.Open(filepath.Join(s.dir, segmentFileName(loc.Segment)))
+			if err != nil {
+				return fail(err)
+			}
+			in, inSeg = f, loc.Segment
+		}
+		frame := make([]byte, loc.Length)
+		if _, err := in.ReadAt(frame, loc.Offset); err != nil {
+			closeIn()
+			return fail(err)
+		}
+		if _, _, reason := readFrame(frame, 0); reason != "" {
+			closeIn()
+			return fail(segmentCorruption(in.Name(), loc.Offset, reason))
+		}
+
+		if out == nil || (size > int64(len(segmentMagic)) && size+loc.Length > segmentSize) {
+			if out != nil {
+				if err := syncAndClose(out); err != nil {
+					closeIn()
+					return fail(err)
+				}
+				next.active++
+			}
+			f, n, err := next.openActive()
+			if err != nil {
+				closeIn()
+				return fail(err)
+			}
+			out, size = f, n
+			created = append(created, f.Name())
+		}
+		if _, err := out.Write(frame); err != nil {
+			closeIn()
+			out.Close()
+			return fail(err)
+		}
+		records = append(records, indexRecord{ID: id, Segment: next.active, Offset: size, Length: loc.Length})
+		size += loc.Length
+		next.diskBytes += loc.Length
+
+		if inflight += loc.Length; inflight >= 1<<20 {
+			progress(inflight)
+			inflight = 0
+		}
+	}
+	closeIn()
+	if out != nil {
+		if err := syncAndClose(out); err != nil {
+			return fail(err)
+		}
+	}
+	progress(inflight)
+
+	created = append(created, filepath.Join(s.dir, next.index))
+	if floor := s.floorRecord(); floor.Floor > 0 || floor.HLC != "" {
+		records = append(records, floor)
+	}
+	if err := next.appendIndex(records); err != nil {
+		return fail(err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return fail(err)
+	}
+	for _, rec := range records {
+		next.apply(rec)
+	}
+
+	// Everything else in the directory, including leftovers of interrupted
+	// checkpoints and compactions, is replaced.
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fail(err)
+	}
+	keep := make(map[string]bool, len(created))
+	for _, path := range created {
+		keep[filepath.Base(path)] = true
+	}
+	next.obsolete = s.obsolete
+	for _, entry := range entries {
+		if !keep[entry.Name()] {
+			next.obsolete = append(next.obsolete, filepath.Join(s.dir, entry.Name()))
+		}
+	}
+	*s = *next
+	return nil
+}
+
+// removeObsolete deletes the files compaction replaced. The caller must
+// have written a manifest that no longer refers to them.
+func (s *segmentStore) removeObsolete() {
+	for _, path := range s.obsolete {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("[WARN] Failed to remove %s: %v\n", path, err)
+		}
+	}
+	s.obsolete = nil
+}
@@ -1,65 +1,184 @@
 package storage
 
 import (
-        "crypto/sha256"
         "encoding/json"
+        "errors"
         "fmt"
         "os"
         "path/filepath"
         "sync"
+        "sync/atomic"
         "time"
+
+        "github.com/developer51709/helixdb/internal/indexing"
 )
 
+var ErrDocumentNotFound = errors.New("document not found")
+
 type Document struct {
         ID        string                 `json:"id"`
         Data      map[string]interface{} `json:"data"`
+        Version   uint64                 `json:"version"`
         CreatedAt time.Time              `json:"createdAt"`
         UpdatedAt time.Time              `json:"updatedAt"`
-        Checksum  string                 `json:"checksum"`
+        // HLC is the hybrid logical clock timestamp of the last write.
+        HLC      string `json:"hlc,omitempty"`
+        Checksum string `json:"checksum"`
 }
 
 type Collection struct {
         Name      string               `json:"name"`
         Documents map[string]*Document `json:"documents"`
-        mu        sync.RWMutex
+        indexes   map[string]*collectionIndex
+        // dirty holds the IDs of documents changed since the last checkpoint.
+        dirty map[string]struct{}
+        // tombstones holds the last version of deleted documents, so that a
+        // document created again under the same ID carries on from it. Once
+        // compaction drops them, floor stands in for them: new documents start
+        // above it.
+        tombstones map[string]tombstone
+        floor      tombstone
+        mu         sync.RWMutex
 }
 
 type Engine struct {
-        dataFile string
-        walDir   string
+        dataFile    string
+        walDir      string
         collections map[string]*Collection
         mu          sync.RWMutex
         wal         *WAL
+        segmentDir  string
+        segmentSize int64
+        // stores and checkpointLSN are guarded by saveMu.
+        stores map[string]*segmentStore
+        saveMu sync.Mutex
+        // saves tracks the checkpoint loop, which checkpoints on requests sent
+        // to checkpoints until stop is closed.
+        saves       sync.WaitGroup
+        checkpoints chan struct{}
+        stop        chan struct{}
+
+        builds  sync.WaitGroup
+        closing atomic.Bool
+        // checkpointLSN is the LSN of the last WAL record reflected in the
+        // data file.
+        checkpointLSN uint64
+        recovery      RecoveryReport
+
+        autoCompact      bool
+        compactThreshold int64
+        compaction       compactionState
+
+        verifyChecksums bool
+        // corrupt collects the documents that failed verification while
+        // loading.
+        corrupt []CorruptDocument
+
+        lock *DirLock
+        // changes feeds the open change streams.
+        changes *changeFeed
+        // clock stamps every document write.
+        clock hlcClock
+}
+
+type Options struct {
+        WAL WALOptions
+        // SegmentSize is the size in bytes at which a collection's segment
+        // file is rotated. Zero means DefaultSegmentSize.
+        SegmentSize int64
+        // VerifyChecksums recomputes the checksum of every document on load.
+        // Documents that fail, or whose records are damaged, are copied to
+        // _corrupt next to the data file. With AutoRecover they are then
+        // restored from the WAL (including archived segments) or from
+        // RepairSources; without it the engine refuses to open.
+        VerifyChecksums bool
+        AutoRecover     bool
+        RepairSources   []RepairSource
+        // AutoCompact compacts a collection in the background once it holds
+        // more than CompactThreshold bytes of deleted and superseded documents.
+        // Zero means DefaultCompactThreshold.
+        AutoCompact      bool
+        CompactThreshold int64
 }
 
 func NewEngine(dataFile, walDir string) (*Engine, error) {
+        return NewEngineWithOptions(dataFile, walDir, Options{})
+}
+
+func NewEngineWithOptions(dataFile, walDir string, opts Options) (*Engine, error) {
         if err := os.MkdirAll(filepath.Dir(dataFile), 0755); err != nil {
                 return nil, fmt.Errorf("creating data directory: %w", err)
         }
         if err := os.MkdirAll(walDir, 0755); err != nil {
                 return nil, fmt.Errorf("creating WAL directory: %w", err)
         }
+        lock, err := LockDataDir(dataFile)
+        if err != nil {
+                return nil, err
+        }
 
+        if opts.SegmentSize <= 0 {
+                opts.SegmentSize = DefaultSegmentSize
+        }
+        if opts.CompactThreshold <= 0 {
+                opts.CompactThreshold = DefaultCompactThreshold
+        }
         e := &Engine{
-                dataFile:    dataFile,
-                walDir:      walDir,
-                collections: make(map[string]*Collection),
+                dataFile:         dataFile,
+                walDir:           walDir,
+                collections:      make(map[string]*Collection),
+                segmentDir:       filepath.Join(filepath.Dir(dataFile), segmentsDirName),
+                segmentSize:      opts.SegmentSize,
+                verifyChecksums:  opts.VerifyChecksums,
+                autoCompact:      opts.AutoCompact,
+                compactThreshold: opts.CompactThreshold,
+                stores:           make(map[string]*segmentStore),
+                checkpoints:      make(chan struct{}, 1),
+                stop:             make(chan struct{}),
+                lock:             lock,
         }
 
-        wal, err := NewWAL(walDir)
+        wal, err := NewWAL(walDir, opts.WAL)
         if err != nil {
+                lock.Unlock()
                 return nil, fmt.Errorf("initializing WAL: %w", err)
         }
         e.wal = wal
 
         if err := e.loadFromDisk(); err != nil {
-                fmt.Printf("[INFO] No existing data file found, starting fresh\n")
+                wal.Close()
+                lock.Unlock()
+                return nil, fmt.Errorf("loading data: %w", err)
+        }
+        quarantineDir, err := e.handleCorruption(opts)
+        if err != nil {
+                wal.Close()
+                lock.Unlock()
+                return nil, err
         }
 
-        if err := e.recover(); err != nil {
-                fmt.Printf("[WARN] Recovery encountered issues: %v\n", err)
+        report, err := e.recover()
+        if err != nil {
+                wal.Close()
+                lock.Unlock()
+                return nil, fmt.Errorf("recovering from WAL: %w", err)
+        }
+        report.Corrupt, report.QuarantineDir = e.corrupt, quarantineDir
+        e.corrupt = nil
+        e.recovery = report
+        if report.TornTail != nil {
+                fmt.Printf("[WARN] Truncated torn WAL record at %s offset %d (%d bytes: %s)\n",
+                        report.TornTail.Segment, report.TornTail.Offset, report.TornTail.Bytes, report.TornTail.Reason)
         }
 
+        e.observeDocuments()
+        e.changes = newChangeFeed(wal.LastLSN())
+        wal.onAppend = e.changes.publish
+
+        e.startIndexBuilds()
+        e.saves.Add(1)
+        go e.checkpointLoop()
+
         return e, nil
 }
 
@@ -95,38 +214,275 @@ func (e *Engine) ListCollections() []string {
 }
 
 func (e *Engine) InsertDocument(collection string, id string, data map[string]interface{}) (*Document, error) {
+        return e.InsertDocumentIf(collection, id, data, Precondition{})
+}
+
+func (e *Engine) InsertDocumentIf(collection string, id string, data map[string]interface{}, cond Precondition) (*Document, error) {
+        col := e.GetCollection(collection)
+
+        var doc *Document
+        err := e.write(col, func() (lsn uint64, err error) {
+                existing := col.Documents[id]
+                if err := cond.Check(existing); err != nil {
+                        return 0, err
+                }
+                doc, lsn, err = e.insertLocked(col, id, data, HLC{})
+                return lsn, err
+        })
+        return doc, err
+}
+
+func (e *Engine) UpdateDocument(collection, id string, data map[string]interface{}) (*Document, error) {
+        col := e.GetCollection(collection)
+
+        var doc *Document
+        err := e.write(col, func() (lsn uint64, err error) {
+                existing, exists := col.Documents[id]
+                if !exists {
+                        return 0, ErrDocumentNotFound
+                }
+                doc, lsn, err = e.updateLocked(col, existing, data, HLC{})
+                return lsn, err
+        })
+        return doc, err
+}
+
+func (e *Engine) UpsertDocument(collection, id string, data map[string]interface{}) (*Document, bool, error) {
+        return e.UpsertDocumentIf(collection, id, data, Precondition{})
+}
+
+func (e *Engine) UpsertDocumentIf(collection, id string, data map[string]interface{}, cond Precondition) (*Document, bool, error) {
+        return e.upsert(collection, id, data, cond, HLC{})
+}
+
+// PutDocumentAt is UpsertDocumentIf for a write made elsewhere at hlc, such
+// as on an offline client. The document keeps hlc as its timestamp, and the
+// engine's clock moves past it.
+func (e *Engine) PutDocumentAt(collection, id string, data map[string]interface{}, hlc HLC, cond Precondition) (*Document, bool, error) {
+        e.clock.observe(hlc)
+        return e.upsert(collection, id, data, cond, hlc)
+}
+
+func (e *Engine) upsert(collection, id string, data map[string]interface{}, cond Precondition, hlc HLC) (*Document, bool, error) {
         col := e.GetCollection(collection)
 
+        var doc *Document
+        var created bool
+        err := e.write(col, func() (lsn uint64, err error) {
+                existing, exists := col.Documents[id]
+                if err := cond.Check(existing); err != nil {
+                        return 0, err
+                }
+                if exists {
+                        doc, lsn, err = e.updateLocked(col, existing, data, hlc)
+                        return lsn, err
+                }
+                created = true
+                doc, lsn, err = e.insertLocked(col, id, data, hlc)
+                return lsn, err
+        })
+        return doc, created, err
+}
+
+func (e *Engine) PatchDocument(collection, id string, patch Patch) (*Document, error) {
+        return e.PatchDocumentIf(collection, id, patch, Precondition{})
+}
+
+func (e *Engine) PatchDocumentIf(collection, id string, patch Patch, cond Precondition) (*Document, error) {
+        col := e.GetCollection(collection)
+
+        var doc *Document
+        err := e.write(col, func() (lsn uint64, err error) {
+                existing, exists := col.Documents[id]
+                if !exists {
+                        return 0, ErrDocumentNotFound
+                }
+                if err := cond.Check(existing); err != nil {
+                        return 0, err
+                }
+                data, err := patch.Apply(existing.Data)
+                if err != nil {
+                        return 0, err
+                }
+                doc, lsn, err = e.updateLocked(col, existing, data, HLC{})
+                return lsn, err
+        })
+        return doc, err
+}
+
+// CompareAndSwap replaces the document only if its current version equals
+// version. A version of 0 means the document must not exist yet.
+func (e *Engine) CompareAndSwap(collection, id string, version uint64, data map[string]interface{}) (*Document, error) {
+        cond := Precondition{IfMatch: []uint64{version}}
+        if version == 0 {
+                cond = Precondition{IfNoneMatchAny: true}
+        }
+        doc, _, err := e.UpsertDocumentIf(collection, id, data, cond)
+        return doc, err
+}
+
+// CompareAndDelete deletes the document only if its current version equals
+// version.
+func (e *Engine) CompareAndDelete(collection, id string, version uint64) error {
+        return e.DeleteDocumentIf(collection, id, Precondition{IfMatch: []uint64{version}})
+}
+
+// write runs fn, which logs and applies a change, under the collection's
+// lock, then waits for the logged record to become durable. The lock is
+// released first so that writers queued behind it can share the flush; in
+// the meantime readers may already see the change. If the flush fails, the
+// engine fails with it, and stops serving the change along with the rest.
+func (e *Engine) write(col *Collection, fn func() (uint64, error)) error {
+        col.mu.Lock()
+        lsn, err := fn()
+        col.mu.Unlock()
+        if err != nil {
+                return err
+        }
+        return e.wal.Sync(lsn)
+}
+
+// insertLocked and updateLocked stamp the document with hlc, or with a new
+// timestamp if it is zero.
+func (e *Engine) insertLocked(col *Collection, id string, data map[string]interface{}, hlc HLC) (*Document, uint64, error) {
+        if err := col.checkUnique(id, data); err != nil {
+                return nil, 0, err
+        }
+
+        version := col.lastVersion(id) + 1
+
+        if hlc.IsZero() {
+                hlc = e.clock.now()
+        }
         now := time.Now().UTC()
         doc := &Document{
                 ID:        id,
                 Data:      data,
+                Version:   version,
                 CreatedAt: now,
                 UpdatedAt: now,
+                HLC:       hlc.String(),
         }
         doc.Checksum = computeChecksum(doc)
 
         entry := WALEntry{
                 Operation:  "INSERT",
-                Collection: collection,
+                Collection: col.Name,
                 DocumentID: id,
                 Data:       data,
+                Version:    version,
+                HLC:        doc.HLC,
                 Timestamp:  now,
         }
-        if err := e.wal.Write(entry); err != nil {
-                return nil, fmt.Errorf("writing WAL: %w", err)
+        lsn, err := e.wal.Append(entry)
+        if err != nil {
+                return nil, 0, fmt.Errorf("writing WAL: %w", err)
         }
 
-        col.mu.Lock()
-        col.Documents[id] = doc
-        col.mu.Unlock()
+        col.put(doc)
+
+        e.scheduleSave()
+
+        return doc, lsn, nil
+}
+
+// ImportDocument creates doc as it is, keeping its version, timestamps and
+// HLC, as when a document moves from another shard. The version is raised
+// past that of a document deleted earlier under the same ID, if any. It
+// fails with ErrPreconditionFailed if the document exists.
+func (e *Engine) ImportDocument(collection string, doc *Document) (*Document, error) {
+        if h, err := ParseHLC(doc.HLC); err == nil {
+                e.clock.observe(h)
+        }
+        col := e.GetCollection(collection)
+
+        var imported *Document
+        err := e.write(col, func() (uint64, error) {
+                if err := (Precondition{IfNoneMatchAny: true}).Check(col.Documents[doc.ID]); err != nil {
+                        return 0, err
+                }
+                if err := col.checkUnique(doc.ID, doc.Data); err != nil {
+                        return 0, err
+                }
+                imported = &Document{
+                        ID:        doc.ID,
+                        Data:      doc.Data,
+                        Version:   max(doc.Version, col.lastVersion(doc.ID)+1),
+                        CreatedAt: doc.CreatedAt.UTC(),
+                        UpdatedAt: doc.UpdatedAt.UTC(),
+                        HLC:       doc.HLC,
+                }
+                imported.Checksum = computeChecksum(imported)
+
+                lsn, err := e.wal.Append(WALEntry{
+                        Operation:  "INSERT",
+                        Collection: col.Name,
+                        DocumentID: doc.ID,
+                        Data:       doc.Data,
+                        Version:    imported.Version,
+                        HLC:        doc.HLC,
+                        Timestamp:  time.Now().UTC(),
+                        CreatedAt:  imported.CreatedAt,
+                        UpdatedAt:  imported.UpdatedAt,
+                })
+                if err != nil {
+                        return 0, fmt.Errorf("writing WAL: %w", err)
+                }
+                col.put(imported)
+                e.scheduleSave()
+                return lsn, nil
+        })
+        return imported, err
+}
+
+// updateLocked replaces existing with a new document carrying data. Stored
+// documents are never mutated in place, so readers holding the old pointer
+// keep seeing a consistent snapshot.
+func (e *Engine) updateLocked(col *Collection, existing *Document, data map[string]interface{}, hlc HLC) (*Document, uint64, error) {
+        if err := col.checkUnique(existing.ID, data); err != nil {
+                return nil, 0, err
+        }
+
+        if hlc.IsZero() {
+                hlc = e.clock.now()
+        }
+        now := time.Now().UTC()
+        doc := &Document{
+                ID:        existing.ID,
+                Data:      data,
+                Version:   existing.Version + 1,
+                CreatedAt: existing.CreatedAt,
+                UpdatedAt: now,
+                HLC:       hlc.String(),
+        }
+        doc.Checksum = computeChecksum(doc)
+
+        entry := WALEntry{
+                Operation:  "UPDATE",
+                Collection: col.Name,
+                DocumentID: existing.ID,
+                Data:       data,
+                Version:    doc.Version,
+                HLC:        doc.HLC,
+                Timestamp:  now,
+        }
+        lsn, err := e.wal.Append(entry)
+        if err != nil {
+                return nil, 0, fmt.Errorf("writing WAL: %w", err)
+        }
 
-        go func() { _ = e.saveToDisk() }()
+        col.put(doc)
 
-        return doc, nil
+        e.scheduleSave()
+
+        return doc, lsn, nil
 }
 
+// GetDocument finds nothing once the engine has failed; see Err.
 func (e *Engine) GetDocument(collection, id string) (*Document, bool) {
+        if e.Err() != nil {
+                return nil, false
+        }
         col := e.GetCollection(collection)
         col.mu.RLock()
         defer col.mu.RUnlock()
@@ -135,152 +491,351 @@ func (e *Engine) GetDocument(collection, id string) (*Document, bool) {
 }
 
 func (e *Engine) DeleteDocument(collection, id string) bool {
-        col := e.GetCollection(collection)
+        return e.DeleteDocumentIf(collection, id, Precondition{}) == nil
+}
 
-        col.mu.Lock()
-        _, exists := col.Documents[id]
-        if exists {
-                delete(col.Documents, id)
+func (e *Engine) DeleteDocumentIf(collection, id string, cond Precondition) error {
+        return e.deleteDocument(collection, id, cond, HLC{})
+}
+
+// DeleteDocumentAt is DeleteDocumentIf for a delete made elsewhere at hlc.
+func (e *Engine) DeleteDocumentAt(collection, id string, hlc HLC, cond Precondition) error {
+        e.clock.observe(hlc)
+        return e.deleteDocument(collection, id, cond, hlc)
+}
+
+// DeletedAt returns the timestamp of the delete of a document that no longer
+// exists. Once compaction has folded its tombstone away, that of the latest
+// delete folded is returned instead. It returns false if the collection
+// knows of no such delete.
+func (e *Engine) DeletedAt(collection, id string) (HLC, bool) {
+        if e.Err() != nil {
+                return HLC{}, false
         }
-        col.mu.Unlock()
+        col := e.GetCollection(collection)
+        col.mu.RLock()
+        defer col.mu.RUnlock()
+        if _, exists := col.Documents[id]; exists {
+                return HLC{}, false
+        }
+        hlc := col.floor.HLC
+        if t, deleted := col.tombstones[id]; deleted {
+                hlc = t.HLC
+        }
+        h, err := ParseHLC(hlc)
+        return h, err == nil && !h.IsZero()
+}
 
-        if exists {
+func (e *Engine) deleteDocument(collection, id string, cond Precondition, hlc HLC) error {
+        col := e.GetCollection(collection)
+
+        return e.write(col, func() (uint64, error) {
+                existing, exists := col.Documents[id]
+                if !exists {
+                        return 0, ErrDocumentNotFound
+                }
+                if err := cond.Check(existing); err != nil {
+                        return 0, err
+                }
+
+                if hlc.IsZero() {
+                        hlc = e.clock.now()
+                }
                 entry := WALEntry{
                         Operation:  "DELETE",
                         Collection: collection,
                         DocumentID: id,
+                        Version:    existing.Version,
+                        HLC:        hlc.String(),
                         Timestamp:  time.Now().UTC(),
                 }
-                _ = e.wal.Write(entry)
-                go func() { _ = e.saveToDisk() }()
-        }
+                lsn, err := e.wal.Append(entry)
+                if err != nil {
+                        return 0, fmt.Errorf("writing WAL: %w", err)
+                }
+
+                col.remove(id, entry.HLC)
+
+                e.scheduleSave()
 
-        return exists
+                return lsn, nil
+        })
 }
 
-func (e *Engine) QueryDocuments(collection string, filter map[string]interface{}, limit int) []*Document {
-        col := e.GetCollection(collection)
-        col.mu.RLock()
-        defer col.mu.RUnlock()
+func (e *Engine) QueryDocuments(collection string, filter map[string]interface{}, limit int) ([]*Document, error) {
+        result, err := e.Query(collection, QueryOptions{Filter: filter, Limit: limit})
+        if err != nil {
+                return nil, err
+        }
+        return result.Documents, nil
+}
 
-        var results []*Document
-        for _, doc := range col.Documents {
-                if matchesFilter(doc.Data, filter) {
-                        results = append(results, doc)
-                        if limit > 0 && len(results) >= limit {
-                                break
-                        }
-                }
+// ExplainQuery runs a query and reports the plan it used and what it cost,
+// without returning the documents.
+func (e *Engine) ExplainQuery(collection string, opts QueryOptions) (*QueryExplain, error) {
+        opts.Explain = true
+        result, err := e.Query(collection, opts)
+        if err != nil {
+                return nil, err
         }
-        return results
+        return result.Explain, nil
 }
 
-func matchesFilter(data map[string]interface{}, filter map[string]interface{}) bool {
-        if len(filter) == 0 {
-                return true
+// legacyData is the single JSON snapshot older versions kept in the data
+// file. It is loaded once and rewritten as segments at the first checkpoint.
+type legacyData struct {
+        Collections map[string]map[string]*Document  `json:"collections"`
+        Indexes     map[string][]indexing.Definition `json:"indexes,omitempty"`
+        LastLSN     uint64                           `json:"lastLSN"`
+}
+
+// minCheckpointInterval spaces out checkpoints so that each one persists
+// a batch of writes.
+const minCheckpointInterval = 200 * time.Millisecond
+
+// scheduleSave asks the checkpoint loop for a checkpoint. Requests made
+// while one is pending are folded into it.
+func (e *Engine) scheduleSave() {
+        select {
+        case e.checkpoints <- struct{}{}:
+        default:
         }
-        for key, val := range filter {
-                docVal, exists := data[key]
-                if !exists {
-                        return false
+}
+
+func (e *Engine) checkpointLoop() {
+        defer e.saves.Done()
+        for {
+                select {
+                case <-e.stop:
+                        return
+                case <-e.checkpoints:
                 }
-                if fmt.Sprintf("%v", docVal) != fmt.Sprintf("%v", val) {
-                        return false
+                if err := e.checkpoint(); err != nil {
+                        fmt.Printf("[WARN] Checkpoint failed: %v\n", err)
+                }
+                e.maybeCompact()
+                select {
+                case <-e.stop:
+                        return
+                case <-time.After(minCheckpointInterval):
                 }
         }
-        return true
 }
 
-func computeChecksum(doc *Document) string {
-        data, _ := json.Marshal(doc.Data)
-        h := sha256.Sum256(data)
-        return fmt.Sprintf("%x", h[:8])
+// checkpoint writes the documents changed since the last checkpoint to
+// their collections' segments, commits them with a new manifest and drops
+// the WAL records it covers.
+func (e *Engine) checkpoint() error {
+        e.saveMu.Lock()
+        defer e.saveMu.Unlock()
+        return e.checkpointLocked()
 }
 
-type diskData struct {
-        Collections map[string]map[string]*Document `json:"collections"`
+func (e *Engine) checkpointLocked() error {
+        // Every record up to lsn is applied by the time the collection is
+        // locked below, since writers hold the collection lock from logging a
+        // record until it is applied. Later records may or may not be
+        // included; replaying them again is harmless.
+        return e.checkpointThrough(e.wal.LastLSN())
 }
 
-func (e *Engine) saveToDisk() error {
+// checkpointThrough writes the dirty documents and a manifest recording
+// that the segments hold every record up to lsn, then truncates the WAL.
+func (e *Engine) checkpointThrough(lsn uint64) error {
+        if err := e.Err(); err != nil {
+                return err
+        }
         e.mu.RLock()
-        dd := diskData{Collections: make(map[string]map[string]*Document)}
-        for name, col := range e.collections {
-                col.mu.RLock()
-                docs := make(map[string]*Document)
-                for id, doc := range col.Documents {
-                        docs[id] = doc
-                }
-                col.mu.RUnlock()
-                dd.Collections[name] = docs
+        cols := make([]*Collection, 0, len(e.collections))
+        for _, col := range e.collections {
+                cols = append(cols, col)
         }
         e.mu.RUnlock()
 
-        data, err := json.MarshalIndent(dd, "", "  ")
-        if err != nil {
-                return err
+        m := manifest{
+                Format:      manifestFormat,
+                LastLSN:     lsn,
+                Collections: make(map[string]manifestCollection, len(cols)),
+        }
+        for _, col := range cols {
+                col.mu.Lock()
+                changes := make(map[string]*Document, len(col.dirty))
+                tombstones := make(map[string]tombstone)
+                for id := range col.dirty {
+                        changes[id] = col.Documents[id]
+                        if t, deleted := col.tombstones[id]; deleted {
+                                tombstones[id] = t
+                        }
+                }
+                col.dirty = nil
+                floor, defs := col.floor, col.indexDefinitions()
+                col.mu.Unlock()
+
+                store, err := e.store(col.Name)
+                if err == nil {
+                        err = store.write(changes, tombstones, floor, e.segmentSize)
+                }
+                if err != nil {
+                        col.mu.Lock()
+                        for id := range changes {
+                                col.markDirty(id)
+                        }
+                        col.mu.Unlock()
+                        return fmt.Errorf("checkpointing %s: %w", col.Name, err)
+                }
+                m.Collections[col.Name] = manifestCollection{Dir: store.name, Index: store.index, IndexSize: store.indexSize, Indexes: defs}
         }
 
-        tmpFile := e.dataFile + ".tmp"
-        if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+        if err := writeManifest(e.dataFile, m); err != nil {
                 return err
         }
-        return os.Rename(tmpFile, e.dataFile)
+        for _, store := range e.stores {
+                store.removeObsolete()
+        }
+        e.checkpointLSN = lsn
+        return e.wal.Truncate(lsn)
+}
+
+// store returns the segment store of a collection, creating it on first
+// use. The caller must hold saveMu.
+func (e *Engine) store(name string) (*segmentStore, error) {
+        if s, exists := e.stores[name]; exists {
+                return s, nil
+        }
+        s, err := newSegmentStore(e.segmentDir, collectionDirName(name))
+        if err != nil {
+                return nil, err
+        }
+        e.stores[name] = s
+        return s, nil
 }
 
 func (e *Engine) loadFromDisk() error {
         data, err := os.ReadFile(e.dataFile)
+        if os.IsNotExist(err) {
+                fmt.Printf("[INFO] No existing data file found, starting fresh\n")
+                return nil
+        }
         if err != nil {
                 return err
         }
 
-        var dd diskData
-        if err := json.Unmarshal(data, &dd); err != nil {
+        var m manifest
+        if err := json.Unmarshal(data, &struct {
+                Format *int `json:"format"`
+        }{&m.Format}); err != nil {
+                return err
+        }
+        if m.Format != manifestFormat {
+                return e.loadLegacy(data)
+        }
+        if err := json.Unmarshal(data, &m); err != nil {
                 return err
         }
 
         e.mu.Lock()
         defer e.mu.Unlock()
-        for name, docs := range dd.Collections {
-                col := &Collection{
-                        Name:      name,
-                        Documents: docs,
+        e.checkpointLSN = m.LastLSN
+        for name, mc := range m.Collections {
+                store, docs, corrupt, err := openSegmentStore(e.segmentDir, mc)
+                if err != nil {
+                        return fmt.Errorf("loading collection %s: %w", name, err)
+                }
+                for i := range corrupt {
+                        corrupt[i].Collection = name
                 }
+                if e.verifyChecksums {
+                        corrupt = append(corrupt, verifyChecksums(name, docs)...)
+                }
+                e.corrupt = append(e.corrupt, corrupt...)
+                e.stores[name] = store
+                col := &Collection{Name: name, Documents: docs, tombstones: store.copyTombstones(), floor: store.floor}
                 e.collections[name] = col
+                e.registerIndexes(col, mc.Indexes)
         }
         return nil
 }
 
-func (e *Engine) recover() error {
-        entries, err := e.wal.ReadAll()
-        if err != nil {
+func (e *Engine) loadLegacy(data []byte) error {
+        var dd legacyData
+        if err := json.Unmarshal(data, &dd); err != nil {
                 return err
         }
-        if len(entries) == 0 {
-                return nil
-        }
+        fmt.Printf("[INFO] Converting data file to segment storage\n")
 
-        fmt.Printf("[INFO] Replaying %d WAL entries\n", len(entries))
-        for _, entry := range entries {
-                col := e.GetCollection(entry.Collection)
-                switch entry.Operation {
-                case "INSERT":
-                        doc := &Document{
-                                ID:        entry.DocumentID,
-                                Data:      entry.Data,
-                                CreatedAt: entry.Timestamp,
-                                UpdatedAt: entry.Timestamp,
+        e.mu.Lock()
+        defer e.mu.Unlock()
+        e.checkpointLSN = dd.LastLSN
+        for name, docs := range dd.Collections {
+                if e.verifyChecksums {
+                        e.corrupt = append(e.corrupt, verifyChecksums(name, docs)...)
+                }
+                col := &Collection{Name: name, Documents: docs}
+                for id, doc := range docs {
+                        if doc.Version == 0 {
+                                doc.Version = 1
                         }
-                        doc.Checksum = computeChecksum(doc)
-                        col.Documents[entry.DocumentID] = doc
-                case "DELETE":
-                        delete(col.Documents, entry.DocumentID)
+                        col.markDirty(id)
+                }
+                e.collections[name] = col
+        }
+        for name, defs := range dd.Indexes {
+                col, exists := e.collections[name]
+                if !exists {
+                        col = &Collection{Name: name, Documents: make(map[string]*Document)}
+                        e.collections[name] = col
+                }
+                e.registerIndexes(col, defs)
+        }
+        return nil
+}
+
+func (e *Engine) registerIndexes(col *Collection, defs []indexing.Definition) {
+        for _, def := range defs {
+                idx, err := indexing.New(def)
+                if err != nil {
+                        fmt.Printf("[WARN] Skipping index %s on %s: %v\n", def.Name, col.Name, err)
+                        continue
                 }
+                col.registerIndex(idx)
+        }
+}
+
+// Err reports why the engine failed, if it did: a WAL record could not be
+// written or made durable. Changes applied in memory may then be missing
+// from disk, so until the engine is reopened, which replays what the WAL
+// does hold, it refuses reads as well as writes and stops checkpointing.
+func (e *Engine) Err() error {
+        if err := e.wal.Err(); err != nil {
+                return fmt.Errorf("%w: %v", ErrEngineFailed, err)
         }
         return nil
 }
 
+// LastLSN returns the LSN of the last record written to the WAL.
+func (e *Engine) LastLSN() uint64 {
+        return e.wal.LastLSN()
+}
+
+// HoldWAL keeps the WAL records after lsn from being truncated by
+// checkpoints, for a reader such as incremental backups that has not
+// consumed them yet. Each name has one hold; ReleaseWAL drops it.
+func (e *Engine) HoldWAL(name string, lsn uint64) {
+        e.wal.Hold(name, lsn)
+}
+
+func (e *Engine) ReleaseWAL(name string) {
+        e.wal.Release(name)
+}
+
 func (e *Engine) Close() error {
-        if err := e.saveToDisk(); err != nil {
+        defer e.lock.Unlock()
+        e.closing.Store(true)
+        e.changes.close()
+        e.builds.Wait()
+        close(e.stop)
+        e.saves.Wait()
+        if err := e.checkpoint(); err != nil {
                 return err
         }
         return e.wal.Close()
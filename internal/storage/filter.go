@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter is a compiled query filter. The filter language follows MongoDB's:
+// field conditions are keyed by dot-notation paths and are either a literal
+// (implicit $eq) or an object of operators, combined with $and, $or and $not.
+type Filter struct {
+	match func(data map[string]interface{}) bool
+}
+
+// valueMatcher is evaluated against every value a path resolves to.
+type valueMatcher func(values []interface{}) bool
+
+func CompileFilter(spec map[string]interface{}) (*Filter, error) {
+	match, err := compileFilter(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{match: match}, nil
+}
+
+// Match reports whether data satisfies the filter. A nil filter matches
+// everything.
+func (f *Filter) Match(data map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	return f.match(data)
+}
+
+func compileFilter(spec map[string]interface{}) (func(map[string]interface{}) bool, error) {
+	var clauses []func(map[string]interface{}) bool
+	for _, key := range sortedKeys(spec) {
+		cond := spec[key]
+		var clause func(map[string]interface{}) bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			clause, err = compileLogical(key, cond)
+		case "$not":
+			sub, ok := cond.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%w: $not expects an object", ErrInvalidFilter)
+			}
+			inner, err := compileFilter(sub)
+			if err != nil {
+				return nil, err
+			}
+			clause = func(data map[string]interface{}) bool { return !inner(data) }
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("%w: unknown top-level operator %s", ErrInvalidFilter, key)
+			}
+			clause, err = compileField(key, cond)
+		}
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, clause)
+	}
+
+	return func(data map[string]interface{}) bool {
+		for _, clause := range clauses {
+			if !clause(data) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileLogical(op string, cond interface{}) (func(map[string]interface{}) bool, error) {
+	list, ok := cond.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%w: %s expects a non-empty array", ErrInvalidFilter, op)
+	}
+
+	subs := make([]func(map[string]interface{}) bool, 0, len(list))
+	for i, item := range list {
+		spec, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: %s element %d must be an object", ErrInvalidFilter, op, i)
+		}
+		sub, err := compileFilter(spec)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	if op == "$and" {
+		return func(data map[string]interface{}) bool {
+			for _, sub := range subs {
+				if !sub(data) {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+	return func(data map[string]interface{}) bool {
+		for _, sub := range subs {
+			if sub(data) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileField(field string, cond interface{}) (func(map[string]interface{}) bool, error) {
+	if field == "" {
+		return nil, fmt.Errorf("%w: empty field name", ErrInvalidFilter)
+	}
+	path := strings.Split(field, ".")
+
+	match, err := compileCondition(cond)
+	if err != nil {
+		return nil, fmt.Errorf("field %q: %w", field, err)
+	}
+	return func(data map[string]interface{}) bool {
+		return match(lookupPath(data, path))
+	}, nil
+}
+
+// compileCondition compiles either an operator object or a literal value.
+func compileCondition(cond interface{}) (valueMatcher, error) {
+	if ops, ok := operatorObject(cond); ok {
+		return compileOperators(ops)
+	}
+	if obj, ok := cond.(map[string]interface{}); ok {
+		for key := range obj {
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("%w: cannot mix operators and fields", ErrInvalidFilter)
+			}
+		}
+	}
+	return eqMatcher(cond), nil
+}
+
+func operatorObject(cond interface{}) (map[string]interface{}, bool) {
+	obj, ok := cond.(map[string]interface{})
+	if !ok || len(obj) == 0 {
+		return nil, false
+	}
+	for key := range obj {
+		if !strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+	}
+	return obj, true
+}
+
+func compileOperators(ops map[string]interface{}) (valueMatcher, error) {
+	var matchers []valueMatcher
+	for _, op := range sortedKeys(ops) {
+		operand := ops[op]
+		var m valueMatcher
+		var err error
+		switch op {
+		case "$eq":
+			m = eqMatcher(operand)
+		case "$ne":
+			eq := eqMatcher(operand)
+			m = func(values []interface{}) bool { return !eq(values) }
+		case "$gt", "$gte", "$lt", "$lte":
+			m, err = rangeMatcher(op, operand)
+		case "$in", "$nin":
+			m, err = inMatcher(op, operand)
+		case "$exists":
+			want, ok := operand.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%w: $exists expects a boolean", ErrInvalidFilter)
+			}
+			m = func(values []interface{}) bool { return (len(values) > 0) == want }
+		case "$regex":
+			m, err = regexMatcher(operand, ops["$options"])
+		case "$options":
+			if _, ok := ops["$regex"]; !ok {
+				return nil, fmt.Errorf("%w: $options requires $regex", ErrInvalidFilter)
+			}
+			continue
+		case "$not":
+			inner, err := compileNot(operand)
+			if err != nil {
+				return nil, err
+			}
+			m = func(values []interface{}) bool { return !inner(values) }
+		case "$elemMatch":
+			m, err = elemMatchMatcher(operand)
+		default:
+			return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidFilter, op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return func(values []interface{}) bool {
+		for _, m := range matchers {
+			if !m(values) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileNot(operand interface{}) (valueMatcher, error) {
+	if ops, ok := operatorObject(operand); ok {
+		return compileOperators(ops)
+	}
+	if pattern, ok := operand.(string); ok {
+		return regexMatcher(pattern, nil)
+	}
+	return nil, fmt.Errorf("%w: $not expects an operator object or a regular expression", ErrInvalidFilter)
+}
+
+func eqMatcher(operand interface{}) valueMatcher {
+	return func(values []interface{}) bool {
+		if operand == nil && len(values) == 0 {
+			return true
+		}
+		return anyCandidate(values, func(v interface{}) bool { return indexing.Compare(v, operand) == 0 })
+	}
+}
+
+func rangeMatcher(op string, operand interface{}) (valueMatcher, error) {
+	switch operand.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, fmt.Errorf("%w: %s expects a scalar operand", ErrInvalidFilter, op)
+	}
+
+	accept := map[string]func(int) bool{
+		"$gt":  func(c int) bool { return c > 0 },
+		"$gte": func(c int) bool { return c >= 0 },
+		"$lt":  func(c int) bool { return c < 0 },
+		"$lte": func(c int) bool { return c <= 0 },
+	}[op]
+
+	return func(values []interface{}) bool {
+		return anyCandidate(values, func(v interface{}) bool {
+			// Range operators only compare values of the same type, so
+			// {"$gt": 5} never matches a string.
+			if indexing.TypeRank(v) != indexing.TypeRank(operand) {
+				return false
+			}
+			return accept(indexing.Compare(v, operand))
+		})
+	}, nil
+}
+
+func inMatcher(op string, operand interface{}) (valueMatcher, error) {
+	list, ok := operand.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s expects an array", ErrInvalidFilter, op)
+	}
+
+	matchers := make([]valueMatcher, 0, len(list))
+	for _, item := range list {
+		matchers = append(matchers, eqMatcher(item))
+	}
+	in := func(values []interface{}) bool {
+		for _, m := range matchers {
+			if m(values) {
+				return true
+			}
+		}
+		return false
+	}
+	if op == "$nin" {
+		return func(values []interface{}) bool { return !in(values) }, nil
+	}
+	return in, nil
+}
+
+func regexMatcher(operand, options interface{}) (valueMatcher, error) {
+	pattern, ok := operand.(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: $regex expects a string", ErrInvalidFilter)
+	}
+	if options != nil {
+		flags, ok := options.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: $options expects a string", ErrInvalidFilter)
+		}
+		for _, f := range flags {
+			if f != 'i' && f != 'm' && f != 's' {
+				return nil, fmt.Errorf("%w: unsupported regex option %q", ErrInvalidFilter, f)
+			}
+		}
+		if flags != "" {
+			pattern = "(?" + flags + ")" + pattern
+		}
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad regular expression: %v", ErrInvalidFilter, err)
+	}
+	return func(values []interface{}) bool {
+		return anyCandidate(values, func(v interface{}) bool {
+			s, ok := v.(string)
+			return ok && re.MatchString(s)
+		})
+	}, nil
+}
+
+func elemMatchMatcher(operand interface{}) (valueMatcher, error) {
+	spec, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: $elemMatch expects an object", ErrInvalidFilter)
+	}
+
+	var matchElem func(interface{}) bool
+	if ops, ok := operatorObject(spec); ok {
+		m, err := compileOperators(ops)
+		if err != nil {
+			return nil, err
+		}
+		matchElem = func(el interface{}) bool { return m([]interface{}{el}) }
+	} else {
+		f, err := compileFilter(spec)
+		if err != nil {
+			return nil, err
+		}
+		matchElem = func(el interface{}) bool {
+			obj, ok := el.(map[string]interface{})
+			return ok && f(obj)
+		}
+	}
+
+	return func(values []interface{}) bool {
+		for _, v := range values {
+			arr, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, el := range arr {
+				if matchElem(el) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// anyCandidate applies fn to each resolved value and, for array values, to
+// each of their elements, so {"tags": "go"} matches {"tags": ["go", "db"]}.
+func anyCandidate(values []interface{}, fn func(interface{}) bool) bool {
+	for _, v := range values {
+		if fn(v) {
+			return true
+		}
+		if arr, ok := v.([]interface{}); ok {
+			for _, el := range arr {
+				if fn(el) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// lookupPath resolves a dot-notation path. Numeric segments index into
+// arrays; any other segment applied to an array fans out over its elements.
+func lookupPath(value interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return lookupPath(child, path[1:])
+	case []interface{}:
+		if idx, err := strconv.Atoi(path[0]); err == nil && idx >= 0 {
+			if idx >= len(v) {
+				return nil
+			}
+			return lookupPath(v[idx], path[1:])
+		}
+		var out []interface{}
+		for _, el := range v {
+			if _, ok := el.(map[string]interface{}); ok {
+				out = append(out, lookupPath(el, path)...)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
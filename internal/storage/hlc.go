@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHLC = errors.New("invalid hybrid logical clock timestamp")
+
+// maxLogical is the largest counter an HLC can carry; the clock moves on to
+// the next millisecond instead of going past it.
+const maxLogical = 99999
+
+// serverNode names the engine's own clock in the timestamps it issues.
+const serverNode = "server"
+
+// HLC is a hybrid logical clock timestamp: wall-clock milliseconds, a
+// counter ordering events within the same millisecond, and the node that
+// issued it, which breaks ties. Its string form sorts in timestamp order.
+type HLC struct {
+	Wall    int64
+	Logical uint32
+	Node    string
+}
+
+func (h HLC) IsZero() bool {
+	return h.Wall == 0 && h.Logical == 0 && h.Node == ""
+}
+
+func (h HLC) String() string {
+	if h.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%015d-%05d-%s", h.Wall, h.Logical, h.Node)
+}
+
+func (h HLC) Compare(o HLC) int {
+	switch {
+	case h.Wall != o.Wall:
+		return cmpInt(h.Wall, o.Wall)
+	case h.Logical != o.Logical:
+		return cmpInt(int64(h.Logical), int64(o.Logical))
+	}
+	return strings.Compare(h.Node, o.Node)
+}
+
+func cmpInt(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// ParseHLC reads the string form of an HLC. The empty string is the zero
+// HLC.
+func ParseHLC(s string) (HLC, error) {
+	if s == "" {
+		return HLC{}, nil
+	}
+	parts := strings.SplitN(s, "-", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return HLC{}, fmt.Errorf("%w: %q", ErrInvalidHLC, s)
+	}
+	wall, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || wall < 0 {
+		return HLC{}, fmt.Errorf("%w: %q", ErrInvalidHLC, s)
+	}
+	logical, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || logical > maxLogical {
+		return HLC{}, fmt.Errorf("%w: %q", ErrInvalidHLC, s)
+	}
+	return HLC{Wall: wall, Logical: uint32(logical), Node: parts[2]}, nil
+}
+
+// DocumentHLC returns the timestamp of the write that produced doc. Documents
+// written before timestamps were recorded get one from their update time.
+func DocumentHLC(doc *Document) HLC {
+	if h, err := ParseHLC(doc.HLC); err == nil && !h.IsZero() {
+		return h
+	}
+	return HLC{Wall: doc.UpdatedAt.UnixMilli(), Node: serverNode}
+}
+
+// hlcClock issues the timestamps of the engine's writes. It never goes
+// backwards, and never behind a timestamp it has observed.
+type hlcClock struct {
+	mu   sync.Mutex
+	last HLC
+}
+
+func (c *hlcClock) now() HLC {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wall := time.Now().UnixMilli()
+	switch {
+	case wall > c.last.Wall:
+		c.last = HLC{Wall: wall}
+	case c.last.Logical < maxLogical:
+		c.last.Logical++
+	default:
+		c.last = HLC{Wall: c.last.Wall + 1}
+	}
+	c.last.Node = serverNode
+	return c.last
+}
+
+// observe moves the clock past h, so that later writes are ordered after
+// the one h stamped.
+func (c *hlcClock) observe(h HLC) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h.Wall > c.last.Wall || (h.Wall == c.last.Wall && h.Logical > c.last.Logical) {
+		c.last = HLC{Wall: h.Wall, Logical: h.Logical, Node: serverNode}
+	}
+}
+
+// observeDocuments moves the clock past every stored timestamp, some of
+// which may have come from clients whose clocks run ahead.
+func (e *Engine) observeDocuments() {
+	for _, col := range e.collections {
+		for _, doc := range col.Documents {
+			if h, err := ParseHLC(doc.HLC); err == nil {
+				e.clock.observe(h)
+			}
+		}
+	}
+}
+
+// Now returns a fresh timestamp from the engine's clock.
+func (e *Engine) Now() HLC {
+	return e.clock.now()
+}
+
+// Observe moves the engine's clock past h, a timestamp received from
+// elsewhere.
+func (e *Engine) Observe(h HLC) {
+	e.clock.observe(h)
+}
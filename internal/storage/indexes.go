@@ -0,0 +1,586 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+var (
+	ErrIndexExists     = errors.New("index already exists")
+	ErrIndexNotFound   = errors.New("index not found")
+	ErrUniqueViolation = errors.New("unique constraint violated")
+)
+
+// UniqueViolationError describes a write rejected by a unique index.
+type UniqueViolationError struct {
+	Collection string
+	Index      string
+	Fields     []string
+	Key        interface{}
+	ExistingID string
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("%v: %s %s = %s already used by document %s",
+		ErrUniqueViolation, e.Collection, strings.Join(e.Fields, ","), indexing.HashKey(e.Key), e.ExistingID)
+}
+
+func (e *UniqueViolationError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+const (
+	IndexBuilding = "building"
+	IndexReady    = "ready"
+	IndexFailed   = "failed"
+)
+
+// backgroundIndexThreshold is the collection size above which CreateIndex
+// returns immediately and builds the index in the background.
+const backgroundIndexThreshold = 10000
+
+// indexBuildBatch is the number of documents indexed per lock acquisition,
+// so that a large build does not stall writers for long.
+const indexBuildBatch = 1024
+
+type IndexStatus struct {
+	indexing.Definition
+	State    string  `json:"state"`
+	Indexed  int     `json:"indexed"`
+	Total    int     `json:"total"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// collectionIndex tracks an index and its build. A building index is
+// already maintained by writes; the builder only has to add the documents
+// that existed when the build started. The planner ignores it until ready.
+type collectionIndex struct {
+	index   indexing.Index
+	state   string
+	indexed int
+	total   int
+	err     string
+}
+
+func (ci *collectionIndex) status() IndexStatus {
+	st := IndexStatus{
+		Definition: ci.index.Definition(),
+		State:      ci.state,
+		Indexed:    ci.indexed,
+		Total:      ci.total,
+		Error:      ci.err,
+	}
+	switch {
+	case ci.state == IndexReady:
+		st.Progress = 1
+	case ci.total > 0:
+		st.Progress = float64(ci.indexed) / float64(ci.total)
+	}
+	return st
+}
+
+// put stores doc and keeps every index of the collection in step with it.
+// The caller must hold c.mu for writing.
+func (c *Collection) put(doc *Document) {
+	if prev, exists := c.Documents[doc.ID]; exists {
+		c.unindex(prev)
+	}
+	delete(c.tombstones, doc.ID)
+	c.Documents[doc.ID] = doc
+	c.markDirty(doc.ID)
+	for _, ci := range c.indexes {
+		if ci.state != IndexFailed {
+			ci.index.Insert(doc.ID, indexKeys(doc.Data, ci.index.Definition()))
+		}
+	}
+}
+
+// remove deletes the document with the given ID and its index entries; hlc
+// is the timestamp of the delete. The caller must hold c.mu for writing.
+func (c *Collection) remove(id, hlc string) {
+	if prev, exists := c.Documents[id]; exists {
+		c.unindex(prev)
+		delete(c.Documents, id)
+		c.bury(id, tombstone{Version: prev.Version, HLC: hlc})
+		c.markDirty(id)
+	}
+}
+
+// tombstone is what is kept of a deleted document: its last version and
+// the HLC of the delete.
+type tombstone struct {
+	Version uint64
+	HLC     string
+}
+
+// cover returns t raised to cover u as well. HLC strings sort in timestamp
+// order.
+func (t tombstone) cover(u tombstone) tombstone {
+	t.Version = max(t.Version, u.Version)
+	t.HLC = max(t.HLC, u.HLC)
+	return t
+}
+
+// bury records that the document was deleted. The caller must hold c.mu
+// for writing.
+func (c *Collection) bury(id string, t tombstone) {
+	if _, exists := c.Documents[id]; exists || t.Version <= c.tombstones[id].Version {
+		return
+	}
+	if c.tombstones == nil {
+		c.tombstones = make(map[string]tombstone)
+	}
+	c.tombstones[id] = t
+	c.markDirty(id)
+}
+
+// lastVersion returns the version of the document, or the version it had
+// when it was deleted, which the floor stands in for once the tombstone is
+// compacted away. The caller must hold c.mu.
+func (c *Collection) lastVersion(id string) uint64 {
+	if doc, exists := c.Documents[id]; exists {
+		return doc.Version
+	}
+	return max(c.tombstones[id].Version, c.floor.Version)
+}
+
+func (c *Collection) markDirty(id string) {
+	if c.dirty == nil {
+		c.dirty = make(map[string]struct{})
+	}
+	c.dirty[id] = struct{}{}
+}
+
+func (c *Collection) unindex(doc *Document) {
+	for _, ci := range c.indexes {
+		if ci.state != IndexFailed {
+			ci.index.Remove(doc.ID, indexKeys(doc.Data, ci.index.Definition()))
+		}
+	}
+}
+
+// indexKeys returns the keys a document contributes to an index. For one
+// field these are every value the path resolves to plus, for arrays, each
+// of their elements, mirroring how filters match array fields; a missing
+// field is indexed under null, which {"field": null} also matches. Compound
+// indexes use the cartesian product of the per-field keys. Sparse indexes
+// skip documents that have none of the fields.
+func indexKeys(data map[string]interface{}, def indexing.Definition) []interface{} {
+	perField := make([][]interface{}, len(def.Fields))
+	present := false
+	for i, field := range def.Fields {
+		values := lookupPath(data, strings.Split(field, "."))
+		if len(values) == 0 {
+			perField[i] = []interface{}{nil}
+			continue
+		}
+		present = true
+		for _, v := range values {
+			perField[i] = append(perField[i], v)
+			if arr, ok := v.([]interface{}); ok {
+				perField[i] = append(perField[i], arr...)
+			}
+		}
+	}
+	if def.Sparse && !present {
+		return nil
+	}
+	if !def.Compound() {
+		return perField[0]
+	}
+
+	tuples := [][]interface{}{{}}
+	for _, keys := range perField {
+		next := make([][]interface{}, 0, len(tuples)*len(keys))
+		for _, t := range tuples {
+			for _, k := range keys {
+				next = append(next, append(append([]interface{}(nil), t...), k))
+			}
+		}
+		tuples = next
+	}
+	out := make([]interface{}, len(tuples))
+	for i, t := range tuples {
+		out[i] = t
+	}
+	return out
+}
+
+// CreateIndex registers a secondary index, logs its definition and builds
+// it over the collection's existing documents. Small collections are
+// indexed before CreateIndex returns; larger ones are indexed in the
+// background, with progress reported by ListIndexes.
+func (e *Engine) CreateIndex(collection string, def indexing.Definition) (IndexStatus, error) {
+	idx, err := indexing.New(def)
+	if err != nil {
+		return IndexStatus{Definition: def}, err
+	}
+	def = idx.Definition()
+
+	col := e.GetCollection(collection)
+	col.mu.Lock()
+	if prev, exists := col.indexes[def.Name]; exists && prev.state != IndexFailed {
+		col.mu.Unlock()
+		return IndexStatus{Definition: def}, fmt.Errorf("%w: %s", ErrIndexExists, def.Name)
+	}
+
+	entry := WALEntry{
+		Operation:  "CREATE_INDEX",
+		Collection: collection,
+		Index:      &def,
+		Timestamp:  time.Now().UTC(),
+	}
+	if _, err := e.wal.Write(entry); err != nil {
+		col.mu.Unlock()
+		return IndexStatus{Definition: def}, fmt.Errorf("writing WAL: %w", err)
+	}
+	ci := col.registerIndex(idx)
+	col.mu.Unlock()
+
+	e.scheduleSave()
+	e.startIndexBuild(col, ci)
+
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	return ci.status(), nil
+}
+
+func (e *Engine) DropIndex(collection, name string) error {
+	col := e.GetCollection(collection)
+	col.mu.Lock()
+	defer col.mu.Unlock()
+
+	ci, exists := col.indexes[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+
+	def := ci.index.Definition()
+	entry := WALEntry{
+		Operation:  "DROP_INDEX",
+		Collection: collection,
+		Index:      &def,
+		Timestamp:  time.Now().UTC(),
+	}
+	if _, err := e.wal.Write(entry); err != nil {
+		return fmt.Errorf("writing WAL: %w", err)
+	}
+	delete(col.indexes, name)
+
+	e.scheduleSave()
+	return nil
+}
+
+func (e *Engine) ListIndexes(collection string) []IndexStatus {
+	col := e.GetCollection(collection)
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+
+	statuses := make([]IndexStatus, 0, len(col.indexes))
+	for _, name := range sortedIndexNames(col.indexes) {
+		statuses = append(statuses, col.indexes[name].status())
+	}
+	return statuses
+}
+
+// registerIndex adds idx in the building state. The caller must hold c.mu
+// for writing.
+func (c *Collection) registerIndex(idx indexing.Index) *collectionIndex {
+	if c.indexes == nil {
+		c.indexes = make(map[string]*collectionIndex)
+	}
+	ci := &collectionIndex{index: idx, state: IndexBuilding}
+	c.indexes[idx.Definition().Name] = ci
+	return ci
+}
+
+// indexDefinitions returns the definitions worth persisting. The caller
+// must hold c.mu.
+func (c *Collection) indexDefinitions() []indexing.Definition {
+	var defs []indexing.Definition
+	for _, name := range sortedIndexNames(c.indexes) {
+		if ci := c.indexes[name]; ci.state != IndexFailed {
+			defs = append(defs, ci.index.Definition())
+		}
+	}
+	return defs
+}
+
+// startIndexBuilds kicks off the builds of every index registered while
+// loading the data file and replaying the WAL.
+func (e *Engine) startIndexBuilds() {
+	e.mu.RLock()
+	cols := make([]*Collection, 0, len(e.collections))
+	for _, col := range e.collections {
+		cols = append(cols, col)
+	}
+	e.mu.RUnlock()
+
+	for _, col := range cols {
+		col.mu.RLock()
+		var pending []*collectionIndex
+		for _, name := range sortedIndexNames(col.indexes) {
+			if ci := col.indexes[name]; ci.state == IndexBuilding {
+				pending = append(pending, ci)
+			}
+		}
+		col.mu.RUnlock()
+		for _, ci := range pending {
+			e.startIndexBuild(col, ci)
+		}
+	}
+}
+
+func (e *Engine) startIndexBuild(col *Collection, ci *collectionIndex) {
+	col.mu.Lock()
+	ids := make([]string, 0, len(col.Documents))
+	for id := range col.Documents {
+		ids = append(ids, id)
+	}
+	ci.total = len(ids)
+	col.mu.Unlock()
+	sort.Strings(ids)
+
+	if len(ids) <= backgroundIndexThreshold {
+		e.buildIndex(col, ci, ids)
+		return
+	}
+	e.builds.Add(1)
+	go func() {
+		defer e.builds.Done()
+		e.buildIndex(col, ci, ids)
+	}()
+}
+
+// buildIndex indexes the documents that existed when the build started.
+// Documents written since are already maintained by put and remove, and
+// inserting the same key twice is a no-op, so the builder can simply read
+// each document's current state.
+func (e *Engine) buildIndex(col *Collection, ci *collectionIndex, ids []string) {
+	def := ci.index.Definition()
+	for start := 0; start < len(ids); start += indexBuildBatch {
+		if e.closing.Load() {
+			return
+		}
+		end := min(start+indexBuildBatch, len(ids))
+
+		col.mu.Lock()
+		if col.indexes[def.Name] != ci {
+			// Dropped while building.
+			col.mu.Unlock()
+			return
+		}
+		for _, id := range ids[start:end] {
+			doc, exists := col.Documents[id]
+			if !exists {
+				continue
+			}
+			keys := indexKeys(doc.Data, def)
+			if def.Unique {
+				if other, key, dup := uniqueConflict(ci.index, id, keys, nil); dup {
+					e.failIndex(col, ci, fmt.Sprintf("duplicate key %v in documents %s and %s", key, other, id))
+					col.mu.Unlock()
+					return
+				}
+			}
+			ci.index.Insert(id, keys)
+		}
+		ci.indexed = end
+		col.mu.Unlock()
+	}
+
+	col.mu.Lock()
+	if col.indexes[def.Name] == ci && ci.state == IndexBuilding {
+		ci.state = IndexReady
+	}
+	col.mu.Unlock()
+}
+
+// failIndex marks a build as failed and logs a drop so that a restart does
+// not retry it. The caller must hold col.mu for writing.
+func (e *Engine) failIndex(col *Collection, ci *collectionIndex, reason string) {
+	def := ci.index.Definition()
+	ci.state = IndexFailed
+	ci.err = reason
+	log.Printf("[WARN] Index %s on %s failed: %s", def.Name, col.Name, reason)
+
+	entry := WALEntry{
+		Operation:  "DROP_INDEX",
+		Collection: col.Name,
+		Index:      &def,
+		Timestamp:  time.Now().UTC(),
+	}
+	if _, err := e.wal.Write(entry); err != nil {
+		log.Printf("[ERROR] Logging drop of failed index %s: %v", def.Name, err)
+	}
+	e.scheduleSave()
+}
+
+// checkUnique returns a *UniqueViolationError if storing data under id would
+// duplicate a key in one of the collection's unique indexes. The caller must
+// hold c.mu.
+func (c *Collection) checkUnique(id string, data map[string]interface{}) error {
+	return c.checkUniqueIgnoring(id, data, nil)
+}
+
+// checkUniqueIgnoring is checkUnique disregarding the current versions of
+// the documents in ignore, which a transaction is about to replace.
+func (c *Collection) checkUniqueIgnoring(id string, data map[string]interface{}, ignore map[string]bool) error {
+	for _, name := range sortedIndexNames(c.indexes) {
+		ci := c.indexes[name]
+		def := ci.index.Definition()
+		if !def.Unique || ci.state == IndexFailed {
+			continue
+		}
+		keys := indexKeys(data, def)
+		other, key, dup := uniqueConflict(ci.index, id, keys, ignore)
+		if !dup && ci.state == IndexBuilding {
+			// Documents the builder has not reached yet are not in the
+			// index, so look at them directly.
+			other, key, dup = c.scanConflict(def, id, keys, ignore)
+		}
+		if dup {
+			return &UniqueViolationError{
+				Collection: c.Name,
+				Index:      def.Name,
+				Fields:     def.Fields,
+				Key:        key,
+				ExistingID: other,
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Collection) scanConflict(def indexing.Definition, id string, keys []interface{}, ignore map[string]bool) (string, interface{}, bool) {
+	if len(keys) == 0 {
+		return "", nil, false
+	}
+	want := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		want[indexing.HashKey(key)] = key
+	}
+	for otherID, doc := range c.Documents {
+		if otherID == id || ignore[otherID] {
+			continue
+		}
+		for _, key := range indexKeys(doc.Data, def) {
+			if k, ok := want[indexing.HashKey(key)]; ok {
+				return otherID, k, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// uniqueConflict reports another document already holding one of keys.
+func uniqueConflict(idx indexing.Index, id string, keys []interface{}, ignore map[string]bool) (string, interface{}, bool) {
+	for _, key := range keys {
+		for _, other := range idx.Lookup(key) {
+			if other != id && !ignore[other] {
+				return other, key, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// planQuery chooses an access path for a query. The caller must hold c.mu.
+func (c *Collection) planQuery(filter map[string]interface{}, sortFields []SortField, limited bool) indexing.Plan {
+	indexes := make([]indexing.Index, 0, len(c.indexes))
+	for _, name := range sortedIndexNames(c.indexes) {
+		if ci := c.indexes[name]; ci.state == IndexReady {
+			indexes = append(indexes, ci.index)
+		}
+	}
+
+	// The index yields the IDs under a key in ascending order, so it can
+	// only serve an ascending id tie-breaker.
+	var order *indexing.Order
+	if len(sortFields) == 2 && sortFields[1].Field == "id" && !sortFields[1].descending() && !isMetadataField(sortFields[0].Field) {
+		order = &indexing.Order{Field: sortFields[0].Field, Descending: sortFields[0].descending()}
+	}
+	return indexing.Choose(indexes, indexPredicates(filter), order, limited, len(c.Documents))
+}
+
+func sortedIndexNames(indexes map[string]*collectionIndex) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func isMetadataField(field string) bool {
+	switch field {
+	case "id", "version", "createdAt", "updatedAt":
+		return true
+	}
+	return false
+}
+
+// indexPredicates extracts the conditions an index can serve from the
+// top-level conjunction of a filter (including nested $and). Anything else
+// is left to the filter, which is re-checked on every candidate.
+func indexPredicates(filter map[string]interface{}) []indexing.Predicate {
+	var preds []indexing.Predicate
+	for _, key := range sortedKeys(filter) {
+		cond := filter[key]
+		if key == "$and" {
+			list, _ := cond.([]interface{})
+			for _, item := range list {
+				if sub, ok := item.(map[string]interface{}); ok {
+					preds = append(preds, indexPredicates(sub)...)
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if pred, ok := fieldPredicate(key, cond); ok {
+			preds = append(preds, pred)
+		}
+	}
+	return preds
+}
+
+func fieldPredicate(field string, cond interface{}) (indexing.Predicate, bool) {
+	pred := indexing.Predicate{Field: field}
+
+	ops, isOps := operatorObject(cond)
+	if !isOps {
+		pred.Eq = []interface{}{cond}
+		return pred, true
+	}
+
+	if v, ok := ops["$eq"]; ok {
+		pred.Eq = []interface{}{v}
+		return pred, true
+	}
+	if list, ok := ops["$in"].([]interface{}); ok {
+		pred.Eq = list
+		return pred, true
+	}
+	for op, v := range ops {
+		switch op {
+		case "$gt", "$gte":
+			if pred.Lower == nil || indexing.Compare(v, pred.Lower.Value) > 0 {
+				pred.Lower = &indexing.Bound{Value: v, Inclusive: op == "$gte"}
+			}
+		case "$lt", "$lte":
+			if pred.Upper == nil || indexing.Compare(v, pred.Upper.Value) < 0 {
+				pred.Upper = &indexing.Bound{Value: v, Inclusive: op == "$lte"}
+			}
+		}
+	}
+	return pred, pred.Lower != nil || pred.Upper != nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in the data directory an engine holds a lock
+// on while it is open.
+const lockFileName = "helixdb.lock"
+
+var ErrDataDirLocked = errors.New("data directory in use")
+
+// DirLock is an exclusive lock on a data directory.
+type DirLock struct {
+	f *os.File
+}
+
+// LockDataDir locks the directory of dataFile, failing with
+// ErrDataDirLocked if an open engine, in this process or another, holds
+// it.
+func LockDataDir(dataFile string) (*DirLock, error) {
+	dir := filepath.Dir(dataFile)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+	f, err := lockFile(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return &DirLock{f: f}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	return unlockFile(l.f)
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile creates the lock file exclusively. It is left behind if the
+// process dies, and must then be removed by hand.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w: %s exists", ErrDataDirLocked, path)
+	}
+	return f, err
+}
+
+func unlockFile(f *os.File) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidPatch    = errors.New("invalid patch")
+	ErrPatchTestFailed = errors.New("patch test failed")
+)
+
+// Patch computes the replacement data for a document. Implementations must
+// not modify the map they are given.
+type Patch interface {
+	Apply(data map[string]interface{}) (map[string]interface{}, error)
+}
+
+// MergePatch is an RFC 7386 JSON Merge Patch.
+type MergePatch map[string]interface{}
+
+func ParseMergePatch(raw []byte) (MergePatch, error) {
+	var patch MergePatch
+	if err := json.Unmarshal(raw, &patch); err != nil || patch == nil {
+		return nil, fmt.Errorf("%w: merge patch must be a JSON object", ErrInvalidPatch)
+	}
+	return patch, nil
+}
+
+func (p MergePatch) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	return mergePatch(data, map[string]interface{}(p)).(map[string]interface{}), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return cloneValue(patch)
+	}
+
+	result := make(map[string]interface{})
+	if targetObj, ok := target.(map[string]interface{}); ok {
+		for k, v := range targetObj {
+			result[k] = cloneValue(v)
+		}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(result, k)
+			continue
+		}
+		result[k] = mergePatch(result[k], v)
+	}
+	return result
+}
+
+// JSONPatchOperation is a single RFC 6902 operation. Value is kept raw so
+// that an explicit null can be told apart from a missing member.
+type JSONPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is an RFC 6902 JSON Patch. Operations are applied in order and
+// the patch fails as a whole if any of them fails.
+type JSONPatch []JSONPatchOperation
+
+func ParseJSONPatch(raw []byte) (JSONPatch, error) {
+	var patch JSONPatch
+	if err := json.Unmarshal(raw, &patch); err != nil {
+		return nil, fmt.Errorf("%w: JSON patch must be an array of operations", ErrInvalidPatch)
+	}
+	for i, op := range patch {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("%w: operation %d (%s) requires a value", ErrInvalidPatch, i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, fmt.Errorf("%w: operation %d (%s): %v", ErrInvalidPatch, i, op.Op, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("%w: operation %d has unknown op %q", ErrInvalidPatch, i, op.Op)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, fmt.Errorf("%w: operation %d (%s): %v", ErrInvalidPatch, i, op.Op, err)
+		}
+	}
+	return patch, nil
+}
+
+func (p JSONPatch) Apply(data map[string]interface{}) (map[string]interface{}, error) {
+	var doc interface{} = cloneValue(data)
+	for i, op := range p {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: document must remain a JSON object", ErrInvalidPatch)
+	}
+	return result, nil
+}
+
+func (op JSONPatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "remove":
+		doc, _, err = removeValue(doc, path)
+		return doc, err
+	case "replace":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := getValue(doc, path); err != nil {
+			return nil, err
+		}
+		return setValue(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		if isProperPrefix(from, path) {
+			return nil, fmt.Errorf("%w: cannot move a value into one of its children", ErrInvalidPatch)
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, cloneValue(value))
+	case "test":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		current, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, ErrPatchTestFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+}
+
+func (op JSONPatchOperation) value() (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(op.Value, &v); err != nil {
+		return nil, fmt.Errorf("%w: invalid value: %v", ErrInvalidPatch, err)
+	}
+	return v, nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isProperPrefix(prefix, path []string) bool {
+	if len(prefix) >= len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, tok := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, ok := node[tok]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, tok)
+			}
+			doc = child
+		case []interface{}:
+			idx, err := arrayIndex(tok, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[idx]
+		default:
+			return nil, fmt.Errorf("%w: cannot traverse into %q", ErrInvalidPatch, tok)
+		}
+	}
+	return doc, nil
+}
+
+// addValue inserts value at path, shifting array elements as RFC 6902
+// "add" requires. It returns the (possibly new) root.
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	return modifyValue(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[tok] = value
+			return node, nil
+		case []interface{}:
+			idx := len(node)
+			if tok != "-" {
+				var err error
+				if idx, err = arrayIndex(tok, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[idx+1:], node[idx:])
+			node[idx] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("%w: cannot add %q to a scalar", ErrInvalidPatch, tok)
+	}, value)
+}
+
+// setValue overwrites the existing value at path.
+func setValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	return modifyValue(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[tok] = value
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(tok, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			node[idx] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("%w: cannot set %q on a scalar", ErrInvalidPatch, tok)
+	}, value)
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot remove the document root", ErrInvalidPatch)
+	}
+	var removed interface{}
+	doc, err := modifyValue(doc, path, func(parent interface{}, tok string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[tok]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, tok)
+			}
+			removed = value
+			delete(node, tok)
+			return node, nil
+		case []interface{}:
+			idx, err := arrayIndex(tok, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[idx]
+			return append(node[:idx], node[idx+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: cannot remove %q from a scalar", ErrInvalidPatch, tok)
+	}, nil)
+	return doc, removed, err
+}
+
+// modifyValue walks to the parent of path's last token, lets fn rewrite that
+// parent, and stores the result back into the chain of ancestors. Arrays
+// change identity when they grow or shrink, which is why the rewritten
+// parent has to be reassigned at every level.
+func modifyValue(doc interface{}, path []string, fn func(parent interface{}, tok string) (interface{}, error), root interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return root, nil
+	}
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	tok := path[0]
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[tok]
+		if !ok {
+			return nil, fmt.Errorf("%w: member %q not found", ErrInvalidPatch, tok)
+		}
+		updated, err := modifyValue(child, path[1:], fn, root)
+		if err != nil {
+			return nil, err
+		}
+		node[tok] = updated
+		return node, nil
+	case []interface{}:
+		idx, err := arrayIndex(tok, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := modifyValue(node[idx], path[1:], fn, root)
+		if err != nil {
+			return nil, err
+		}
+		node[idx] = updated
+		return node, nil
+	}
+	return nil, fmt.Errorf("%w: cannot traverse into %q", ErrInvalidPatch, tok)
+}
+
+func arrayIndex(tok string, max int) (int, error) {
+	if tok == "" || (len(tok) > 1 && tok[0] == '0') {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, tok)
+	}
+	idx, err := strconv.Atoi(tok)
+	if err != nil || idx < 0 || idx > max {
+		return 0, fmt.Errorf("%w: array index %q out of range", ErrInvalidPatch, tok)
+	}
+	return idx, nil
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, child := range val {
+			out[k] = cloneValue(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, child := range val {
+			out[i] = cloneValue(child)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,43 @@
+package storage
+
+import "errors"
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition guards a write against the current version of the document,
+// mirroring the HTTP If-Match and If-None-Match headers. A nil version list
+// means the corresponding header was not given; a non-nil empty list matches
+// nothing.
+type Precondition struct {
+	IfMatch        []uint64
+	IfMatchAny     bool
+	IfNoneMatch    []uint64
+	IfNoneMatchAny bool
+}
+
+// Check reports ErrPreconditionFailed when existing (nil if the document
+// does not exist) does not satisfy p.
+func (p Precondition) Check(existing *Document) error {
+	if p.IfMatchAny && existing == nil {
+		return ErrPreconditionFailed
+	}
+	if p.IfMatch != nil && (existing == nil || !containsVersion(p.IfMatch, existing.Version)) {
+		return ErrPreconditionFailed
+	}
+	if p.IfNoneMatchAny && existing != nil {
+		return ErrPreconditionFailed
+	}
+	if p.IfNoneMatch != nil && existing != nil && containsVersion(p.IfNoneMatch, existing.Version) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func containsVersion(versions []uint64, version uint64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,489 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// sortTimeLayout is fixed-width so that formatted timestamps compare
+// correctly as strings, both in memory and inside cursors.
+const sortTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+type SortField struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"`
+}
+
+func (s SortField) descending() bool {
+	return strings.EqualFold(s.Direction, "desc") || strings.EqualFold(s.Direction, "descending")
+}
+
+// QueryOptions describes a query against a single collection. Sort fields
+// and projections use dot-notation paths into the document data, except for
+// the metadata fields id, version, createdAt and updatedAt.
+type QueryOptions struct {
+	Filter     map[string]interface{}
+	Sort       []SortField
+	Projection map[string]interface{}
+	Skip       int
+	Limit      int
+	Cursor     string
+	// Explain asks for a QueryExplain describing how the query ran.
+	Explain bool
+}
+
+type QueryResult struct {
+	Documents  []*Document
+	NextCursor string
+	Explain    *QueryExplain
+}
+
+const (
+	SortByIndex  = "index"
+	SortInMemory = "in-memory"
+)
+
+// QueryExplain reports the access path the planner chose and what executing
+// it cost.
+type QueryExplain struct {
+	Plan              string      `json:"plan"`
+	Index             string      `json:"index,omitempty"`
+	IndexFields       []string    `json:"indexFields,omitempty"`
+	EstimatedExamined int         `json:"estimatedExamined"`
+	DocsExamined      int         `json:"docsExamined"`
+	Matched           int         `json:"matched"`
+	Returned          int         `json:"returned"`
+	SortStrategy      string      `json:"sortStrategy"`
+	Sort              []SortField `json:"sort"`
+	EarlyStop         bool        `json:"earlyStop"`
+	ExecutionTimeMs   float64     `json:"executionTimeMs"`
+}
+
+type queryCursor struct {
+	Keys  []interface{} `json:"k"`
+	Query string        `json:"q"`
+}
+
+func (e *Engine) Query(collection string, opts QueryOptions) (*QueryResult, error) {
+	if err := e.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	filter, err := CompileFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	sortFields, err := normalizeSort(opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+	project, err := compileProjection(opts.Projection)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Skip < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("%w: skip and limit must not be negative", ErrInvalidQuery)
+	}
+
+	fingerprint := queryFingerprint(opts.Filter, sortFields)
+	var after []interface{}
+	if opts.Cursor != "" {
+		if after, err = decodeCursor(opts.Cursor, fingerprint, len(sortFields)); err != nil {
+			return nil, err
+		}
+	}
+
+	col := e.GetCollection(collection)
+	col.mu.RLock()
+	plan := col.planQuery(opts.Filter, sortFields, opts.Limit > 0)
+
+	// An ordered plan yields documents already sorted, so the scan can stop
+	// as soon as it has one more document than the page needs.
+	want := -1
+	if plan.Ordered && opts.Limit > 0 {
+		want = opts.Skip + opts.Limit + 1
+	}
+
+	var matched []sortedDoc
+	examined := 0
+	visit := func(doc *Document) bool {
+		examined++
+		if !filter.Match(doc.Data) {
+			return true
+		}
+		sd := sortedDoc{doc: doc, keys: sortKeys(doc, sortFields)}
+		if after != nil && compareSortKeys(sd.keys, after, sortFields) <= 0 {
+			return true
+		}
+		matched = append(matched, sd)
+		return want < 0 || len(matched) < want
+	}
+
+	if plan.Kind == indexing.PlanCollectionScan {
+		for _, doc := range col.Documents {
+			visit(doc)
+		}
+	} else {
+		plan.Scan(func(id string) bool {
+			doc, ok := col.Documents[id]
+			return !ok || visit(doc)
+		})
+	}
+	col.mu.RUnlock()
+
+	var explain *QueryExplain
+	if opts.Explain {
+		explain = &QueryExplain{
+			Plan:              plan.Kind,
+			EstimatedExamined: plan.Estimate,
+			DocsExamined:      examined,
+			Matched:           len(matched),
+			SortStrategy:      SortInMemory,
+			Sort:              sortFields,
+			EarlyStop:         want > 0 && len(matched) == want,
+		}
+		if plan.Index != nil {
+			def := plan.Index.Definition()
+			explain.Index = def.Name
+			explain.IndexFields = def.Fields
+		}
+		if plan.Ordered {
+			explain.SortStrategy = SortByIndex
+		}
+	}
+
+	if !plan.Ordered {
+		sort.Slice(matched, func(i, j int) bool {
+			return compareSortKeys(matched[i].keys, matched[j].keys, sortFields) < 0
+		})
+	}
+
+	if opts.Skip >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[opts.Skip:]
+	}
+
+	result := &QueryResult{Explain: explain}
+	if opts.Limit > 0 && len(matched) > opts.Limit {
+		matched = matched[:opts.Limit]
+		result.NextCursor = encodeCursor(matched[len(matched)-1].keys, fingerprint)
+	}
+
+	result.Documents = make([]*Document, 0, len(matched))
+	for _, sd := range matched {
+		result.Documents = append(result.Documents, project(sd.doc))
+	}
+	if explain != nil {
+		explain.Returned = len(result.Documents)
+		explain.ExecutionTimeMs = float64(time.Since(start).Microseconds()) / 1000
+	}
+	return result, nil
+}
+
+// MergeQuery puts together the page opts selects from documents gathered
+// from several shards. Each shard must have been queried with opts' filter,
+// sort and cursor, no projection or skip, and a limit of Skip+Limit+1 if
+// Limit is set.
+func MergeQuery(docs []*Document, opts QueryOptions) (*QueryResult, error) {
+	sortFields, err := normalizeSort(opts.Sort)
+	if err != nil {
+		return nil, err
+	}
+	project, err := compileProjection(opts.Projection)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Skip < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("%w: skip and limit must not be negative", ErrInvalidQuery)
+	}
+
+	matched := make([]sortedDoc, len(docs))
+	for i, doc := range docs {
+		matched[i] = sortedDoc{doc: doc, keys: sortKeys(doc, sortFields)}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compareSortKeys(matched[i].keys, matched[j].keys, sortFields) < 0
+	})
+
+	if opts.Skip >= len(matched) {
+		matched = nil
+	} else {
+		matched = matched[opts.Skip:]
+	}
+
+	result := &QueryResult{}
+	if opts.Limit > 0 && len(matched) > opts.Limit {
+		matched = matched[:opts.Limit]
+		result.NextCursor = encodeCursor(matched[len(matched)-1].keys, queryFingerprint(opts.Filter, sortFields))
+	}
+
+	result.Documents = make([]*Document, 0, len(matched))
+	for _, sd := range matched {
+		result.Documents = append(result.Documents, project(sd.doc))
+	}
+	return result, nil
+}
+
+type sortedDoc struct {
+	doc  *Document
+	keys []interface{}
+}
+
+// normalizeSort validates the requested sort and appends an id tie-breaker
+// so that the order, and therefore every cursor, is total and stable.
+func normalizeSort(fields []SortField) ([]SortField, error) {
+	out := make([]SortField, 0, len(fields)+1)
+	hasID := false
+	for _, f := range fields {
+		if f.Field == "" {
+			return nil, fmt.Errorf("%w: sort field name is required", ErrInvalidQuery)
+		}
+		switch strings.ToLower(f.Direction) {
+		case "", "asc", "ascending", "desc", "descending":
+		default:
+			return nil, fmt.Errorf("%w: sort direction for %q must be asc or desc", ErrInvalidQuery, f.Field)
+		}
+		if f.Field == "id" {
+			hasID = true
+		}
+		out = append(out, f)
+	}
+	if !hasID {
+		out = append(out, SortField{Field: "id"})
+	}
+	return out, nil
+}
+
+func sortKeys(doc *Document, fields []SortField) []interface{} {
+	keys := make([]interface{}, len(fields))
+	for i, f := range fields {
+		keys[i] = sortValue(doc, f)
+	}
+	return keys
+}
+
+func sortValue(doc *Document, f SortField) interface{} {
+	switch f.Field {
+	case "id":
+		return doc.ID
+	case "version":
+		return float64(doc.Version)
+	case "createdAt":
+		return formatSortTime(doc.CreatedAt)
+	case "updatedAt":
+		return formatSortTime(doc.UpdatedAt)
+	}
+
+	values := lookupPath(doc.Data, strings.Split(f.Field, "."))
+	if len(values) == 0 {
+		return nil
+	}
+	// Like MongoDB, an array sorts by its smallest element ascending and by
+	// its largest element descending.
+	arr, ok := values[0].([]interface{})
+	if !ok || len(arr) == 0 {
+		return values[0]
+	}
+	best := arr[0]
+	for _, el := range arr[1:] {
+		c := indexing.Compare(el, best)
+		if (f.descending() && c > 0) || (!f.descending() && c < 0) {
+			best = el
+		}
+	}
+	return best
+}
+
+func compareSortKeys(a, b []interface{}, fields []SortField) int {
+	for i, f := range fields {
+		c := indexing.Compare(a[i], b[i])
+		if f.descending() {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// queryFingerprint ties a cursor to the filter and sort it was issued for.
+func queryFingerprint(filter map[string]interface{}, fields []SortField) string {
+	data, _ := json.Marshal(struct {
+		Filter map[string]interface{} `json:"f"`
+		Sort   []SortField            `json:"s"`
+	}{filter, fields})
+	h := sha256.Sum256(data)
+	return fmt.Sprintf("%x", h[:8])
+}
+
+func encodeCursor(keys []interface{}, fingerprint string) string {
+	data, _ := json.Marshal(queryCursor{Keys: keys, Query: fingerprint})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token, fingerprint string, nkeys int) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	var c queryCursor
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Keys) != nkeys {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if c.Query != fingerprint {
+		return nil, fmt.Errorf("%w: cursor was issued for a different filter or sort", ErrInvalidQuery)
+	}
+	return c.Keys, nil
+}
+
+type projectionNode struct {
+	children map[string]*projectionNode
+}
+
+func newProjectionNode() *projectionNode {
+	return &projectionNode{children: make(map[string]*projectionNode)}
+}
+
+// add marks a dot-notation path as a leaf of the projection tree.
+func (n *projectionNode) add(field string) {
+	node := n
+	for _, seg := range strings.Split(field, ".") {
+		if node.children == nil {
+			// A shorter path already covers this one.
+			return
+		}
+		child, ok := node.children[seg]
+		if !ok {
+			child = newProjectionNode()
+			node.children[seg] = child
+		}
+		node = child
+	}
+	node.children = nil
+}
+
+// compileProjection returns a function that copies a document keeping (or
+// dropping) the listed data paths. Inclusion and exclusion cannot be mixed.
+func compileProjection(spec map[string]interface{}) (func(*Document) *Document, error) {
+	if len(spec) == 0 {
+		return func(doc *Document) *Document { return doc }, nil
+	}
+
+	root := newProjectionNode()
+	include := -1
+	for field, v := range spec {
+		on, ok := projectionFlag(v)
+		if !ok {
+			return nil, fmt.Errorf("%w: projection for %q must be 0, 1, true or false", ErrInvalidQuery, field)
+		}
+		mode := 0
+		if on {
+			mode = 1
+		}
+		if include != -1 && include != mode {
+			return nil, fmt.Errorf("%w: projection cannot mix inclusion and exclusion", ErrInvalidQuery)
+		}
+		include = mode
+		if field == "" {
+			return nil, fmt.Errorf("%w: empty projection field", ErrInvalidQuery)
+		}
+
+		root.add(field)
+	}
+
+	return func(doc *Document) *Document {
+		projected := *doc
+		if include == 1 {
+			projected.Data = includePaths(doc.Data, root)
+		} else {
+			projected.Data = excludePaths(doc.Data, root)
+		}
+		return &projected
+	}, nil
+}
+
+// projectionFlag interprets 0, 1, true and false as exclusion or inclusion.
+func projectionFlag(v interface{}) (on bool, ok bool) {
+	if b, isBool := v.(bool); isBool {
+		return b, true
+	}
+	n, isNum := indexing.Number(v)
+	if !isNum || (n != 0 && n != 1) {
+		return false, false
+	}
+	return n == 1, true
+}
+
+func includePaths(data map[string]interface{}, node *projectionNode) map[string]interface{} {
+	out := make(map[string]interface{})
+	for key, child := range node.children {
+		v, ok := data[key]
+		if !ok {
+			continue
+		}
+		if child.children == nil {
+			out[key] = cloneValue(v)
+			continue
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			out[key] = includePaths(val, child)
+		case []interface{}:
+			arr := make([]interface{}, 0, len(val))
+			for _, el := range val {
+				if obj, ok := el.(map[string]interface{}); ok {
+					arr = append(arr, includePaths(obj, child))
+				}
+			}
+			out[key] = arr
+		}
+	}
+	return out
+}
+
+func excludePaths(data map[string]interface{}, node *projectionNode) map[string]interface{} {
+	out := make(map[string]interface{}, len(data))
+	for key, v := range data {
+		child, ok := node.children[key]
+		switch {
+		case !ok:
+			out[key] = cloneValue(v)
+		case child.children == nil:
+			// excluded entirely
+		default:
+			switch val := v.(type) {
+			case map[string]interface{}:
+				out[key] = excludePaths(val, child)
+			case []interface{}:
+				arr := make([]interface{}, len(val))
+				for i, el := range val {
+					if obj, ok := el.(map[string]interface{}); ok {
+						arr[i] = excludePaths(obj, child)
+					} else {
+						arr[i] = cloneValue(el)
+					}
+				}
+				out[key] = arr
+			default:
+				out[key] = cloneValue(v)
+			}
+		}
+	}
+	return out
+}
+
+func formatSortTime(t time.Time) string {
+	return t.UTC().Format(sortTimeLayout)
+}
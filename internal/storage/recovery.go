@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+// RecoveryReport describes what the engine found in the WAL and the stored
+// documents at startup.
+type RecoveryReport struct {
+	// CheckpointLSN is the last LSN already reflected in the data file.
+	CheckpointLSN uint64 `json:"checkpointLSN"`
+	LastLSN       uint64 `json:"lastLSN"`
+	// Replayed counts the records applied on top of the data file.
+	Replayed int       `json:"replayed"`
+	TornTail *TornTail `json:"tornTail,omitempty"`
+	// Corrupt lists the documents that failed verification, and
+	// QuarantineDir where copies of them were saved.
+	Corrupt       []CorruptDocument `json:"corrupt,omitempty"`
+	QuarantineDir string            `json:"quarantineDir,omitempty"`
+}
+
+// RepairSource supplies intact copies of documents that failed
+// verification, such as a backup. Lookup returns nil if it has none.
+type RepairSource struct {
+	Name   string
+	Lookup func(collection, id string) (*Document, error)
+}
+
+// RecoveryReport returns the outcome of the WAL recovery run when the engine
+// was opened.
+func (e *Engine) RecoveryReport() RecoveryReport {
+	return e.recovery
+}
+
+// handleCorruption quarantines the documents that failed verification and,
+// if allowed, repairs them. It returns the quarantine directory.
+func (e *Engine) handleCorruption(opts Options) (string, error) {
+	if len(e.corrupt) == 0 {
+		return "", nil
+	}
+	dir, err := quarantine(filepath.Dir(e.dataFile), e.corrupt)
+	if err != nil {
+		return "", fmt.Errorf("quarantining corrupt documents: %w", err)
+	}
+	if !opts.AutoRecover {
+		return dir, fmt.Errorf("%w: %d documents failed verification and were copied to %s; enable recovery.autoRecover to repair them",
+			ErrCorruptData, len(e.corrupt), dir)
+	}
+
+	repaired := e.repair(opts.RepairSources)
+	if err := writeQuarantineReport(dir, e.corrupt); err != nil {
+		return dir, fmt.Errorf("quarantining corrupt documents: %w", err)
+	}
+	fmt.Printf("[WARN] %d documents failed verification (copied to %s); repaired %d\n", len(e.corrupt), dir, repaired)
+	for _, doc := range e.corrupt {
+		if doc.RepairedFrom == "" {
+			fmt.Printf("[WARN] Could not repair %s/%s: %s\n", doc.Collection, doc.ID, doc.Reason)
+		}
+	}
+	return dir, nil
+}
+
+// repair restores the corrupt documents from the WAL, including archived
+// segments, then from sources, and returns how many it restored. A
+// document it cannot restore stays removed. Every one is marked dirty so
+// that the next checkpoint replaces its damaged record.
+func (e *Engine) repair(sources []RepairSource) int {
+	wanted := make(map[txnKey]*CorruptDocument, len(e.corrupt))
+	for i := range e.corrupt {
+		doc := &e.corrupt[i]
+		wanted[txnKey{doc.Collection, doc.ID}] = doc
+	}
+
+	// The latest record of a document in the log is its latest state.
+	latest := make(map[txnKey]*Document)
+	// deleted holds the version a document had when it was deleted.
+	deleted := make(map[txnKey]uint64)
+	var visit func(entry WALEntry)
+	visit = func(entry WALEntry) {
+		if entry.Operation == "TXN" {
+			for _, op := range entry.Ops {
+				visit(op)
+			}
+			return
+		}
+		key := txnKey{entry.Collection, entry.DocumentID}
+		if wanted[key] == nil {
+			return
+		}
+		prev := latest[key]
+		switch entry.Operation {
+		case "INSERT", "UPDATE":
+			doc := &Document{
+				ID:        entry.DocumentID,
+				Data:      entry.Data,
+				Version:   replayVersion(entry, docVersion(prev)),
+				CreatedAt: entry.Timestamp,
+				UpdatedAt: entry.Timestamp,
+				HLC:       entry.HLC,
+			}
+			if !entry.CreatedAt.IsZero() {
+				doc.CreatedAt, doc.UpdatedAt = entry.CreatedAt, entry.UpdatedAt
+			}
+			if entry.Operation == "UPDATE" && prev != nil {
+				doc.CreatedAt = prev.CreatedAt
+			}
+			doc.Checksum = computeChecksum(doc)
+			latest[key] = doc
+			delete(deleted, key)
+		case "DELETE":
+			latest[key], deleted[key] = nil, entry.Version
+		}
+	}
+	history, err := e.wal.History()
+	if err != nil {
+		fmt.Printf("[WARN] Cannot read the WAL for repairs: %v\n", err)
+	}
+	for _, entry := range history {
+		visit(entry)
+	}
+
+	repaired := 0
+	for key, bad := range wanted {
+		col := e.collections[key.collection]
+		doc := latest[key]
+		deletedVersion, wasDeleted := deleted[key]
+		// A state older than the damaged copy would lose writes.
+		found := (doc != nil && doc.Version >= bad.Version) || (wasDeleted && deletedVersion >= bad.Version)
+		if found {
+			bad.RepairedFrom = "wal"
+		}
+		for _, src := range sources {
+			if found {
+				break
+			}
+			d, err := src.Lookup(key.collection, key.id)
+			if err != nil {
+				fmt.Printf("[WARN] Repair source %s failed for %s/%s: %v\n", src.Name, key.collection, key.id, err)
+				continue
+			}
+			if d != nil && d.ID == key.id && computeChecksum(d) == d.Checksum {
+				doc, found = d, true
+				bad.RepairedFrom = src.Name
+			}
+		}
+
+		if found {
+			repaired++
+			if doc != nil {
+				col.Documents[key.id] = doc
+			}
+		}
+		col.markDirty(key.id)
+	}
+	return repaired
+}
+
+// recover replays the WAL records newer than the data file. A damaged
+// record before the end of the log is an error: skipping it would silently
+// lose a write.
+func (e *Engine) recover() (RecoveryReport, error) {
+	report := RecoveryReport{CheckpointLSN: e.checkpointLSN, TornTail: e.wal.TornTail()}
+	if err := e.wal.EnsureLSN(e.checkpointLSN); err != nil {
+		return report, err
+	}
+	entries, err := e.wal.ReadAll()
+	if err != nil {
+		return report, err
+	}
+	report.LastLSN = e.wal.LastLSN()
+
+	// Records at or below the checkpoint are already in the data file.
+	// Legacy records have no LSN and are always replayed.
+	var tail []WALEntry
+	for _, entry := range entries {
+		if entry.LSN == 0 || entry.LSN > e.checkpointLSN {
+			tail = append(tail, entry)
+		}
+	}
+	report.Replayed = len(tail)
+	if len(tail) == 0 {
+		return report, nil
+	}
+
+	fmt.Printf("[INFO] Replaying %d WAL entries after LSN %d\n", len(tail), e.checkpointLSN)
+	for _, entry := range tail {
+		e.replay(entry)
+	}
+	return report, nil
+}
+
+// replay applies one WAL entry. A transaction's operations are logged as a
+// single TXN entry, so they are replayed together or, if the entry was torn,
+// not at all.
+func (e *Engine) replay(entry WALEntry) {
+	if entry.Operation == "TXN" {
+		for _, op := range entry.Ops {
+			e.replay(op)
+		}
+		return
+	}
+
+	if h, err := ParseHLC(entry.HLC); err == nil {
+		e.clock.observe(h)
+	}
+	col := e.GetCollection(entry.Collection)
+	switch entry.Operation {
+	case "INSERT":
+		createdAt, updatedAt := entry.Timestamp, entry.Timestamp
+		if !entry.CreatedAt.IsZero() {
+			createdAt, updatedAt = entry.CreatedAt, entry.UpdatedAt
+		}
+		doc := &Document{
+			ID:        entry.DocumentID,
+			Data:      entry.Data,
+			Version:   replayVersion(entry, col.lastVersion(entry.DocumentID)),
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+			HLC:       entry.HLC,
+		}
+		doc.Checksum = computeChecksum(doc)
+		col.put(doc)
+	case "UPDATE":
+		createdAt := entry.Timestamp
+		if existing, exists := col.Documents[entry.DocumentID]; exists {
+			createdAt = existing.CreatedAt
+		}
+		doc := &Document{
+			ID:        entry.DocumentID,
+			Data:      entry.Data,
+			Version:   replayVersion(entry, col.lastVersion(entry.DocumentID)),
+			CreatedAt: createdAt,
+			UpdatedAt: entry.Timestamp,
+			HLC:       entry.HLC,
+		}
+		doc.Checksum = computeChecksum(doc)
+		col.put(doc)
+	case "DELETE":
+		col.remove(entry.DocumentID, entry.HLC)
+		col.bury(entry.DocumentID, tombstone{Version: entry.Version, HLC: entry.HLC})
+	case "CREATE_INDEX":
+		if entry.Index == nil {
+			return
+		}
+		if _, exists := col.indexes[entry.Index.Name]; exists {
+			return
+		}
+		idx, err := indexing.New(*entry.Index)
+		if err != nil {
+			fmt.Printf("[WARN] Skipping index %s on %s: %v\n", entry.Index.Name, col.Name, err)
+			return
+		}
+		col.registerIndex(idx)
+	case "DROP_INDEX":
+		if entry.Index != nil {
+			delete(col.indexes, entry.Index.Name)
+		}
+	}
+}
+
+// replayVersion returns the version recorded in entry, deriving one from the
+// previous version for WAL files written before versions existed.
+func replayVersion(entry WALEntry, prev uint64) uint64 {
+	if entry.Version != 0 {
+		return entry.Version
+	}
+	return prev + 1
+}
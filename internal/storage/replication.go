@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+)
+
+var (
+	ErrReadOnly       = errors.New("engine is a read-only replica")
+	ErrReplicationGap = errors.New("replicated record out of sequence")
+)
+
+// SetReadOnly makes every write fail with ErrReadOnly. A read-only engine
+// only changes through ApplyReplicated.
+func (e *Engine) SetReadOnly(readOnly bool) {
+	e.wal.mu.Lock()
+	defer e.wal.mu.Unlock()
+	e.wal.readOnly = readOnly
+}
+
+func (e *Engine) ReadOnly() bool {
+	e.wal.mu.Lock()
+	defer e.wal.mu.Unlock()
+	return e.wal.readOnly
+}
+
+// Proposer replicates a record through a consensus log before the engine
+// applies it. It returns the LSN it gave the record once the record is
+// committed and has been logged with LogCommitted.
+type Proposer func(entry WALEntry) (uint64, error)
+
+// SetProposer routes every write through propose. The writer keeps its
+// locks until the record is committed, so its checks still hold when the
+// write is applied.
+func (e *Engine) SetProposer(propose Proposer) {
+	e.wal.mu.Lock()
+	defer e.wal.mu.Unlock()
+	e.wal.propose = propose
+}
+
+// LogCommitted logs a committed record that this engine proposed; the
+// writer waiting on the proposal applies it. Records proposed elsewhere
+// go through ApplyReplicated.
+func (e *Engine) LogCommitted(entry WALEntry) error {
+	if e.closing.Load() {
+		return ErrEngineClosed
+	}
+	return e.wal.appendReplicated(entry)
+}
+
+// WALStream delivers WAL records in order, for replicas to copy.
+type WALStream struct {
+	sub *subscription
+	wal *WAL
+}
+
+// StreamWAL streams every record after since, as logged. It fails with
+// ErrChangesUnavailable if some of them have already been removed.
+func (e *Engine) StreamWAL(since uint64) (*WALStream, error) {
+	sub, err := e.subscribe(since, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &WALStream{sub: sub, wal: e.wal}, nil
+}
+
+// Next returns the next record, waiting for one if needed. Like
+// ChangeStream.Next it fails with ErrStreamLagged or ErrEngineClosed.
+//
+// A record is only returned once it is on stable storage, whatever the
+// SyncMode: replicas that applied a record the leader then lost in a crash
+// would diverge from it once it gave the LSN to another record.
+func (s *WALStream) Next(ctx context.Context) (WALEntry, error) {
+	entry, err := s.sub.next(ctx)
+	if err != nil {
+		return WALEntry{}, err
+	}
+	if err := s.wal.flush(entry.LSN); err != nil {
+		return WALEntry{}, err
+	}
+	return entry, nil
+}
+
+func (s *WALStream) Close() {
+	s.sub.close()
+}
+
+// ApplyReplicated logs a record received from a leader under its original
+// LSN and applies it. Records must arrive in sequence, starting right
+// after LastLSN.
+func (e *Engine) ApplyReplicated(entry WALEntry) error {
+	if e.closing.Load() {
+		return ErrEngineClosed
+	}
+	cols := e.lockEntryCollections(entry)
+	err := e.wal.appendReplicated(entry)
+	if err == nil {
+		e.replay(entry)
+	}
+	var build []*collectionIndex
+	if err == nil && entry.Operation == "CREATE_INDEX" && entry.Index != nil {
+		if ci := cols[0].indexes[entry.Index.Name]; ci != nil && ci.state == IndexBuilding {
+			build = append(build, ci)
+		}
+	}
+	for _, col := range cols {
+		col.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, ci := range build {
+		e.startIndexBuild(cols[0], ci)
+	}
+	e.scheduleSave()
+	return e.wal.Sync(entry.LSN)
+}
+
+// lockEntryCollections write-locks the collections entry touches, in name
+// order.
+func (e *Engine) lockEntryCollections(entry WALEntry) []*Collection {
+	names := []string{entry.Collection}
+	if entry.Operation == "TXN" {
+		seen := make(map[string]bool)
+		names = names[:0]
+		for _, op := range entry.Ops {
+			if !seen[op.Collection] {
+				seen[op.Collection] = true
+				names = append(names, op.Collection)
+			}
+		}
+		sort.Strings(names)
+	}
+	cols := make([]*Collection, 0, len(names))
+	for _, name := range names {
+		col := e.GetCollection(name)
+		col.mu.Lock()
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+// SyncWAL makes every record logged so far durable, whatever the
+// durability setting.
+func (e *Engine) SyncWAL() error {
+	return e.wal.flush(e.wal.LastLSN())
+}
+
+// InstallSnapshot replaces the engine's documents and indexes with those
+// of src, an engine opened on a backup of another node, and numbers new
+// records after src's last LSN. Change streams open meanwhile are closed
+// with ErrChangesUnavailable, as the records in between were never logged
+// here. Nothing else may write to the engine while it runs.
+func (e *Engine) InstallSnapshot(src *Engine) error {
+	if e.closing.Load() {
+		return ErrEngineClosed
+	}
+	lsn := src.LastLSN()
+	if last := e.wal.LastLSN(); lsn < last {
+		return fmt.Errorf("%w: the snapshot ends at LSN %d, before the log (%d)", ErrReplicationGap, lsn, last)
+	}
+	e.saveMu.Lock()
+	defer e.saveMu.Unlock()
+
+	names := append(e.ListCollections(), src.ListCollections()...)
+	sort.Strings(names)
+	names = slices.Compact(names)
+	type build struct {
+		col *Collection
+		ci  *collectionIndex
+	}
+	var builds []build
+	for _, name := range names {
+		from := src.GetCollection(name)
+		from.mu.RLock()
+		docs, tombstones, floor, defs := maps.Clone(from.Documents), maps.Clone(from.tombstones), from.floor, from.indexDefinitions()
+		from.mu.RUnlock()
+
+		col := e.GetCollection(name)
+		col.mu.Lock()
+		// Every document either side has is written by the checkpoint
+		// below, which drops those the snapshot lacks.
+		for id := range col.Documents {
+			col.markDirty(id)
+		}
+		for id := range col.tombstones {
+			col.markDirty(id)
+		}
+		for id := range docs {
+			col.markDirty(id)
+		}
+		for id := range tombstones {
+			col.markDirty(id)
+		}
+		col.Documents, col.tombstones, col.floor, col.indexes = docs, tombstones, floor, nil
+		e.registerIndexes(col, defs)
+		for _, name := range sortedIndexNames(col.indexes) {
+			builds = append(builds, build{col, col.indexes[name]})
+		}
+		col.mu.Unlock()
+
+		for _, doc := range docs {
+			if h, err := ParseHLC(doc.HLC); err == nil {
+				e.clock.observe(h)
+			}
+		}
+	}
+	for _, b := range builds {
+		e.startIndexBuild(b.col, b.ci)
+	}
+
+	// The records before lsn are never replayed: once the manifest says
+	// the segments hold them, recovery numbers new records after lsn.
+	if err := e.checkpointThrough(lsn); err != nil {
+		return err
+	}
+	if err := e.wal.EnsureLSN(lsn); err != nil {
+		return err
+	}
+	e.changes.reset(lsn)
+	return nil
+}
@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+// Checkpointed documents live under a segments directory next to the data
+// file, one directory per collection. A collection's segment files are
+// append-only logs of framed document records, and its index log maps each
+// document ID to the record holding its latest version or marks it
+// deleted. A checkpoint appends only the documents changed since the
+// previous one, then replaces the data file with a small manifest holding
+// the checkpoint LSN and how much of each index log it covers. Index
+// entries past that were written by an interrupted checkpoint and are
+// discarded when the collection is next written.
+
+const (
+	segmentMagic     = "HXSEG01\n"
+	indexMagic       = "HXIDX01\n"
+	segmentIndexFile = "index"
+	segmentsDirName  = "segments"
+
+	// manifestFormat distinguishes the manifest from the single JSON
+	// snapshot older versions kept in the data file.
+	manifestFormat = 2
+
+	DefaultSegmentSize = 64 << 20
+)
+
+var ErrSegmentCorrupt = errors.New("segment corrupt")
+
+type manifest struct {
+	Format      int                           `json:"format"`
+	LastLSN     uint64                        `json:"lastLSN"`
+	Collections map[string]manifestCollection `json:"collections"`
+}
+
+type manifestCollection struct {
+	Dir string `json:"dir"`
+	// Index names the index log; compaction starts a new one.
+	Index     string                `json:"index,omitempty"`
+	IndexSize int64                 `json:"indexSize"`
+	Indexes   []indexing.Definition `json:"indexes,omitempty"`
+}
+
+// segmentLocation is the framed record holding a document's latest version.
+type segmentLocation struct {
+	Segment uint32
+	Offset  int64
+	Length  int64
+}
+
+// indexRecord is one entry of a collection's index log.
+type indexRecord struct {
+	ID      string `json:"id"`
+	Segment uint32 `json:"seg,omitempty"`
+	Offset  int64  `json:"off,omitempty"`
+	Length  int64  `json:"len,omitempty"`
+	Deleted bool   `json:"del,omitempty"`
+	// Version is the last version of a deleted document, and HLC the
+	// timestamp of the delete.
+	Version uint64 `json:"ver,omitempty"`
+	HLC     string `json:"hlc,omitempty"`
+	// Floor, in an entry without an ID, is the version floor of the
+	// collection, and HLC that of the latest delete folded into it.
+	Floor uint64 `json:"floor,omitempty"`
+}
+
+// segmentStore is the on-disk state of one collection. The engine only
+// touches it while holding saveMu.
+type segmentStore struct {
+	dir       string
+	name      string
+	locations map[string]segmentLocation
+	// tombstones holds the last version of deleted documents, and floor
+	// the highest one compaction folded away.
+	tombstones map[string]tombstone
+	floor      tombstone
+	active     uint32
+	index      string
+	indexSize  int64
+	// diskBytes counts the record bytes in the segment files and liveBytes
+	// those of the records the index points to; the difference is what
+	// compaction would reclaim.
+	diskBytes int64
+	liveBytes int64
+	// obsolete lists files replaced by compaction, deleted once a manifest
+	// no longer refers to them.
+	obsolete []string
+}
+
+// newSegmentStore returns an empty store for a collection the manifest does
+// not know about, clearing anything an uncommitted checkpoint left behind.
+func newSegmentStore(root, name string) (*segmentStore, error) {
+	s := &segmentStore{
+		dir:       filepath.Join(root, name),
+		name:      name,
+		locations: make(map[string]segmentLocation),
+		active:    1,
+		index:     segmentIndexFile,
+	}
+	if err := os.RemoveAll(s.dir); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSegmentStore reads the committed part of a collection's index log and
+// returns the documents it points to, along with those whose records could
+// not be read. A damaged index log is an error.
+func openSegmentStore(root string, mc manifestCollection) (*segmentStore, map[string]*Document, []CorruptDocument, error) {
+	if mc.IndexSize == 0 {
+		s, err := newSegmentStore(root, mc.Dir)
+		return s, make(map[string]*Document), nil, err
+	}
+	s := &segmentStore{
+		dir:       filepath.Join(root, mc.Dir),
+		name:      mc.Dir,
+		locations: make(map[string]segmentLocation),
+		active:    1,
+		index:     mc.Index,
+		indexSize: mc.IndexSize,
+	}
+	if s.index == "" {
+		s.index = segmentIndexFile
+	}
+
+	if err := s.loadIndex(); err != nil {
+		return nil, nil, nil, err
+	}
+	docs, corrupt, err := s.readDocuments()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	segments, err := s.segmentNumbers()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, n := range segments {
+		info, err := os.Stat(filepath.Join(s.dir, segmentFileName(n)))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if size := info.Size() - int64(len(segmentMagic)); size > 0 {
+			s.diskBytes += size
+		}
+		s.active = n
+	}
+	return s, docs, corrupt, nil
+}
+
+// loadIndex applies the committed part of the index log.
+func (s *segmentStore) loadIndex() error {
+	path := filepath.Join(s.dir, s.index)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSegmentCorrupt, err)
+	}
+	if int64(len(data)) < s.indexSize || !bytes.HasPrefix(data, []byte(indexMagic)) {
+		return segmentCorruption(path, 0, "index log shorter than the checkpoint")
+	}
+	data = data[:s.indexSize]
+	for off := int64(len(indexMagic)); off < int64(len(data)); {
+		payload, end, reason := readFrame(data, off)
+		if reason != "" {
+			return segmentCorruption(path, off, reason)
+		}
+		var rec indexRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return segmentCorruption(path, off, fmt.Sprintf("undecodable index entry: %v", err))
+		}
+		s.apply(rec)
+		off = end
+	}
+	return nil
+}
+
+// apply records an index entry in the in-memory index.
+func (s *segmentStore) apply(rec indexRecord) {
+	if rec.ID == "" {
+		s.floor = s.floor.cover(tombstone{Version: rec.Floor, HLC: rec.HLC})
+		return
+	}
+	if prev, exists := s.locations[rec.ID]; exists {
+		s.liveBytes -= prev.Length
+		delete(s.locations, rec.ID)
+	}
+	delete(s.tombstones, rec.ID)
+	switch {
+	case !rec.Deleted:
+		s.locations[rec.ID] = segmentLocation{Segment: rec.Segment, Offset: rec.Offset, Length: rec.Length}
+		s.liveBytes += rec.Length
+	case rec.Version > 0:
+		if s.tombstones == nil {
+			s.tombstones = make(map[string]tombstone)
+		}
+		s.tombstones[rec.ID] = tombstone{Version: rec.Version, HLC: rec.HLC}
+	}
+}
+
+func (s *segmentStore) copyTombstones() map[string]tombstone {
+	tombstones := make(map[string]tombstone, len(s.tombstones))
+	for id, t := range s.tombstones {
+		tombstones[id] = t
+	}
+	return tombstones
+}
+
+// floorRecord returns the index entry that stands in for the tombstones in
+// a new index log: a floor covering every deleted document.
+func (s *segmentStore) floorRecord() indexRecord {
+	floor := s.floor
+	for _, t := range s.tombstones {
+		floor = floor.cover(t)
+	}
+	return indexRecord{Floor: floor.Version, HLC: floor.HLC}
+}
+
+// garbage is the number of bytes compaction would reclaim: the superseded
+// records in the segments and, at least, the tombstones in the index log.
+func (s *segmentStore) garbage() int64 {
+	garbage := s.diskBytes - s.liveBytes
+	for id := range s.tombstones {
+		garbage += int64(frameHeaderSize + len(id))
+	}
+	return garbage
+}
+
+// readDocuments loads every document the index points to, reading the
+// segments in order. Records that are missing or damaged are returned as
+// corrupt rather than failing the whole collection.
+func (s *segmentStore) readDocuments() (map[string]*Document, []CorruptDocument, error) {
+	bySegment := make(map[uint32][]string)
+	for id, loc := range s.locations {
+		bySegment[loc.Segment] = append(bySegment[loc.Segment], id)
+	}
+
+	docs := make(map[string]*Document, len(s.locations))
+	var corrupt []CorruptDocument
+	for seg, ids := range bySegment {
+		sort.Slice(ids, func(i, j int) bool { return s.locations[ids[i]].Offset < s.locations[ids[j]].Offset })
+		path := filepath.Join(s.dir, segmentFileName(seg))
+		f, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		for _, id := range ids {
+			loc := s.locations[id]
+			bad := CorruptDocument{ID: id, Segment: path, Offset: loc.Offset}
+			if f == nil {
+				bad.Reason = "segment file missing"
+				corrupt = append(corrupt, bad)
+				continue
+			}
+			doc, raw, reason, err := readSegmentRecord(f, loc)
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			if reason == "" && doc.ID != id {
+				reason = fmt.Sprintf("record holds document %q", doc.ID)
+			}
+			if reason != "" {
+				bad.Reason, bad.raw = reason, raw
+				corrupt = append(corrupt, bad)
+				continue
+			}
+			docs[id] = doc
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+	return docs, corrupt, nil
+}
+
+// readSegmentRecord reads the record at loc. A damaged record is reported
+// through reason, with whatever bytes could be read; err is only set for
+// I/O failures.
+func readSegmentRecord(f *os.File, loc segmentLocation) (doc *Document, raw []byte, reason string, err error) {
+	raw = make([]byte, loc.Length)
+	n, err := f.ReadAt(raw, loc.Offset)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, raw[:n], "record extends past end of file", nil
+		}
+		return nil, nil, "", err
+	}
+	payload, end, reason := readFrame(raw, 0)
+	if reason == "" && end != loc.Length {
+		reason = "record length does not match the index"
+	}
+	if reason != "" {
+		return nil, raw, reason, nil
+	}
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, payload, fmt.Sprintf("undecodable document: %v", err), nil
+	}
+	return doc, payload, "", nil
+}
+
+// write appends the changed documents, nil meaning deleted, to the active
+// segment and records their locations in the index log, along with the
+// tombstones of deleted ones and the version floor if it rose. Both are synced before it returns, but the
+// changes only count once a manifest covering the new index size has been
+// written.
+func (s *segmentStore) write(changes map[string]*Document, tombstones map[string]tombstone, floor tombstone, segmentSize int64) error {
+	raised := s.floor.cover(floor) != s.floor
+	if len(changes) == 0 && !raised {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(changes))
+	for id := range changes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	f, size, err := s.openActive()
+	if err != nil {
+		return err
+	}
+	var records []indexRecord
+	if raised {
+		records = append(records, indexRecord{Floor: floor.Version, HLC: floor.HLC})
+	}
+	for _, id := range ids {
+		doc := changes[id]
+		if doc == nil {
+			_, stored := s.locations[id]
+			if t := tombstones[id]; stored || t.Version > s.tombstones[id].Version {
+				records = append(records, indexRecord{ID: id, Deleted: true, Version: t.Version, HLC: t.HLC})
+			}
+			continue
+		}
+		payload, err := json.Marshal(doc)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		frame := encodeFrame(payload)
+		if size > int64(len(segmentMagic)) && size+int64(len(frame)) > segmentSize {
+			if err := syncAndClose(f); err != nil {
+				return err
+			}
+			s.active++
+			if f, size, err = s.openActive(); err != nil {
+				return err
+			}
+		}
+		if _, err := f.Write(frame); err != nil {
+			f.Close()
+			return err
+		}
+		records = append(records, indexRecord{ID: id, Segment: s.active, Offset: size, Length: int64(len(frame))})
+		size += int64(len(frame))
+		s.diskBytes += int64(len(frame))
+	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+
+	if err := s.appendIndex(records); err != nil {
+		return err
+	}
+	// New segment and index files, and the directory of a new collection,
+	// must outlive a crash as much as their contents.
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(s.dir)); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		s.apply(rec)
+	}
+	return nil
+}
+
+// appendIndex adds records to the index log after its committed size,
+// overwriting whatever an interrupted checkpoint wrote there.
+func (s *segmentStore) appendIndex(records []indexRecord) error {
+	var buf bytes.Buffer
+	size := s.indexSize
+	if size == 0 {
+		buf.WriteString(indexMagic)
+	}
+	for _, rec := range records {
+		payload, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf.Write(encodeFrame(payload))
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, s.index), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(buf.Bytes(), size); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+	s.indexSize = size + int64(buf.Len())
+	return nil
+}
+
+// openActive opens the active segment for appending. The size comes from
+// the file itself, so a checkpoint that failed halfway through an append
+// cannot throw off later offsets.
+func (s *segmentStore) openActive() (*os.File, int64, error) {
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentFileName(s.active)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		if _, err := f.Write([]byte(segmentMagic)); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		size = int64(len(segmentMagic))
+	}
+	return f, size, nil
+}
+
+func (s *segmentStore) segmentNumbers() ([]uint32, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var numbers []uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 32)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, uint32(n))
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+func segmentFileName(n uint32) string {
+	return fmt.Sprintf("%06d.seg", n)
+}
+
+// collectionDirName maps a collection name to a directory name that is
+// safe on any filesystem and distinct for distinct names.
+func collectionDirName(name string) string {
+	dir := url.PathEscape(name)
+	if strings.HasPrefix(dir, ".") {
+		dir = "%2E" + dir[1:]
+	}
+	return dir
+}
+
+func segmentCorruption(path string, offset int64, reason string) error {
+	return fmt.Errorf("%w: %s at offset %d: %s", ErrSegmentCorrupt, path, offset, reason)
+}
+
+func syncAndClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes the files created or renamed in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return syncAndClose(d)
+}
+
+// writeManifest atomically and durably replaces the data file with m; the
+// WAL it covers may be truncated as soon as it returns.
+func writeManifest(path string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+var (
+	ErrTxnConflict = errors.New("transaction conflict")
+	ErrTxnDone     = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is a multi-document transaction. Reads see the transaction's own
+// writes; writes are buffered until Commit, which checks that nothing the
+// transaction read has changed since (optimistic concurrency), then logs
+// every write as one WAL entry and applies them together. A Txn is not safe
+// for concurrent use.
+type Txn struct {
+	e       *Engine
+	reads   map[txnKey]uint64
+	writes  map[txnKey]*txnWrite
+	order   []txnKey
+	results []txnKey
+	done    bool
+}
+
+type txnKey struct {
+	collection string
+	id         string
+}
+
+// txnWrite is the final state of one document in a transaction. A nil data
+// with deleted set removes the document.
+type txnWrite struct {
+	data    map[string]interface{}
+	deleted bool
+	// replace is set by Insert, which gives the document a fresh CreatedAt
+	// like InsertDocument does; other writes keep the existing one.
+	replace bool
+	doc     *Document
+}
+
+func (e *Engine) Begin() *Txn {
+	return &Txn{
+		e:      e,
+		reads:  make(map[txnKey]uint64),
+		writes: make(map[txnKey]*txnWrite),
+	}
+}
+
+// Get returns the document as the transaction sees it.
+// Documents written by the transaction carry no version or timestamps
+// until it commits.
+func (t *Txn) Get(collection, id string) (*Document, bool) {
+	key := txnKey{collection, id}
+	if w, staged := t.writes[key]; staged {
+		if w.deleted {
+			return nil, false
+		}
+		return &Document{ID: id, Data: w.data}, true
+	}
+	doc := t.committed(key)
+	return doc, doc != nil
+}
+
+// Check evaluates cond against the document as the transaction sees it.
+// Because the read is validated at commit, the precondition still holds
+// when the transaction's writes are applied.
+func (t *Txn) Check(collection, id string, cond Precondition) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	key := txnKey{collection, id}
+	if w, staged := t.writes[key]; staged {
+		// The version a staged write will get is not known until commit.
+		if w.deleted {
+			return cond.Check(nil)
+		}
+		next := t.reads[key] + 1
+		if doc := t.committed(key); doc == nil {
+			next = t.e.lastVersion(collection, id) + 1
+		}
+		return cond.Check(&Document{ID: id, Version: next})
+	}
+	return cond.Check(t.committed(key))
+}
+
+func (t *Txn) Insert(collection, id string, data map[string]interface{}) error {
+	return t.stage(txnKey{collection, id}, &txnWrite{data: data, replace: true})
+}
+
+func (t *Txn) Upsert(collection, id string, data map[string]interface{}) error {
+	return t.stage(txnKey{collection, id}, &txnWrite{data: data})
+}
+
+func (t *Txn) Update(collection, id string, data map[string]interface{}) error {
+	key := txnKey{collection, id}
+	if _, exists := t.visible(key); !exists {
+		return ErrDocumentNotFound
+	}
+	return t.stage(key, &txnWrite{data: data})
+}
+
+func (t *Txn) Patch(collection, id string, patch Patch) error {
+	key := txnKey{collection, id}
+	current, exists := t.visible(key)
+	if !exists {
+		return ErrDocumentNotFound
+	}
+	data, err := patch.Apply(current)
+	if err != nil {
+		return err
+	}
+	return t.stage(key, &txnWrite{data: data})
+}
+
+func (t *Txn) Delete(collection, id string) error {
+	key := txnKey{collection, id}
+	if _, exists := t.visible(key); !exists {
+		return ErrDocumentNotFound
+	}
+	return t.stage(key, &txnWrite{deleted: true})
+}
+
+func (t *Txn) Rollback() {
+	t.done = true
+	t.writes = nil
+}
+
+// Commit applies the transaction's writes atomically. It returns, for each
+// write call in order, the resulting document (nil for deletes).
+// ErrTxnConflict means another writer changed a document the transaction
+// read; the caller may retry with a new transaction.
+func (t *Txn) Commit() ([]*Document, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+	t.done = true
+	if len(t.order) == 0 {
+		return nil, nil
+	}
+
+	lsn, err := t.apply()
+	if err != nil {
+		return nil, err
+	}
+	// As with single writes, the locks are released before waiting for the
+	// flush so that other writers can join it.
+	if err := t.e.wal.Sync(lsn); err != nil {
+		return nil, err
+	}
+
+	docs := make([]*Document, len(t.results))
+	for i, key := range t.results {
+		docs[i] = t.writes[key].doc
+	}
+	return docs, nil
+}
+
+// apply validates and logs the transaction under the collections' locks and
+// applies its writes, returning the LSN of its WAL record.
+func (t *Txn) apply() (uint64, error) {
+	cols := t.lockCollections()
+	defer func() {
+		for _, col := range cols {
+			col.mu.Unlock()
+		}
+	}()
+
+	for key, version := range t.reads {
+		if current := cols[key.collection].Documents[key.id]; docVersion(current) != version {
+			return 0, fmt.Errorf("%w: %s/%s changed", ErrTxnConflict, key.collection, key.id)
+		}
+	}
+
+	now, hlc := time.Now().UTC(), t.e.clock.now().String()
+	entry := WALEntry{Operation: "TXN", Timestamp: now}
+	for _, key := range t.order {
+		w := t.writes[key]
+		col := cols[key.collection]
+		existing := col.Documents[key.id]
+		op := WALEntry{
+			Collection: key.collection,
+			DocumentID: key.id,
+			HLC:        hlc,
+			Timestamp:  now,
+		}
+		switch {
+		case w.deleted:
+			if existing == nil {
+				continue
+			}
+			op.Operation = "DELETE"
+			op.Version = existing.Version
+		default:
+			doc := &Document{
+				ID:        key.id,
+				Data:      w.data,
+				Version:   col.lastVersion(key.id) + 1,
+				CreatedAt: now,
+				UpdatedAt: now,
+				HLC:       hlc,
+			}
+			op.Operation = "INSERT"
+			if existing != nil && !w.replace {
+				doc.CreatedAt = existing.CreatedAt
+				op.Operation = "UPDATE"
+			}
+			doc.Checksum = computeChecksum(doc)
+			w.doc = doc
+			op.Data = w.data
+			op.Version = doc.Version
+		}
+		entry.Ops = append(entry.Ops, op)
+	}
+
+	if err := t.checkUnique(cols); err != nil {
+		return 0, err
+	}
+	lsn, err := t.e.wal.Append(entry)
+	if err != nil {
+		return 0, fmt.Errorf("writing WAL: %w", err)
+	}
+
+	for _, key := range t.order {
+		w := t.writes[key]
+		if w.deleted {
+			cols[key.collection].remove(key.id, hlc)
+		} else {
+			cols[key.collection].put(w.doc)
+		}
+	}
+	t.e.scheduleSave()
+	return lsn, nil
+}
+
+func (t *Txn) stage(key txnKey, w *txnWrite) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if _, staged := t.writes[key]; !staged {
+		t.order = append(t.order, key)
+	}
+	t.writes[key] = w
+	t.results = append(t.results, key)
+	return nil
+}
+
+// visible returns the data of a document as the transaction sees it,
+// recording a read of the committed version if the transaction has not
+// written it.
+func (t *Txn) visible(key txnKey) (map[string]interface{}, bool) {
+	if w, staged := t.writes[key]; staged {
+		return w.data, !w.deleted
+	}
+	doc := t.committed(key)
+	if doc == nil {
+		return nil, false
+	}
+	return doc.Data, true
+}
+
+func (t *Txn) committed(key txnKey) *Document {
+	doc, _ := t.e.GetDocument(key.collection, key.id)
+	if _, seen := t.reads[key]; !seen {
+		t.reads[key] = docVersion(doc)
+	}
+	return doc
+}
+
+// lockCollections write-locks every collection the transaction touches, in
+// name order so that concurrent commits cannot deadlock.
+func (t *Txn) lockCollections() map[string]*Collection {
+	names := make(map[string]bool)
+	for key := range t.reads {
+		names[key.collection] = true
+	}
+	for _, key := range t.order {
+		names[key.collection] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	cols := make(map[string]*Collection, len(sorted))
+	for _, name := range sorted {
+		col := t.e.GetCollection(name)
+		col.mu.Lock()
+		cols[name] = col
+	}
+	return cols
+}
+
+// checkUnique validates the transaction's writes against unique indexes,
+// both against documents outside the transaction and against each other.
+// The caller must hold the collections' locks.
+func (t *Txn) checkUnique(cols map[string]*Collection) error {
+	written := make(map[string]map[string]bool)
+	for _, key := range t.order {
+		if written[key.collection] == nil {
+			written[key.collection] = make(map[string]bool)
+		}
+		written[key.collection][key.id] = true
+	}
+
+	claimed := make(map[string]string)
+	for _, key := range t.order {
+		w := t.writes[key]
+		if w.deleted {
+			continue
+		}
+		col := cols[key.collection]
+		if err := col.checkUniqueIgnoring(key.id, w.data, written[key.collection]); err != nil {
+			return err
+		}
+		for _, name := range sortedIndexNames(col.indexes) {
+			ci := col.indexes[name]
+			def := ci.index.Definition()
+			if !def.Unique || ci.state == IndexFailed {
+				continue
+			}
+			for _, k := range indexKeys(w.data, def) {
+				slot := key.collection + "\x00" + name + "\x00" + indexing.HashKey(k)
+				if other, taken := claimed[slot]; taken && other != key.id {
+					return &UniqueViolationError{
+						Collection: key.collection,
+						Index:      name,
+						Fields:     def.Fields,
+						Key:        k,
+						ExistingID: other,
+					}
+				}
+				claimed[slot] = key.id
+			}
+		}
+	}
+	return nil
+}
+
+func docVersion(doc *Document) uint64 {
+	if doc == nil {
+		return 0
+	}
+	return doc.Version
+}
+
+// lastVersion is Collection.lastVersion under the collection's lock.
+func (e *Engine) lastVersion(collection, id string) uint64 {
+	col := e.GetCollection(collection)
+	col.mu.RLock()
+	defer col.mu.RUnlock()
+	return col.lastVersion(id)
+}
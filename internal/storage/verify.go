@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+)
+
+// Checks a VerifyProblem can belong to.
+const (
+	CheckDataFile = "datafile"
+	CheckDocument = "document"
+	CheckIndex    = "index"
+	CheckWAL      = "wal"
+)
+
+// VerifyReport is the result of an offline integrity check of a data
+// directory.
+type VerifyReport struct {
+	DataFile string `json:"dataFile"`
+	// Format is "segments", "legacy" for a single JSON snapshot, or
+	// "missing" when there is no data file yet.
+	Format        string              `json:"format"`
+	CheckpointLSN uint64              `json:"checkpointLSN"`
+	Collections   []VerifyCollection  `json:"collections"`
+	WAL           VerifyWAL           `json:"wal"`
+	Problems      []VerifyProblem     `json:"problems"`
+	Repair        *VerifyRepairResult `json:"repair,omitempty"`
+}
+
+type VerifyCollection struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+	Indexes   int    `json:"indexes"`
+}
+
+type VerifyWAL struct {
+	Segments         int    `json:"segments"`
+	ArchivedSegments int    `json:"archivedSegments"`
+	Records          int    `json:"records"`
+	FirstLSN         uint64 `json:"firstLSN,omitempty"`
+	LastLSN          uint64 `json:"lastLSN,omitempty"`
+}
+
+// VerifyProblem is one inconsistency found by Verify.
+type VerifyProblem struct {
+	Check      string `json:"check"`
+	Collection string `json:"collection,omitempty"`
+	ID         string `json:"id,omitempty"`
+	File       string `json:"file,omitempty"`
+	Offset     int64  `json:"offset,omitempty"`
+	Message    string `json:"message"`
+}
+
+// VerifyRepairResult records what a repair run changed; the problems left
+// afterwards are those of the enclosing report.
+type VerifyRepairResult struct {
+	Found         int               `json:"found"`
+	Corrupt       []CorruptDocument `json:"corrupt,omitempty"`
+	TornTail      *TornTail         `json:"tornTail,omitempty"`
+	QuarantineDir string            `json:"quarantineDir,omitempty"`
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problem(p VerifyProblem) {
+	r.Problems = append(r.Problems, p)
+}
+
+// Verify checks a data directory that no engine has open: the manifest and
+// index logs, every document record and checksum, the secondary index
+// definitions and unique constraints, and the framing and LSN ordering of
+// the WAL, including archived segments when opts.WAL.ArchiveDir is set. It
+// never writes. Problems are listed in the report; an error means the
+// check itself could not run.
+func Verify(dataFile, walDir string, opts Options) (*VerifyReport, error) {
+	report := &VerifyReport{DataFile: dataFile, Problems: []VerifyProblem{}}
+
+	collections, err := verifyDataFile(report, dataFile)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := collections[name]
+		report.Collections = append(report.Collections, VerifyCollection{Name: name, Documents: len(c.docs), Indexes: len(c.indexes)})
+		verifyIndexes(report, name, c.docs, c.indexes)
+	}
+
+	if err := verifyWAL(report, walDir, opts.WAL.ArchiveDir); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+type verifiedCollection struct {
+	docs    map[string]*Document
+	indexes []indexing.Definition
+}
+
+func verifyDataFile(report *VerifyReport, dataFile string) (map[string]verifiedCollection, error) {
+	collections := make(map[string]verifiedCollection)
+	data, err := os.ReadFile(dataFile)
+	if os.IsNotExist(err) {
+		report.Format = "missing"
+		return collections, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &struct {
+		Format *int `json:"format"`
+	}{&m.Format}); err != nil {
+		report.problem(VerifyProblem{Check: CheckDataFile, File: dataFile, Message: fmt.Sprintf("unreadable data file: %v", err)})
+		return collections, nil
+	}
+
+	if m.Format != manifestFormat {
+		report.Format = "legacy"
+		var dd legacyData
+		if err := json.Unmarshal(data, &dd); err != nil {
+			report.problem(VerifyProblem{Check: CheckDataFile, File: dataFile, Message: fmt.Sprintf("unreadable data file: %v", err)})
+			return collections, nil
+		}
+		report.CheckpointLSN = dd.LastLSN
+		names := make([]string, 0, len(dd.Collections))
+		for name := range dd.Collections {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			docs := dd.Collections[name]
+			for id, doc := range docs {
+				if doc == nil || doc.ID != id {
+					report.problem(VerifyProblem{Check: CheckDocument, Collection: name, ID: id, File: dataFile, Message: "document is stored under another ID"})
+					delete(docs, id)
+				}
+			}
+			verifyDocuments(report, name, docs, nil)
+			collections[name] = verifiedCollection{docs: docs, indexes: dd.Indexes[name]}
+		}
+		for name, defs := range dd.Indexes {
+			if _, exists := collections[name]; !exists {
+				collections[name] = verifiedCollection{docs: map[string]*Document{}, indexes: defs}
+			}
+		}
+		return collections, nil
+	}
+
+	report.Format = "segments"
+	if err := json.Unmarshal(data, &m); err != nil {
+		report.problem(VerifyProblem{Check: CheckDataFile, File: dataFile, Message: fmt.Sprintf("unreadable manifest: %v", err)})
+		return collections, nil
+	}
+	report.CheckpointLSN = m.LastLSN
+	root := filepath.Join(filepath.Dir(dataFile), segmentsDirName)
+	names := make([]string, 0, len(m.Collections))
+	for name := range m.Collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mc := m.Collections[name]
+		c := verifiedCollection{docs: map[string]*Document{}, indexes: mc.Indexes}
+		collections[name] = c
+		if mc.Dir != collectionDirName(name) {
+			report.problem(VerifyProblem{Check: CheckDataFile, Collection: name, File: dataFile, Message: fmt.Sprintf("collection directory is %q, want %q", mc.Dir, collectionDirName(name))})
+		}
+		if mc.IndexSize == 0 {
+			continue
+		}
+		s := &segmentStore{
+			dir:       filepath.Join(root, mc.Dir),
+			name:      mc.Dir,
+			locations: make(map[string]segmentLocation),
+			index:     mc.Index,
+			indexSize: mc.IndexSize,
+		}
+		if s.index == "" {
+			s.index = segmentIndexFile
+		}
+		if err := s.loadIndex(); err != nil {
+			if !errors.Is(err, ErrSegmentCorrupt) {
+				return nil, err
+			}
+			report.problem(VerifyProblem{Check: CheckDataFile, Collection: name, File: filepath.Join(s.dir, s.index), Message: err.Error()})
+			continue
+		}
+		docs, corrupt, err := s.readDocuments()
+		if err != nil {
+			return nil, err
+		}
+		c.docs = docs
+		collections[name] = c
+		verifyDocuments(report, name, docs, corrupt)
+	}
+	return collections, nil
+}
+
+// verifyDocuments reports the damaged records and checksum mismatches of a
+// collection, leaving only intact documents in docs.
+func verifyDocuments(report *VerifyReport, collection string, docs map[string]*Document, corrupt []CorruptDocument) {
+	corrupt = append(corrupt, verifyChecksums(collection, docs)...)
+	sort.Slice(corrupt, func(i, j int) bool { return corrupt[i].ID < corrupt[j].ID })
+	for _, bad := range corrupt {
+		report.problem(VerifyProblem{
+			Check:      CheckDocument,
+			Collection: collection,
+			ID:         bad.ID,
+			File:       bad.Segment,
+			Offset:     bad.Offset,
+			Message:    bad.Reason,
+		})
+	}
+}
+
+// verifyIndexes rebuilds the secondary indexes of a collection to check
+// their definitions and unique constraints.
+func verifyIndexes(report *VerifyReport, collection string, docs map[string]*Document, defs []indexing.Definition) {
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, def := range defs {
+		idx, err := indexing.New(def)
+		if err != nil {
+			report.problem(VerifyProblem{Check: CheckIndex, Collection: collection, Message: fmt.Sprintf("index %s: %v", def.Name, err)})
+			continue
+		}
+		def = idx.Definition()
+		for _, id := range ids {
+			keys := indexKeys(docs[id].Data, def)
+			if def.Unique {
+				if other, key, dup := uniqueConflict(idx, id, keys, nil); dup {
+					report.problem(VerifyProblem{
+						Check:      CheckIndex,
+						Collection: collection,
+						ID:         id,
+						Message:    fmt.Sprintf("unique index %s: key %s is also held by %s", def.Name, indexing.HashKey(key), other),
+					})
+					continue
+				}
+			}
+			idx.Insert(id, keys)
+		}
+	}
+}
+
+// verifyWAL checks the framing of every WAL segment and that LSNs increase
+// by one from the first record of each segment, which must match its name.
+// The live log must also pick up where the checkpoint left off.
+func verifyWAL(report *VerifyReport, walDir, archiveDir string) error {
+	if archiveDir != "" {
+		archived, err := listSegments(archiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.WAL.ArchivedSegments = len(archived)
+		if _, err := verifyWALSegments(report, archived, false); err != nil {
+			return err
+		}
+	}
+
+	segments, err := listSegments(walDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	legacy := filepath.Join(walDir, legacyWALFile)
+	if _, err := os.Stat(legacy); err == nil {
+		segments = append([]walSegment{{path: legacy}}, segments...)
+	}
+	report.WAL.Segments = len(segments)
+	first, err := verifyWALSegments(report, segments, true)
+	if err != nil {
+		return err
+	}
+	if first > report.CheckpointLSN+1 {
+		report.problem(VerifyProblem{
+			Check:   CheckWAL,
+			File:    walDir,
+			Message: fmt.Sprintf("records %d to %d after the checkpoint are missing", report.CheckpointLSN+1, first-1),
+		})
+	}
+	return nil
+}
+
+// verifyWALSegments scans segments in order and returns the first LSN they
+// hold. When live is set the last segment is the active one, and the
+// records are counted in the report.
+func verifyWALSegments(report *VerifyReport, segments []walSegment, live bool) (uint64, error) {
+	var first, prev uint64
+	for i, seg := range segments {
+		scan, err := scanSegment(seg.path, live && i == len(segments)-1)
+		var corrupt *WALCorruptionError
+		if errors.As(err, &corrupt) {
+			report.problem(VerifyProblem{Check: CheckWAL, File: corrupt.Segment, Offset: corrupt.Offset, Message: corrupt.Reason})
+		} else if err != nil {
+			return 0, err
+		}
+		if scan.tail != nil {
+			report.problem(VerifyProblem{
+				Check:   CheckWAL,
+				File:    scan.tail.Segment,
+				Offset:  scan.tail.Offset,
+				Message: fmt.Sprintf("torn tail of %d bytes: %s", scan.tail.Bytes, scan.tail.Reason),
+			})
+		}
+
+		for j, entry := range scan.entries {
+			if entry.LSN == 0 {
+				// Records of the line-based log carry no LSN.
+				continue
+			}
+			switch {
+			case j == 0 && seg.first != 0 && entry.LSN != seg.first:
+				report.problem(VerifyProblem{Check: CheckWAL, File: seg.path, Message: fmt.Sprintf("segment starts at LSN %d, not %d as named", entry.LSN, seg.first)})
+			case prev != 0 && entry.LSN != prev+1:
+				report.problem(VerifyProblem{Check: CheckWAL, File: seg.path, Message: fmt.Sprintf("LSN %d follows %d", entry.LSN, prev)})
+			}
+			if first == 0 {
+				first = entry.LSN
+			}
+			prev = entry.LSN
+		}
+		if live {
+			report.WAL.Records += len(scan.entries)
+		}
+	}
+	if live {
+		report.WAL.FirstLSN, report.WAL.LastLSN = first, prev
+	}
+	return first, nil
+}
+
+// Repair verifies the data directory and, if anything is wrong, opens it
+// with checksum verification and automatic recovery: corrupt documents are
+// quarantined and restored from the WAL or opts.RepairSources where
+// possible, a torn WAL tail is cut off, and the result is checkpointed. It
+// then verifies again. Damage in the middle of the WAL cannot be repaired.
+func Repair(dataFile, walDir string, opts Options) (*VerifyReport, error) {
+	before, err := Verify(dataFile, walDir, opts)
+	if err != nil || before.OK() {
+		return before, err
+	}
+
+	opts.VerifyChecksums, opts.AutoRecover, opts.AutoCompact = true, true, false
+	engine, err := NewEngineWithOptions(dataFile, walDir, opts)
+	if err != nil {
+		return nil, fmt.Errorf("repair: %w", err)
+	}
+	recovery := engine.RecoveryReport()
+	if err := engine.Close(); err != nil {
+		return nil, fmt.Errorf("repair: %w", err)
+	}
+
+	after, err := Verify(dataFile, walDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	after.Repair = &VerifyRepairResult{
+		Found:         len(before.Problems),
+		Corrupt:       recovery.Corrupt,
+		TornTail:      recovery.TornTail,
+		QuarantineDir: recovery.QuarantineDir,
+	}
+	return after, nil
+}
@@ -1,99 +1,897 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/developer51709/helixdb/internal/indexing"
 )
 
+// DefaultWALSegmentSize is the size at which a WAL segment is sealed and a
+// new one started.
+const DefaultWALSegmentSize = 64 << 20
+
+// legacyWALFile is the single, unsegmented log written by older versions.
+// It is replayed once and removed at the first checkpoint.
+const legacyWALFile = "current.wal"
+
+// walMagic starts every framed segment. Segments without it hold one JSON
+// record per line, as written by older versions.
+const walMagic = "HXWAL01\n"
+
+// frameHeaderSize is the size of the header before each framed record: the
+// payload length and its CRC32C, both little-endian uint32.
+const frameHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrWALCorrupt = errors.New("WAL corrupt")
+
+// WALCorruptionError locates a damaged record.
+type WALCorruptionError struct {
+	Segment string
+	Offset  int64
+	Reason  string
+}
+
+func (e *WALCorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d: %s", ErrWALCorrupt, e.Segment, e.Offset, e.Reason)
+}
+
+func (e *WALCorruptionError) Unwrap() error {
+	return ErrWALCorrupt
+}
+
+// TornTail describes an incomplete record cut off the end of the log when
+// it was opened, typically left by a crash in the middle of a write.
+type TornTail struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Bytes   int64  `json:"bytes"`
+	Reason  string `json:"reason"`
+}
+
 type WALEntry struct {
+	LSN        uint64                 `json:"lsn,omitempty"`
 	Operation  string                 `json:"operation"`
 	Collection string                 `json:"collection"`
 	DocumentID string                 `json:"documentId"`
 	Data       map[string]interface{} `json:"data,omitempty"`
+	Version    uint64                 `json:"version,omitempty"`
+	HLC        string                 `json:"hlc,omitempty"`
+	Index      *indexing.Definition   `json:"index,omitempty"`
+	Ops        []WALEntry             `json:"ops,omitempty"`
 	Timestamp  time.Time              `json:"timestamp"`
+	// CreatedAt and UpdatedAt are set on the INSERT of an imported
+	// document, whose times are not that of the record.
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+}
+
+type WALOptions struct {
+	// SegmentSize is the size in bytes at which the active segment is
+	// rotated. Zero means DefaultWALSegmentSize.
+	SegmentSize int64
+	// ArchiveDir, when set, receives checkpointed segments instead of them
+	// being deleted.
+	ArchiveDir string
+	// Sync chooses when records are flushed to stable storage. Empty means
+	// SyncAlways.
+	Sync SyncMode
+	// MaxSyncDelay is how long a SyncBatched flush waits for more records
+	// to join it. Zero means DefaultMaxSyncDelay.
+	MaxSyncDelay time.Duration
 }
 
+// SyncMode is the durability guarantee of an acknowledged write.
+type SyncMode string
+
+const (
+	// SyncAlways acknowledges a write once it is fsynced. Writers that
+	// arrive while a flush is running share the next one.
+	SyncAlways SyncMode = "always"
+	// SyncBatched holds each flush for up to MaxSyncDelay so that more
+	// writers share it, trading latency for throughput.
+	SyncBatched SyncMode = "batched"
+	// SyncOS never fsyncs on write and leaves flushing to the operating
+	// system; a machine crash can lose acknowledged writes.
+	SyncOS SyncMode = "os"
+)
+
+const DefaultMaxSyncDelay = 5 * time.Millisecond
+
+// WAL is a write-ahead log split into segment files named after the log
+// sequence number (LSN) of their first record. LSNs increase by one per
+// record.
 type WAL struct {
-	dir  string
-	file *os.File
-	mu   sync.Mutex
+	dir     string
+	opts    WALOptions
+	file    *os.File
+	size    int64
+	nextLSN uint64
+	torn    *TornTail
+	mu      sync.Mutex
+
+	// Group commit state: synced is the highest LSN known to be on stable
+	// storage, syncing is set while a writer flushes on behalf of everyone
+	// waiting on cond, and syncErr poisons the log after a failed flush.
+	synced  uint64
+	syncing bool
+	syncErr error
+	cond    *sync.Cond
+	// failed is set with syncErr, for readers that check it without mu.
+	failed atomic.Bool
+
+	// holds maps the name of each reader that still needs records to the
+	// last LSN it has consumed; Truncate keeps everything after the
+	// lowest.
+	holds map[string]uint64
+
+	// onAppend, if set, is called under mu with every record appended.
+	onAppend func(WALEntry)
+	// readOnly rejects Append; records then only arrive through
+	// appendReplicated.
+	readOnly bool
+	// propose, if set, replicates records before they are logged; see
+	// Engine.SetProposer.
+	propose Proposer
 }
 
-func NewWAL(dir string) (*WAL, error) {
+func NewWAL(dir string, opts WALOptions) (*WAL, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("creating WAL directory: %w", err)
 	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultWALSegmentSize
+	}
+	switch opts.Sync {
+	case "":
+		opts.Sync = SyncAlways
+	case SyncAlways, SyncBatched, SyncOS:
+	default:
+		return nil, fmt.Errorf("unknown WAL sync mode %q", opts.Sync)
+	}
+	if opts.MaxSyncDelay <= 0 {
+		opts.MaxSyncDelay = DefaultMaxSyncDelay
+	}
+	w := &WAL{dir: dir, opts: opts, nextLSN: 1}
+	w.cond = sync.NewCond(&w.mu)
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		if err := w.openSegment(w.nextLSN); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	// Continue numbering after the last record of the newest segment, first
+	// cutting off any record a crash left half-written.
+	last := segments[len(segments)-1]
+	scan, err := scanSegment(last.path, true)
+	if err != nil {
+		return nil, err
+	}
+	if scan.tail != nil {
+		if err := os.Truncate(last.path, scan.tail.Offset); err != nil {
+			return nil, fmt.Errorf("truncating torn WAL tail: %w", err)
+		}
+		w.torn = scan.tail
+	}
+	w.nextLSN = last.first
+	for _, entry := range scan.entries {
+		if entry.LSN >= w.nextLSN {
+			w.nextLSN = entry.LSN + 1
+		}
+	}
+	w.synced = w.nextLSN - 1
+
+	if !scan.framed {
+		// Never append framed records to an old line-format segment.
+		if err := w.openSegment(w.nextLSN); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+	if err := w.openSegment(last.first); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
 
-	walPath := filepath.Join(dir, "current.wal")
-	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Write appends the entry and waits until it is durable. It returns the
+// entry's LSN.
+func (w *WAL) Write(entry WALEntry) (uint64, error) {
+	lsn, err := w.Append(entry)
 	if err != nil {
-		return nil, fmt.Errorf("opening WAL file: %w", err)
+		return 0, err
 	}
+	return lsn, w.Sync(lsn)
+}
 
-	return &WAL{dir: dir, file: f}, nil
+// Append assigns the entry the next LSN and writes it to the active segment
+// without waiting for it to reach stable storage; call Sync with the LSN
+// before acknowledging the write. With a proposer set, the entry is handed
+// to it instead, and is logged once committed.
+func (w *WAL) Append(entry WALEntry) (uint64, error) {
+	w.mu.Lock()
+	if w.readOnly {
+		w.mu.Unlock()
+		return 0, ErrReadOnly
+	}
+	if propose := w.propose; propose != nil {
+		w.mu.Unlock()
+		return propose(entry)
+	}
+	defer w.mu.Unlock()
+	entry.LSN = w.nextLSN
+	return w.appendLocked(entry)
 }
 
-func (w *WAL) Write(entry WALEntry) error {
+// appendReplicated appends a record copied from another log, which must
+// be the next one in sequence.
+func (w *WAL) appendReplicated(entry WALEntry) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if entry.LSN != w.nextLSN {
+		return fmt.Errorf("%w: got LSN %d, expected %d", ErrReplicationGap, entry.LSN, w.nextLSN)
+	}
+	_, err := w.appendLocked(entry)
+	return err
+}
 
-	data, err := json.Marshal(entry)
+func (w *WAL) appendLocked(entry WALEntry) (uint64, error) {
+	if w.syncErr != nil {
+		return 0, w.syncErr
+	}
+
+	payload, err := json.Marshal(entry)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	data = append(data, '\n')
+	data := encodeFrame(payload)
 
+	if w.size > int64(len(walMagic)) && w.size+int64(len(data)) > w.opts.SegmentSize {
+		if err := w.rotate(entry.LSN); err != nil {
+			return 0, err
+		}
+	}
 	if _, err := w.file.Write(data); err != nil {
-		return err
+		// Cut off whatever part of the record made it to the file, so that
+		// the next one does not land after garbage. If even that fails, the
+		// log refuses further records.
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.fail(fmt.Errorf("writing WAL: %w", err))
+		}
+		return 0, err
+	}
+	w.size += int64(len(data))
+	w.nextLSN++
+	if w.onAppend != nil {
+		w.onAppend(entry)
+	}
+	return entry.LSN, nil
+}
+
+// fail poisons the log with err. The caller must hold w.mu.
+func (w *WAL) fail(err error) {
+	w.syncErr = err
+	w.failed.Store(true)
+}
+
+// Err returns the error that poisoned the log, if any: appended records may
+// then not be on stable storage, and no more are accepted.
+func (w *WAL) Err() error {
+	if !w.failed.Load() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncErr
+}
+
+// Sync blocks until every record up to lsn is durable under the configured
+// SyncMode. Concurrent callers are served by a single fsync: the first one
+// in flushes everything appended so far while the rest wait for it.
+func (w *WAL) Sync(lsn uint64) error {
+	if w.opts.Sync == SyncOS {
+		return nil
 	}
-	return w.file.Sync()
+	return w.flush(lsn)
 }
 
+// flush is Sync regardless of the SyncMode.
+func (w *WAL) flush(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < lsn {
+		if w.syncErr != nil {
+			return w.syncErr
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		w.syncing = true
+		if w.opts.Sync == SyncBatched {
+			w.mu.Unlock()
+			time.Sleep(w.opts.MaxSyncDelay)
+			w.mu.Lock()
+		}
+		target, f := w.nextLSN-1, w.file
+		w.mu.Unlock()
+		err := f.Sync()
+		w.mu.Lock()
+		w.syncing = false
+
+		// A segment rotated or closed meanwhile was synced before closing.
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			w.fail(fmt.Errorf("syncing WAL: %w", err))
+		} else if target > w.synced {
+			w.synced = target
+		}
+		w.cond.Broadcast()
+	}
+	return nil
+}
+
+// TornTail reports the incomplete record removed when the log was opened,
+// if there was one.
+func (w *WAL) TornTail() *TornTail {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.torn
+}
+
+// LastLSN returns the LSN of the most recently written record, or 0.
+func (w *WAL) LastLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.nextLSN - 1
+}
+
+// EnsureLSN makes sure new records are numbered after lsn. The engine calls
+// it with the checkpoint LSN, which is ahead of the log when every segment
+// holding those records has been removed.
+func (w *WAL) EnsureLSN(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if lsn < w.nextLSN {
+		return nil
+	}
+	w.nextLSN = lsn + 1
+	return w.rotate(w.nextLSN)
+}
+
+// ReadAll returns every record in the log: first any legacy records, which
+// have no LSN, then the segments in order. A damaged record anywhere but at
+// the very end of the legacy log is reported as a *WALCorruptionError.
 func (w *WAL) ReadAll() ([]WALEntry, error) {
-	walPath := filepath.Join(w.dir, "current.wal")
-	data, err := os.ReadFile(walPath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// The legacy log was the active log when it was last written, so it may
+	// end in a torn record; that record is skipped.
+	legacy, err := scanSegment(filepath.Join(w.dir, legacyWALFile), true)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	entries := legacy.entries
+
+	segments, err := w.segments()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+		return nil, err
+	}
+	for _, seg := range segments {
+		scan, err := scanSegment(seg.path, false)
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, scan.entries...)
+	}
+	return entries, nil
+}
+
+// History returns every record still on disk: those in the archive
+// directory, if one is set, followed by those in the log.
+func (w *WAL) History() ([]WALEntry, error) {
+	var entries []WALEntry
+	if w.opts.ArchiveDir != "" {
+		archived, err := ReadWALDir(w.opts.ArchiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		entries = archived
+	}
+
+	live, err := w.ReadAll()
+	if err != nil {
 		return nil, err
 	}
+	// A segment being archived can briefly be in both places.
+	if n := len(entries); n > 0 {
+		last := entries[n-1].LSN
+		for len(live) > 0 && live[0].LSN != 0 && live[0].LSN <= last {
+			live = live[1:]
+		}
+	}
+	return append(entries, live...), nil
+}
 
+// Read returns, in order, up to limit records after since (all of them if
+// limit is not positive) from the archive directory, if one is set, and the
+// log. Unlike History it skips the segments that end before since+1 and
+// stops reading once it has limit records.
+func (w *WAL) Read(since uint64, limit int) ([]WALEntry, error) {
 	var entries []WALEntry
-	for _, line := range splitLines(data) {
-		if len(line) == 0 {
-			continue
+	// add appends the records after since and reports whether there are
+	// limit of them.
+	add := func(records []WALEntry) bool {
+		for _, entry := range records {
+			// A segment being archived can briefly be in both places.
+			if entry.LSN <= since || (len(entries) > 0 && entry.LSN <= entries[len(entries)-1].LSN) {
+				continue
+			}
+			entries = append(entries, entry)
+			if limit > 0 && len(entries) >= limit {
+				return true
+			}
 		}
-		var entry WALEntry
-		if err := json.Unmarshal(line, &entry); err != nil {
-			continue
+		return false
+	}
+	// read adds the records of segments, starting with the one holding
+	// since+1.
+	read := func(segments []walSegment) (bool, error) {
+		start := 0
+		for i, seg := range segments {
+			if seg.first <= since+1 {
+				start = i
+			}
 		}
-		entries = append(entries, entry)
+		for _, seg := range segments[start:] {
+			scan, err := scanSegment(seg.path, false)
+			if err != nil {
+				return false, err
+			}
+			if add(scan.entries) {
+				return true, nil
+			}
+		}
+		return false, nil
 	}
-	return entries, nil
+
+	w.mu.Lock()
+	live, err := w.segments()
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if w.opts.ArchiveDir != "" && (len(live) == 0 || live[0].first > since+1) {
+		archived, err := listSegments(w.opts.ArchiveDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if done, err := read(archived); done || err != nil {
+			return entries, err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	legacy, err := scanSegment(filepath.Join(w.dir, legacyWALFile), true)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if add(legacy.entries) {
+		return entries, nil
+	}
+	// Segments may have been archived since they were listed.
+	if live, err = w.segments(); err != nil {
+		return nil, err
+	}
+	_, err = read(live)
+	return entries, err
+}
+
+// Truncate removes (or archives) every sealed segment whose records all have
+// an LSN at or below lsn, along with the legacy log. The active segment is
+// always kept.
+func (w *WAL) Truncate(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, held := range w.holds {
+		lsn = min(lsn, held)
+	}
+
+	if err := os.Remove(filepath.Join(w.dir, legacyWALFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(segments); i++ {
+		// A segment ends just before the next one starts.
+		if segments[i+1].first-1 > lsn {
+			break
+		}
+		if err := w.retire(segments[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hold keeps the records after lsn from being truncated until the hold
+// named name is moved or released.
+func (w *WAL) Hold(name string, lsn uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.holds == nil {
+		w.holds = make(map[string]uint64)
+	}
+	w.holds[name] = lsn
+}
+
+func (w *WAL) Release(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.holds, name)
 }
 
 func (w *WAL) Close() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	w.synced = w.nextLSN - 1
 	return w.file.Close()
 }
 
-func splitLines(data []byte) [][]byte {
-	var lines [][]byte
-	start := 0
-	for i, b := range data {
-		if b == '\n' {
-			lines = append(lines, data[start:i])
-			start = i + 1
+// retire removes a checkpointed segment, or moves it to the archive. The
+// archived copy is durable before the segment leaves the WAL directory.
+func (w *WAL) retire(path string) error {
+	if w.opts.ArchiveDir == "" {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(w.opts.ArchiveDir, 0755); err != nil {
+		return fmt.Errorf("creating WAL archive directory: %w", err)
+	}
+	dest := filepath.Join(w.opts.ArchiveDir, filepath.Base(path))
+	if err := os.Rename(path, dest); err != nil {
+		// The archive may be on another filesystem.
+		if err := copyDurably(path, dest); err != nil {
+			return fmt.Errorf("archiving WAL segment: %w", err)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if err := syncDir(w.opts.ArchiveDir); err != nil {
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// copyDurably copies src to dest through a temporary file, syncing both
+// the copy and the directory it is renamed into.
+func copyDurably(src, dest string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncAndClose(f); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dest))
+}
+
+// rotate seals the active segment and starts a new one whose first record
+// will have the given LSN. The caller must hold w.mu.
+func (w *WAL) rotate(first uint64) error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.synced = w.nextLSN - 1
+	return w.openSegment(first)
+}
+
+func (w *WAL) openSegment(first uint64) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(first)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening WAL segment: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	if w.size == 0 {
+		if _, err := f.Write([]byte(walMagic)); err != nil {
+			return fmt.Errorf("writing WAL segment header: %w", err)
+		}
+		w.size = int64(len(walMagic))
+	}
+	return nil
+}
+
+type walSegment struct {
+	first uint64
+	path  string
+}
+
+func (w *WAL) segments() ([]walSegment, error) {
+	return listSegments(w.dir)
+}
+
+func listSegments(dir string) ([]walSegment, error) {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, entry := range names {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".wal") || name == legacyWALFile {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d.wal", first)
+}
+
+type segmentScan struct {
+	entries []WALEntry
+	framed  bool
+	// tail is set when the segment ends in an incomplete record.
+	tail *TornTail
+}
+
+// scanSegment decodes a segment. If last is set, a damaged final record is
+// treated as torn and reported in the result; otherwise, and for damage
+// followed by more data, it returns a *WALCorruptionError.
+func scanSegment(path string, last bool) (segmentScan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return segmentScan{}, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte(walMagic)):
+		return scanFramed(path, data, last)
+	case len(data) < len(walMagic) && bytes.HasPrefix([]byte(walMagic), data):
+		// Crashed while writing the header of a new segment.
+		scan := segmentScan{framed: true}
+		if len(data) > 0 {
+			if !last {
+				return scan, &WALCorruptionError{Segment: path, Offset: 0, Reason: "truncated segment header"}
+			}
+			scan.tail = &TornTail{Segment: path, Offset: 0, Bytes: int64(len(data)), Reason: "truncated segment header"}
+		}
+		return scan, nil
+	}
+	return scanLines(path, data, last)
+}
+
+func scanFramed(path string, data []byte, last bool) (segmentScan, error) {
+	scan := segmentScan{framed: true}
+	size := int64(len(data))
+	off := int64(len(walMagic))
+
+	damaged := func(reason string, end int64) error {
+		if last && end >= size {
+			scan.tail = &TornTail{Segment: path, Offset: off, Bytes: size - off, Reason: reason}
+			return nil
+		}
+		return &WALCorruptionError{Segment: path, Offset: off, Reason: reason}
+	}
+
+	for off < size {
+		payload, end, reason := readFrame(data, off)
+		if reason != "" {
+			return scan, damaged(reason, end)
+		}
+		var entry WALEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return scan, &WALCorruptionError{Segment: path, Offset: off, Reason: fmt.Sprintf("undecodable record: %v", err)}
+		}
+		scan.entries = append(scan.entries, entry)
+		off = end
+	}
+	return scan, nil
+}
+
+// ReadWALDir decodes every segment in a directory that is not being
+// written to, such as a WAL archive or the wal directory of a backup. Any
+// damage is an error.
+func ReadWALDir(dir string) ([]WALEntry, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []WALEntry
+	for _, seg := range segments {
+		scan, err := scanSegment(seg.path, false)
+		if err != nil {
+			return nil, err
 		}
+		entries = append(entries, scan.entries...)
+	}
+	return entries, nil
+}
+
+// WriteWALSegment writes entries to dir as one sealed segment.
+func WriteWALSegment(dir string, entries []WALEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	data, err := encodeSegment(entries)
+	if err != nil {
+		return err
 	}
-	if start < len(data) {
-		lines = append(lines, data[start:])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, segmentName(entries[0].LSN)))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return syncAndClose(f)
+}
+
+func encodeSegment(entries []WALEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(walMagic)
+	for _, entry := range entries {
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodeFrame(payload))
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeFrame prefixes payload with its length and CRC32C.
+func encodeFrame(payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+	copy(frame[frameHeaderSize:], payload)
+	return frame
+}
+
+// readFrame decodes the framed record at off in data. If the record is
+// damaged it returns why, with end set to how far the damage extends: to
+// the end of data when the record may simply have been cut short.
+func readFrame(data []byte, off int64) (payload []byte, end int64, reason string) {
+	size := int64(len(data))
+	if size-off < frameHeaderSize {
+		return nil, size, "truncated record header"
+	}
+	length := int64(binary.LittleEndian.Uint32(data[off : off+4]))
+	sum := binary.LittleEndian.Uint32(data[off+4 : off+8])
+	end = off + frameHeaderSize + length
+	if length == 0 {
+		// Written records are never empty; zeros are space the filesystem
+		// allocated for a write that never landed.
+		if bytes.Count(data[off:], []byte{0}) != int(size-off) {
+			return nil, off + frameHeaderSize, "zero-length record"
+		}
+		return nil, size, "zero-filled tail"
+	}
+	if end > size {
+		// Only the last record written can be cut short. An intact record
+		// after this one means its length is damaged instead.
+		if frameAfter(data, off+frameHeaderSize) {
+			return nil, off + frameHeaderSize, "damaged record length"
+		}
+		return nil, size, "record extends past end of file"
+	}
+	payload = data[off+frameHeaderSize : end]
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, end, "checksum mismatch"
+	}
+	return payload, end, ""
+}
+
+// frameAfter reports whether an intact record starts anywhere in data from
+// off on. Payloads are JSON objects, which never contain the zero bytes of
+// a header, so one cannot be mistaken for a record within another.
+func frameAfter(data []byte, off int64) bool {
+	size := int64(len(data))
+	for ; off+frameHeaderSize < size; off++ {
+		if data[off+frameHeaderSize] != '{' {
+			continue
+		}
+		length := int64(binary.LittleEndian.Uint32(data[off : off+4]))
+		end := off + frameHeaderSize + length
+		if length == 0 || end > size {
+			continue
+		}
+		if crc32.Checksum(data[off+frameHeaderSize:end], crcTable) == binary.LittleEndian.Uint32(data[off+4:off+8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanLines reads the line-delimited format of older versions. Only a final
+// line without its newline can be torn.
+func scanLines(path string, data []byte, last bool) (segmentScan, error) {
+	var scan segmentScan
+	off := int64(0)
+	for off < int64(len(data)) {
+		rest := data[off:]
+		n := bytes.IndexByte(rest, '\n')
+		line, complete := rest, false
+		if n >= 0 {
+			line, complete = rest[:n], true
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry WALEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				if last && !complete {
+					scan.tail = &TornTail{Segment: path, Offset: off, Bytes: int64(len(line)), Reason: "incomplete line"}
+					return scan, nil
+				}
+				return scan, &WALCorruptionError{Segment: path, Offset: off, Reason: fmt.Sprintf("undecodable record: %v", err)}
+			}
+			scan.entries = append(scan.entries, entry)
+		}
+		off += int64(len(line))
+		if complete {
+			off++
+		}
 	}
-	return lines
+	return scan, nil
 }
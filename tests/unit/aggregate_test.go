@@ -0,0 +1,99 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestAggregatePipelines(t *testing.T) {
+	engine, _ := newEngine(t)
+	orders := []map[string]interface{}{
+		{"customer": "ann", "total": 30.0, "items": []interface{}{"pen", "ink"}, "ship": map[string]interface{}{"city": "Oslo"}},
+		{"customer": "bob", "total": 12.5, "items": []interface{}{"pad"}, "ship": map[string]interface{}{"city": "Bergen"}},
+		{"customer": "ann", "total": 7.5, "items": []interface{}{}, "ship": map[string]interface{}{"city": "Oslo"}},
+		{"customer": "cid", "total": "n/a", "status": "void"},
+	}
+	for i, o := range orders {
+		if _, err := engine.InsertDocument("orders", string(rune('a'+i)), o); err != nil {
+			t.Fatalf("InsertDocument: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		pipeline string
+		want     string
+	}{
+		{
+			name:     "group and sort",
+			pipeline: `[{"$match": {"status": {"$exists": false}}}, {"$group": {"_id": "$customer", "spent": {"$sum": "$total"}, "avg": {"$avg": "$total"}, "n": {"$count": {}}, "max": {"$max": "$total"}, "ids": {"$push": "$_id"}}}, {"$sort": {"spent": -1}}]`,
+			want:     `[{"_id":"ann","avg":18.75,"ids":["a","c"],"max":30,"n":2,"spent":37.5},{"_id":"bob","avg":12.5,"ids":["b"],"max":12.5,"n":1,"spent":12.5}]`,
+		},
+		{
+			name:     "unwind then count",
+			pipeline: `[{"$unwind": "$items"}, {"$count": "lines"}]`,
+			want:     `[{"lines":3}]`,
+		},
+		{
+			name:     "unwind preserving empties",
+			pipeline: `[{"$unwind": {"path": "$items", "preserveNullAndEmptyArrays": true}}, {"$project": {"_id": 0, "items": 1}}]`,
+			want:     `[{"items":"pen"},{"items":"ink"},{"items":"pad"},{"items":[]},{}]`,
+		},
+		{
+			name:     "project with computed fields",
+			pipeline: `[{"$match": {"total": {"$gt": 10}}}, {"$sort": [{"field": "total", "direction": "asc"}]}, {"$limit": 1}, {"$project": {"customer": 1, "city": "$ship.city", "meta": {"t": "$total"}}}]`,
+			want:     `[{"_id":"b","city":"Bergen","customer":"bob","meta":{"t":12.5}}]`,
+		},
+		{
+			name:     "group everything",
+			pipeline: `[{"$group": {"_id": null, "cities": {"$push": "$ship.city"}, "min": {"$min": "$total"}}}]`,
+			want:     `[{"_id":null,"cities":["Oslo","Bergen","Oslo"],"min":7.5}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		var pipeline []storage.Stage
+		if err := json.Unmarshal([]byte(tt.pipeline), &pipeline); err != nil {
+			t.Fatalf("%s: bad pipeline: %v", tt.name, err)
+		}
+		rows, err := engine.Aggregate("orders", pipeline)
+		if err != nil {
+			t.Fatalf("%s: Aggregate: %v", tt.name, err)
+		}
+		got, _ := json.Marshal(rows)
+		if string(got) != tt.want {
+			t.Errorf("%s:\n got  %s\n want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if doc, _ := engine.GetDocument("orders", "a"); len(doc.Data["items"].([]interface{})) != 2 {
+		t.Fatalf("aggregation modified a stored document: %+v", doc.Data)
+	}
+}
+
+func TestAggregateRejectsMalformedPipelines(t *testing.T) {
+	engine, _ := newEngine(t)
+	for _, raw := range []string{
+		`[{"$bogus": {}}]`,
+		`[{"$match": {}, "$limit": 1}]`,
+		`[{"$group": {"total": {"$sum": 1}}}]`,
+		`[{"$group": {"_id": "$a", "x": {"$median": "$b"}}}]`,
+		`[{"$sort": {"a": 1, "b": -1}}]`,
+		`[{"$limit": 0}]`,
+		`[{"$unwind": "tags"}]`,
+		`[{"$project": {"a": 1, "b": 0}}]`,
+		`[{"$limit": 1}, {"$match": {"a": {"$bad": 1}}}]`,
+	} {
+		var pipeline []storage.Stage
+		if err := json.Unmarshal([]byte(raw), &pipeline); err != nil {
+			t.Fatalf("bad test pipeline %s: %v", raw, err)
+		}
+		_, err := engine.Aggregate("orders", pipeline)
+		if !errors.Is(err, storage.ErrInvalidPipeline) && !errors.Is(err, storage.ErrInvalidFilter) {
+			t.Errorf("Aggregate(%s) error = %v, want invalid pipeline", raw, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestIncrementalBackupsSurviveCheckpoints(t *testing.T) {
+	dir := t.TempDir()
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "data", "helix.db"), filepath.Join(dir, "data", "wal"), storage.Options{
+		WAL: storage.WALOptions{SegmentSize: 1024},
+	})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+	scheduler, err := backup.New(engine, config.BackupConfig{Enabled: true, Mode: backup.ModeIncremental, Directory: filepath.Join(dir, "backups")})
+	if err != nil {
+		t.Fatalf("backup.New: %v", err)
+	}
+
+	engine.InsertDocument("items", "0", map[string]interface{}{"n": 0.0})
+	base, err := scheduler.Run()
+	if err != nil || base.Type != storage.BackupSnapshot {
+		t.Fatalf("first Run = %+v, %v", base, err)
+	}
+
+	// Enough writes to seal WAL segments, and time for checkpoints that
+	// would otherwise remove them.
+	for i := 1; i < 50; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	time.Sleep(500 * time.Millisecond)
+	if segments, _ := filepath.Glob(filepath.Join(dir, "data", "wal", "*.wal")); len(segments) < 2 {
+		t.Fatalf("WAL segments were not held: %v", segments)
+	}
+
+	inc, err := scheduler.Run()
+	if err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if inc.Type != storage.BackupIncremental || inc.Base != base.ID || inc.FromLSN != base.LSN || inc.LSN != base.LSN+49 {
+		t.Fatalf("incremental backup = %+v", inc)
+	}
+	if b, err := scheduler.Run(); b != nil || err != nil {
+		t.Fatalf("Run without new writes = %+v, %v", b, err)
+	}
+
+	status, err := scheduler.Status()
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if len(status.Backups) != 2 || status.TotalSize <= 0 || status.LastSuccess == nil || status.LastFailure != nil {
+		t.Fatalf("status = %+v", status)
+	}
+	backups, _ := backup.List(filepath.Join(dir, "backups"))
+	if chain, err := backup.Chain(backups, base.ID); err != nil || len(chain) != 2 {
+		t.Fatalf("Chain = %v, %v", chain, err)
+	}
+	if _, err := storage.ReadBackup(filepath.Join(dir, "backups", inc.ID)); err != nil {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+}
+
+func TestBackupRetentionKeepsNewestPerDay(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "backups")
+	day := 24 * time.Hour
+	now := time.Now().UTC()
+	fake := func(id, kind, base string, age time.Duration) {
+		os.MkdirAll(filepath.Join(root, id), 0755)
+		data, _ := json.Marshal(storage.BackupManifest{Format: 1, ID: id, Type: kind, Base: base, CreatedAt: now.Add(-age)})
+		os.WriteFile(filepath.Join(root, id, storage.BackupManifestFile), data, 0644)
+	}
+	fake("yesterday-late", storage.BackupSnapshot, "", day)
+	fake("yesterday-early", storage.BackupSnapshot, "", day+time.Minute)
+	fake("two-days", storage.BackupSnapshot, "", 2*day)
+	fake("two-days-inc", storage.BackupIncremental, "two-days", 2*day-time.Hour)
+
+	engine := openEngine(t, filepath.Join(dir, "data"))
+	defer engine.Close()
+	scheduler, err := backup.New(engine, config.BackupConfig{Enabled: true, Mode: backup.ModeSnapshot, Directory: root, KeepDaily: 2})
+	if err != nil {
+		t.Fatalf("backup.New: %v", err)
+	}
+	b, err := scheduler.Run()
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	backups, _ := backup.List(root)
+	var ids []string
+	for _, kept := range backups {
+		ids = append(ids, kept.ID)
+	}
+	if len(ids) != 2 || ids[0] != "yesterday-late" || ids[1] != b.ID {
+		t.Fatalf("kept %v", ids)
+	}
+}
+
+func TestBackupSchedulerRejectsUnknownMode(t *testing.T) {
+	engine, _ := newEngine(t)
+	if _, err := backup.New(engine, config.BackupConfig{Mode: "differential"}); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
+
+func TestBackupEndpoint(t *testing.T) {
+	engine, _ := newEngine(t)
+	engine.InsertDocument("items", "a", map[string]interface{}{"n": 1.0})
+	root := filepath.Join(t.TempDir(), "backups")
+	backups, _ := backup.New(engine, config.BackupConfig{Directory: root})
+	ts := httptest.NewServer(server.New(engine, backups, nil, nil, nil, config.Config{}).Handler())
+	defer ts.Close()
+
+	var manifest storage.BackupManifest
+	if code := doJSON(t, http.MethodPost, ts.URL+"/admin/backup", nil, &manifest); code != http.StatusCreated || manifest.ID == "" || manifest.LSN == 0 {
+		t.Fatalf("POST /admin/backup = %d, %+v", code, manifest)
+	}
+	if _, err := os.Stat(filepath.Join(root, manifest.ID)); err != nil {
+		t.Fatalf("backup directory: %v", err)
+	}
+
+	// Backups taken in the same second, by hand or on the schedule, get
+	// IDs of their own.
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		os.MkdirAll(filepath.Join(root, storage.NewBackupID(now.Add(time.Duration(i)*time.Second))), 0755)
+	}
+	var second storage.BackupManifest
+	if code := doJSON(t, http.MethodPost, ts.URL+"/admin/backup", nil, &second); code != http.StatusCreated || second.ID == manifest.ID {
+		t.Fatalf("second POST /admin/backup = %d, %+v", code, second)
+	}
+	engine.InsertDocument("items", "b", map[string]interface{}{"n": 2.0})
+	scheduled, err := backups.Run()
+	if err != nil || scheduled.ID == manifest.ID || scheduled.ID == second.ID {
+		t.Fatalf("Run = %+v, %v", scheduled, err)
+	}
+	if list, _ := backup.List(root); len(list) != 3 {
+		t.Fatalf("backups = %d, want 3", len(list))
+	}
+}
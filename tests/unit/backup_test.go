@@ -0,0 +1,102 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestBackupIsConsistentWhileWritesContinue(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, filepath.Join(dir, "data"))
+	engine.CreateIndex("items", indexing.Definition{Fields: []string{"n"}})
+	for i := 0; i < 100; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 100; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+			}
+		}
+	}()
+	backupDir := filepath.Join(dir, "backups", "b1")
+	manifest, err := engine.Backup(backupDir)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if _, err := engine.Backup(backupDir); !errors.Is(err, storage.ErrBackupExists) {
+		t.Fatalf("second Backup = %v", err)
+	}
+	engine.Close()
+
+	read, err := storage.ReadBackup(backupDir)
+	if err != nil {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+	if read.LSN != manifest.LSN || read.ID != "b1" || len(read.Indexes["items"]) != 1 || len(read.Files) < 3 {
+		t.Fatalf("manifest = %+v", read)
+	}
+
+	restored := openEngine(t, backupDir)
+	defer restored.Close()
+	docs, _ := restored.QueryDocuments("items", nil, 0)
+	// The index definition is record 1, so documents 0 to LSN-2 are in.
+	if want := int(manifest.LSN) - 1; len(docs) != want || want < 100 {
+		t.Fatalf("backup at LSN %d holds %d documents", manifest.LSN, len(docs))
+	}
+	if indexes := restored.ListIndexes("items"); len(indexes) != 1 {
+		t.Fatalf("indexes = %+v", indexes)
+	}
+}
+
+func TestBackupChecksumsAndRepairSource(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, filepath.Join(dir, "data"))
+	engine.InsertDocument("users", "u1", map[string]interface{}{"name": "alice"})
+	if _, err := engine.Backup(filepath.Join(dir, "backups", "b1")); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	engine.Close()
+
+	// A damaged data directory is repaired from the backup.
+	os.RemoveAll(filepath.Join(dir, "data", "wal"))
+	damageDocument(t, filepath.Join(dir, "data"), "users", `"name":"alice"`)
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "data", "helix.db"), filepath.Join(dir, "data", "wal"), storage.Options{
+		VerifyChecksums: true,
+		AutoRecover:     true,
+		RepairSources:   []storage.RepairSource{storage.BackupRepairSource(filepath.Join(dir, "backups"))},
+	})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+	if doc, _ := engine.GetDocument("users", "u1"); doc == nil || doc.Data["name"] != "alice" {
+		t.Fatalf("u1 after repair = %+v", doc)
+	}
+	if corrupt := engine.RecoveryReport().Corrupt; len(corrupt) != 1 || corrupt[0].RepairedFrom != "backup" {
+		t.Fatalf("report = %+v", corrupt)
+	}
+
+	// A damaged backup fails validation.
+	damageDocument(t, filepath.Join(dir, "backups", "b1"), "users", `"name":"alice"`)
+	if _, err := storage.ReadBackup(filepath.Join(dir, "backups", "b1")); !errors.Is(err, storage.ErrBackupInvalid) {
+		t.Fatalf("ReadBackup of a damaged backup = %v", err)
+	}
+}
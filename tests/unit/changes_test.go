@@ -0,0 +1,487 @@
+package unit
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// nextChanges reads n changes from stream, summarized as "OP id@lsn".
+func nextChanges(t *testing.T, stream *storage.ChangeStream, n int) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	for len(got) < n {
+		c, err := stream.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next after %v: %v", got, err)
+		}
+		got = append(got, fmt.Sprintf("%s %s@%d", c.Operation, c.DocumentID, c.LSN))
+	}
+	return got
+}
+
+func TestChangeStreamsFollowWrites(t *testing.T) {
+	engine := openEngine(t, t.TempDir())
+	engine.InsertDocument("users", "old", map[string]interface{}{"age": 50.0})
+
+	all, err := engine.Changes(storage.ChangeOptions{Collection: "users"})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer all.Close()
+	adults, err := engine.Changes(storage.ChangeOptions{Collection: "users", Filter: map[string]interface{}{"age": map[string]interface{}{"$gte": 18.0}}})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer adults.Close()
+	if _, err := engine.Changes(storage.ChangeOptions{Filter: map[string]interface{}{"$bogus": 1.0}}); !errors.Is(err, storage.ErrInvalidFilter) {
+		t.Fatalf("Changes with a bad filter = %v", err)
+	}
+
+	engine.InsertDocument("users", "kid", map[string]interface{}{"age": 9.0})  // 2
+	engine.InsertDocument("posts", "p1", map[string]interface{}{"age": 30.0})  // 3
+	engine.UpdateDocument("users", "kid", map[string]interface{}{"age": 19.0}) // 4
+	txn := engine.Begin()
+	txn.Insert("users", "a", map[string]interface{}{"age": 40.0})
+	txn.Delete("users", "old")
+	if _, err := txn.Commit(); err != nil { // 5
+		t.Fatalf("Commit: %v", err)
+	}
+
+	want := []string{"INSERT kid@2", "UPDATE kid@4", "INSERT a@5", "DELETE old@5"}
+	if got := nextChanges(t, all, 4); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("all = %v, want %v", got, want)
+	}
+	want = []string{"UPDATE kid@4", "INSERT a@5", "DELETE old@5"}
+	if got := nextChanges(t, adults, 3); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("filtered = %v, want %v", got, want)
+	}
+
+	// Resuming from an LSN replays what came after it.
+	resumed, err := engine.Changes(storage.ChangeOptions{Collection: "users", Since: 2})
+	if err != nil {
+		t.Fatalf("Changes since 2: %v", err)
+	}
+	defer resumed.Close()
+	engine.DeleteDocument("users", "a") // 6
+	want = []string{"UPDATE kid@4", "INSERT a@5", "DELETE old@5", "DELETE a@6"}
+	if got := nextChanges(t, resumed, 4); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("resumed = %v, want %v", got, want)
+	}
+	if _, err := engine.Changes(storage.ChangeOptions{Since: 99}); !errors.Is(err, storage.ErrChangesUnavailable) {
+		t.Fatalf("Changes since a future LSN = %v", err)
+	}
+
+	engine.Close()
+	nextChanges(t, all, 1)
+	if _, err := all.Next(context.Background()); !errors.Is(err, storage.ErrEngineClosed) {
+		t.Fatalf("Next after Close = %v", err)
+	}
+}
+
+func TestChangeStreamsResumeFromWAL(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	for i := 1; i <= 5; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	engine.Close()
+
+	// After a restart the changes are only in the WAL.
+	engine = openEngine(t, dir)
+	stream, err := engine.Changes(storage.ChangeOptions{Since: 3})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	engine.InsertDocument("items", "6", map[string]interface{}{"n": 6.0})
+	want := []string{"INSERT 4@4", "INSERT 5@5", "INSERT 6@6"}
+	if got := nextChanges(t, stream, 3); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("resumed = %v, want %v", got, want)
+	}
+	stream.Close()
+	engine.Close()
+
+	// Once checkpointed records are removed, they cannot be streamed.
+	small := filepath.Join(dir, "small")
+	engine, err = storage.NewEngineWithOptions(filepath.Join(small, "helix.db"), filepath.Join(small, "wal"), storage.Options{
+		WAL: storage.WALOptions{SegmentSize: 1024},
+	})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	engine.Close()
+	engine, err = storage.NewEngineWithOptions(filepath.Join(small, "helix.db"), filepath.Join(small, "wal"), storage.Options{})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+	if _, err := engine.Changes(storage.ChangeOptions{Since: 1}); !errors.Is(err, storage.ErrChangesUnavailable) {
+		t.Fatalf("Changes since a removed record = %v", err)
+	}
+}
+
+func TestReadChangesPagesThroughTheWAL(t *testing.T) {
+	dir := t.TempDir()
+	open := func(opts storage.WALOptions) *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), storage.Options{WAL: opts})
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+	small := storage.WALOptions{SegmentSize: 1024, ArchiveDir: filepath.Join(dir, "archive")}
+	engine := open(small)
+	for i := 0; i < 300; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	engine.Close()
+
+	// The records are now spread over archived and live segments.
+	engine = open(small)
+	var got []string
+	var since uint64
+	for pages := 0; ; pages++ {
+		changes, checkpoint, more, err := engine.ReadChanges(since, nil, 7)
+		if err != nil {
+			t.Fatalf("ReadChanges since %d: %v", since, err)
+		}
+		if more && len(changes) != 7 {
+			t.Fatalf("page of %d changes with more to come", len(changes))
+		}
+		for _, c := range changes {
+			got = append(got, c.DocumentID)
+		}
+		since = checkpoint
+		if !more {
+			break
+		}
+		if pages > 50 {
+			t.Fatalf("pages never end")
+		}
+	}
+	if len(got) != 300 || got[0] != "0" || got[299] != "299" || since != engine.LastLSN() {
+		t.Fatalf("read %d changes (%v ... %v) up to %d, last LSN %d", len(got), got[0], got[len(got)-1], since, engine.LastLSN())
+	}
+	engine.Close()
+}
+
+func TestChangeStreamsHoldTheWALTheyReadBack(t *testing.T) {
+	dir := t.TempDir()
+	open := func(opts storage.WALOptions) *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), storage.Options{WAL: opts})
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+	engine := open(storage.WALOptions{})
+	for i := 0; i < 1500; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	engine.Close()
+
+	// A stream reading back from the WAL keeps the records it has yet to
+	// read from being checkpointed away.
+	engine = open(storage.WALOptions{SegmentSize: 1024})
+	defer engine.Close()
+	stream, err := engine.Changes(storage.ChangeOptions{Since: 300})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer stream.Close()
+	nextChanges(t, stream, 10)
+	engine.InsertDocument("items", "1500", map[string]interface{}{"n": 1500.0})
+	if _, err := engine.Backup(filepath.Join(dir, "backups", "b1")); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	rest := nextChanges(t, stream, 1191)
+	if last := rest[len(rest)-1]; !strings.HasPrefix(last, "INSERT 1500@") {
+		t.Fatalf("last change = %s", last)
+	}
+}
+
+func TestChangeStreamsResumeInsideATransaction(t *testing.T) {
+	engine, _ := newEngine(t)
+	engine.InsertDocument("items", "0", map[string]interface{}{"n": 0.0}) // 1
+	txn := engine.Begin()
+	for i := 1; i <= 3; i++ {
+		txn.Insert("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	if _, err := txn.Commit(); err != nil { // 2
+		t.Fatalf("Commit: %v", err)
+	}
+	engine.InsertDocument("items", "4", map[string]interface{}{"n": 4.0}) // 3
+
+	for within, want := range map[int][]string{
+		1: {"INSERT 2@2", "INSERT 3@2", "INSERT 4@3"},
+		3: {"INSERT 4@3"},
+	} {
+		stream, err := engine.Changes(storage.ChangeOptions{Collection: "items", Since: 2, Within: within})
+		if err != nil {
+			t.Fatalf("Changes: %v", err)
+		}
+		if got := nextChanges(t, stream, len(want)); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("resumed within %d = %v, want %v", within, got, want)
+		}
+		stream.Close()
+	}
+}
+
+func TestChangeStreamThatFallsBehindIsClosed(t *testing.T) {
+	dir := t.TempDir()
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), storage.Options{
+		WAL: storage.WALOptions{Sync: storage.SyncOS},
+	})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+	stream, err := engine.Changes(storage.ChangeOptions{})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer stream.Close()
+
+	for i := 0; i < 2000; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	var last storage.Change
+	for {
+		c, err := stream.Next(context.Background())
+		if errors.Is(err, storage.ErrStreamLagged) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		last = c
+	}
+	if last.LSN == 0 || last.LSN >= 2000 {
+		t.Fatalf("last change before falling behind = %+v", last)
+	}
+
+	// The reader picks up where it stopped.
+	resumed, err := engine.Changes(storage.ChangeOptions{Since: last.LSN})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer resumed.Close()
+	if got := nextChanges(t, resumed, int(2000-last.LSN)); got[len(got)-1] != "INSERT 1999@2000" {
+		t.Fatalf("resumed ends with %s", got[len(got)-1])
+	}
+}
+
+func startChangesServer(t *testing.T, engine *storage.Engine) *httptest.Server {
+	t.Helper()
+	backups, _ := backup.New(engine, config.BackupConfig{})
+	ts := httptest.NewServer(server.New(engine, backups, nil, nil, nil, config.Config{}).Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// readEvents reads n events from an SSE stream as "id data.documentId".
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	t.Helper()
+	var got []string
+	var id string
+	for len(got) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events after %v: %v", got, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var c storage.Change
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &c); err != nil {
+				t.Fatalf("event data %q: %v", line, err)
+			}
+			got = append(got, id+" "+c.DocumentID)
+		}
+	}
+	return got
+}
+
+func TestChangesOverServerSentEvents(t *testing.T) {
+	engine, _ := newEngine(t)
+	ts := startChangesServer(t, engine)
+	engine.InsertDocument("items", "a", map[string]interface{}{"n": 1.0}) // 1
+	txn := engine.Begin()
+	txn.Insert("items", "b", map[string]interface{}{"n": 2.0})
+	txn.Insert("items", "c", map[string]interface{}{"n": 3.0})
+	if _, err := txn.Commit(); err != nil { // 2
+		t.Fatalf("Commit: %v", err)
+	}
+
+	for _, tc := range []struct {
+		url, lastEventID string
+		want             []string
+	}{
+		{"/collections/items/changes?since=1", "", []string{"2.0 b", "2.1 c", "3.0 d"}},
+		// An EventSource that saw the first write of the transaction
+		// resumes with the second.
+		{"/collections/items/changes", "2.0", []string{"2.1 c", "3.0 d"}},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+tc.url, nil)
+		if tc.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", tc.lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.url, err)
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("GET %s = %d %s", tc.url, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		r := bufio.NewReader(resp.Body)
+		if tc.lastEventID == "" {
+			// The live write arrives after the replayed ones.
+			if got := readEvents(t, r, 2); fmt.Sprint(got) != fmt.Sprint(tc.want[:2]) {
+				t.Fatalf("GET %s = %v, want %v", tc.url, got, tc.want)
+			}
+			engine.InsertDocument("items", "d", map[string]interface{}{"n": 4.0}) // 3
+			if got := readEvents(t, r, 1); fmt.Sprint(got) != fmt.Sprint(tc.want[2:]) {
+				t.Fatalf("GET %s = %v, want %v", tc.url, got, tc.want)
+			}
+		} else if got := readEvents(t, r, len(tc.want)); fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("GET %s with Last-Event-ID %s = %v, want %v", tc.url, tc.lastEventID, got, tc.want)
+		}
+		cancel()
+		resp.Body.Close()
+	}
+}
+
+func TestChangesSinceRemovedRecordsAreGone(t *testing.T) {
+	dir := t.TempDir()
+	open := func(opts storage.Options) *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+	engine := open(storage.Options{WAL: storage.WALOptions{SegmentSize: 1024}})
+	for i := 0; i < 50; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	engine.Close()
+	engine = open(storage.Options{})
+	defer engine.Close()
+	ts := startChangesServer(t, engine)
+
+	var body map[string]string
+	if code := doJSON(t, http.MethodGet, ts.URL+"/collections/items/changes?since=1", nil, &body); code != http.StatusGone || body["error"] == "" {
+		t.Fatalf("GET since a removed record = %d, %v", code, body)
+	}
+	if code := doJSON(t, http.MethodGet, ts.URL+"/collections/items/changes?since=x", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("GET with a bad since = %d", code)
+	}
+}
+
+// wsWrite sends a masked client frame.
+func wsWrite(t *testing.T, conn net.Conn, op byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | op, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+}
+
+// wsRead reads an unmasked server frame.
+func wsRead(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	n := int(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return head[0] & 0x0F, payload
+}
+
+func TestChangesOverWebSocket(t *testing.T) {
+	engine, _ := newEngine(t)
+	ts := startChangesServer(t, engine)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /collections/items/changes HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		strings.TrimPrefix(ts.URL, "http://"), key)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake = %d %v", resp.StatusCode, resp.Header)
+	}
+
+	engine.InsertDocument("items", "a", map[string]interface{}{"n": 1.0})
+	op, payload := wsRead(t, r)
+	var c storage.Change
+	if err := json.Unmarshal(payload, &c); op != 0x1 || err != nil || c.DocumentID != "a" || c.Operation != "INSERT" {
+		t.Fatalf("text frame = %x %s", op, payload)
+	}
+
+	wsWrite(t, conn, 0x9, []byte("hello"))
+	if op, payload := wsRead(t, r); op != 0xA || string(payload) != "hello" {
+		t.Fatalf("answer to ping = %x %q", op, payload)
+	}
+
+	// The server answers the closing handshake with the same code, then
+	// hangs up.
+	wsWrite(t, conn, 0x8, binary.BigEndian.AppendUint16(nil, 1000))
+	if op, payload := wsRead(t, r); op != 0x8 || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Fatalf("close frame = %x %q", op, payload)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("after closing: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// damageDocument flips a byte inside the stored data of a document.
+func damageDocument(t *testing.T, dir, collection, marker string) {
+	t.Helper()
+	segments, _ := filepath.Glob(filepath.Join(dir, "segments", collection, "*.seg"))
+	for _, path := range segments {
+		data, _ := os.ReadFile(path)
+		if i := bytes.LastIndex(data, []byte(marker)); i >= 0 {
+			data[i+len(marker)-2] ^= 0x01
+			os.WriteFile(path, data, 0644)
+			return
+		}
+	}
+	t.Fatalf("%s not found in segments", marker)
+}
+
+func TestCorruptDocumentsRefuseStartWithoutAutoRecover(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"collections":{"users":{
+		"u1":{"id":"u1","data":{"name":"alice"},"version":1,"checksum":"0000000000000000"},
+		"u2":{"id":"u2","data":{"name":"bob"},"version":1}}}}`
+	os.WriteFile(filepath.Join(dir, "helix.db"), []byte(legacy), 0644)
+
+	_, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), storage.Options{VerifyChecksums: true})
+	if !errors.Is(err, storage.ErrCorruptData) {
+		t.Fatalf("NewEngineWithOptions = %v, want ErrCorruptData", err)
+	}
+
+	reports, _ := filepath.Glob(filepath.Join(dir, "_corrupt", "*", "report.json"))
+	if len(reports) != 1 {
+		t.Fatalf("quarantine reports: %v", reports)
+	}
+	var report storage.QuarantineReport
+	data, _ := os.ReadFile(reports[0])
+	json.Unmarshal(data, &report)
+	if len(report.Documents) != 1 || report.Documents[0].ID != "u1" || report.Documents[0].RepairedFrom != "" {
+		t.Fatalf("report = %+v", report)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(reports[0]), "users", "u1")); err != nil {
+		t.Fatalf("corrupt document was not copied: %v", err)
+	}
+}
+
+func TestAutoRecoverRepairsFromWALAndRepairSources(t *testing.T) {
+	dir := t.TempDir()
+	opts := storage.Options{
+		WAL:             storage.WALOptions{ArchiveDir: filepath.Join(dir, "archive")},
+		VerifyChecksums: true,
+		AutoRecover:     true,
+	}
+	open := func(opts storage.Options) *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+
+	engine := open(opts)
+	engine.InsertDocument("users", "u1", map[string]interface{}{"name": "alice"})
+	engine.UpdateDocument("users", "u1", map[string]interface{}{"name": "alicia"})
+	engine.InsertDocument("users", "u2", map[string]interface{}{"name": "bob"})
+	engine.InsertDocument("users", "u3", map[string]interface{}{"name": "carol"})
+	backup, _ := engine.GetDocument("users", "u2")
+	engine.Close()
+
+	damageDocument(t, dir, "users", `"name":"alicia"`)
+	engine = open(opts)
+	if doc, _ := engine.GetDocument("users", "u1"); doc == nil || doc.Data["name"] != "alicia" || doc.Version != 2 {
+		t.Fatalf("u1 after repair from WAL = %+v", doc)
+	}
+	if corrupt := engine.RecoveryReport().Corrupt; len(corrupt) != 1 || corrupt[0].RepairedFrom != "wal" {
+		t.Fatalf("report = %+v", corrupt)
+	}
+	engine.Close()
+
+	// Without the log, only the repair source can help.
+	os.RemoveAll(filepath.Join(dir, "wal"))
+	os.RemoveAll(filepath.Join(dir, "archive"))
+	damageDocument(t, dir, "users", `"name":"bob"`)
+	damageDocument(t, dir, "users", `"name":"carol"`)
+	opts.RepairSources = []storage.RepairSource{{
+		Name: "backup",
+		Lookup: func(collection, id string) (*storage.Document, error) {
+			if id == "u2" {
+				return backup, nil
+			}
+			return nil, nil
+		},
+	}}
+	engine = open(opts)
+	if doc, _ := engine.GetDocument("users", "u2"); doc == nil || doc.Data["name"] != "bob" {
+		t.Fatalf("u2 after repair from backup = %+v", doc)
+	}
+	if _, ok := engine.GetDocument("users", "u3"); ok {
+		t.Fatal("unrepairable document was kept")
+	}
+	engine.Close()
+
+	// The repairs were checkpointed: the next start finds nothing wrong.
+	engine = open(storage.Options{VerifyChecksums: true})
+	defer engine.Close()
+	if corrupt := engine.RecoveryReport().Corrupt; len(corrupt) != 0 {
+		t.Fatalf("corruption after repair: %+v", corrupt)
+	}
+	if doc, _ := engine.GetDocument("users", "u1"); doc == nil || doc.Data["name"] != "alicia" {
+		t.Fatalf("u1 after restart = %+v", doc)
+	}
+}
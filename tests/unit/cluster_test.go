@@ -0,0 +1,330 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/cluster"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+// clusterNode is one node of an in-process cluster, serving its API on a
+// loopback port.
+type clusterNode struct {
+	id     string
+	dir    string
+	url    string
+	engine *storage.Engine
+	node   *cluster.Node
+	srv    *httptest.Server
+}
+
+func (cn *clusterNode) stop() {
+	if cn.srv == nil {
+		return
+	}
+	cn.srv.Close()
+	cn.node.Stop()
+	cn.engine.Close()
+	cn.srv = nil
+}
+
+// startClusterNode starts a node on ln with its data under dir/id.
+func startClusterNode(t *testing.T, dir, id string, ln net.Listener, members []config.ClusterMember) *clusterNode {
+	t.Helper()
+	return startClusterNodeWith(t, dir, id, ln, members, 0)
+}
+
+// startClusterNodeWith starts a node that compacts its Raft log every
+// snapshotEntries entries, or at the default if zero.
+func startClusterNodeWith(t *testing.T, dir, id string, ln net.Listener, members []config.ClusterMember, snapshotEntries int) *clusterNode {
+	t.Helper()
+	cn := &clusterNode{id: id, dir: filepath.Join(dir, id), url: "http://" + ln.Addr().String()}
+	cn.engine = openEngine(t, cn.dir)
+	cfg := config.Config{
+		Storage: config.StorageConfig{DataFile: filepath.Join(cn.dir, "helix.db"), WALDirectory: filepath.Join(cn.dir, "wal")},
+		Cluster: config.ClusterConfig{
+			Enabled:             true,
+			NodeID:              id,
+			Address:             cn.url,
+			Members:             members,
+			ElectionTimeoutMs:   150,
+			HeartbeatIntervalMs: 30,
+			SnapshotEntries:     snapshotEntries,
+		},
+	}
+	var err error
+	if cn.node, err = cluster.NewNode(cn.engine, cfg); err != nil {
+		t.Fatalf("NewNode(%s): %v", id, err)
+	}
+	backups, _ := backup.New(cn.engine, config.BackupConfig{})
+	cn.srv = httptest.NewUnstartedServer(server.New(cn.engine, backups, nil, cn.node, nil, cfg).Handler())
+	cn.srv.Listener.Close()
+	cn.srv.Listener = ln
+	cn.srv.Start()
+	cn.node.Start()
+	t.Cleanup(cn.stop)
+	return cn
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	return ln
+}
+
+// startCluster starts a cluster of n nodes.
+func startCluster(t *testing.T, n int) []*clusterNode {
+	dir := t.TempDir()
+	listeners := make([]net.Listener, n)
+	var members []config.ClusterMember
+	for i := range listeners {
+		listeners[i] = listen(t)
+		members = append(members, config.ClusterMember{ID: fmt.Sprintf("n%d", i+1), Address: "http://" + listeners[i].Addr().String()})
+	}
+	nodes := make([]*clusterNode, n)
+	for i, ln := range listeners {
+		nodes[i] = startClusterNode(t, dir, members[i].ID, ln, members)
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader waits for one of the running nodes to be elected and able to
+// take writes.
+func waitLeader(t *testing.T, nodes []*clusterNode) *clusterNode {
+	t.Helper()
+	var leader *clusterNode
+	waitFor(t, "a leader", func() bool {
+		for _, cn := range nodes {
+			if cn.srv != nil && cn.node.IsLeader() {
+				status := cn.node.Status()
+				if status.AppliedIndex == status.LastIndex {
+					leader = cn
+					return true
+				}
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func waitReplicated(t *testing.T, nodes []*clusterNode, collection, id string, exists bool) {
+	t.Helper()
+	for _, cn := range nodes {
+		if cn.srv == nil {
+			continue
+		}
+		waitFor(t, fmt.Sprintf("%s/%s on %s", collection, id, cn.id), func() bool {
+			_, ok := cn.engine.GetDocument(collection, id)
+			return ok == exists
+		})
+	}
+}
+
+func TestClusterReplicatesAndForwardsWrites(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	if _, err := leader.engine.InsertDocument("users", "u1", map[string]interface{}{"name": "ada"}); err != nil {
+		t.Fatalf("InsertDocument on the leader: %v", err)
+	}
+	waitReplicated(t, nodes, "users", "u1", true)
+
+	var follower *clusterNode
+	for _, cn := range nodes {
+		if cn != leader {
+			follower = cn
+		}
+	}
+	if _, err := follower.engine.InsertDocument("users", "u2", map[string]interface{}{}); !errors.Is(err, cluster.ErrNotLeader) {
+		t.Fatalf("InsertDocument on a follower = %v", err)
+	}
+
+	// Writes sent to a follower over HTTP are forwarded to the leader.
+	resp, err := http.Post(follower.url+"/collections/users", "application/json", strings.NewReader(`{"id":"u2","data":{"name":"grace"}}`))
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST to a follower = %v, %v", resp, err)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, follower.url+"/collections/users/u1", nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE on a follower = %v, %v", resp, err)
+	}
+	waitReplicated(t, nodes, "users", "u2", true)
+	waitReplicated(t, nodes, "users", "u1", false)
+
+	for _, cn := range nodes {
+		if doc, _ := cn.engine.GetDocument("users", "u2"); doc.Version != 1 || doc.Data["name"] != "grace" {
+			t.Fatalf("u2 on %s = %+v", cn.id, doc)
+		}
+		if cn.engine.LastLSN() != leader.engine.LastLSN() {
+			t.Fatalf("LSN on %s = %d, leader has %d", cn.id, cn.engine.LastLSN(), leader.engine.LastLSN())
+		}
+	}
+}
+
+func TestClusterFailsOverAndRejoins(t *testing.T) {
+	nodes := startCluster(t, 3)
+	old := waitLeader(t, nodes)
+	if _, err := old.engine.InsertDocument("orders", "o1", map[string]interface{}{"total": 10.0}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+	waitReplicated(t, nodes, "orders", "o1", true)
+
+	old.stop()
+	leader := waitLeader(t, nodes)
+	if leader == old {
+		t.Fatal("stopped node is still leader")
+	}
+	if _, err := leader.engine.UpdateDocument("orders", "o1", map[string]interface{}{"total": 12.0}); err != nil {
+		t.Fatalf("UpdateDocument on the new leader: %v", err)
+	}
+
+	// The old leader catches up when it comes back.
+	addr := strings.TrimPrefix(old.url, "http://")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	var members []config.ClusterMember
+	for _, cn := range nodes {
+		members = append(members, config.ClusterMember{ID: cn.id, Address: cn.url})
+	}
+	back := startClusterNode(t, filepath.Dir(old.dir), old.id, ln, members)
+	waitFor(t, "the old leader to catch up", func() bool {
+		doc, ok := back.engine.GetDocument("orders", "o1")
+		return ok && doc.Version == 2
+	})
+	if back.engine.LastLSN() != leader.engine.LastLSN() {
+		t.Fatalf("LSN after rejoining = %d, leader has %d", back.engine.LastLSN(), leader.engine.LastLSN())
+	}
+}
+
+func TestClusterMembershipChanges(t *testing.T) {
+	nodes := startCluster(t, 1)
+	first := waitLeader(t, nodes)
+	if _, err := first.engine.InsertDocument("items", "a", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+
+	// New nodes start with no members and get the whole log once added.
+	dir := filepath.Dir(first.dir)
+	for _, id := range []string{"n2", "n3"} {
+		ln := listen(t)
+		cn := startClusterNode(t, dir, id, ln, nil)
+		if err := first.node.AddMember(cluster.Member{ID: id, Address: cn.url}); err != nil {
+			t.Fatalf("AddMember(%s): %v", id, err)
+		}
+		nodes = append(nodes, cn)
+	}
+	waitReplicated(t, nodes, "items", "a", true)
+	if members := first.node.Status().Members; len(members) != 3 {
+		t.Fatalf("members = %+v", members)
+	}
+
+	// Removing the leader hands the cluster over to the others.
+	if err := first.node.RemoveMember(first.id); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	leader := waitLeader(t, nodes[1:])
+	if _, err := leader.engine.InsertDocument("items", "b", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument after removing the old leader: %v", err)
+	}
+	waitReplicated(t, nodes[1:], "items", "b", true)
+	if members := leader.node.Status().Members; len(members) != 2 {
+		t.Fatalf("members after removal = %+v", members)
+	}
+}
+
+func TestClusterCompactsLogAndSendsSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	ln := listen(t)
+	members := []config.ClusterMember{{ID: "n1", Address: "http://" + ln.Addr().String()}}
+	first := startClusterNodeWith(t, dir, "n1", ln, members, 5)
+	waitLeader(t, []*clusterNode{first})
+	for i := 0; i < 20; i++ {
+		if _, err := first.engine.InsertDocument("items", fmt.Sprintf("i%02d", i), map[string]interface{}{"n": float64(i)}); err != nil {
+			t.Fatalf("InsertDocument: %v", err)
+		}
+	}
+	if !first.engine.DeleteDocument("items", "i00") {
+		t.Fatal("DeleteDocument failed")
+	}
+	waitFor(t, "the log to be compacted", func() bool { return first.node.Status().SnapshotIndex >= 15 })
+
+	// The entries a new node needs are gone, so it gets a snapshot, which
+	// carries the version of the deleted document on.
+	second := startClusterNodeWith(t, dir, "n2", listen(t), nil, 5)
+	if err := first.node.AddMember(cluster.Member{ID: "n2", Address: second.url}); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	nodes := []*clusterNode{first, second}
+	waitReplicated(t, nodes, "items", "i19", true)
+	waitReplicated(t, nodes, "items", "i00", false)
+	if _, err := first.engine.InsertDocument("items", "i00", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument after the snapshot: %v", err)
+	}
+	waitFor(t, "the write after the snapshot", func() bool {
+		doc, ok := second.engine.GetDocument("items", "i00")
+		return ok && doc.Version == 2
+	})
+	if status := second.node.Status(); status.SnapshotIndex == 0 || status.Error != "" {
+		t.Fatalf("status of the new node = %+v", status)
+	}
+
+	// A compacted log is read back on restart.
+	addr := strings.TrimPrefix(second.url, "http://")
+	second.stop()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %v", addr, err)
+	}
+	back := startClusterNodeWith(t, dir, "n2", ln, nil, 5)
+	if _, err := first.engine.UpdateDocument("items", "i01", map[string]interface{}{"n": 100.0}); err != nil {
+		t.Fatalf("UpdateDocument: %v", err)
+	}
+	waitFor(t, "the restarted node to catch up", func() bool {
+		doc, ok := back.engine.GetDocument("items", "i01")
+		return ok && doc.Version == 2
+	})
+	if back.engine.LastLSN() != first.engine.LastLSN() {
+		t.Fatalf("LSN after restarting = %d, leader has %d", back.engine.LastLSN(), first.engine.LastLSN())
+	}
+}
+
+func TestClusterRefusesExistingData(t *testing.T) {
+	engine, dir := newEngine(t)
+	if _, err := engine.InsertDocument("items", "a", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+	cfg := config.Config{
+		Storage: config.StorageConfig{DataFile: filepath.Join(dir, "helix.db"), WALDirectory: filepath.Join(dir, "wal")},
+		Cluster: config.ClusterConfig{Enabled: true, NodeID: "n1", Address: "http://127.0.0.1:1"},
+	}
+	if _, err := cluster.NewNode(engine, cfg); err == nil || !strings.Contains(err.Error(), "no Raft log") {
+		t.Fatalf("NewNode on existing data: %v", err)
+	}
+}
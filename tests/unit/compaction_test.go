@@ -0,0 +1,184 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestCompactionDropsSupersededAndDeletedDocuments(t *testing.T) {
+	dir := t.TempDir()
+	opts := storage.Options{SegmentSize: 4096}
+	open := func() *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+
+	engine := open()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			engine.UpsertDocument("items", fmt.Sprint(i), map[string]interface{}{"round": float64(round)})
+		}
+		// Restart so that every round lands in the segments.
+		engine.Close()
+		engine = open()
+	}
+	for i := 0; i < 50; i++ {
+		engine.DeleteDocument("items", fmt.Sprint(i))
+	}
+
+	before := dirSize(t, filepath.Join(dir, "segments"))
+	status, err := engine.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if status.State != storage.CompactionDone || status.CollectionsTotal != 1 || status.Progress != 1 || status.ReclaimedBytes <= 0 {
+		t.Fatalf("status = %+v", status)
+	}
+	after := dirSize(t, filepath.Join(dir, "segments"))
+	if after >= before/3 {
+		t.Fatalf("segments went from %d to %d bytes", before, after)
+	}
+	if indexes, _ := filepath.Glob(filepath.Join(dir, "segments", "items", "index*")); len(indexes) != 1 {
+		t.Fatalf("old index logs were kept: %v", indexes)
+	}
+
+	engine.UpdateDocument("items", "99", map[string]interface{}{"round": 4.0})
+	engine.Close()
+	engine = open()
+	defer engine.Close()
+	docs, _ := engine.QueryDocuments("items", nil, 0)
+	if len(docs) != 50 {
+		t.Fatalf("after compaction and restart %d documents, want 50", len(docs))
+	}
+	if doc, _ := engine.GetDocument("items", "99"); doc.Data["round"] != 4.0 || doc.Version != 4 {
+		t.Fatalf("document after restart = %+v", doc)
+	}
+	if doc, _ := engine.GetDocument("items", "50"); doc.Data["round"] != 2.0 {
+		t.Fatalf("document after restart = %+v", doc)
+	}
+}
+
+func TestCompactionFoldsTombstonesIntoAVersionFloor(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		engine.InsertDocument("items", id, map[string]interface{}{"n": 1.0})
+		if i%10 == 0 {
+			engine.UpdateDocument("items", id, map[string]interface{}{"n": 2.0})
+		}
+		engine.DeleteDocument("items", id)
+	}
+	last, ok := engine.DeletedAt("items", "99")
+	if !ok {
+		t.Fatal("DeletedAt found no delete")
+	}
+	engine.Close()
+	engine = openEngine(t, dir)
+	if _, err := engine.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	engine.Close()
+
+	// No tombstone is kept per deleted document...
+	indexes, _ := filepath.Glob(filepath.Join(dir, "segments", "items", "index*"))
+	if len(indexes) != 1 {
+		t.Fatalf("index logs = %v", indexes)
+	}
+	if data, _ := os.ReadFile(indexes[0]); bytes.Contains(data, []byte(`"del"`)) {
+		t.Fatalf("compacted index log still holds tombstones: %q", data)
+	}
+
+	// ...but documents created again still start above their old versions,
+	// before and after a restart, and the latest delete is known.
+	engine = openEngine(t, dir)
+	if hlc, ok := engine.DeletedAt("items", "50"); !ok || hlc != last {
+		t.Fatalf("DeletedAt after compaction = %v, %v, want %v", hlc, ok, last)
+	}
+	if doc, err := engine.InsertDocument("items", "1", map[string]interface{}{"n": 3.0}); err != nil || doc.Version <= 1 {
+		t.Fatalf("recreated document = %+v, %v", doc, err)
+	}
+	if doc, err := engine.InsertDocument("items", "10", map[string]interface{}{"n": 3.0}); err != nil || doc.Version <= 2 {
+		t.Fatalf("recreated document = %+v, %v", doc, err)
+	}
+	engine.Close()
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	if doc, err := engine.InsertDocument("items", "20", map[string]interface{}{"n": 3.0}); err != nil || doc.Version <= 2 {
+		t.Fatalf("recreated document after restart = %+v, %v", doc, err)
+	}
+}
+
+func TestAutoCompactionRunsPastThreshold(t *testing.T) {
+	dir := t.TempDir()
+	opts := storage.Options{AutoCompact: true, CompactThreshold: 1024}
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		engine.UpsertDocument("items", fmt.Sprint(i%10), map[string]interface{}{"i": float64(i), "pad": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"})
+		if status := engine.CompactionStatus(); status.Trigger == "auto" && status.State == storage.CompactionDone {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no automatic compaction: %+v", engine.CompactionStatus())
+}
+
+func TestCompactEndpoint(t *testing.T) {
+	engine, _ := newEngine(t)
+	engine.InsertDocument("items", "a", map[string]interface{}{"n": 1.0})
+	engine.UpdateDocument("items", "a", map[string]interface{}{"n": 2.0})
+	backups, _ := backup.New(engine, config.BackupConfig{})
+	ts := httptest.NewServer(server.New(engine, backups, nil, nil, nil, config.Config{}).Handler())
+	defer ts.Close()
+
+	// A write waiting on its proposer keeps the collection locked, which
+	// holds up the compaction's checkpoint.
+	proposing, release := make(chan struct{}), make(chan struct{})
+	engine.SetProposer(func(storage.WALEntry) (uint64, error) {
+		close(proposing)
+		<-release
+		return 0, errors.New("not committed")
+	})
+	go engine.InsertDocument("items", "b", map[string]interface{}{"n": 1.0})
+	<-proposing
+
+	var status storage.CompactionStatus
+	if code := doJSON(t, http.MethodPost, ts.URL+"/admin/compact", nil, &status); code != http.StatusAccepted || status.State != storage.CompactionRunning {
+		t.Fatalf("POST /admin/compact = %d, %+v", code, status)
+	}
+	var body map[string]string
+	if code := doJSON(t, http.MethodPost, ts.URL+"/admin/compact", nil, &body); code != http.StatusConflict || body["error"] == "" {
+		t.Fatalf("second POST /admin/compact = %d, %v", code, body)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for status.State == storage.CompactionRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		doJSON(t, http.MethodGet, ts.URL+"/admin/compact", nil, &status)
+	}
+	if status.State != storage.CompactionDone {
+		t.Fatalf("compaction status = %+v", status)
+	}
+}
@@ -0,0 +1,335 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestBTreeMatchesSortedReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tree := indexing.NewBTree()
+	ref := make(map[float64]map[string]bool)
+
+	for i := 0; i < 20000; i++ {
+		key := float64(rng.Intn(3000))
+		id := fmt.Sprintf("d%d", rng.Intn(4))
+		if rng.Intn(3) == 0 {
+			removed := tree.Delete(key, id)
+			if removed != ref[key][id] {
+				t.Fatalf("Delete(%v, %s) = %v, reference says %v", key, id, removed, ref[key][id])
+			}
+			delete(ref[key], id)
+			if len(ref[key]) == 0 {
+				delete(ref, key)
+			}
+			continue
+		}
+		added := tree.Insert(key, id)
+		if added == ref[key][id] {
+			t.Fatalf("Insert(%v, %s) = %v, reference already had it: %v", key, id, added, ref[key][id])
+		}
+		if ref[key] == nil {
+			ref[key] = make(map[string]bool)
+		}
+		ref[key][id] = true
+	}
+
+	keys := make([]float64, 0, len(ref))
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	if tree.Len() != len(keys) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(keys))
+	}
+
+	var got []float64
+	tree.Ascend(nil, nil, func(key interface{}, ids []string) bool {
+		got = append(got, key.(float64))
+		if len(ids) != len(ref[key.(float64)]) || !sort.StringsAreSorted(ids) {
+			t.Fatalf("posting for %v = %v, want %v", key, ids, ref[key.(float64)])
+		}
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("ascending walk out of order")
+	}
+
+	var desc []float64
+	tree.Descend(&indexing.Bound{Value: 100.0, Inclusive: true}, &indexing.Bound{Value: 200.0}, func(key interface{}, _ []string) bool {
+		desc = append(desc, key.(float64))
+		return true
+	})
+	var want []float64
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i] >= 100 && keys[i] < 200 {
+			want = append(want, keys[i])
+		}
+	}
+	if fmt.Sprint(desc) != fmt.Sprint(want) {
+		t.Fatalf("descending range = %v, want %v", desc, want)
+	}
+}
+
+func TestIndexedQueriesMatchFullScans(t *testing.T) {
+	indexed, _ := newEngine(t)
+	plain, _ := newEngine(t)
+
+	for _, def := range []indexing.Definition{
+		{Fields: []string{"age"}},
+		{Fields: []string{"city"}, Type: indexing.TypeHash},
+		{Fields: []string{"tags"}},
+		{Fields: []string{"city", "age"}},
+		{Fields: []string{"nick"}, Sparse: true},
+	} {
+		if _, err := indexed.CreateIndex("people", def); err != nil {
+			t.Fatalf("CreateIndex: %v", err)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	cities := []string{"Oslo", "Bergen", "Trondheim"}
+	for i := 0; i < 500; i++ {
+		id := fmt.Sprintf("p%03d", rng.Intn(300))
+		data := map[string]interface{}{
+			"age":  float64(rng.Intn(80)),
+			"tags": []interface{}{cities[rng.Intn(3)], "x"},
+		}
+		if rng.Intn(4) != 0 {
+			data["city"] = cities[rng.Intn(3)]
+		}
+		if rng.Intn(10) == 0 {
+			data["age"] = "unknown"
+		}
+		if rng.Intn(3) == 0 {
+			data["nick"] = string(rune('a' + rng.Intn(5)))
+		}
+		remove := rng.Intn(5) == 0
+		for _, engine := range []*storage.Engine{indexed, plain} {
+			if remove {
+				engine.DeleteDocument("people", id)
+			} else {
+				engine.UpsertDocument("people", id, data)
+			}
+		}
+	}
+
+	queries := []storage.QueryOptions{
+		{Filter: map[string]interface{}{"city": "Oslo"}},
+		{Filter: map[string]interface{}{"city": nil}},
+		{Filter: map[string]interface{}{"city": map[string]interface{}{"$in": []interface{}{"Oslo", "Bergen"}}}},
+		{Filter: map[string]interface{}{"age": map[string]interface{}{"$gte": 18.0, "$lt": 30.0}}},
+		{Filter: map[string]interface{}{"age": map[string]interface{}{"$gt": 60.0}}, Sort: []storage.SortField{{Field: "age", Direction: "desc"}}, Limit: 7},
+		{Filter: map[string]interface{}{"age": map[string]interface{}{"$lt": 10.0}}, Sort: []storage.SortField{{Field: "age"}}, Limit: 5, Skip: 2},
+		{Sort: []storage.SortField{{Field: "age"}}, Limit: 10},
+		{Filter: map[string]interface{}{"tags": "Bergen", "age": map[string]interface{}{"$lte": 40.0}}},
+		{Filter: map[string]interface{}{"$and": []interface{}{map[string]interface{}{"city": "Trondheim"}}}, Sort: []storage.SortField{{Field: "age"}}},
+		{Filter: map[string]interface{}{"city": "Oslo", "age": map[string]interface{}{"$gte": 30.0}}},
+		{Filter: map[string]interface{}{"city": map[string]interface{}{"$in": []interface{}{"Oslo", "Bergen"}}, "age": 42.0}},
+		{Filter: map[string]interface{}{"city": map[string]interface{}{"$gt": "C"}}},
+		{Filter: map[string]interface{}{"nick": "c"}},
+		{Filter: map[string]interface{}{"nick": nil}},
+	}
+
+	for _, q := range queries {
+		a, err := indexed.Query("people", q)
+		if err != nil {
+			t.Fatalf("indexed query %+v: %v", q, err)
+		}
+		b, err := plain.Query("people", q)
+		if err != nil {
+			t.Fatalf("plain query %+v: %v", q, err)
+		}
+		if ids(a.Documents) != ids(b.Documents) || a.NextCursor != b.NextCursor {
+			t.Errorf("query %+v:\n indexed %s\n scan    %s", q, ids(a.Documents), ids(b.Documents))
+		}
+	}
+}
+
+func ids(docs []*storage.Document) string {
+	out := make([]string, len(docs))
+	for i, d := range docs {
+		out[i] = d.ID
+	}
+	return strings.Join(out, ",")
+}
+
+func TestIndexDefinitionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+
+	engine.InsertDocument("users", "u1", map[string]interface{}{"email": "a@example.com", "org": "x"})
+	engine.InsertDocument("users", "u2", map[string]interface{}{"email": "b@example.com", "org": "x"})
+
+	status, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"org", "email"}, Unique: true})
+	if err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if status.State != storage.IndexReady || status.Name != "org_email_btree" || status.Indexed != 2 {
+		t.Fatalf("status = %+v", status)
+	}
+	if _, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"org", "email"}, Unique: true}); !errors.Is(err, storage.ErrIndexExists) {
+		t.Fatalf("duplicate CreateIndex error = %v, want ErrIndexExists", err)
+	}
+	if _, err := engine.CreateIndex("users", indexing.Definition{Name: "by_org", Fields: []string{"org"}, Unique: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	list := engine.ListIndexes("users")
+	if len(list) != 2 || list[0].Name != "by_org" || list[0].State != storage.IndexFailed || list[0].Error == "" {
+		t.Fatalf("a unique index over duplicates should fail, got %+v", list)
+	}
+	if _, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"email"}, Type: indexing.TypeHash, Sparse: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	engine = openEngine(t, dir)
+	var names []string
+	for _, st := range engine.ListIndexes("users") {
+		if st.State != storage.IndexReady || st.Indexed != 2 {
+			t.Errorf("index %s after restart = %+v", st.Name, st)
+		}
+		names = append(names, st.Name)
+	}
+	if strings.Join(names, ",") != "email_hash,org_email_btree" {
+		t.Fatalf("indexes after restart = %v", names)
+	}
+	if err := engine.DropIndex("users", "email_hash"); err != nil {
+		t.Fatalf("DropIndex: %v", err)
+	}
+	if err := engine.DropIndex("users", "email_hash"); !errors.Is(err, storage.ErrIndexNotFound) {
+		t.Fatalf("second DropIndex error = %v, want ErrIndexNotFound", err)
+	}
+	engine.Close()
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	if list := engine.ListIndexes("users"); len(list) != 1 || list[0].Name != "org_email_btree" {
+		t.Fatalf("indexes after drop and restart = %+v", list)
+	}
+}
+
+func TestUniqueIndexRejectsDuplicateWrites(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+
+	if _, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"email"}, Unique: true, Sparse: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if _, err := engine.InsertDocument("users", "u1", map[string]interface{}{"email": "a@example.com"}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+
+	_, err := engine.InsertDocument("users", "u2", map[string]interface{}{"email": "a@example.com"})
+	var uv *storage.UniqueViolationError
+	if !errors.As(err, &uv) || !errors.Is(err, storage.ErrUniqueViolation) {
+		t.Fatalf("duplicate insert error = %v, want UniqueViolationError", err)
+	}
+	if uv.ExistingID != "u1" || uv.Index != "email_btree" || uv.Key != "a@example.com" {
+		t.Fatalf("violation = %+v", uv)
+	}
+
+	// Documents without the field are exempt from a sparse unique index.
+	for _, id := range []string{"u2", "u3"} {
+		if _, err := engine.InsertDocument("users", id, map[string]interface{}{"name": id}); err != nil {
+			t.Fatalf("InsertDocument %s: %v", id, err)
+		}
+	}
+	if _, err := engine.UpdateDocument("users", "u1", map[string]interface{}{"email": "a@example.com", "name": "alice"}); err != nil {
+		t.Fatalf("rewriting own key: %v", err)
+	}
+	if _, err := engine.UpdateDocument("users", "u2", map[string]interface{}{"email": "a@example.com"}); !errors.Is(err, storage.ErrUniqueViolation) {
+		t.Fatalf("duplicate update error = %v", err)
+	}
+	patch, _ := storage.ParseMergePatch([]byte(`{"email": "a@example.com"}`))
+	if _, err := engine.PatchDocument("users", "u3", patch); !errors.Is(err, storage.ErrUniqueViolation) {
+		t.Fatalf("duplicate patch error = %v", err)
+	}
+	engine.Close()
+
+	// Rejected writes never reached the WAL.
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	for _, id := range []string{"u2", "u3"} {
+		doc, _ := engine.GetDocument("users", id)
+		if doc.Version != 1 || doc.Data["email"] != nil {
+			t.Fatalf("%s after restart = %+v", id, doc)
+		}
+	}
+}
+
+func TestExplainReportsPlanAndWork(t *testing.T) {
+	engine, _ := newEngine(t)
+	for i := 0; i < 100; i++ {
+		engine.InsertDocument("items", fmt.Sprintf("i%03d", i), map[string]interface{}{"n": float64(i), "kind": fmt.Sprint(i % 4)})
+	}
+
+	opts := storage.QueryOptions{
+		Filter: map[string]interface{}{"n": map[string]interface{}{"$gte": 90.0}},
+		Sort:   []storage.SortField{{Field: "n"}},
+		Limit:  3,
+	}
+	scan, err := engine.ExplainQuery("items", opts)
+	if err != nil {
+		t.Fatalf("ExplainQuery: %v", err)
+	}
+	if scan.Plan != indexing.PlanCollectionScan || scan.DocsExamined != 100 || scan.Matched != 10 || scan.Returned != 3 || scan.SortStrategy != storage.SortInMemory {
+		t.Fatalf("collection scan explain = %+v", scan)
+	}
+
+	if _, err := engine.CreateIndex("items", indexing.Definition{Fields: []string{"n"}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	opts.Explain = true
+	result, err := engine.Query("items", opts)
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	ex := result.Explain
+	if ex == nil || ex.Plan != indexing.PlanIndexRange || ex.Index != "n_btree" || ex.SortStrategy != storage.SortByIndex {
+		t.Fatalf("indexed explain = %+v", ex)
+	}
+	if !ex.EarlyStop || ex.DocsExamined != 4 || ex.Returned != 3 || len(result.Documents) != 3 {
+		t.Fatalf("indexed explain work = %+v", ex)
+	}
+}
+
+func TestIndexedSortHonorsIDTieBreakerDirection(t *testing.T) {
+	engine, _ := newEngine(t)
+	for i := 0; i < 6; i++ {
+		engine.InsertDocument("people", fmt.Sprintf("d%d", i), map[string]interface{}{"age": float64(30 + i%2)})
+	}
+	if _, err := engine.CreateIndex("people", indexing.Definition{Fields: []string{"age"}}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+
+	for _, tc := range []struct {
+		sort []storage.SortField
+		want string
+	}{
+		{[]storage.SortField{{Field: "age"}, {Field: "id"}}, "d0 d2"},
+		{[]storage.SortField{{Field: "age"}, {Field: "id", Direction: "desc"}}, "d4 d2"},
+		{[]storage.SortField{{Field: "age", Direction: "desc"}, {Field: "id", Direction: "desc"}}, "d5 d3"},
+	} {
+		result, err := engine.Query("people", storage.QueryOptions{Sort: tc.sort, Limit: 2})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		var got []string
+		for _, doc := range result.Documents {
+			got = append(got, doc.ID)
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Fatalf("sort %+v = %v, want %s", tc.sort, got, tc.want)
+		}
+	}
+}
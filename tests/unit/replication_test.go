@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/replication"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestFollowerAppliesLeaderWAL(t *testing.T) {
+	dir := t.TempDir()
+	leader := openEngine(t, filepath.Join(dir, "leader"))
+	defer leader.Close()
+	leader.InsertDocument("users", "u1", map[string]interface{}{"email": "a@example.com"})
+	snap, err := leader.Backup(filepath.Join(dir, "backups", "snap"))
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	if _, err := backup.Restore(filepath.Join(dir, "backups", "snap"), filepath.Join(dir, "follower", "helix.db"), filepath.Join(dir, "follower", "wal"), backup.RestoreOptions{}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	follower := openEngine(t, filepath.Join(dir, "follower"))
+	defer follower.Close()
+	follower.SetReadOnly(true)
+
+	stream, err := leader.StreamWAL(snap.LSN)
+	if err != nil {
+		t.Fatalf("StreamWAL: %v", err)
+	}
+	defer stream.Close()
+	leader.CreateIndex("users", indexing.Definition{Fields: []string{"email"}, Unique: true})
+	leader.InsertDocument("users", "u2", map[string]interface{}{"email": "b@example.com"})
+	txn := leader.Begin()
+	txn.Delete("users", "u1")
+	txn.Insert("posts", "p1", map[string]interface{}{"by": "u2"})
+	if _, err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for follower.LastLSN() < leader.LastLSN() {
+		entry, err := stream.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if err := follower.ApplyReplicated(entry); err != nil {
+			t.Fatalf("ApplyReplicated(%d): %v", entry.LSN, err)
+		}
+	}
+
+	if doc, ok := follower.GetDocument("users", "u2"); !ok || doc.Version != 1 {
+		t.Fatalf("u2 = %+v", doc)
+	}
+	if _, ok := follower.GetDocument("users", "u1"); ok {
+		t.Fatal("u1 was not deleted")
+	}
+	if _, ok := follower.GetDocument("posts", "p1"); !ok {
+		t.Fatal("p1 missing")
+	}
+	if indexes := follower.ListIndexes("users"); len(indexes) != 1 || indexes[0].State != storage.IndexReady {
+		t.Fatalf("indexes = %+v", indexes)
+	}
+
+	if _, err := follower.InsertDocument("users", "u3", map[string]interface{}{}); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("write on a follower = %v", err)
+	}
+	if err := follower.ApplyReplicated(storage.WALEntry{LSN: follower.LastLSN() + 2, Operation: "DELETE", Collection: "users", DocumentID: "u2"}); !errors.Is(err, storage.ErrReplicationGap) {
+		t.Fatalf("ApplyReplicated out of sequence = %v", err)
+	}
+}
+
+func TestFollowerBootstrapsAndTailsOverHTTP(t *testing.T) {
+	dir := t.TempDir()
+	leader := openEngine(t, filepath.Join(dir, "leader"))
+	for i := 0; i < 5; i++ {
+		leader.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+	}
+	backups, _ := backup.New(leader, config.BackupConfig{})
+	ts := httptest.NewServer(server.New(leader, backups, nil, nil, nil, config.Config{}).Handler())
+	defer ts.Close()
+	defer leader.Close()
+
+	cfg := config.Config{
+		Storage:     config.StorageConfig{DataFile: filepath.Join(dir, "follower", "helix.db"), WALDirectory: filepath.Join(dir, "follower", "wal")},
+		Replication: config.ReplicationConfig{Role: replication.RoleFollower, Leader: ts.URL, Name: "f1"},
+	}
+	report, err := replication.Bootstrap(cfg)
+	if err != nil || report.LSN != 5 {
+		t.Fatalf("Bootstrap = %+v, %v", report, err)
+	}
+	engine, err := storage.NewEngine(cfg.Storage.DataFile, cfg.Storage.WALDirectory)
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	defer engine.Close()
+	f := replication.NewFollower(engine, cfg)
+	f.Start()
+	defer f.Stop()
+
+	leader.InsertDocument("items", "new", map[string]interface{}{"n": 99.0})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if doc, ok := engine.GetDocument("items", "new"); ok && doc.Data["n"] == 99.0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower did not catch up: %+v", f.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := f.Status(); !status.Connected || status.AppliedLSN != 6 || status.LagRecords != 0 {
+		t.Fatalf("status = %+v", status)
+	}
+
+	// The follower's own API refuses writes but serves queries.
+	fs := httptest.NewServer(server.New(engine, backups, f, nil, nil, cfg).Handler())
+	defer fs.Close()
+	resp, _ := http.Post(fs.URL+"/collections/items", "application/json", strings.NewReader(`{"data":{}}`))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("POST on a follower = %s", resp.Status)
+	}
+	resp, _ = http.Post(fs.URL+"/collections/items/query", "application/json", strings.NewReader(`{"filter":{"n":99}}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("query on a follower = %s", resp.Status)
+	}
+}
@@ -0,0 +1,161 @@
+package unit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestRestoreReplaysIncrementalsUpToTarget(t *testing.T) {
+	dir := t.TempDir()
+	data, root := filepath.Join(dir, "data"), filepath.Join(dir, "backups")
+	engine := openEngine(t, data)
+	insert := func(from, to int) {
+		for i := from; i < to; i++ {
+			engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"n": float64(i)})
+		}
+	}
+	insert(0, 10)
+	snap, err := engine.Backup(filepath.Join(root, "a-snap"))
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	insert(10, 20)
+	if _, err := engine.BackupIncremental(filepath.Join(root, "b-inc"), snap.ID, snap.LSN); err != nil {
+		t.Fatalf("BackupIncremental: %v", err)
+	}
+	insert(20, 30)
+
+	// The data directory is in use.
+	if _, err := backup.Restore(root, filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), backup.RestoreOptions{}); !errors.Is(err, storage.ErrDataDirLocked) {
+		t.Fatalf("Restore while open = %v", err)
+	}
+	engine.Close()
+
+	count := func() int {
+		t.Helper()
+		restored := openEngine(t, data)
+		defer restored.Close()
+		docs, _ := restored.QueryDocuments("items", nil, 0)
+		return len(docs)
+	}
+
+	// Point in time: document 15 is record snap.LSN+6.
+	report, err := backup.Restore(filepath.Join(root, "b-inc"), filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), backup.RestoreOptions{UntilLSN: snap.LSN + 6})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if len(report.Backups) != 2 || report.LSN != snap.LSN+6 || report.Replayed != 6 {
+		t.Fatalf("report = %+v", report)
+	}
+	if n := count(); n != 16 {
+		t.Fatalf("restored %d documents, want 16", n)
+	}
+	if _, err := os.Stat(filepath.Join(report.PreviousDir, "helix.db")); err != nil {
+		t.Fatalf("previous data: %v", err)
+	}
+
+	// The whole chain, picked from the backup directory.
+	if report, err = backup.Restore(root, filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), backup.RestoreOptions{}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if n := count(); n != 20 || report.Snapshot != "a-snap" {
+		t.Fatalf("restored %d documents from %+v", n, report)
+	}
+
+	// Past the end of the backups.
+	if _, err := backup.Restore(root, filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), backup.RestoreOptions{UntilLSN: snap.LSN + 15}); !errors.Is(err, backup.ErrRestoreTarget) {
+		t.Fatalf("Restore past the end = %v", err)
+	}
+}
+
+func TestRestoreRejectsDamagedBackup(t *testing.T) {
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	engine := openEngine(t, data)
+	engine.InsertDocument("users", "u1", map[string]interface{}{"name": "alice"})
+	if _, err := engine.Backup(filepath.Join(dir, "backups", "b1")); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	engine.InsertDocument("users", "u2", map[string]interface{}{"name": "bob"})
+	engine.Close()
+
+	damageDocument(t, filepath.Join(dir, "backups", "b1"), "users", `"name":"alice"`)
+	if _, err := backup.Restore(filepath.Join(dir, "backups", "b1"), filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), backup.RestoreOptions{}); !errors.Is(err, storage.ErrBackupInvalid) {
+		t.Fatalf("Restore of a damaged backup = %v", err)
+	}
+
+	// The live data is untouched.
+	engine = openEngine(t, data)
+	defer engine.Close()
+	if doc, _ := engine.GetDocument("users", "u2"); doc == nil {
+		t.Fatal("u2 lost by a failed restore")
+	}
+}
+
+func TestRestoreStartsANewArchiveAfterPointInTime(t *testing.T) {
+	dir := t.TempDir()
+	data, archive := filepath.Join(dir, "data"), filepath.Join(dir, "archive")
+	open := func() *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), storage.Options{
+			WAL: storage.WALOptions{SegmentSize: 512, ArchiveDir: archive},
+		})
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+	restore := func(opts backup.RestoreOptions) *backup.RestoreReport {
+		t.Helper()
+		opts.ArchiveDir = archive
+		report, err := backup.Restore(filepath.Join(dir, "snap"), filepath.Join(data, "helix.db"), filepath.Join(data, "wal"), opts)
+		if err != nil {
+			t.Fatalf("Restore: %v", err)
+		}
+		return report
+	}
+	insert := func(engine *storage.Engine, prefix string, from, to int) {
+		for i := from; i < to; i++ {
+			if _, err := engine.InsertDocument("items", fmt.Sprintf("%s%d", prefix, i), map[string]interface{}{"n": float64(i)}); err != nil {
+				t.Fatalf("InsertDocument: %v", err)
+			}
+		}
+	}
+
+	engine := open()
+	insert(engine, "old", 0, 5)
+	if _, err := engine.Backup(filepath.Join(dir, "snap")); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	insert(engine, "old", 5, 19)
+	engine.Close()
+
+	// Back to LSN 8, then a new history from there.
+	report := restore(backup.RestoreOptions{UntilLSN: 8})
+	if report.PreviousArchiveDir == "" {
+		t.Fatalf("archive past the restored LSN left in place: %+v", report)
+	}
+	engine = open()
+	insert(engine, "new", 0, 6)
+	engine.Close()
+
+	// Restoring again replays the new history, not the discarded one.
+	report = restore(backup.RestoreOptions{})
+	engine = open()
+	defer engine.Close()
+	docs, _ := engine.QueryDocuments("items", nil, 0)
+	for _, doc := range docs {
+		var n int
+		if _, err := fmt.Sscanf(doc.ID, "old%d", &n); err == nil && n >= 8 {
+			t.Fatalf("discarded document %s restored", doc.ID)
+		}
+	}
+	if doc, _ := engine.GetDocument("items", "new0"); doc == nil || report.LSN <= 8 {
+		t.Fatalf("new history not restored: %d documents, %+v", len(docs), report)
+	}
+}
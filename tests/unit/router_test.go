@@ -0,0 +1,356 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/router"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+type testShard struct {
+	router.Shard
+	engine *storage.Engine
+}
+
+func startShard(t *testing.T, id string) testShard {
+	t.Helper()
+	engine, _ := newEngine(t)
+	backups, _ := backup.New(engine, config.BackupConfig{})
+	srv := httptest.NewServer(server.New(engine, backups, nil, nil, nil, config.Config{}).Handler())
+	t.Cleanup(srv.Close)
+	return testShard{Shard: router.Shard{ID: id, Address: srv.URL}, engine: engine}
+}
+
+func startRouter(t *testing.T, shards ...testShard) (*router.Router, string) {
+	t.Helper()
+	cfg := config.Config{Router: config.RouterConfig{StateFile: filepath.Join(t.TempDir(), "router.json")}}
+	for _, sh := range shards {
+		cfg.Router.Shards = append(cfg.Router.Shards, config.RouterShard{ID: sh.ID, Address: sh.Address})
+	}
+	rt, err := router.New(cfg)
+	if err != nil {
+		t.Fatalf("router.New: %v", err)
+	}
+	rt.Start()
+	srv := httptest.NewServer(rt.Handler(cfg.Security))
+	t.Cleanup(func() {
+		srv.Close()
+		rt.Stop()
+	})
+	return rt, srv.URL
+}
+
+func doJSON(t *testing.T, method, url string, body interface{}, out interface{}) int {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+// holders returns the shards that have the document.
+func holders(shards []testShard, collection, id string) []string {
+	var held []string
+	for _, sh := range shards {
+		if _, ok := sh.engine.GetDocument(collection, id); ok {
+			held = append(held, sh.ID)
+		}
+	}
+	return held
+}
+
+func TestRouterSpreadsDocumentsAndMergesQueries(t *testing.T) {
+	shards := []testShard{startShard(t, "s1"), startShard(t, "s2")}
+	_, url := startRouter(t, shards...)
+	ring := router.NewRing([]router.Shard{shards[0].Shard, shards[1].Shard}, 0)
+
+	var created []string
+	for i := 0; i < 40; i++ {
+		id := fmt.Sprintf("u%02d", i)
+		created = append(created, id)
+		body := map[string]interface{}{"id": id, "data": map[string]interface{}{"n": float64(i), "team": []string{"a", "b"}[i%2]}}
+		if status := doJSON(t, http.MethodPost, url+"/collections/users", body, nil); status != http.StatusCreated {
+			t.Fatalf("POST %s = %d", id, status)
+		}
+	}
+	perShard := map[string]int{}
+	for _, id := range created {
+		held := holders(shards, "users", id)
+		if len(held) != 1 || held[0] != ring.Owner("users", id).ID {
+			t.Fatalf("%s is on %v, want %s", id, held, ring.Owner("users", id).ID)
+		}
+		perShard[held[0]]++
+	}
+	if perShard["s1"] == 0 || perShard["s2"] == 0 {
+		t.Fatalf("documents per shard = %v", perShard)
+	}
+
+	var doc storage.Document
+	if status := doJSON(t, http.MethodGet, url+"/collections/users/u07", nil, &doc); status != http.StatusOK || doc.Data["n"] != 7.0 {
+		t.Fatalf("GET u07 = %d, %+v", status, doc)
+	}
+	if status := doJSON(t, http.MethodPatch, url+"/collections/users/u07", map[string]interface{}{"n": 70.0}, &doc); status != http.StatusOK || doc.Version != 2 {
+		t.Fatalf("PATCH u07 = %d, %+v", status, doc)
+	}
+
+	// Pages of a sorted query come out the same as from a single node.
+	var seen []float64
+	cursor := ""
+	for {
+		var page struct {
+			Documents  []*storage.Document `json:"documents"`
+			NextCursor string              `json:"nextCursor"`
+		}
+		query := map[string]interface{}{"sort": []storage.SortField{{Field: "n", Direction: "desc"}}, "limit": 7, "cursor": cursor, "projection": map[string]interface{}{"n": 1}}
+		if status := doJSON(t, http.MethodPost, url+"/collections/users/query", query, &page); status != http.StatusOK {
+			t.Fatalf("query = %d", status)
+		}
+		for _, d := range page.Documents {
+			seen = append(seen, d.Data["n"].(float64))
+			if _, ok := d.Data["team"]; ok {
+				t.Fatalf("projection not applied: %+v", d.Data)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 40 || !sort.IsSorted(sort.Reverse(sort.Float64Slice(seen))) || seen[0] != 70 {
+		t.Fatalf("paged query = %v", seen)
+	}
+
+	var skipped struct {
+		Documents []*storage.Document `json:"documents"`
+	}
+	doJSON(t, http.MethodPost, url+"/collections/users/query", map[string]interface{}{"sort": []storage.SortField{{Field: "id"}}, "skip": 35, "limit": 10}, &skipped)
+	if len(skipped.Documents) != 5 || skipped.Documents[0].ID != "u35" {
+		t.Fatalf("skip 35 = %+v", skipped.Documents)
+	}
+
+	var agg struct {
+		Results []map[string]interface{} `json:"results"`
+	}
+	pipeline := []storage.Stage{
+		{"$match": map[string]interface{}{"n": map[string]interface{}{"$lt": 10.0}}},
+		{"$group": map[string]interface{}{"_id": "$team", "count": map[string]interface{}{"$sum": 1.0}}},
+		{"$sort": map[string]interface{}{"_id": 1.0}},
+	}
+	if status := doJSON(t, http.MethodPost, url+"/collections/users/aggregate", map[string]interface{}{"pipeline": pipeline}, &agg); status != http.StatusOK {
+		t.Fatalf("aggregate = %d", status)
+	}
+	if len(agg.Results) != 2 || agg.Results[0]["count"] != 5.0 || agg.Results[1]["count"] != 4.0 {
+		t.Fatalf("aggregate = %+v", agg.Results)
+	}
+
+	// A transaction has to stay on one shard.
+	var a, b string
+	for _, id := range created {
+		switch ring.Owner("users", id).ID {
+		case "s1":
+			a = id
+		case "s2":
+			b = id
+		}
+	}
+	txn := map[string]interface{}{"operations": []map[string]interface{}{
+		{"op": "delete", "collection": "users", "id": a},
+		{"op": "delete", "collection": "users", "id": b},
+	}}
+	if status := doJSON(t, http.MethodPost, url+"/transactions", txn, nil); status != http.StatusBadRequest {
+		t.Fatalf("transaction across shards = %d", status)
+	}
+}
+
+func TestRouterAddsShardAndRebalances(t *testing.T) {
+	shards := []testShard{startShard(t, "s1"), startShard(t, "s2")}
+	rt, url := startRouter(t, shards...)
+	if status := doJSON(t, http.MethodPost, url+"/collections/orders/indexes", map[string]interface{}{"field": "customer"}, nil); status != http.StatusCreated && status != http.StatusAccepted {
+		t.Fatalf("create index = %d", status)
+	}
+	before := map[string]string{}
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("o%03d", i)
+		body := map[string]interface{}{"id": id, "data": map[string]interface{}{"customer": fmt.Sprintf("c%d", i%7)}}
+		if status := doJSON(t, http.MethodPost, url+"/collections/orders", body, nil); status != http.StatusCreated {
+			t.Fatalf("POST %s = %d", id, status)
+		}
+		before[id] = holders(shards, "orders", id)[0]
+	}
+	// Moved documents keep their versions, timestamps and HLCs.
+	for i := 0; i < 200; i += 10 {
+		id := fmt.Sprintf("o%03d", i)
+		body := map[string]interface{}{"data": map[string]interface{}{"customer": "updated"}}
+		if status := doJSON(t, http.MethodPut, url+"/collections/orders/"+id, body, nil); status != http.StatusOK {
+			t.Fatalf("PUT %s = %d", id, status)
+		}
+	}
+	docs := map[string]*storage.Document{}
+	for _, sh := range shards {
+		result, err := sh.engine.Query("orders", storage.QueryOptions{})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		for _, doc := range result.Documents {
+			docs[doc.ID] = doc
+		}
+	}
+
+	added := startShard(t, "s3")
+	if status := doJSON(t, http.MethodPost, url+router.ShardsPath, added.Shard, nil); status != http.StatusAccepted {
+		t.Fatalf("add shard = %d", status)
+	}
+	if status := doJSON(t, http.MethodPost, url+router.ShardsPath, added.Shard, nil); status != http.StatusConflict {
+		t.Fatalf("adding it again = %d", status)
+	}
+	// Requests keep working while documents move.
+	var doc storage.Document
+	if status := doJSON(t, http.MethodGet, url+"/collections/orders/o042", nil, &doc); status != http.StatusOK || doc.ID != "o042" {
+		t.Fatalf("GET during rebalance = %d, %+v", status, doc)
+	}
+	waitFor(t, "the rebalance", func() bool {
+		status := rt.Status()
+		return !status.Rebalancing && status.Rebalance != nil && status.Rebalance.State == router.RebalanceCompleted
+	})
+
+	all := append(shards, added)
+	moved := 0
+	for id, was := range before {
+		held := holders(all, "orders", id)
+		if len(held) != 1 {
+			t.Fatalf("%s is on %v", id, held)
+		}
+		// Only documents the new shard took over have moved.
+		if held[0] != was {
+			if held[0] != "s3" {
+				t.Fatalf("%s moved from %s to %s", id, was, held[0])
+			}
+			old := docs[id]
+			doc, _ := added.engine.GetDocument("orders", id)
+			if doc.Version != old.Version || !doc.CreatedAt.Equal(old.CreatedAt) || !doc.UpdatedAt.Equal(old.UpdatedAt) || doc.HLC != old.HLC {
+				t.Fatalf("%s after moving = %+v, was %+v", id, doc, old)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved == len(before) {
+		t.Fatalf("moved %d of %d documents", moved, len(before))
+	}
+	if indexes := added.engine.ListIndexes("orders"); len(indexes) != 1 || indexes[0].Fields[0] != "customer" {
+		t.Fatalf("indexes on the new shard = %+v", indexes)
+	}
+
+	var result struct {
+		Count int `json:"count"`
+	}
+	doJSON(t, http.MethodPost, url+"/collections/orders/query", map[string]interface{}{"filter": map[string]interface{}{}}, &result)
+	if result.Count != len(before) {
+		t.Fatalf("count after rebalance = %d", result.Count)
+	}
+}
+
+func TestRouterServesOtherDocumentsWhileARequestIsSlow(t *testing.T) {
+	s1 := startShard(t, "s1")
+	target, err := url.Parse(s1.Address)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	forward := httputil.NewSingleHostReverseProxy(target)
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Path == "/collections/items/slow" {
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+		}
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+	slowShard := testShard{Shard: router.Shard{ID: "s1", Address: proxy.URL}, engine: s1.engine}
+	rt, url := startRouter(t, slowShard)
+	for _, id := range []string{"slow", "fast"} {
+		if status := doJSON(t, http.MethodPost, url+"/collections/items", map[string]interface{}{"id": id, "data": map[string]interface{}{"n": 1.0}}, nil); status != http.StatusCreated {
+			t.Fatalf("POST %s = %d", id, status)
+		}
+	}
+
+	slow := make(chan int, 1)
+	go func() {
+		slow <- doJSON(t, http.MethodPut, url+"/collections/items/slow", map[string]interface{}{"data": map[string]interface{}{"n": 2.0}}, nil)
+	}()
+	<-entered
+	added := startShard(t, "s2")
+	addErr := make(chan error, 1)
+	go func() { addErr <- rt.AddShard(context.Background(), added.Shard) }()
+
+	// Adding a shard waits for the slow request, but nothing else does.
+	served := make(chan int, 1)
+	go func() {
+		for len(rt.Status().Shards) != 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		served <- doJSON(t, http.MethodGet, url+"/collections/items/fast", nil, nil)
+	}()
+	select {
+	case status := <-served:
+		if status != http.StatusOK {
+			t.Errorf("GET fast = %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("a request for another document waited for the slow one")
+	}
+	select {
+	case err := <-addErr:
+		t.Errorf("AddShard returned %v before the slow request was done", err)
+	default:
+	}
+
+	close(release)
+	if status := <-slow; status != http.StatusOK {
+		t.Fatalf("PUT slow = %d", status)
+	}
+	if err := <-addErr; err != nil {
+		t.Fatalf("AddShard: %v", err)
+	}
+	waitFor(t, "the rebalance", func() bool { return !rt.Status().Rebalancing })
+	all := []testShard{slowShard, added}
+	for _, id := range []string{"slow", "fast"} {
+		if held := holders(all, "items", id); len(held) != 1 {
+			t.Fatalf("%s is on %v", id, held)
+		}
+	}
+	if doc, ok := slowShard.engine.GetDocument("items", "slow"); ok && doc.Data["n"] != 2.0 {
+		t.Fatalf("slow after the rebalance = %+v", doc)
+	}
+	if doc, ok := added.engine.GetDocument("items", "slow"); ok && doc.Data["n"] != 2.0 {
+		t.Fatalf("slow after the rebalance = %+v", doc)
+	}
+}
@@ -0,0 +1,102 @@
+package unit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	var total int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func TestCheckpointAppendsOnlyChangedDocuments(t *testing.T) {
+	dir := t.TempDir()
+	opts := storage.Options{SegmentSize: 4096}
+	open := func() *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+
+	engine := open()
+	for i := 0; i < 300; i++ {
+		engine.InsertDocument("items", fmt.Sprint(i), map[string]interface{}{"i": float64(i), "name": "item"})
+	}
+	engine.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segments", "items", "*.seg"))
+	if len(segments) < 2 {
+		t.Fatalf("expected several segments, got %v", segments)
+	}
+	var manifest struct {
+		Format int `json:"format"`
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "helix.db"))
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Format != 2 || len(data) > 1024 {
+		t.Fatalf("data file is not a small manifest: %d bytes, %v", len(data), err)
+	}
+
+	before := dirSize(t, filepath.Join(dir, "segments"))
+	engine = open()
+	engine.UpdateDocument("items", "7", map[string]interface{}{"i": 7.0, "name": "changed"})
+	engine.DeleteDocument("items", "8")
+	engine.Close()
+	if grown := dirSize(t, filepath.Join(dir, "segments")) - before; grown <= 0 || grown > 512 {
+		t.Fatalf("checkpoint of two changes grew segments by %d bytes", grown)
+	}
+
+	// Leftovers from a checkpoint that never wrote its manifest are ignored.
+	f, _ := os.OpenFile(filepath.Join(dir, "segments", "items", "index"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte("garbage from an interrupted checkpoint"))
+	f.Close()
+
+	engine = open()
+	defer engine.Close()
+	docs, _ := engine.QueryDocuments("items", nil, 0)
+	if len(docs) != 299 {
+		t.Fatalf("after restart %d documents, want 299", len(docs))
+	}
+	if doc, _ := engine.GetDocument("items", "7"); doc.Data["name"] != "changed" || doc.Version != 2 {
+		t.Fatalf("updated document after restart = %+v", doc)
+	}
+	if _, ok := engine.GetDocument("items", "8"); ok {
+		t.Fatal("deleted document came back")
+	}
+	if _, err := engine.InsertDocument("items", "new", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+}
+
+func TestLegacyDataFileIsConvertedToSegments(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"collections":{"users":{"u1":{"id":"u1","data":{"name":"alice"},"version":3}}},"lastLSN":0}`
+	os.WriteFile(filepath.Join(dir, "helix.db"), []byte(legacy), 0644)
+
+	engine := openEngine(t, dir)
+	engine.Close()
+	engine = openEngine(t, dir)
+	defer engine.Close()
+
+	doc, ok := engine.GetDocument("users", "u1")
+	if !ok || doc.Data["name"] != "alice" || doc.Version != 3 {
+		t.Fatalf("converted document = %+v", doc)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segments", "users", "index")); err != nil {
+		t.Fatalf("legacy data was not written to segments: %v", err)
+	}
+}
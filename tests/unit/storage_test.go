@@ -0,0 +1,443 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func openEngine(t *testing.T, dir string) *storage.Engine {
+	t.Helper()
+	engine, err := storage.NewEngine(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"))
+	if err != nil {
+		t.Fatalf("NewEngine: %v", err)
+	}
+	return engine
+}
+
+func newEngine(t *testing.T) (*storage.Engine, string) {
+	t.Helper()
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	t.Cleanup(func() { _ = engine.Close() })
+	return engine, dir
+}
+
+func TestUpdateDocumentPreservesCreatedAt(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	orig, err := engine.InsertDocument("users", "u1", map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	doc, err := engine.UpdateDocument("users", "u1", map[string]interface{}{"name": "bob"})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if !doc.CreatedAt.Equal(orig.CreatedAt) {
+		t.Errorf("CreatedAt changed: %v -> %v", orig.CreatedAt, doc.CreatedAt)
+	}
+	if !doc.UpdatedAt.After(orig.UpdatedAt) {
+		t.Errorf("UpdatedAt not bumped: %v -> %v", orig.UpdatedAt, doc.UpdatedAt)
+	}
+	if doc.Checksum == orig.Checksum {
+		t.Errorf("checksum not recomputed")
+	}
+	if orig.Data["name"] != "alice" {
+		t.Errorf("previous document was mutated: %v", orig.Data)
+	}
+}
+
+func TestUpdateMissingDocument(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	_, err := engine.UpdateDocument("users", "nope", map[string]interface{}{})
+	if !errors.Is(err, storage.ErrDocumentNotFound) {
+		t.Fatalf("expected ErrDocumentNotFound, got %v", err)
+	}
+}
+
+func TestUpsertDocument(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	_, created, err := engine.UpsertDocument("users", "u1", map[string]interface{}{"n": 1.0})
+	if err != nil || !created {
+		t.Fatalf("first upsert: created=%v err=%v", created, err)
+	}
+	doc, created, err := engine.UpsertDocument("users", "u1", map[string]interface{}{"n": 2.0})
+	if err != nil || created {
+		t.Fatalf("second upsert: created=%v err=%v", created, err)
+	}
+	if doc.Data["n"] != 2.0 {
+		t.Errorf("unexpected data: %v", doc.Data)
+	}
+}
+
+func TestPatchDocument(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	_, err := engine.InsertDocument("users", "u1", map[string]interface{}{
+		"name":    "alice",
+		"address": map[string]interface{}{"city": "Oslo", "zip": "0150"},
+		"tags":    []interface{}{"a", "c"},
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	merge, err := storage.ParseMergePatch([]byte(`{"address":{"zip":null,"country":"NO"},"age":30}`))
+	if err != nil {
+		t.Fatalf("parse merge patch: %v", err)
+	}
+	doc, err := engine.PatchDocument("users", "u1", merge)
+	if err != nil {
+		t.Fatalf("merge patch: %v", err)
+	}
+	addr := doc.Data["address"].(map[string]interface{})
+	if _, ok := addr["zip"]; ok || addr["country"] != "NO" || addr["city"] != "Oslo" || doc.Data["age"] != 30.0 {
+		t.Errorf("unexpected merge result: %v", doc.Data)
+	}
+
+	jsonPatch, err := storage.ParseJSONPatch([]byte(`[
+		{"op":"test","path":"/name","value":"alice"},
+		{"op":"add","path":"/tags/1","value":"b"},
+		{"op":"move","from":"/address/city","path":"/city"},
+		{"op":"remove","path":"/age"}
+	]`))
+	if err != nil {
+		t.Fatalf("parse JSON patch: %v", err)
+	}
+	doc, err = engine.PatchDocument("users", "u1", jsonPatch)
+	if err != nil {
+		t.Fatalf("JSON patch: %v", err)
+	}
+	tags := doc.Data["tags"].([]interface{})
+	if len(tags) != 3 || tags[1] != "b" || doc.Data["city"] != "Oslo" {
+		t.Errorf("unexpected JSON patch result: %v", doc.Data)
+	}
+	if _, ok := doc.Data["age"]; ok {
+		t.Errorf("age not removed: %v", doc.Data)
+	}
+
+	failing, _ := storage.ParseJSONPatch([]byte(`[{"op":"test","path":"/name","value":"bob"},{"op":"remove","path":"/name"}]`))
+	if _, err := engine.PatchDocument("users", "u1", failing); !errors.Is(err, storage.ErrPatchTestFailed) {
+		t.Fatalf("expected ErrPatchTestFailed, got %v", err)
+	}
+	if got, _ := engine.GetDocument("users", "u1"); got.Data["name"] != "alice" {
+		t.Errorf("failed patch was partially applied: %v", got.Data)
+	}
+}
+
+func TestUpdateSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+
+	orig, _ := engine.InsertDocument("users", "u1", map[string]interface{}{"name": "alice"})
+	if _, err := engine.UpdateDocument("users", "u1", map[string]interface{}{"name": "bob"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := engine.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+
+	doc, ok := engine.GetDocument("users", "u1")
+	if !ok {
+		t.Fatal("document missing after restart")
+	}
+	if doc.Data["name"] != "bob" || !doc.CreatedAt.Equal(orig.CreatedAt) {
+		t.Errorf("unexpected document after restart: %+v", doc)
+	}
+}
+
+func TestDocumentVersions(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	doc, _ := engine.InsertDocument("users", "u1", map[string]interface{}{"n": 1.0})
+	if doc.Version != 1 {
+		t.Fatalf("expected version 1, got %d", doc.Version)
+	}
+	doc, _ = engine.UpdateDocument("users", "u1", map[string]interface{}{"n": 2.0})
+	if doc.Version != 2 {
+		t.Fatalf("expected version 2, got %d", doc.Version)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	doc, err := engine.CompareAndSwap("users", "u1", 0, map[string]interface{}{"n": 1.0})
+	if err != nil {
+		t.Fatalf("create via CAS: %v", err)
+	}
+	if _, err := engine.CompareAndSwap("users", "u1", 0, map[string]interface{}{"n": 9.0}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed for existing doc, got %v", err)
+	}
+
+	if _, err := engine.CompareAndSwap("users", "u1", doc.Version, map[string]interface{}{"n": 2.0}); err != nil {
+		t.Fatalf("CAS with current version: %v", err)
+	}
+	if _, err := engine.CompareAndSwap("users", "u1", doc.Version, map[string]interface{}{"n": 3.0}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed for stale version, got %v", err)
+	}
+	if got, _ := engine.GetDocument("users", "u1"); got.Data["n"] != 2.0 || got.Version != 2 {
+		t.Errorf("unexpected document: %+v", got)
+	}
+
+	if err := engine.CompareAndDelete("users", "u1", 1); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed on stale delete, got %v", err)
+	}
+	if err := engine.CompareAndDelete("users", "u1", 2); err != nil {
+		t.Fatalf("delete with current version: %v", err)
+	}
+}
+
+func TestVersionSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	engine.InsertDocument("users", "u1", map[string]interface{}{"n": 1.0})
+	engine.UpdateDocument("users", "u1", map[string]interface{}{"n": 2.0})
+	engine.UpdateDocument("users", "u1", map[string]interface{}{"n": 3.0})
+	engine.Close()
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	doc, _ := engine.GetDocument("users", "u1")
+	if doc.Version != 3 {
+		t.Errorf("expected version 3 after restart, got %d", doc.Version)
+	}
+}
+
+func TestVersionContinuesAfterDelete(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	engine.InsertDocument("users", "u1", map[string]interface{}{"n": 1.0})
+	engine.DeleteDocument("users", "u1")
+	doc, err := engine.InsertDocument("users", "u1", map[string]interface{}{"n": 2.0})
+	if err != nil {
+		t.Fatalf("recreate: %v", err)
+	}
+	if doc.Version != 2 {
+		t.Fatalf("expected version 2 after recreate, got %d", doc.Version)
+	}
+	if _, err := engine.CompareAndSwap("users", "u1", 1, map[string]interface{}{"n": 9.0}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected ErrPreconditionFailed for the deleted document's version, got %v", err)
+	}
+
+	// The last version of a deleted document survives a checkpoint, a
+	// compaction and a restart.
+	engine.InsertDocument("users", "u2", map[string]interface{}{"n": 1.0})
+	engine.UpdateDocument("users", "u2", map[string]interface{}{"n": 2.0})
+	engine.DeleteDocument("users", "u2")
+	engine.Close()
+	engine = openEngine(t, dir)
+	if _, err := engine.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	engine.Close()
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	if doc, _ := engine.InsertDocument("users", "u2", map[string]interface{}{"n": 3.0}); doc == nil || doc.Version != 3 {
+		t.Errorf("expected version 3 after restart, got %+v", doc)
+	}
+}
+
+func TestStaleIfMatchAfterRecreate(t *testing.T) {
+	engine, _ := newEngine(t)
+	backups, _ := backup.New(engine, config.BackupConfig{})
+	ts := httptest.NewServer(server.New(engine, backups, nil, nil, nil, config.Config{}).Handler())
+	defer ts.Close()
+
+	url := ts.URL + "/collections/users/u1"
+	doJSON(t, http.MethodPut, url, map[string]interface{}{"data": map[string]interface{}{"n": 1.0}}, nil)
+	doJSON(t, http.MethodDelete, url, nil, nil)
+	doJSON(t, http.MethodPut, url, map[string]interface{}{"data": map[string]interface{}{"n": 2.0}}, nil)
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		req, _ := http.NewRequest(method, url, strings.NewReader(`{"data": {"n": 9}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", `"1"`)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s with a stale ETag: expected 412, got %d", method, resp.StatusCode)
+		}
+	}
+	if doc, _ := engine.GetDocument("users", "u1"); doc == nil || doc.Data["n"] != 2.0 {
+		t.Errorf("unexpected document: %+v", doc)
+	}
+}
+
+func queryIDs(t *testing.T, engine *storage.Engine, filter map[string]interface{}) map[string]bool {
+	t.Helper()
+	docs, err := engine.QueryDocuments("people", filter, 0)
+	if err != nil {
+		t.Fatalf("query %v: %v", filter, err)
+	}
+	ids := make(map[string]bool)
+	for _, d := range docs {
+		ids[d.ID] = true
+	}
+	return ids
+}
+
+func TestQueryOperators(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	engine.InsertDocument("people", "a", map[string]interface{}{
+		"age": 30.0, "name": "Alice", "tags": []interface{}{"admin", "dev"},
+		"address": map[string]interface{}{"city": "Oslo"},
+		"scores":  []interface{}{map[string]interface{}{"k": "x", "v": 5.0}, map[string]interface{}{"k": "y", "v": 9.0}},
+	})
+	engine.InsertDocument("people", "b", map[string]interface{}{
+		"age": "30", "name": "bob", "tags": []interface{}{"dev"}, "active": true,
+	})
+	engine.InsertDocument("people", "c", map[string]interface{}{
+		"age": 45, "name": "Carol", "address": map[string]interface{}{"city": "Bergen"}, "active": false, "nick": nil,
+	})
+
+	cases := []struct {
+		filter string
+		want   []string
+	}{
+		{`{"age": 30}`, []string{"a"}},
+		{`{"age": "30"}`, []string{"b"}},
+		{`{"age": {"$gte": 30}}`, []string{"a", "c"}},
+		{`{"age": {"$gt": 30, "$lt": 50}}`, []string{"c"}},
+		{`{"age": {"$ne": 30}}`, []string{"b", "c"}},
+		{`{"age": {"$in": [45, "30"]}}`, []string{"b", "c"}},
+		{`{"age": {"$nin": [45, "30"]}}`, []string{"a"}},
+		{`{"active": {"$exists": false}}`, []string{"a"}},
+		{`{"nick": null}`, []string{"a", "b", "c"}},
+		{`{"active": true}`, []string{"b"}},
+		{`{"name": {"$regex": "^c", "$options": "i"}}`, []string{"c"}},
+		{`{"name": {"$not": {"$regex": "^[A-Z]"}}}`, []string{"b"}},
+		{`{"address.city": "Oslo"}`, []string{"a"}},
+		{`{"tags": "dev"}`, []string{"a", "b"}},
+		{`{"tags.0": "admin"}`, []string{"a"}},
+		{`{"scores.v": {"$gt": 8}}`, []string{"a"}},
+		{`{"scores": {"$elemMatch": {"k": "x", "v": {"$gt": 6}}}}`, nil},
+		{`{"scores": {"$elemMatch": {"k": "y", "v": {"$gt": 6}}}}`, []string{"a"}},
+		{`{"$or": [{"name": "bob"}, {"age": {"$gt": 40}}]}`, []string{"b", "c"}},
+		{`{"$and": [{"tags": "dev"}, {"$not": {"name": "bob"}}]}`, []string{"a"}},
+	}
+
+	for _, tc := range cases {
+		var filter map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.filter), &filter); err != nil {
+			t.Fatalf("bad test filter %s: %v", tc.filter, err)
+		}
+		got := queryIDs(t, engine, filter)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.filter, got, tc.want)
+			continue
+		}
+		for _, id := range tc.want {
+			if !got[id] {
+				t.Errorf("%s: got %v, want %v", tc.filter, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestQueryRejectsMalformedFilters(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	for _, raw := range []string{
+		`{"age": {"$between": [1, 2]}}`,
+		`{"age": {"$in": 5}}`,
+		`{"$or": []}`,
+		`{"name": {"$regex": "("}}`,
+		`{"age": {"$gt": 1, "x": 2}}`,
+		`{"$where": "1"}`,
+	} {
+		var filter map[string]interface{}
+		json.Unmarshal([]byte(raw), &filter)
+		if _, err := engine.QueryDocuments("people", filter, 0); !errors.Is(err, storage.ErrInvalidFilter) {
+			t.Errorf("%s: expected ErrInvalidFilter, got %v", raw, err)
+		}
+	}
+}
+
+func TestQuerySortProjectionAndCursor(t *testing.T) {
+	engine, _ := newEngine(t)
+
+	for i, name := range []string{"d", "b", "e", "a", "c"} {
+		engine.InsertDocument("people", name, map[string]interface{}{
+			"name":   name,
+			"group":  float64(i % 2),
+			"secret": "x",
+			"nested": map[string]interface{}{"keep": 1.0, "drop": 2.0},
+		})
+	}
+
+	result, err := engine.Query("people", storage.QueryOptions{
+		Sort:       []storage.SortField{{Field: "group"}, {Field: "name", Direction: "desc"}},
+		Projection: map[string]interface{}{"name": 1.0, "nested.keep": true},
+	})
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var order []string
+	for _, d := range result.Documents {
+		order = append(order, d.ID)
+		if _, ok := d.Data["secret"]; ok {
+			t.Errorf("projection leaked secret: %v", d.Data)
+		}
+		if nested := d.Data["nested"].(map[string]interface{}); len(nested) != 1 {
+			t.Errorf("unexpected nested projection: %v", nested)
+		}
+	}
+	if got := strings.Join(order, ""); got != "edcba" {
+		t.Errorf("unexpected order %q", got)
+	}
+	if stored, _ := engine.GetDocument("people", "a"); stored.Data["secret"] != "x" {
+		t.Errorf("projection mutated stored document")
+	}
+
+	var paged []string
+	opts := storage.QueryOptions{Sort: []storage.SortField{{Field: "name"}}, Limit: 2}
+	for {
+		page, err := engine.Query("people", opts)
+		if err != nil {
+			t.Fatalf("page: %v", err)
+		}
+		for _, d := range page.Documents {
+			paged = append(paged, d.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if got := strings.Join(paged, ""); got != "abcde" {
+		t.Errorf("unexpected paged order %q", got)
+	}
+
+	if _, err := engine.Query("people", storage.QueryOptions{Sort: []storage.SortField{{Field: "group"}}, Cursor: opts.Cursor}); !errors.Is(err, storage.ErrInvalidQuery) {
+		t.Errorf("expected ErrInvalidQuery for mismatched cursor, got %v", err)
+	}
+
+	skipped, _ := engine.Query("people", storage.QueryOptions{Sort: []storage.SortField{{Field: "name"}}, Skip: 3})
+	if len(skipped.Documents) != 2 || skipped.Documents[0].ID != "d" {
+		t.Errorf("unexpected skip result: %v", skipped.Documents)
+	}
+}
@@ -0,0 +1,350 @@
+package unit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/backup"
+	"github.com/developer51709/helixdb/internal/clientsync"
+	"github.com/developer51709/helixdb/internal/config"
+	"github.com/developer51709/helixdb/internal/server"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func newSync(t *testing.T, cfg config.SyncConfig) (*clientsync.Service, *storage.Engine) {
+	t.Helper()
+	engine, _ := newEngine(t)
+	svc, err := clientsync.New(engine, cfg)
+	if err != nil {
+		t.Fatalf("clientsync.New: %v", err)
+	}
+	return svc, engine
+}
+
+// stamp returns a client timestamp offset from now.
+func stamp(offset time.Duration, node string) string {
+	return storage.HLC{Wall: time.Now().Add(offset).UnixMilli(), Node: node}.String()
+}
+
+func push(t *testing.T, svc *clientsync.Service, m clientsync.Mutation) clientsync.Result {
+	t.Helper()
+	resp, err := svc.Push([]clientsync.Mutation{m})
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	return resp.Results[0]
+}
+
+func TestHLCOrdering(t *testing.T) {
+	a := storage.HLC{Wall: 1700000000000, Logical: 2, Node: "a"}
+	b := storage.HLC{Wall: 1700000000000, Logical: 10, Node: "a"}
+	c := storage.HLC{Wall: 1700000000000, Logical: 10, Node: "b"}
+	if a.Compare(b) >= 0 || b.Compare(c) >= 0 || c.Compare(a) <= 0 || a.Compare(a) != 0 {
+		t.Fatalf("comparisons out of order")
+	}
+	if !(a.String() < b.String() && b.String() < c.String()) {
+		t.Fatalf("string forms out of order: %s %s %s", a, b, c)
+	}
+	parsed, err := storage.ParseHLC(b.String())
+	if err != nil || parsed != b {
+		t.Fatalf("ParseHLC(%s) = %+v, %v", b, parsed, err)
+	}
+	for _, bad := range []string{"x", "1-2", "abc-0-n", "1-999999-n", "1-0-"} {
+		if _, err := storage.ParseHLC(bad); !errors.Is(err, storage.ErrInvalidHLC) {
+			t.Fatalf("ParseHLC(%q) = %v", bad, err)
+		}
+	}
+
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	first := engine.Now()
+	if second := engine.Now(); second.Compare(first) <= 0 {
+		t.Fatalf("clock went from %s to %s", first, second)
+	}
+	// The clock moves past timestamps it observes, across restarts too.
+	ahead := storage.HLC{Wall: time.Now().Add(time.Hour).UnixMilli(), Node: "client"}
+	doc, _, err := engine.PutDocumentAt("notes", "n1", map[string]interface{}{"x": 1.0}, ahead, storage.Precondition{})
+	if err != nil || doc.HLC != ahead.String() {
+		t.Fatalf("PutDocumentAt = %+v, %v", doc, err)
+	}
+	if now := engine.Now(); now.Compare(ahead) <= 0 {
+		t.Fatalf("clock %s is not past %s", now, ahead)
+	}
+	engine.Close()
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	if doc, _ := engine.GetDocument("notes", "n1"); doc.HLC != ahead.String() {
+		t.Fatalf("HLC after restart = %q", doc.HLC)
+	}
+	if now := engine.Now(); now.Compare(ahead) <= 0 {
+		t.Fatalf("clock %s after restart is not past %s", now, ahead)
+	}
+}
+
+func TestSyncPullResetThenChanges(t *testing.T) {
+	svc, engine := newSync(t, config.SyncConfig{})
+	engine.InsertDocument("notes", "n1", map[string]interface{}{"text": "a"})
+	engine.InsertDocument("notes", "n2", map[string]interface{}{"text": "b"})
+	engine.InsertDocument("other", "o1", map[string]interface{}{"text": "c"})
+
+	snap, err := svc.Pull(clientsync.PullRequest{Collections: []string{"notes"}})
+	if err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if !snap.Reset || len(snap.Documents["notes"]) != 2 || snap.Documents["other"] != nil || snap.Checkpoint != engine.LastLSN() {
+		t.Fatalf("snapshot = %+v", snap)
+	}
+
+	engine.UpdateDocument("notes", "n1", map[string]interface{}{"text": "a2"})
+	engine.InsertDocument("other", "o2", map[string]interface{}{"text": "d"})
+	engine.DeleteDocument("notes", "n2")
+	txn := engine.Begin()
+	txn.Insert("notes", "n3", map[string]interface{}{"text": "e"})
+	txn.Insert("notes", "n4", map[string]interface{}{"text": "f"})
+	if _, err := txn.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// With a limit of two, the transaction's writes still come together.
+	var got []string
+	since := snap.Checkpoint
+	for pulls := 0; ; pulls++ {
+		resp, err := svc.Pull(clientsync.PullRequest{Since: &since, Collections: []string{"notes"}, Limit: 2})
+		if err != nil || resp.Reset {
+			t.Fatalf("Pull since %d = %+v, %v", since, resp, err)
+		}
+		for _, c := range resp.Changes {
+			if c.HLC == "" {
+				t.Fatalf("change without an HLC: %+v", c)
+			}
+			got = append(got, c.Operation+" "+c.DocumentID)
+		}
+		since = resp.Checkpoint
+		if !resp.More {
+			break
+		}
+		if pulls > 5 {
+			t.Fatalf("pulls never end")
+		}
+	}
+	want := []string{"UPDATE n1", "DELETE n2", "INSERT n3", "INSERT n4"}
+	if len(got) != len(want) {
+		t.Fatalf("changes = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("changes = %v, want %v", got, want)
+		}
+	}
+	if since != engine.LastLSN() {
+		t.Fatalf("checkpoint = %d, last LSN %d", since, engine.LastLSN())
+	}
+
+	// A checkpoint the server cannot resume from gets a snapshot.
+	future := engine.LastLSN() + 100
+	resp, err := svc.Pull(clientsync.PullRequest{Since: &future})
+	if err != nil || !resp.Reset || len(resp.Documents["notes"]) != 3 || len(resp.Documents["other"]) != 2 {
+		t.Fatalf("Pull from the future = %+v, %v", resp, err)
+	}
+}
+
+func TestSyncPushResolvesConflicts(t *testing.T) {
+	svc, engine := newSync(t, config.SyncConfig{
+		Strategy:    clientsync.StrategyReject,
+		Collections: map[string]string{"lww": clientsync.StrategyLWW, "merged": clientsync.StrategyMerge},
+	})
+
+	// A write based on the current version is applied with its timestamp.
+	created := stamp(0, "c1")
+	result := push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "a"}, HLC: created})
+	if result.Status != clientsync.StatusApplied || result.Document.Version != 1 || result.Document.HLC != created {
+		t.Fatalf("create = %+v", result)
+	}
+	// Pushing it again is harmless.
+	result = push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "a"}, HLC: created})
+	if result.Status != clientsync.StatusApplied || result.Document.Version != 1 {
+		t.Fatalf("retried create = %+v", result)
+	}
+
+	// reject keeps the server's document.
+	engine.UpdateDocument("notes", "n1", map[string]interface{}{"text": "server"})
+	result = push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "client"}, BaseVersion: 1, HLC: stamp(time.Second, "c1")})
+	if result.Status != clientsync.StatusRejected || result.Conflict.Resolution != clientsync.ResolutionRejected || result.Document.Data["text"] != "server" || result.Conflict.ServerVersion != 2 {
+		t.Fatalf("rejected = %+v", result)
+	}
+
+	// lww keeps the later write.
+	engine.InsertDocument("lww", "d1", map[string]interface{}{"n": 1.0})
+	engine.UpdateDocument("lww", "d1", map[string]interface{}{"n": 2.0})
+	result = push(t, svc, clientsync.Mutation{Collection: "lww", ID: "d1", Op: clientsync.OpPut, Data: map[string]interface{}{"n": 3.0}, BaseVersion: 1, HLC: stamp(-time.Minute, "c1")})
+	if result.Status != clientsync.StatusRejected || result.Conflict.Resolution != clientsync.ResolutionServerWins || result.Document.Data["n"] != 2.0 {
+		t.Fatalf("earlier client write = %+v", result)
+	}
+	later := stamp(5*time.Second, "c1")
+	result = push(t, svc, clientsync.Mutation{Collection: "lww", ID: "d1", Op: clientsync.OpPut, Data: map[string]interface{}{"n": 4.0}, BaseVersion: 1, HLC: later})
+	if result.Status != clientsync.StatusResolved || result.Conflict.Resolution != clientsync.ResolutionClientWins || result.Document.Data["n"] != 4.0 || result.Document.HLC != later {
+		t.Fatalf("later client write = %+v", result)
+	}
+	// The server's next write is ordered after the client's.
+	doc, _ := engine.UpdateDocument("lww", "d1", map[string]interface{}{"n": 5.0})
+	if storage.DocumentHLC(doc).Compare(storage.DocumentHLC(result.Document)) <= 0 {
+		t.Fatalf("server write %s is not after %s", doc.HLC, later)
+	}
+
+	// merge combines changes to different fields.
+	base := map[string]interface{}{"title": "t", "body": "b", "tags": []interface{}{"x"}}
+	engine.InsertDocument("merged", "m1", base)
+	engine.UpdateDocument("merged", "m1", map[string]interface{}{"title": "server title", "body": "b", "tags": []interface{}{"x"}})
+	result = push(t, svc, clientsync.Mutation{Collection: "merged", ID: "m1", Op: clientsync.OpPut, Base: base, BaseVersion: 1, HLC: stamp(0, "c1"),
+		Data: map[string]interface{}{"title": "t", "body": "client body", "tags": []interface{}{"x"}}})
+	if result.Status != clientsync.StatusResolved || result.Conflict.Resolution != clientsync.ResolutionMerged {
+		t.Fatalf("merge = %+v", result)
+	}
+	if d := result.Document.Data; d["title"] != "server title" || d["body"] != "client body" || result.Document.Version != 3 {
+		t.Fatalf("merged document = %+v", result.Document)
+	}
+	// Changes to the same field are a conflict, reported by field.
+	current := result.Document.Data
+	engine.UpdateDocument("merged", "m1", map[string]interface{}{"title": "server title", "body": "client body", "tags": []interface{}{"y"}})
+	result = push(t, svc, clientsync.Mutation{Collection: "merged", ID: "m1", Op: clientsync.OpPut, Base: current, BaseVersion: 3, HLC: stamp(0, "c1"),
+		Data: map[string]interface{}{"title": "client title", "body": "client body", "tags": []interface{}{"z"}}})
+	if result.Status != clientsync.StatusRejected || len(result.Conflict.Fields) != 1 || result.Conflict.Fields[0] != "tags" {
+		t.Fatalf("overlapping merge = %+v", result)
+	}
+	if doc, _ := engine.GetDocument("merged", "m1"); doc.Version != 4 {
+		t.Fatalf("document written despite the conflict: %+v", doc)
+	}
+
+	// Deletes: of a current document, of one deleted on the server.
+	result = push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpDelete, BaseVersion: 2, HLC: stamp(0, "c1")})
+	if result.Status != clientsync.StatusApplied || result.Document != nil {
+		t.Fatalf("delete = %+v", result)
+	}
+	result = push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{}, BaseVersion: 2, HLC: stamp(0, "c2")})
+	if result.Status != clientsync.StatusRejected || result.Conflict == nil {
+		t.Fatalf("put after the server deleted = %+v", result)
+	}
+
+	// A malformed push, or one from a clock far ahead, writes nothing.
+	bad := []clientsync.Mutation{
+		{Collection: "notes", ID: "n9", Op: clientsync.OpPut, Data: map[string]interface{}{}, HLC: stamp(0, "c1")},
+		{Collection: "notes", ID: "n8", Op: clientsync.OpPut, Data: map[string]interface{}{}, HLC: stamp(time.Hour, "c1")},
+	}
+	if _, err := svc.Push(bad); !errors.Is(err, clientsync.ErrClockDrift) {
+		t.Fatalf("Push from the future = %v", err)
+	}
+	bad[1] = clientsync.Mutation{Collection: "notes", ID: "n8", Op: "upsert", HLC: stamp(0, "c1")}
+	if _, err := svc.Push(bad); !errors.Is(err, clientsync.ErrInvalidMutation) {
+		t.Fatalf("Push with an unknown op = %v", err)
+	}
+	if _, ok := engine.GetDocument("notes", "n9"); ok {
+		t.Fatalf("rejected push wrote n9")
+	}
+}
+
+func TestSyncPushBasedOnADeletedDocumentConflicts(t *testing.T) {
+	for _, strategy := range []string{clientsync.StrategyReject, clientsync.StrategyMerge, clientsync.StrategyLWW} {
+		t.Run(strategy, func(t *testing.T) {
+			svc, engine := newSync(t, config.SyncConfig{Strategy: strategy})
+			lww := strategy == clientsync.StrategyLWW
+
+			// The client saw n1 and n2 at version 1; the server then deleted
+			// both and recreated n2, which does not reuse the version.
+			for _, id := range []string{"n1", "n2"} {
+				engine.InsertDocument("notes", id, map[string]interface{}{"text": "old"})
+				engine.DeleteDocument("notes", id)
+			}
+			recreated, err := engine.InsertDocument("notes", "n2", map[string]interface{}{"text": "new"})
+			if err != nil || recreated.Version != 2 {
+				t.Fatalf("recreated = %+v, %v", recreated, err)
+			}
+
+			// A write made before the delete never brings the document back.
+			result := push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "early"}, BaseVersion: 1, HLC: stamp(-time.Second, "c1")})
+			if result.Status != clientsync.StatusRejected || result.Conflict == nil || (lww && result.Conflict.Resolution != clientsync.ResolutionServerWins) {
+				t.Fatalf("write before the delete = %+v", result)
+			}
+			if doc, ok := engine.GetDocument("notes", "n1"); ok {
+				t.Fatalf("deleted document written by an earlier write: %+v", doc)
+			}
+
+			// A later one does under lww, which the other strategies reject.
+			result = push(t, svc, clientsync.Mutation{Collection: "notes", ID: "n1", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "late"}, BaseVersion: 1, HLC: stamp(time.Second, "c1")})
+			doc, ok := engine.GetDocument("notes", "n1")
+			if lww {
+				if result.Status != clientsync.StatusResolved || result.Conflict == nil || result.Conflict.Resolution != clientsync.ResolutionClientWins || !ok || doc.Version != 2 || doc.Data["text"] != "late" {
+					t.Fatalf("write after the delete = %+v, document %+v", result, doc)
+				}
+			} else if result.Status != clientsync.StatusRejected || result.Conflict == nil || result.Conflict.Resolution != clientsync.ResolutionRejected || ok {
+				t.Fatalf("write after the delete = %+v, document %+v", result, doc)
+			}
+
+			// Against the recreated document, writes made before it conflict
+			// with it, and lose.
+			for _, m := range []clientsync.Mutation{
+				{Collection: "notes", ID: "n2", Op: clientsync.OpPut, Data: map[string]interface{}{"text": "client"}, BaseVersion: 1, HLC: stamp(-time.Second, "c1")},
+				{Collection: "notes", ID: "n2", Op: clientsync.OpDelete, BaseVersion: 1, HLC: stamp(-time.Second, "c2")},
+			} {
+				result := push(t, svc, m)
+				if result.Status != clientsync.StatusRejected || result.Conflict == nil || result.Conflict.ServerVersion != 2 {
+					t.Fatalf("%s based on the deleted document = %+v", m.Op, result)
+				}
+			}
+			if doc, _ := engine.GetDocument("notes", "n2"); doc.Version != 2 || doc.Data["text"] != "new" {
+				t.Fatalf("document written despite the conflict: %+v", doc)
+			}
+		})
+	}
+}
+
+func TestSyncOverHTTP(t *testing.T) {
+	engine, _ := newEngine(t)
+	backups, _ := backup.New(engine, config.BackupConfig{})
+	svc, err := clientsync.New(engine, config.SyncConfig{Strategy: clientsync.StrategyLWW})
+	if err != nil {
+		t.Fatalf("clientsync.New: %v", err)
+	}
+	srv := httptest.NewServer(server.New(engine, backups, nil, nil, svc, config.Config{}).Handler())
+	defer srv.Close()
+
+	var snap clientsync.PullResponse
+	if status := doJSON(t, http.MethodGet, srv.URL+clientsync.PullPath, nil, &snap); status != http.StatusOK || !snap.Reset || snap.HLC == "" {
+		t.Fatalf("first pull = %d, %+v", status, snap)
+	}
+
+	body := map[string]interface{}{"mutations": []clientsync.Mutation{
+		{Collection: "todos", ID: "t1", Op: clientsync.OpPut, Data: map[string]interface{}{"done": false}, HLC: stamp(0, "phone")},
+		{Collection: "todos", ID: "t2", Op: clientsync.OpPut, Data: map[string]interface{}{"done": true}, HLC: stamp(0, "phone")},
+	}}
+	var pushed clientsync.PushResponse
+	if status := doJSON(t, http.MethodPost, srv.URL+clientsync.PushPath, body, &pushed); status != http.StatusOK || len(pushed.Results) != 2 || pushed.Conflicts != 0 {
+		t.Fatalf("push = %d, %+v", status, pushed)
+	}
+
+	var pulled clientsync.PullResponse
+	url := srv.URL + clientsync.PullPath + "?collections=todos&since=" + strconv.FormatUint(snap.Checkpoint, 10)
+	if status := doJSON(t, http.MethodGet, url, nil, &pulled); status != http.StatusOK || pulled.Reset || len(pulled.Changes) != 2 {
+		t.Fatalf("pull = %d, %+v", status, pulled)
+	}
+	var idsSeen []string
+	for _, c := range pulled.Changes {
+		idsSeen = append(idsSeen, c.DocumentID)
+	}
+	sort.Strings(idsSeen)
+	if idsSeen[0] != "t1" || idsSeen[1] != "t2" {
+		t.Fatalf("pulled %v", idsSeen)
+	}
+
+	bad := map[string]interface{}{"mutations": []map[string]interface{}{{"collection": "todos", "id": "t3", "op": "put", "data": map[string]interface{}{}}}}
+	if status := doJSON(t, http.MethodPost, srv.URL+clientsync.PushPath, bad, nil); status != http.StatusBadRequest {
+		t.Fatalf("push without an hlc = %d", status)
+	}
+	if status := doJSON(t, http.MethodGet, srv.URL+clientsync.PullPath+"?since=x", nil, nil); status != http.StatusBadRequest {
+		t.Fatalf("pull since x = %d", status)
+	}
+}
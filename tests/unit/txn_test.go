@@ -0,0 +1,141 @@
+package unit
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestTransactionCommitsAtomically(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	engine.InsertDocument("accounts", "a", map[string]interface{}{"balance": 100.0})
+	engine.InsertDocument("accounts", "b", map[string]interface{}{"balance": 0.0})
+
+	tx := engine.Begin()
+	a, _ := tx.Get("accounts", "a")
+	b, _ := tx.Get("accounts", "b")
+	tx.Update("accounts", "a", map[string]interface{}{"balance": a.Data["balance"].(float64) - 40})
+	tx.Update("accounts", "b", map[string]interface{}{"balance": b.Data["balance"].(float64) + 40})
+	tx.Insert("ledger", "t1", map[string]interface{}{"from": "a", "to": "b", "amount": 40.0})
+	if got, _ := tx.Get("accounts", "a"); got.Data["balance"] != 60.0 {
+		t.Fatalf("transaction does not see its own write: %v", got.Data)
+	}
+	if got, _ := engine.GetDocument("accounts", "a"); got.Data["balance"] != 100.0 {
+		t.Fatalf("uncommitted write is visible: %v", got.Data)
+	}
+	docs, err := tx.Commit()
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if len(docs) != 3 || docs[0].Version != 2 || docs[2].Version != 1 {
+		t.Fatalf("Commit results = %+v", docs)
+	}
+	if _, err := tx.Commit(); !errors.Is(err, storage.ErrTxnDone) {
+		t.Fatalf("second Commit error = %v", err)
+	}
+	engine.Close()
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	a, _ = engine.GetDocument("accounts", "a")
+	b, _ = engine.GetDocument("accounts", "b")
+	if a.Data["balance"] != 60.0 || b.Data["balance"] != 40.0 || a.Version != 2 {
+		t.Fatalf("after restart a=%+v b=%+v", a, b)
+	}
+	if _, ok := engine.GetDocument("ledger", "t1"); !ok {
+		t.Fatal("ledger entry missing after restart")
+	}
+}
+
+func TestTransactionConflictsAndRollback(t *testing.T) {
+	engine, _ := newEngine(t)
+	engine.InsertDocument("c", "x", map[string]interface{}{"n": 1.0})
+
+	tx := engine.Begin()
+	if err := tx.Check("c", "x", storage.Precondition{IfMatch: []uint64{1}}); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	tx.Upsert("c", "y", map[string]interface{}{"n": 2.0})
+	engine.UpdateDocument("c", "x", map[string]interface{}{"n": 5.0})
+	if _, err := tx.Commit(); !errors.Is(err, storage.ErrTxnConflict) {
+		t.Fatalf("Commit after concurrent write = %v, want ErrTxnConflict", err)
+	}
+	if _, ok := engine.GetDocument("c", "y"); ok {
+		t.Fatal("conflicting transaction was partly applied")
+	}
+
+	tx = engine.Begin()
+	if err := tx.Check("c", "x", storage.Precondition{IfMatch: []uint64{1}}); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("stale Check = %v", err)
+	}
+	tx.Delete("c", "x")
+	tx.Rollback()
+	if _, ok := engine.GetDocument("c", "x"); !ok {
+		t.Fatal("rolled back delete was applied")
+	}
+}
+
+func TestTransactionUniqueIndexes(t *testing.T) {
+	engine, _ := newEngine(t)
+	if _, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"email"}, Unique: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	engine.InsertDocument("users", "u1", map[string]interface{}{"email": "a"})
+	engine.InsertDocument("users", "u2", map[string]interface{}{"email": "b"})
+
+	// Swapping two unique values is fine as a whole.
+	tx := engine.Begin()
+	tx.Update("users", "u1", map[string]interface{}{"email": "b"})
+	tx.Update("users", "u2", map[string]interface{}{"email": "a"})
+	if _, err := tx.Commit(); err != nil {
+		t.Fatalf("swap Commit: %v", err)
+	}
+
+	tx = engine.Begin()
+	tx.Insert("users", "u3", map[string]interface{}{"email": "c"})
+	tx.Insert("users", "u4", map[string]interface{}{"email": "c"})
+	if _, err := tx.Commit(); !errors.Is(err, storage.ErrUniqueViolation) {
+		t.Fatalf("duplicate within transaction = %v", err)
+	}
+	if _, ok := engine.GetDocument("users", "u3"); ok {
+		t.Fatal("rejected transaction was partly applied")
+	}
+}
+
+func TestTornTransactionIsNotReplayed(t *testing.T) {
+	dir := t.TempDir()
+	engine := openEngine(t, dir)
+	engine.InsertDocument("c", "keep", map[string]interface{}{"n": 1.0})
+	engine.Close()
+	os.Remove(filepath.Join(dir, "helix.db"))
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal", "*.wal"))
+	f, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record header promising more payload than made it to disk.
+	payload := `{"operation":"TXN","ops":[{"operation":"INSERT","collection":"c","documentId":"half","data":{"n":2}},{"operation":"DELE`
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)+40))
+	f.Write(append(header, payload...))
+	f.Close()
+
+	engine = openEngine(t, dir)
+	defer engine.Close()
+	if _, ok := engine.GetDocument("c", "keep"); !ok {
+		t.Fatal("committed document lost")
+	}
+	if _, ok := engine.GetDocument("c", "half"); ok {
+		t.Fatal("torn transaction was partly replayed")
+	}
+	if engine.RecoveryReport().TornTail == nil {
+		t.Fatal("recovery report does not mention the torn record")
+	}
+}
@@ -0,0 +1,99 @@
+package unit
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/developer51709/helixdb/internal/indexing"
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestVerifyFindsAndRepairsDamage(t *testing.T) {
+	dir := t.TempDir()
+	dataFile, walDir := filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal")
+	opts := storage.Options{WAL: storage.WALOptions{ArchiveDir: filepath.Join(dir, "archive")}}
+
+	engine, err := storage.NewEngineWithOptions(dataFile, walDir, opts)
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	if _, err := engine.CreateIndex("users", indexing.Definition{Fields: []string{"email"}, Unique: true}); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	engine.InsertDocument("users", "u1", map[string]interface{}{"email": "alice@example.com"})
+	engine.InsertDocument("users", "u2", map[string]interface{}{"email": "bob@example.com"})
+	engine.Close()
+
+	report, err := storage.Verify(dataFile, walDir, opts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !report.OK() || report.Format != "segments" || len(report.Collections) != 1 || report.Collections[0].Documents != 2 || report.Collections[0].Indexes != 1 {
+		t.Fatalf("report of a healthy directory = %+v", report)
+	}
+
+	damageDocument(t, dir, "users", `"email":"alice@example.com"`)
+	segments, _ := filepath.Glob(filepath.Join(walDir, "*.wal"))
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	report, err = storage.Verify(dataFile, walDir, opts)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(report.Problems) != 2 {
+		t.Fatalf("problems = %+v", report.Problems)
+	}
+	if p := report.Problems[0]; p.Check != storage.CheckDocument || p.ID != "u1" {
+		t.Fatalf("first problem = %+v", p)
+	}
+	if p := report.Problems[1]; p.Check != storage.CheckWAL || p.File != segments[len(segments)-1] {
+		t.Fatalf("second problem = %+v", p)
+	}
+
+	report, err = storage.Repair(dataFile, walDir, opts)
+	if err != nil {
+		t.Fatalf("Repair: %v", err)
+	}
+	if !report.OK() || report.Repair == nil || report.Repair.Found != 2 || report.Repair.TornTail == nil {
+		t.Fatalf("report after repair = %+v", report)
+	}
+	if corrupt := report.Repair.Corrupt; len(corrupt) != 1 || corrupt[0].RepairedFrom != "wal" {
+		t.Fatalf("repaired documents = %+v", corrupt)
+	}
+}
+
+func TestVerifyReportsUniqueViolationsAndWALGaps(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"collections":{"users":{
+		"u1":{"id":"u1","data":{"email":"same@example.com"},"version":1},
+		"u2":{"id":"u2","data":{"email":"same@example.com"},"version":1}}},
+		"indexes":{"users":[{"fields":["email"],"unique":true}]},"lastLSN":10}`
+	os.WriteFile(filepath.Join(dir, "helix.db"), []byte(legacy), 0644)
+	os.MkdirAll(filepath.Join(dir, "wal"), 0755)
+	// The log resumes at LSN 20 although the checkpoint only covers 10.
+	payload := []byte(`{"lsn":20,"operation":"DELETE","collection":"users","documentId":"u1","timestamp":"2026-01-01T00:00:00Z"}`)
+	frame := make([]byte, 8, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+	os.WriteFile(filepath.Join(dir, "wal", "00000000000000000020.wal"), append([]byte("HXWAL01\n"), append(frame, payload...)...), 0644)
+
+	report, err := storage.Verify(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), storage.Options{})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if report.Format != "legacy" || len(report.Problems) != 2 || report.WAL.FirstLSN != 20 {
+		t.Fatalf("report = %+v", report)
+	}
+	if p := report.Problems[0]; p.Check != storage.CheckIndex || p.ID != "u2" {
+		t.Fatalf("first problem = %+v", p)
+	}
+	if p := report.Problems[1]; p.Check != storage.CheckWAL || !strings.Contains(p.Message, "11 to 19") {
+		t.Fatalf("second problem = %+v", p)
+	}
+}
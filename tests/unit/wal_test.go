@@ -0,0 +1,226 @@
+package unit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestWALRotatesAndTruncatesSegments(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	wal, err := storage.NewWAL(dir, storage.WALOptions{SegmentSize: 1024, ArchiveDir: archive})
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		lsn, err := wal.Write(storage.WALEntry{
+			Operation:  "INSERT",
+			Collection: "c",
+			DocumentID: fmt.Sprint(i),
+			Data:       map[string]interface{}{"padding": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"},
+			Timestamp:  time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if lsn != uint64(i) {
+			t.Fatalf("Write %d got LSN %d", i, lsn)
+		}
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segments) < 3 {
+		t.Fatalf("expected rotation into several segments, got %v", segments)
+	}
+
+	if err := wal.Truncate(30); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if entries[0].LSN > 31 || entries[len(entries)-1].LSN != 50 {
+		t.Fatalf("after truncate log holds LSNs %d..%d", entries[0].LSN, entries[len(entries)-1].LSN)
+	}
+	archived, _ := filepath.Glob(filepath.Join(archive, "*.wal"))
+	if len(archived) == 0 {
+		t.Fatal("truncated segments were not archived")
+	}
+	wal.Close()
+
+	wal, err = storage.NewWAL(dir, storage.WALOptions{SegmentSize: 1024})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer wal.Close()
+	if lsn, _ := wal.Write(storage.WALEntry{Operation: "DELETE", Collection: "c", DocumentID: "1"}); lsn != 51 {
+		t.Fatalf("LSN after reopen = %d, want 51", lsn)
+	}
+}
+
+func TestRestartReplaysOnlyTheWALTail(t *testing.T) {
+	dir := t.TempDir()
+	opts := storage.Options{WAL: storage.WALOptions{SegmentSize: 2048}}
+	open := func() *storage.Engine {
+		engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+		if err != nil {
+			t.Fatalf("NewEngineWithOptions: %v", err)
+		}
+		return engine
+	}
+
+	engine := open()
+	for i := 0; i < 200; i++ {
+		engine.UpsertDocument("c", fmt.Sprint(i%20), map[string]interface{}{"i": float64(i)})
+	}
+	engine.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal", "*.wal"))
+	if len(segments) != 1 {
+		t.Fatalf("checkpointed segments were kept: %v", segments)
+	}
+
+	wal, err := storage.NewWAL(filepath.Join(dir, "wal"), opts.WAL)
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	entries, _ := wal.ReadAll()
+	wal.Close()
+	if len(entries) == 0 || len(entries) >= 200 || entries[len(entries)-1].LSN != 200 {
+		t.Fatalf("log holds %d records after checkpoint", len(entries))
+	}
+
+	engine = open()
+	defer engine.Close()
+	docs, _ := engine.QueryDocuments("c", nil, 0)
+	if len(docs) != 20 {
+		t.Fatalf("after restart %d documents, want 20", len(docs))
+	}
+	doc, _ := engine.GetDocument("c", "19")
+	if doc.Data["i"] != 199.0 || doc.Version != 10 {
+		t.Fatalf("document after restart = %+v", doc)
+	}
+	if _, err := engine.InsertDocument("c", "new", map[string]interface{}{}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+}
+
+func TestWALTruncatesTornTailAndRejectsMidLogCorruption(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := storage.NewWAL(dir, storage.WALOptions{})
+	if err != nil {
+		t.Fatalf("NewWAL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Write(storage.WALEntry{Operation: "INSERT", Collection: "c", DocumentID: fmt.Sprint(i)})
+	}
+	wal.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	path := segments[0]
+	intact, _ := os.ReadFile(path)
+	os.WriteFile(path, append(intact, 0x40, 0, 0, 0, 1, 2), 0644)
+
+	wal, err = storage.NewWAL(dir, storage.WALOptions{})
+	if err != nil {
+		t.Fatalf("reopen with torn tail: %v", err)
+	}
+	if torn := wal.TornTail(); torn == nil || torn.Offset != int64(len(intact)) {
+		t.Fatalf("TornTail = %+v, want offset %d", torn, len(intact))
+	}
+	if lsn, err := wal.Write(storage.WALEntry{Operation: "DELETE", Collection: "c", DocumentID: "0"}); err != nil || lsn != 4 {
+		t.Fatalf("Write after truncation = %d, %v", lsn, err)
+	}
+	wal.Close()
+
+	wal, _ = storage.NewWAL(dir, storage.WALOptions{})
+	entries, err := wal.ReadAll()
+	wal.Close()
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("ReadAll after truncation = %d entries, %v", len(entries), err)
+	}
+
+	// Flip a byte inside the first record's payload.
+	data, _ := os.ReadFile(path)
+	data[len("HXWAL01\n")+10] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	_, err = storage.NewEngine(filepath.Join(t.TempDir(), "helix.db"), dir)
+	var corrupt *storage.WALCorruptionError
+	if !errors.Is(err, storage.ErrWALCorrupt) || !errors.As(err, &corrupt) || corrupt.Offset != int64(len("HXWAL01\n")) {
+		t.Fatalf("NewEngine on corrupt WAL = %v", err)
+	}
+
+	// A damaged length that runs a record past the end of the file is not
+	// a torn tail when intact records follow it.
+	os.WriteFile(path, intact, 0644)
+	second := int64(len("HXWAL01\n")) + 8 + int64(binary.LittleEndian.Uint32(intact[len("HXWAL01\n"):]))
+	data = append([]byte(nil), intact...)
+	data[second+2] ^= 0x01
+	os.WriteFile(path, data, 0644)
+
+	_, err = storage.NewEngine(filepath.Join(t.TempDir(), "helix.db"), dir)
+	if !errors.Is(err, storage.ErrWALCorrupt) || !errors.As(err, &corrupt) || corrupt.Offset != second {
+		t.Fatalf("NewEngine with a damaged record length = %v", err)
+	}
+}
+
+func TestGroupCommitAcknowledgesEveryConcurrentWrite(t *testing.T) {
+	for _, mode := range []storage.SyncMode{storage.SyncAlways, storage.SyncBatched, storage.SyncOS} {
+		t.Run(string(mode), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := storage.Options{WAL: storage.WALOptions{Sync: mode, MaxSyncDelay: time.Millisecond}}
+			engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), filepath.Join(dir, "wal"), opts)
+			if err != nil {
+				t.Fatalf("NewEngineWithOptions: %v", err)
+			}
+
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < 25; i++ {
+						id := fmt.Sprintf("%d-%d", w, i)
+						if _, err := engine.InsertDocument("c", id, map[string]interface{}{"w": float64(w)}); err != nil {
+							t.Errorf("InsertDocument %s: %v", id, err)
+						}
+						if i%5 == 0 && !engine.DeleteDocument("c", id) {
+							t.Errorf("DeleteDocument %s failed", id)
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+
+			wal, err := storage.NewWAL(filepath.Join(dir, "wal"), opts.WAL)
+			if err != nil {
+				t.Fatalf("NewWAL: %v", err)
+			}
+			entries, _ := wal.ReadAll()
+			wal.Close()
+			if len(entries) != 8*25+8*5 {
+				t.Fatalf("log holds %d records, want %d", len(entries), 8*25+8*5)
+			}
+			for i, entry := range entries {
+				if entry.LSN != uint64(i+1) {
+					t.Fatalf("record %d has LSN %d", i, entry.LSN)
+				}
+			}
+			engine.Close()
+		})
+	}
+
+	if _, err := storage.NewWAL(t.TempDir(), storage.WALOptions{Sync: "sometimes"}); err == nil {
+		t.Fatal("unknown sync mode accepted")
+	}
+}
@@ -0,0 +1,85 @@
+//go:build unix
+
+package unit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/developer51709/helixdb/internal/storage"
+)
+
+func TestFailedWALSyncStopsTheEngine(t *testing.T) {
+	dir := t.TempDir()
+	walDir := filepath.Join(dir, "wal")
+	engine, err := storage.NewEngineWithOptions(filepath.Join(dir, "helix.db"), walDir, storage.Options{
+		WAL: storage.WALOptions{SegmentSize: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewEngineWithOptions: %v", err)
+	}
+	defer engine.Close()
+	if _, err := engine.InsertDocument("items", "a", map[string]interface{}{"n": 1.0}); err != nil {
+		t.Fatalf("InsertDocument: %v", err)
+	}
+	stream, err := engine.Changes(storage.ChangeOptions{Since: engine.LastLSN()})
+	if err != nil {
+		t.Fatalf("Changes: %v", err)
+	}
+	defer stream.Close()
+
+	// The next record goes to a new segment, which is made a pipe: writing
+	// to it works, fsyncing it does not.
+	fifo := filepath.Join(walDir, fmt.Sprintf("%020d.wal", engine.LastLSN()+1))
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Skipf("mkfifo: %v", err)
+	}
+	go func() {
+		if f, err := os.Open(fifo); err == nil {
+			io.Copy(io.Discard, f)
+			f.Close()
+		}
+	}()
+	if _, err := engine.InsertDocument("items", "b", map[string]interface{}{"n": 2.0}); err == nil {
+		t.Fatal("InsertDocument succeeded with a failing fsync")
+	}
+
+	// The change is in memory but not on disk: nothing serves it.
+	if err := engine.Err(); !errors.Is(err, storage.ErrEngineFailed) {
+		t.Fatalf("Err = %v", err)
+	}
+	if _, ok := engine.GetDocument("items", "b"); ok {
+		t.Fatal("GetDocument served the failed write")
+	}
+	if _, err := engine.Query("items", storage.QueryOptions{}); !errors.Is(err, storage.ErrEngineFailed) {
+		t.Fatalf("Query = %v", err)
+	}
+	if _, _, _, err := engine.ReadChanges(0, nil, 0); !errors.Is(err, storage.ErrEngineFailed) {
+		t.Fatalf("ReadChanges = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if c, err := stream.Next(ctx); err == nil {
+		t.Fatalf("change stream served the failed write: %+v", c)
+	}
+	if _, err := engine.InsertDocument("items", "c", map[string]interface{}{"n": 3.0}); err == nil {
+		t.Fatal("InsertDocument succeeded after a failed fsync")
+	}
+
+	ts := startChangesServer(t, engine)
+	var health map[string]interface{}
+	if code := doJSON(t, http.MethodGet, ts.URL+"/health", nil, &health); code != http.StatusServiceUnavailable || health["status"] != "failed" || health["error"] == nil {
+		t.Fatalf("GET /health = %d, %v", code, health)
+	}
+	if code := doJSON(t, http.MethodGet, ts.URL+"/collections/items/a", nil, nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("GET document = %d", code)
+	}
+}